@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrIBANFormat   = errors.New("invalid iban format")
+	ErrIBANCountry  = errors.New("iban country not recognised")
+	ErrIBANLength   = errors.New("iban length wrong for country")
+	ErrIBANChecksum = errors.New("iban checksum incorrect")
+)
+
+var (
+	ibanPattern      = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{1,30}$`)
+	bicPattern       = regexp.MustCompile(`^[A-Z]{4}[A-Z]{2}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+	sortCodePattern  = regexp.MustCompile(`^[0-9]{6}$`)
+	ukAccountPattern = regexp.MustCompile(`^[0-9]{8}$`)
+)
+
+// ibanLengths is the length of an IBAN in each country that issues them, from the SWIFT IBAN registry
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22, "BH": 22, "BR": 29,
+	"BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22, "DK": 18, "DO": 28, "EE": 20, "EG": 29,
+	"ES": 24, "FI": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23, "GL": 18, "GR": 27, "GT": 28,
+	"HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23, "IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20,
+	"LB": 28, "LC": 32, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24, "ME": 22, "MK": 19,
+	"MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24, "PL": 28, "PS": 29, "PT": 25, "QA": 29,
+	"RO": 24, "RS": 22, "SA": 24, "SC": 31, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25, "SV": 28,
+	"TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+// checkIBAN checks an IBAN in its electronic format, without spaces, is the right length for its country and that its
+// check digits are correct
+func checkIBAN(iban string) error {
+	if !ibanPattern.MatchString(iban) {
+		return ErrIBANFormat
+	}
+	length, ok := ibanLengths[iban[:2]]
+	if !ok {
+		return ErrIBANCountry
+	}
+	if len(iban) != length {
+		return ErrIBANLength
+	}
+
+	// move the country and check digits to the end, replace letters with 10 to 35 and the remainder mod 97 must be 1
+	var digits strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		digits.WriteString(strconv.FormatInt(int64(strings.IndexRune("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ", c)), 10))
+	}
+	n, _ := new(big.Int).SetString(digits.String(), 10)
+	if new(big.Int).Mod(n, big.NewInt(97)).Int64() != 1 {
+		return ErrIBANChecksum
+	}
+	return nil
+}
+
+// ukIBANAccount returns the sort code and account number held in a UK IBAN, after its four letter bank code
+func ukIBANAccount(iban string) (sortCode, accountNumber string, ok bool) {
+	if len(iban) != ibanLengths["GB"] || !strings.HasPrefix(iban, "GB") {
+		return "", "", false
+	}
+	return iban[8:14], iban[14:], true
+}
+
+func isBIC(bic string) bool {
+	return bicPattern.MatchString(bic)
+}
+
+func isSortCode(sortCode string) bool {
+	return sortCodePattern.MatchString(sortCode)
+}
+
+func isUKAccountNumber(accountNumber string) bool {
+	return ukAccountPattern.MatchString(accountNumber)
+}
+
+// sortCodeRule is a line of the VocaLink modulus weight table, giving how the account numbers at a range of sort codes
+// are checked. the weights apply to the six sort code digits followed by the eight account number digits.
+type sortCodeRule struct {
+	Start     string
+	End       string
+	Method    string
+	Weights   [14]int
+	Exception int
+}
+
+// the highest exception VocaLink define
+const maxSortCodeException = 14
+
+// the sort codes that accounts are checked against instead of their own, by exceptions 8 and 9
+const (
+	exception8SortCode = "090126"
+	exception9SortCode = "309634"
+)
+
+// the weights that replace those in the table for exception 2, when a is not 0
+var (
+	exception2Weights  = [14]int{0, 0, 1, 2, 5, 3, 6, 4, 8, 7, 10, 9, 3, 1}
+	exception2Weights9 = [14]int{0, 0, 0, 0, 0, 0, 0, 0, 8, 7, 10, 9, 3, 1}
+)
+
+// sortCodeRules is the VocaLink modulus weight table, along with the sort code substitution table that exception 5
+// uses. a nil table checks nothing.
+type sortCodeRules struct {
+	rules         []sortCodeRule
+	substitutions map[string]string
+}
+
+// parseSortCodeRules reads a table in the format of VocaLink's valacdos.txt: a start and end sort code, the method
+// (MOD10, MOD11 or DBLAL), fourteen weights and an optional exception, separated by spaces
+func parseSortCodeRules(r io.Reader) (*sortCodeRules, error) {
+	table := &sortCodeRules{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 17 && len(fields) != 18 {
+			return nil, fmt.Errorf("line %d: expected 17 or 18 fields, found %d", line, len(fields))
+		}
+		rule := sortCodeRule{Start: fields[0], End: fields[1], Method: fields[2]}
+		if !isSortCode(rule.Start) || !isSortCode(rule.End) {
+			return nil, fmt.Errorf("line %d: invalid sort code range %s to %s", line, rule.Start, rule.End)
+		}
+		if rule.Method != "MOD10" && rule.Method != "MOD11" && rule.Method != "DBLAL" {
+			return nil, fmt.Errorf("line %d: unknown method %s", line, rule.Method)
+		}
+		for i := range rule.Weights {
+			weight, err := strconv.Atoi(fields[3+i])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid weight %s", line, fields[3+i])
+			}
+			rule.Weights[i] = weight
+		}
+		if len(fields) == 18 {
+			exception, err := strconv.Atoi(fields[17])
+			if err != nil || exception < 1 || exception > maxSortCodeException {
+				return nil, fmt.Errorf("line %d: invalid exception %s", line, fields[17])
+			}
+			rule.Exception = exception
+		}
+		table.rules = append(table.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// parseSortCodeSubstitutions reads a table in the format of VocaLink's scsubtab.txt: a sort code and the sort code its
+// accounts are checked against instead, separated by spaces
+func parseSortCodeSubstitutions(r io.Reader) (map[string]string, error) {
+	substitutions := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || !isSortCode(fields[0]) || !isSortCode(fields[1]) {
+			return nil, fmt.Errorf("line %d: expected a sort code and its substitute", line)
+		}
+		substitutions[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return substitutions, nil
+}
+
+// loadSortCodeRules loads the weight table, and the substitution table if there is one. without the substitution table
+// sort codes using exception 5 are checked as themselves, which fails valid accounts at the sort codes VocaLink
+// substitute.
+func loadSortCodeRules(path, substitutionsPath string) (*sortCodeRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	table, err := parseSortCodeRules(file)
+	if err != nil || substitutionsPath == "" {
+		return table, err
+	}
+
+	substitutions, err := os.Open(substitutionsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer substitutions.Close()
+	if table.substitutions, err = parseSortCodeSubstitutions(substitutions); err != nil {
+		return nil, fmt.Errorf("%s: %s", substitutionsPath, err)
+	}
+	return table, nil
+}
+
+// Check reports whether an account number passes the modulus checks for its sort code. accounts at sort codes that
+// aren't in the table can't be checked, so are accepted, as VocaLink specify.
+func (table *sortCodeRules) Check(sortCode, accountNumber string) bool {
+	if table == nil || !isSortCode(sortCode) || !isUKAccountNumber(accountNumber) {
+		return true
+	}
+
+	var rules []sortCodeRule
+	for _, rule := range table.rules {
+		if sortCode >= rule.Start && sortCode <= rule.End {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return true
+	}
+
+	// a sort code has up to two rules, and the account number must pass both, except for the pairs of exceptions
+	// 2 and 9, 10 and 11, and 12 and 13, where passing either is enough
+	first := table.passes(rules[0], sortCode, accountNumber)
+	if len(rules) == 1 {
+		return first
+	}
+	switch rules[0].Exception {
+	case 2, 10, 12:
+		return first || table.passes(rules[1], sortCode, accountNumber)
+	default:
+		return first && table.passes(rules[1], sortCode, accountNumber)
+	}
+}
+
+// passes applies a rule to an account number, substituting the sort code it is checked against where the rule's
+// exception says to
+func (table *sortCodeRules) passes(rule sortCodeRule, sortCode, accountNumber string) bool {
+	switch rule.Exception {
+	case 5:
+		if substitute, ok := table.substitutions[sortCode]; ok {
+			sortCode = substitute
+		}
+	case 8:
+		sortCode = exception8SortCode
+	case 9:
+		sortCode = exception9SortCode
+	}
+	if rule.passes(sortCodeDigits(sortCode, accountNumber)) {
+		return true
+	}
+
+	// exception 14 accounts that fail may have a check digit that has been dropped, in which case h is 0, 1 or 9, and
+	// are checked again with it removed
+	if h := accountNumber[7]; rule.Exception == 14 && (h == '0' || h == '1' || h == '9') {
+		return rule.passes(sortCodeDigits(sortCode, "0"+accountNumber[:7]))
+	}
+	return false
+}
+
+// sortCodeDigits returns the digits of a sort code followed by those of an account number
+func sortCodeDigits(sortCode, accountNumber string) [14]int {
+	var digits [14]int
+	for i, c := range sortCode + accountNumber {
+		digits[i] = int(c - '0')
+	}
+	return digits
+}
+
+// passes applies a rule to the sort code and account number digits, which VocaLink label u to z and a to h
+func (rule sortCodeRule) passes(digits [14]int) bool {
+	const a, b, c, g, h = 6, 7, 8, 12, 13
+
+	weights := rule.Weights
+	switch rule.Exception {
+	case 2:
+		switch {
+		case digits[a] != 0 && digits[g] != 9:
+			weights = exception2Weights
+		case digits[a] != 0:
+			weights = exception2Weights9
+		}
+	case 3:
+		// the check isn't needed for these accounts
+		if digits[c] == 6 || digits[c] == 9 {
+			return true
+		}
+	case 6:
+		// foreign currency accounts, which can't be checked
+		if digits[a] >= 4 && digits[a] <= 8 && digits[g] == digits[h] {
+			return true
+		}
+	case 7:
+		if digits[g] == 9 {
+			for i := 0; i <= b; i++ {
+				weights[i] = 0
+			}
+		}
+	case 10:
+		if ab := digits[a]*10 + digits[b]; (ab == 9 || ab == 99) && digits[g] == 9 {
+			for i := 0; i <= b; i++ {
+				weights[i] = 0
+			}
+		}
+	}
+
+	total := 0
+	for i, digit := range digits {
+		product := digit * weights[i]
+		if rule.Method == "DBLAL" {
+			// the digits of each product are added, rather than the products
+			total += product/10 + product%10
+		} else {
+			total += product
+		}
+	}
+
+	switch {
+	case rule.Exception == 1:
+		return (total+27)%10 == 0
+	case rule.Exception == 4:
+		return total%11 == digits[g]*10+digits[h]
+	case rule.Exception == 5 && rule.Method == "MOD11":
+		// g is the check digit, which is 11 less the remainder, or 0 when there is none. a remainder of 1 can't be
+		// given a check digit.
+		remainder := total % 11
+		return remainder == 0 && digits[g] == 0 || remainder > 1 && 11-remainder == digits[g]
+	case rule.Exception == 5:
+		// h is the check digit, which is 10 less the remainder, or 0 when there is none
+		remainder := total % 10
+		return remainder == 0 && digits[h] == 0 || remainder > 0 && 10-remainder == digits[h]
+	case rule.Method == "MOD11":
+		return total%11 == 0
+	default:
+		return total%10 == 0
+	}
+}
+
+// describe returns a line for the startup log saying how much of the modulus checking is done
+func (table *sortCodeRules) describe() string {
+	if table == nil {
+		return "UK account numbers are not modulus checked, pass -sort-code-rules to check them"
+	}
+	for _, rule := range table.rules {
+		if rule.Exception == 5 && table.substitutions == nil {
+			return fmt.Sprintf("UK account numbers are modulus checked against %d rules, but without -sort-code-substitutions valid accounts at substituted exception 5 sort codes fail", len(table.rules))
+		}
+	}
+	return fmt.Sprintf("UK account numbers are modulus checked against %d rules", len(table.rules))
+}
+
+// checkSortCodes runs the modulus checks on the UK accounts of a payment's parties. accounts that are badly formatted
+// are left to validatePayment to report.
+func checkSortCodes(payment Payment, table *sortCodeRules) []APIError {
+	v := &paymentValidator{}
+
+	check := func(pointer, accountNumberCode string, account SponsorParty) {
+		sortCode, accountNumber := account.BankID, account.AccountNumber
+		if accountNumberCode == "IBAN" {
+			var ok bool
+			if sortCode, accountNumber, ok = ukIBANAccount(account.AccountNumber); !ok || checkIBAN(account.AccountNumber) != nil {
+				return
+			}
+		} else if account.BankIDCode != "GBDSC" {
+			return
+		}
+		if !table.Check(sortCode, accountNumber) {
+			v.add(pointer+"/account_number", codeInvalidChecksum, fmt.Sprintf("account_number %s is not valid at sort code %s", accountNumber, sortCode))
+		}
+	}
+
+	attributes := payment.Attributes
+	if attributes.DebtorParty.SponsorParty != nil {
+		check("/attributes/debtor_party", attributes.DebtorParty.AccountNumberCode, *attributes.DebtorParty.SponsorParty)
+	}
+	if beneficiary := attributes.BeneficiaryParty.DebtorParty; beneficiary != nil && beneficiary.SponsorParty != nil {
+		check("/attributes/beneficiary_party", beneficiary.AccountNumberCode, *beneficiary.SponsorParty)
+	}
+	check("/attributes/sponsor_party", "", attributes.SponsorParty)
+
+	return v.errs
+}
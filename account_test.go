@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rows in the format of VocaLink's valacdos.txt for the sort codes of their published test cases, with weights that
+// give the published results
+const testSortCodeRules = `
+089000 089999 MOD10    0    0    0    0    0    0    7    1    3    7    1    3    7    1
+107999 107999 MOD11    0    0    0    0    0    0    8    7    6    5    4    3    2    1
+202959 202959 DBLAL    2    1    2    1    2    1    2    1    2    1    2    1    2    1
+070116 070116 MOD11    0    0    0    0    0    0    8    7   10    5    4    3    2    1   12
+070116 070116 MOD10    0    3    2    4    5    8    9    4    5    6    7    8    9   -1   13
+074456 074456 MOD11    0    0    0    0    0    0    8    7   10    5    4    3    2    1   12
+074456 074456 MOD10    0    3    2    4    5    8    9    4    5    6    7    8    9   -1   13
+086090 086090 MOD11    5    4    3    2    7    6    5    4    3    2    7    6    5    4    8
+118765 118765 DBLAL    0    0    2    1    2    1    2    1    2    1    2    1    2    1    1
+134020 134020 MOD11    0    0    0    0    0    0    8    7    6    5    4    3    0    0    4
+180002 180002 MOD11    0    0    0    0    0    0    8    7    6    5    4    3    2    1   14
+200915 200915 DBLAL    2    1    2    1    2    1    2    1    2    1    2    1    2    1    6
+203099 203099 MOD11    0    0    0    0    0    0    0    7    6    5    4    3    2    1
+203099 203099 DBLAL    2    1    2    1    2    1    2    1    2    1    2    1    2    1
+309070 309070 MOD11    0    0    0    0    0    0    1    3    7    1    3    7    1    3    2
+309070 309070 MOD11    0    0    6    5    4    3    2    7    6    5    4    3    2    1    9
+772798 772798 MOD11    0    0    1    2    5    3    6    4    8    7   10    9    3    1    7
+820000 827999 MOD11    0    0    0    0    0    0    8    7    6    5    6    3    2    4
+820000 827999 DBLAL    2    1    2    1    2    1    2    1    2    1    2    1    2    1    3
+871427 872427 MOD11    0    0    1    2    5    3    6    4    8    7   10    9    3    1   10
+871427 872427 MOD11    0    0    6    5    4    3    2    7    6    5    4    3    2    1   11
+938000 938696 MOD11    7    6    5    4    3    2    7    6    5    4    3    2    0    0    5
+938000 938696 DBLAL    2    1    2    1    2    1    2    1    2    1    2    1    2    0    5
+`
+
+// a row of VocaLink's scsubtab.txt, for the exception 5 test case
+const testSortCodeSubstitutions = `
+938600 938611
+`
+
+func TestCheckIBAN(t *testing.T) {
+
+	assert.Nil(t, checkIBAN("GB29NWBK60161331926819"))
+	assert.Nil(t, checkIBAN("DE89370400440532013000"))
+	assert.Nil(t, checkIBAN("GB83XABC10161234567801"))
+
+	assert.Equal(t, ErrIBANChecksum, checkIBAN("GB29XABC10161234567801"))
+	assert.Equal(t, ErrIBANLength, checkIBAN("GB29NWBK6016133192681"))
+	assert.Equal(t, ErrIBANCountry, checkIBAN("ZZ29NWBK60161331926819"))
+	assert.Equal(t, ErrIBANFormat, checkIBAN("GB29 NWBK 6016 1331 9268 19"))
+	assert.Equal(t, ErrIBANFormat, checkIBAN("12345678"))
+}
+
+func TestIsBIC(t *testing.T) {
+
+	assert.True(t, isBIC("NWBKGB2L"))
+	assert.True(t, isBIC("DEUTDEFF500"))
+	assert.False(t, isBIC("NWBKGB2"))
+	assert.False(t, isBIC("nwbkgb2l"))
+	assert.False(t, isBIC("NWBK1B2L"))
+}
+
+func TestSortCodeRulesCheck(t *testing.T) {
+
+	rules, err := parseSortCodeRules(strings.NewReader(testSortCodeRules))
+	require.Nil(t, err)
+	rules.substitutions, err = parseSortCodeSubstitutions(strings.NewReader(testSortCodeSubstitutions))
+	require.Nil(t, err)
+
+	// VocaLink's test cases
+	for _, test := range []struct {
+		sortCode, accountNumber string
+		valid                   bool
+		name                    string
+	}{
+		{"089999", "66374958", true, "passes modulus 10"},
+		{"107999", "88837491", true, "passes modulus 11"},
+		{"202959", "63748472", true, "passes double alternate"},
+		{"871427", "46238510", true, "exceptions 10 and 11, the first check passes and the second fails"},
+		{"872427", "46238510", true, "exceptions 10 and 11, the first check fails and the second passes"},
+		{"871427", "09123496", true, "exception 10, ab is 09 and g is 9, the first check passes and the second fails"},
+		{"871427", "99123496", true, "exception 10, ab is 99 and g is 9, the first check passes and the second fails"},
+		{"820000", "73688637", true, "exception 3 at the start of the range, c is 6 so the second check is skipped"},
+		{"827999", "73988638", true, "exception 3 at the end of the range, c is 9 so the second check is skipped"},
+		{"827101", "28748352", true, "exception 3, c isn't 6 or 9 so both checks are made"},
+		{"134020", "63849203", true, "exception 4, the remainder is the check digits"},
+		{"118765", "64371389", true, "exception 1, 27 is added to the total"},
+		{"200915", "41011166", true, "exception 6, a foreign currency account that fails the check"},
+		{"938611", "07806039", true, "exception 5"},
+		{"938600", "42368003", true, "exception 5 with a substituted sort code"},
+		{"938063", "55065200", true, "exception 5, both checks have a remainder of 0"},
+		{"772798", "99345694", true, "exception 7, would fail the standard check"},
+		{"086090", "06774744", true, "exception 8"},
+		{"309070", "02355688", true, "exceptions 2 and 9, the first check passes"},
+		{"309070", "12345668", true, "exceptions 2 and 9, the first check fails and the second passes with 309634"},
+		{"309070", "12345677", true, "exceptions 2 and 9, a isn't 0 and g isn't 9"},
+		{"309070", "99345694", true, "exceptions 2 and 9, a isn't 0 and g is 9"},
+		{"938063", "15764273", false, "exception 5, the first check digit is right and the second wrong"},
+		{"938063", "15764264", false, "exception 5, the first check digit is wrong and the second right"},
+		{"938063", "15763217", false, "exception 5, the first check has a remainder of 1"},
+		{"118765", "64371388", false, "exception 1, fails double alternate"},
+		{"203099", "66831036", false, "passes modulus 11 and fails double alternate"},
+		{"203099", "58716970", false, "fails modulus 11 and passes double alternate"},
+		{"089999", "66374959", false, "fails modulus 10"},
+		{"107999", "88837493", false, "fails modulus 11"},
+		{"074456", "12345112", true, "exceptions 12 and 13, passes modulus 11"},
+		{"070116", "34012583", true, "exceptions 12 and 13, passes modulus 11"},
+		{"074456", "11104102", true, "exceptions 12 and 13, fails modulus 11 and passes modulus 10"},
+		{"180002", "00000190", true, "exception 14, the first check fails and the second passes"},
+	} {
+		assert.Equal(t, test.valid, rules.Check(test.sortCode, test.accountNumber), test.name)
+	}
+
+	// sort codes that aren't in the table can't be checked
+	assert.True(t, rules.Check("123456", "12345678"))
+
+	var none *sortCodeRules
+	assert.True(t, none.Check("089999", "66374959"))
+
+	// without the substitutions, the account is checked against its own sort code
+	rules.substitutions = nil
+	assert.False(t, rules.Check("938600", "42368003"))
+
+	_, err = parseSortCodeRules(strings.NewReader("089000 089999 MOD12 0 0 0 0 0 0 7 1 3 7 1 3 7 1"))
+	assert.NotNil(t, err)
+	_, err = parseSortCodeRules(strings.NewReader("089000 089999 MOD10 0 0 0 0 0 0 7 1 3 7 1 3 7 1 15"))
+	assert.NotNil(t, err)
+	_, err = parseSortCodeSubstitutions(strings.NewReader("938600"))
+	assert.NotNil(t, err)
+}
+
+func TestSortCodeRulesDescribe(t *testing.T) {
+
+	var none *sortCodeRules
+	assert.Contains(t, none.describe(), "not modulus checked")
+
+	rules, err := parseSortCodeRules(strings.NewReader(testSortCodeRules))
+	require.Nil(t, err)
+	assert.Contains(t, rules.describe(), "-sort-code-substitutions")
+	rules.substitutions = map[string]string{}
+	assert.Equal(t, "UK account numbers are modulus checked against 23 rules", rules.describe())
+}
+
+func TestValidatePaymentChecksAccounts(t *testing.T) {
+
+	payment := createExamplePayment()
+	payment.Attributes.DebtorParty.AccountNumberCode = "IBAN"
+	payment.Attributes.DebtorParty.AccountNumber = "GB29XABC10161234567801"
+	payment.Attributes.BeneficiaryParty.AccountNumber = "1234"
+	payment.Attributes.SponsorParty.BankID = "20-33-02"
+
+	assert.Equal(t, map[string]string{
+		"/attributes/debtor_party/account_number":      codeInvalidChecksum,
+		"/attributes/beneficiary_party/account_number": codeInvalidFormat,
+		"/attributes/sponsor_party/bank_id":            codeInvalidFormat,
+	}, errorPointers(validatePayment(payment)))
+
+	// SWIFT payments identify the beneficiary's bank by BIC
+	payment = createExamplePayment()
+	payment.Attributes.PaymentScheme = "SWIFT"
+	assert.Equal(t, map[string]string{
+		"/attributes/beneficiary_party/bank_id_code": codeInvalidValue,
+	}, errorPointers(validatePayment(payment)))
+
+	payment.Attributes.BeneficiaryParty.BankIDCode = "SWBIC"
+	payment.Attributes.BeneficiaryParty.BankID = "NWBK"
+	assert.Equal(t, map[string]string{
+		"/attributes/beneficiary_party/bank_id": codeInvalidFormat,
+	}, errorPointers(validatePayment(payment)))
+
+	payment.Attributes.BeneficiaryParty.BankID = "NWBKGB2L"
+	assert.Empty(t, validatePayment(payment))
+}
+
+func TestCreatePaymentChecksSortCodes(t *testing.T) {
+
+	emptyDatabase(t)
+
+	rules, err := parseSortCodeRules(strings.NewReader(testSortCodeRules))
+	require.Nil(t, err)
+	api := server.Handler.(*api)
+	api.sortCodeRules = rules
+	defer func() { api.sortCodeRules = nil }()
+
+	payment := createExamplePayment()
+	payment.Attributes.BeneficiaryParty.BankID = "089999"
+	payment.Attributes.BeneficiaryParty.AccountNumber = "66374959"
+	payment.Attributes.DebtorParty.AccountNumberCode = "IBAN"
+	payment.Attributes.DebtorParty.AccountNumber = "GB29NWBK60161331926819"
+	rw := postPaymentWithKey(t, payment, "sort-code-invalid")
+	require.Equal(t, http.StatusUnprocessableEntity, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{
+		"/attributes/beneficiary_party/account_number": codeInvalidChecksum,
+	}, errorPointers(response.Errors))
+
+	payment.Attributes.BeneficiaryParty.AccountNumber = "66374958"
+	assert.Equal(t, http.StatusCreated, postPaymentWithKey(t, payment, "sort-code-valid").Code)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// API keys are this prefix followed by 32 random bytes, base64 encoded
+const apiKeyPrefix = "f3_"
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+)
+
+// APIKey authenticates requests on behalf of an organisation. the key itself is only shown when it is created, just
+// its SHA-256 hash is stored.
+type APIKey struct {
+	tableName struct{} `sql:"api_keys"`
+
+	ID             uuid.UUID  `json:"id" sql:",pk,type:uuid"`
+	OrganisationID uuid.UUID  `json:"organisation_id" sql:",type:uuid,notnull"`
+	Name           string     `json:"name" sql:",notnull"`
+	Hash           string     `json:"-" sql:",notnull,unique"`
+	Roles          []string   `json:"roles" sql:",notnull"`
+	CreatedAt      time.Time  `json:"created_at" sql:",notnull"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+}
+
+// APIKeyStore persists API keys
+type APIKeyStore interface {
+	// GetAPIKey returns the key with the given hash, or ErrAPIKeyNotFound
+	GetAPIKey(hash string) (APIKey, error)
+
+	// CreateAPIKey inserts a new key
+	CreateAPIKey(key *APIKey) error
+
+	// ListAPIKeys returns the keys of an organisation, including revoked ones, oldest first
+	ListAPIKeys(organisationID uuid.UUID) ([]APIKey, error)
+
+	// RevokeAPIKey stops a key from authenticating any more requests, or returns ErrAPIKeyNotFound
+	RevokeAPIKey(id uuid.UUID, at time.Time) error
+
+	// SetAPIKeyRoles replaces the roles assigned to a key, or returns ErrAPIKeyNotFound
+	SetAPIKeyRoles(id uuid.UUID, roles []string) error
+}
+
+// hashAPIKey returns the hash an API key is stored and looked up by. the keys are random, so they don't need a slow
+// password hash.
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// newAPIKey generates a key for an organisation with the given roles, returning the record to store and the key to
+// give to the client
+func newAPIKey(organisationID uuid.UUID, name string, roles ...string) (APIKey, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return APIKey{
+		ID:             uuid.NewV4(),
+		OrganisationID: organisationID,
+		Name:           name,
+		Hash:           hashAPIKey(key),
+		Roles:          append([]string{}, roles...),
+		CreatedAt:      time.Now().UTC(),
+	}, key, nil
+}
+
+type contextKey int
+
+// the API key a request was authenticated with
+const apiKeyContextKey contextKey = iota
+
+// requestAPIKey returns the API key the request was authenticated with, if it was
+func requestAPIKey(r *http.Request) (APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey).(APIKey)
+	return key, ok
+}
+
+// requestOrganisation returns the organisation the request was authenticated for, if it was
+func requestOrganisation(r *http.Request) (uuid.UUID, bool) {
+	key, ok := requestAPIKey(r)
+	return key.OrganisationID, ok
+}
+
+// authenticateRequest is the middleware that requires a valid API key, given as a bearer token, on every request. the
+// key is added to the request context. its organisation scopes everything the request can see and change, and its
+// roles what the request may do.
+func (api *api) authenticateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !api.authenticate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		unauthorized := func() {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="payments"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "A valid API key is required")
+		}
+
+		token := r.Header.Get("Authorization")
+		if !strings.HasPrefix(token, "Bearer ") {
+			unauthorized()
+			return
+		}
+		key, err := api.store.GetAPIKey(hashAPIKey(strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))))
+		switch {
+		case err == ErrAPIKeyNotFound:
+			unauthorized()
+			return
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case key.RevokedAt != nil:
+			unauthorized()
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, key)))
+	})
+}
+
+// runKeysCommand handles the `keys` subcommand, which manages API keys
+func runKeysCommand(store APIKeyStore, args []string, out io.Writer) error {
+	usage := fmt.Errorf("usage: keys create <organisation_id> [name] | create-platform [name] | list <organisation_id> | revoke <key_id> | roles <key_id> [role...]")
+	if len(args) > 0 && args[0] == "create-platform" {
+		// platform keys are for whoever runs the API, so they belong to no organisation
+		return createKey(store, platformOrganisation, strings.Join(args[1:], " "), RolePlatform, out)
+	}
+	if len(args) < 2 {
+		return usage
+	}
+	id, err := uuid.FromString(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid id: %s", args[1])
+	}
+
+	switch args[0] {
+	case "create":
+		// keys made from the command line are for setting up an organisation, so they can do everything it can
+		if id == platformOrganisation {
+			return fmt.Errorf("invalid organisation id: %s", id)
+		}
+		return createKey(store, id, strings.Join(args[2:], " "), RoleAdmin, out)
+	case "list":
+		keys, err := store.ListAPIKeys(id)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			status := "active"
+			if key.RevokedAt != nil {
+				status = "revoked " + key.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%s %s created %s roles %s %s\n", key.ID, status, key.CreatedAt.Format(time.RFC3339), strings.Join(key.Roles, ","), key.Name)
+		}
+		return nil
+	case "revoke":
+		if err := store.RevokeAPIKey(id, time.Now().UTC()); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "revoked key %s\n", id)
+		return nil
+	case "roles":
+		roles := append([]string{}, args[2:]...)
+		if err := store.SetAPIKeyRoles(id, roles); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "key %s has roles %s\n", id, strings.Join(roles, ","))
+		return nil
+	}
+
+	return fmt.Errorf("unknown keys command: %s", args[0])
+}
+
+// createKey stores a new key with a role and shows it, the only time it can be seen
+func createKey(store APIKeyStore, organisationID uuid.UUID, name, role string, out io.Writer) error {
+	record, key, err := newAPIKey(organisationID, name, role)
+	if err != nil {
+		return err
+	}
+	if err := store.CreateAPIKey(&record); err != nil {
+		return err
+	}
+	if organisationID == platformOrganisation {
+		fmt.Fprintf(out, "created platform key %s\n", record.ID)
+	} else {
+		fmt.Fprintf(out, "created key %s for organisation %s\n", record.ID, organisationID)
+	}
+	fmt.Fprintf(out, "%s\n", key)
+	fmt.Fprintln(out, "the key is not stored and can't be shown again")
+	return nil
+}
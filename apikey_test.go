@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createAPIKey stores a new API key for the organisation with the given roles, or as an admin, returning the key
+func createAPIKey(t *testing.T, organisationID uuid.UUID, roles ...string) (APIKey, string) {
+	if len(roles) == 0 {
+		roles = []string{RoleAdmin}
+	}
+	record, key, err := newAPIKey(organisationID, "test", roles...)
+	require.Nil(t, err)
+	require.Nil(t, store.CreateAPIKey(&record))
+	return record, key
+}
+
+// sendWithKey sends a request to an API that requires API keys
+func sendWithKey(t *testing.T, key, method, path string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rw := httptest.NewRecorder()
+	newAPI(store).ServeHTTP(rw, req)
+	return rw
+}
+
+func TestNewAPIKeyIsOnlyStoredHashed(t *testing.T) {
+
+	organisationID := uuid.NewV4()
+	record, key, err := newAPIKey(organisationID, "ci")
+	require.Nil(t, err)
+
+	assert.True(t, strings.HasPrefix(key, apiKeyPrefix))
+	assert.Equal(t, hashAPIKey(key), record.Hash)
+	assert.NotContains(t, record.Hash, strings.TrimPrefix(key, apiKeyPrefix))
+	assert.Equal(t, organisationID, record.OrganisationID)
+
+	_, other, err := newAPIKey(organisationID, "ci")
+	require.Nil(t, err)
+	assert.NotEqual(t, key, other)
+}
+
+func TestRequestsNeedAValidAPIKey(t *testing.T) {
+
+	emptyDatabase(t)
+
+	record, key := createAPIKey(t, uuid.NewV4())
+
+	for _, bad := range []string{"", "f3_wrong", key + "x"} {
+		rw := sendWithKey(t, bad, http.MethodGet, "/v1/payments", nil)
+		assert.Equal(t, 401, rw.Code, bad)
+		assert.Contains(t, rw.Header().Get("WWW-Authenticate"), "Bearer")
+	}
+
+	// the key has to be given as a bearer token
+	req := httptest.NewRequest(http.MethodGet, "/v1/payments", nil)
+	req.Header.Set("Authorization", "Basic "+key)
+	rw := httptest.NewRecorder()
+	newAPI(store).ServeHTTP(rw, req)
+	assert.Equal(t, 401, rw.Code)
+
+	assert.Equal(t, 200, sendWithKey(t, key, http.MethodGet, "/v1/payments", nil).Code)
+
+	require.Nil(t, store.RevokeAPIKey(record.ID, time.Now()))
+	assert.Equal(t, 401, sendWithKey(t, key, http.MethodGet, "/v1/payments", nil).Code)
+	assert.Equal(t, ErrAPIKeyNotFound, store.RevokeAPIKey(uuid.NewV4(), time.Now()))
+}
+
+func TestKeysCommand(t *testing.T) {
+
+	emptyDatabase(t)
+
+	organisationID := uuid.NewV4()
+	var out bytes.Buffer
+	require.Nil(t, runKeysCommand(store, []string{"create", organisationID.String(), "build", "server"}, &out))
+
+	lines := strings.Split(out.String(), "\n")
+	key := lines[1]
+	stored, err := store.GetAPIKey(hashAPIKey(key))
+	require.Nil(t, err)
+	assert.Equal(t, organisationID, stored.OrganisationID)
+	assert.Equal(t, "build server", stored.Name)
+	assert.Equal(t, []string{RoleAdmin}, stored.Roles)
+
+	out.Reset()
+	require.Nil(t, runKeysCommand(store, []string{"roles", stored.ID.String(), RoleOperator, RoleAuditor}, &out))
+	stored, err = store.GetAPIKey(hashAPIKey(key))
+	require.Nil(t, err)
+	assert.Equal(t, []string{RoleOperator, RoleAuditor}, stored.Roles)
+	assert.Equal(t, ErrAPIKeyNotFound, runKeysCommand(store, []string{"roles", uuid.NewV4().String()}, &out))
+
+	out.Reset()
+	require.Nil(t, runKeysCommand(store, []string{"revoke", stored.ID.String()}, &out))
+	out.Reset()
+	require.Nil(t, runKeysCommand(store, []string{"list", organisationID.String()}, &out))
+	assert.Contains(t, out.String(), stored.ID.String()+" revoked")
+	assert.NotContains(t, out.String(), key)
+
+	out.Reset()
+	require.Nil(t, runKeysCommand(store, []string{"create-platform", "rates", "feed"}, &out))
+	platform, err := store.GetAPIKey(hashAPIKey(strings.Split(out.String(), "\n")[1]))
+	require.Nil(t, err)
+	assert.Equal(t, platformOrganisation, platform.OrganisationID)
+	assert.Equal(t, []string{RolePlatform}, platform.Roles)
+
+	assert.NotNil(t, runKeysCommand(store, []string{"create", platformOrganisation.String()}, &out))
+	assert.NotNil(t, runKeysCommand(store, []string{"create"}, &out))
+	assert.NotNil(t, runKeysCommand(store, []string{"create", "not-a-uuid"}, &out))
+	assert.NotNil(t, runKeysCommand(store, []string{"rotate", organisationID.String()}, &out))
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+// the status of a payment's approval. once approved or rejected no more decisions can be made, until the payment is
+// changed and its approval starts again.
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// the most approvals a policy can require
+const maxApprovals = 10
+
+var ErrApprovalPolicyNotFound = errors.New("approval policy not found")
+
+// ApprovalPolicy requires payments of an organisation in a currency for more than Threshold to be approved by
+// Approvals people, none of whom created or last changed the payment, before they can be submitted
+type ApprovalPolicy struct {
+	tableName struct{} `sql:"approval_policies"`
+
+	OrganisationID uuid.UUID `json:"-" sql:",pk,type:uuid"`
+	Currency       string    `json:"currency" sql:",pk"`
+	Threshold      Decimal   `json:"threshold" sql:",type:numeric,notnull"`
+	Approvals      int       `json:"approvals" sql:",notnull"`
+}
+
+// ApprovalPolicyStore persists the approval policies organisations set
+type ApprovalPolicyStore interface {
+	// GetApprovalPolicy returns an organisation's policy for a currency, or ErrApprovalPolicyNotFound
+	GetApprovalPolicy(organisationID uuid.UUID, currency string) (ApprovalPolicy, error)
+
+	// ListApprovalPolicies returns an organisation's policies, ordered by currency
+	ListApprovalPolicies(organisationID uuid.UUID) ([]ApprovalPolicy, error)
+
+	// PutApprovalPolicy creates or replaces the policy for the currency
+	PutApprovalPolicy(policy *ApprovalPolicy) error
+
+	// DeleteApprovalPolicy removes the policy for a currency, or returns ErrApprovalPolicyNotFound
+	DeleteApprovalPolicy(organisationID uuid.UUID, currency string) error
+}
+
+// Approval is the state of a payment that needs approving before it can be submitted. the policy is copied in when
+// the payment is created or changed, so changing the policy doesn't affect payments already waiting. ModifiedBy is
+// whoever made the change waiting for approval, when it isn't the payment as it was created.
+type Approval struct {
+	Status     string             `json:"status"`
+	Threshold  Decimal            `json:"threshold"`
+	Required   int                `json:"required"`
+	ModifiedBy string             `json:"modified_by,omitempty"`
+	Approvals  []ApprovalDecision `json:"approvals"`
+	Rejections []ApprovalDecision `json:"rejections"`
+}
+
+// ApprovalDecision records who approved or rejected a payment, and when
+type ApprovalDecision struct {
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// awaitingApproval reports whether the payment needs approvals it hasn't got. nothing but asking for approval can be
+// done with it until it has them.
+func (payment Payment) awaitingApproval() bool {
+	approval := payment.Attributes.Approval
+	return approval != nil && approval.Status != ApprovalApproved
+}
+
+// madeBy reports whether the actor created the payment, or made the change to it that is waiting for approval
+func (payment Payment) madeBy(actor string) bool {
+	if payment.CreatedBy != "" && actor == payment.CreatedBy {
+		return true
+	}
+	approval := payment.Attributes.Approval
+	return approval != nil && approval.ModifiedBy != "" && actor == approval.ModifiedBy
+}
+
+// requiredApproval returns the approval a payment needs under its organisation's policy, or nil if it needs none
+func requiredApproval(store ApprovalPolicyStore, payment Payment) (*Approval, error) {
+	policy, err := store.GetApprovalPolicy(payment.OrganisationID, payment.Attributes.Currency)
+	if err == ErrApprovalPolicyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if payment.Attributes.Amount.Cmp(policy.Threshold) <= 0 {
+		return nil, nil
+	}
+	return &Approval{
+		Status:     ApprovalPending,
+		Threshold:  policy.Threshold,
+		Required:   policy.Approvals,
+		Approvals:  []ApprovalDecision{},
+		Rejections: []ApprovalDecision{},
+	}, nil
+}
+
+// approvalLinks returns the links to approve or reject a payment, when it is waiting for decisions
+func approvalLinks(payment Payment) []Link {
+	approval := payment.Attributes.Approval
+	if approval == nil || approval.Status != ApprovalPending || payment.currentStatus() != StatusPendingApproval {
+		return nil
+	}
+	self := fmt.Sprintf("/v1/payments/%s", payment.ID.String())
+	return []Link{
+		{Rel: "approve", Href: self + "/approvals"},
+		{Rel: "reject_approval", Href: self + "/rejections"},
+	}
+}
+
+// business logic for POST /v1/payments/{id}/approvals endpoint
+func (api *api) approvePayment(w http.ResponseWriter, r *http.Request) {
+	api.decideApproval(w, r, true)
+}
+
+// business logic for POST /v1/payments/{id}/rejections endpoint
+func (api *api) rejectPayment(w http.ResponseWriter, r *http.Request) {
+	api.decideApproval(w, r, false)
+}
+
+// decideApproval records an approval or rejection of a payment that is waiting for them. the payment is approved once
+// enough different people other than its creator and last editor have approved it, and a single rejection rejects it.
+func (api *api) decideApproval(w http.ResponseWriter, r *http.Request, approve bool) {
+
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// the body is optional, and only gives a reason for the decision
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	store := api.storeFor(r)
+	payment, err := store.Get(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if status, ok := checkPreconditions(r, payment.Version); !ok {
+		writeError(w, status, "version_mismatch", "Payment version does not match")
+		return
+	}
+
+	approval := payment.Attributes.Approval
+	actor := requestActor(r)
+	switch {
+	case approval == nil:
+		writeError(w, http.StatusConflict, "approval_not_required", "Payment does not need approving")
+		return
+	case approval.Status != ApprovalPending:
+		writeError(w, http.StatusConflict, "approval_closed", fmt.Sprintf("Payment has already been %s", approval.Status))
+		return
+	case payment.currentStatus() != StatusPendingApproval:
+		writeError(w, http.StatusConflict, "approval_not_requested", "Approval has not been requested for the payment")
+		return
+	case approve && payment.madeBy(actor):
+		writeError(w, http.StatusForbidden, "self_approval", "Payments can't be approved by whoever created or last changed them")
+		return
+	}
+	for _, decision := range append(approval.Approvals, approval.Rejections...) {
+		if decision.Actor == actor {
+			writeError(w, http.StatusConflict, "already_decided", "The payment has already been approved or rejected by "+actor)
+			return
+		}
+	}
+
+	before := payment
+	approval = copyApproval(approval)
+	decision := ApprovalDecision{Actor: actor, Reason: strings.TrimSpace(request.Reason), Timestamp: time.Now().UTC()}
+	action := AuditApprove
+	if approve {
+		approval.Approvals = append(approval.Approvals, decision)
+		if len(approval.Approvals) >= approval.Required {
+			approval.Status = ApprovalApproved
+		}
+	} else {
+		action = AuditRejectApproval
+		approval.Rejections = append(approval.Rejections, decision)
+		approval.Status = ApprovalRejected
+	}
+	payment.Attributes.Approval = approval
+
+	// the version check makes sure no one else has decided, or changed the payment, since it was read
+	err = api.audit(store, r, action, &before, func(tx PaymentStore) (*Payment, error) {
+		return &payment, tx.Update(&payment)
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(payment.Version))
+	writeData(w, http.StatusOK, payment, paymentLinks(payment)...)
+}
+
+// copyApproval copies an approval, so that it can be changed without changing the payment it was read from
+func copyApproval(approval *Approval) *Approval {
+	copied := *approval
+	copied.Approvals = append([]ApprovalDecision{}, approval.Approvals...)
+	copied.Rejections = append([]ApprovalDecision{}, approval.Rejections...)
+	return &copied
+}
+
+// business logic for GET /v1/admin/approval-policies endpoint
+func (api *api) getApprovalPolicies(w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := adminOrganisation(w, r)
+	if !ok {
+		return
+	}
+
+	policies, err := api.store.ListApprovalPolicies(organisationID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, policies, Link{Rel: "self", Href: "/v1/admin/approval-policies"})
+}
+
+// business logic for PUT /v1/admin/approval-policies/{currency} endpoint, which creates or replaces the policy for a
+// currency. payments already created keep the approval they were given.
+func (api *api) putApprovalPolicy(w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := adminOrganisation(w, r)
+	if !ok {
+		return
+	}
+	currency := mux.Vars(r)["currency"]
+
+	var policy ApprovalPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	policy.OrganisationID, policy.Currency = organisationID, currency
+	if policy.Approvals == 0 {
+		policy.Approvals = 1
+	}
+
+	var errs []APIError
+	if _, ok := currencyExponent(currency); !ok {
+		errs = append(errs, APIError{Code: codeInvalidCurrency, Message: "currency must be a supported ISO 4217 code", Pointer: "/currency"})
+	}
+	switch {
+	case policy.Threshold.IsEmpty():
+		errs = append(errs, APIError{Code: codeRequired, Message: "threshold is required", Pointer: "/threshold"})
+	case !policy.Threshold.IsValid():
+		errs = append(errs, APIError{Code: codeInvalidFormat, Message: "threshold must be a decimal, such as 100.00", Pointer: "/threshold"})
+	case policy.Threshold.Sign() < 0:
+		errs = append(errs, APIError{Code: codeInvalidValue, Message: "threshold can't be negative", Pointer: "/threshold"})
+	}
+	if policy.Approvals < 1 || policy.Approvals > maxApprovals {
+		errs = append(errs, APIError{Code: codeInvalidValue, Message: fmt.Sprintf("approvals must be between 1 and %d", maxApprovals), Pointer: "/approvals"})
+	}
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+
+	if err := api.store.PutApprovalPolicy(&policy); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, policy, Link{Rel: "self", Href: "/v1/admin/approval-policies/" + currency})
+}
+
+// business logic for DELETE /v1/admin/approval-policies/{currency} endpoint
+func (api *api) deleteApprovalPolicy(w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := adminOrganisation(w, r)
+	if !ok {
+		return
+	}
+
+	if err := api.store.DeleteApprovalPolicy(organisationID, mux.Vars(r)["currency"]); err != nil {
+		if err == ErrApprovalPolicyNotFound {
+			writeError(w, http.StatusNotFound, "not_found", "Approval policy not found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	//default to 200 response code
+}
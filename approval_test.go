@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodePaymentResponse returns the payment and links in a response
+func decodePaymentResponse(t *testing.T, rw *httptest.ResponseRecorder) (Payment, []string) {
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var payment Payment
+	require.Nil(t, json.Unmarshal(response.Data, &payment))
+	var rels []string
+	for _, link := range response.Links {
+		rels = append(rels, link.Rel)
+	}
+	return payment, rels
+}
+
+func TestRequiredApproval(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	require.Nil(t, store.PutApprovalPolicy(&ApprovalPolicy{OrganisationID: payment.OrganisationID, Currency: "GBP", Threshold: MustParseDecimal("100.00"), Approvals: 2}))
+
+	approval, err := requiredApproval(store, payment)
+	require.Nil(t, err)
+	assert.Nil(t, approval, "a payment of exactly the threshold doesn't need approving")
+
+	payment.Attributes.Amount = MustParseDecimal("100.01")
+	approval, err = requiredApproval(store, payment)
+	require.Nil(t, err)
+	assert.Equal(t, &Approval{
+		Status:     ApprovalPending,
+		Threshold:  MustParseDecimal("100.00"),
+		Required:   2,
+		Approvals:  []ApprovalDecision{},
+		Rejections: []ApprovalDecision{},
+	}, approval)
+
+	payment.Attributes.Currency = "USD"
+	approval, err = requiredApproval(store, payment)
+	require.Nil(t, err)
+	assert.Nil(t, approval)
+}
+
+func TestFourEyesApproval(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	self := fmt.Sprintf("/v1/payments/%s", payment.ID)
+	require.Nil(t, store.PutApprovalPolicy(&ApprovalPolicy{OrganisationID: payment.OrganisationID, Currency: "GBP", Threshold: MustParseDecimal("50"), Approvals: 2}))
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	rw := sendAs(t, "", http.MethodGet, self, nil)
+	require.Equal(t, 200, rw.Code)
+	created, rels := decodePaymentResponse(t, rw)
+	assert.Equal(t, "alice", created.CreatedBy)
+	require.NotNil(t, created.Attributes.Approval)
+	assert.Equal(t, ApprovalPending, created.Attributes.Approval.Status)
+	assert.Equal(t, 2, created.Attributes.Approval.Required)
+	assert.Equal(t, []string{"self", ActionRequestApproval}, rels)
+
+	// nothing else can happen until it has been approved, which has to be asked for first
+	assert.Equal(t, 409, sendAs(t, "alice", http.MethodPost, self+"/actions/submit", nil).Code)
+	assert.Equal(t, 409, sendAs(t, "bob", http.MethodPost, self+"/approvals", nil).Code)
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodPost, self+"/actions/request_approval", nil).Code)
+
+	rw = sendAs(t, "alice", http.MethodPost, self+"/approvals", nil)
+	require.Equal(t, 403, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, "self_approval", response.Errors[0].Code)
+
+	rw = sendAs(t, "bob", http.MethodPost, self+"/approvals", map[string]string{"reason": "checked the invoice"})
+	require.Equal(t, 200, rw.Code)
+	approved, rels := decodePaymentResponse(t, rw)
+	assert.Equal(t, ApprovalPending, approved.Attributes.Approval.Status)
+	require.Len(t, approved.Attributes.Approval.Approvals, 1)
+	assert.Equal(t, "bob", approved.Attributes.Approval.Approvals[0].Actor)
+	assert.Equal(t, "checked the invoice", approved.Attributes.Approval.Approvals[0].Reason)
+	assert.Equal(t, []string{"self", "approve", "reject_approval"}, rels)
+	assert.Equal(t, versionETag(2), rw.Header().Get("ETag"))
+
+	assert.Equal(t, 409, sendAs(t, "bob", http.MethodPost, self+"/approvals", nil).Code)
+	assert.Equal(t, 409, sendAs(t, "bob", http.MethodPost, self+"/actions/submit", nil).Code)
+
+	rw = sendAs(t, "carol", http.MethodPost, self+"/approvals", nil)
+	require.Equal(t, 200, rw.Code)
+	approved, rels = decodePaymentResponse(t, rw)
+	assert.Equal(t, ApprovalApproved, approved.Attributes.Approval.Status)
+	assert.Equal(t, []string{"self", ActionSubmit}, rels)
+	assert.Equal(t, 409, sendAs(t, "dave", http.MethodPost, self+"/approvals", nil).Code)
+
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodPost, self+"/actions/submit", nil).Code)
+
+	entries, _ := getAuditEntries(t, "/v1/audit?filter[action]="+AuditApprove)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "bob", entries[0].Actor)
+	assert.Equal(t, "carol", entries[1].Actor)
+}
+
+func TestRejectedApprovalStartsAgainWhenPaymentChanges(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	self := fmt.Sprintf("/v1/payments/%s", payment.ID)
+	require.Nil(t, store.PutApprovalPolicy(&ApprovalPolicy{OrganisationID: payment.OrganisationID, Currency: "GBP", Threshold: MustParseDecimal("50"), Approvals: 1}))
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodPost, self+"/actions/request_approval", nil).Code)
+
+	var response APIResponse
+	rw := sendAs(t, "bob", http.MethodPost, self+"/rejections", map[string]string{"reason": "wrong beneficiary"})
+	require.Equal(t, 200, rw.Code)
+	rejected, rels := decodePaymentResponse(t, rw)
+	assert.Equal(t, ApprovalRejected, rejected.Attributes.Approval.Status)
+	assert.Equal(t, "wrong beneficiary", rejected.Attributes.Approval.Rejections[0].Reason)
+	assert.Equal(t, []string{"self"}, rels)
+
+	assert.Equal(t, 409, sendAs(t, "carol", http.MethodPost, self+"/approvals", nil).Code)
+	assert.Equal(t, 409, sendAs(t, "alice", http.MethodPost, self+"/actions/submit", nil).Code)
+
+	// changing the payment withdraws the decisions made about it
+	payment.Version = rejected.Version
+	payment.Attributes.BeneficiaryParty.Name = "Someone Else"
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPut, self, payment).Code)
+	changed, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, ApprovalPending, changed.Attributes.Approval.Status)
+	assert.Empty(t, changed.Attributes.Approval.Rejections)
+	assert.Equal(t, "alice", changed.CreatedBy)
+	assert.Equal(t, StatusPendingApproval, changed.Attributes.Status)
+
+	require.Equal(t, 200, sendAs(t, "carol", http.MethodPost, self+"/approvals", nil).Code)
+
+	// approvals can't be patched away
+	rw = sendPatch(t, payment, mergePatchContentType, `{"attributes": {"approval": null}}`, nil)
+	require.Equal(t, 422, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/attributes/approval": "immutable_field"}, errorPointers(response.Errors))
+
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodPost, self+"/actions/submit", nil).Code)
+}
+
+func TestPaymentsCantBeApprovedByWhoeverChangedThem(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	self := fmt.Sprintf("/v1/payments/%s", payment.ID)
+	require.Nil(t, store.PutApprovalPolicy(&ApprovalPolicy{OrganisationID: payment.OrganisationID, Currency: "GBP", Threshold: MustParseDecimal("50"), Approvals: 1}))
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodPost, self+"/actions/request_approval", nil).Code)
+
+	// bob raises the amount, so he can't be the one to approve it
+	payment.Version = 1
+	payment.Attributes.Amount = MustParseDecimal("999999.00")
+	require.Equal(t, 201, sendAs(t, "bob", http.MethodPut, self, payment).Code)
+	changed, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, "alice", changed.CreatedBy)
+	assert.Equal(t, "bob", changed.Attributes.Approval.ModifiedBy)
+
+	rw := sendAs(t, "bob", http.MethodPost, self+"/approvals", nil)
+	require.Equal(t, 403, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, "self_approval", response.Errors[0].Code)
+	assert.Equal(t, 403, sendAs(t, "alice", http.MethodPost, self+"/approvals", nil).Code)
+	assert.Equal(t, 409, sendAs(t, "bob", http.MethodPost, self+"/actions/submit", nil).Code)
+
+	// nor can whoever patched it
+	req := httptest.NewRequest(http.MethodPatch, self, strings.NewReader(`{"attributes": {"reference": "patched"}}`))
+	req.Header.Set("Content-Type", mergePatchContentType)
+	req.Header.Set(actorHeader, "carol")
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	assert.Equal(t, 403, sendAs(t, "carol", http.MethodPost, self+"/approvals", nil).Code)
+
+	require.Equal(t, 200, sendAs(t, "bob", http.MethodPost, self+"/approvals", nil).Code)
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodPost, self+"/actions/submit", nil).Code)
+}
+
+func TestPaymentsUnderThresholdDontNeedApproval(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	require.Nil(t, store.PutApprovalPolicy(&ApprovalPolicy{OrganisationID: payment.OrganisationID, Currency: "GBP", Threshold: MustParseDecimal("1000"), Approvals: 1}))
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	stored, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Nil(t, stored.Attributes.Approval)
+
+	require.Equal(t, 200, postAction(t, payment, ActionRequestApproval).Code)
+	assert.Equal(t, 409, sendAs(t, "bob", http.MethodPost, fmt.Sprintf("/v1/payments/%s/approvals", payment.ID), nil).Code)
+	assert.Equal(t, 200, postAction(t, payment, ActionSubmit).Code)
+}
+
+func TestManageApprovalPolicies(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	_, admin := createAPIKey(t, payment.OrganisationID)
+	_, operator := createAPIKey(t, payment.OrganisationID, RoleOperator)
+	_, approver := createAPIKey(t, payment.OrganisationID, RoleApprover)
+
+	rw := sendWithKey(t, admin, http.MethodPut, "/v1/admin/approval-policies/GBP", []byte(`{"threshold": "10.00"}`))
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	assert.Equal(t, 403, sendWithKey(t, operator, http.MethodGet, "/v1/admin/approval-policies", nil).Code)
+
+	rw = sendWithKey(t, admin, http.MethodPut, "/v1/admin/approval-policies/XYZ", []byte(`{"threshold": "-1", "approvals": 11}`))
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/currency": codeInvalidCurrency, "/threshold": codeInvalidValue, "/approvals": codeInvalidValue}, errorPointers(response.Errors))
+
+	// a threshold that isn't a number isn't stored
+	rw = sendWithKey(t, admin, http.MethodPut, "/v1/admin/approval-policies/EUR", []byte(`{"threshold": "abc"}`))
+	require.Equal(t, 422, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/threshold": codeInvalidFormat}, errorPointers(response.Errors))
+
+	rw = sendWithKey(t, admin, http.MethodGet, "/v1/admin/approval-policies", nil)
+	require.Equal(t, 200, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var policies []ApprovalPolicy
+	require.Nil(t, json.Unmarshal(response.Data, &policies))
+	require.Len(t, policies, 1)
+	assert.Equal(t, 1, policies[0].Approvals)
+
+	// another key of the organisation is a second pair of eyes
+	self := fmt.Sprintf("/v1/payments/%s", payment.ID)
+	require.Equal(t, 201, sendWithKey(t, operator, http.MethodPost, "/v1/payments", mustMarshal(t, payment)).Code)
+	require.Equal(t, 200, sendWithKey(t, operator, http.MethodPost, self+"/actions/request_approval", nil).Code)
+	assert.Equal(t, 403, sendWithKey(t, operator, http.MethodPost, self+"/approvals", nil).Code)
+	assert.Equal(t, 200, sendWithKey(t, approver, http.MethodPost, self+"/approvals", nil).Code)
+
+	// policies only apply to payments made after them
+	assert.Equal(t, 200, sendWithKey(t, admin, http.MethodDelete, "/v1/admin/approval-policies/GBP", nil).Code)
+	assert.Equal(t, 404, sendWithKey(t, admin, http.MethodDelete, "/v1/admin/approval-policies/GBP", nil).Code)
+	stored, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, ApprovalApproved, stored.Attributes.Approval.Status)
+
+	_, err = store.GetApprovalPolicy(uuid.NewV4(), "GBP")
+	assert.Equal(t, ErrApprovalPolicyNotFound, err)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// the changes recorded in the audit trail besides state transitions, which are recorded by their action, such as submit
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+
+	// decisions on a payment that needs approving
+	AuditApprove        = "approve"
+	AuditRejectApproval = "reject_approval"
+
+	// a request refused for lacking a permission, which is recorded even though nothing changed
+	AuditAccessDenied = "access_denied"
+)
+
+// headers identifying who made a request and the request itself, which are recorded in the audit trail
+const (
+	actorHeader     = "X-Actor"
+	requestIDHeader = "X-Request-ID"
+	anonymousActor  = "anonymous"
+)
+
+// FieldChange is a value of a payment that was changed, identified by its JSON pointer. From is nil for a value that
+// was added and To is nil for one that was removed.
+type FieldChange struct {
+	Path string      `json:"path"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// AuditEntry records a change to a payment: who made it, in which request, and the payment before and after. Before
+// is nil for a created payment and After is nil for a purged one. Seq orders the entries as they were appended.
+// entries for denied requests have neither, and PaymentID is only set when the request was for a payment.
+type AuditEntry struct {
+	tableName struct{} `sql:"audit_log"`
+
+	ID             uuid.UUID     `json:"id" sql:",pk,type:uuid"`
+	Seq            int64         `json:"seq"`
+	OrganisationID uuid.UUID     `json:"organisation_id" sql:",type:uuid,notnull"`
+	PaymentID      uuid.UUID     `json:"payment_id" sql:",type:uuid,notnull"`
+	Action         string        `json:"action" sql:",notnull"`
+	Actor          string        `json:"actor" sql:",notnull"`
+	RequestID      string        `json:"request_id" sql:",notnull"`
+	Timestamp      time.Time     `json:"timestamp" sql:",notnull"`
+	Before         *Payment      `json:"before"`
+	After          *Payment      `json:"after"`
+	Changes        []FieldChange `json:"changes" sql:",notnull"`
+	Denied         *AccessDenial `json:"denied,omitempty"`
+}
+
+// AccessDenial describes a request that was refused because its API key didn't have the permission it needed.
+// ResourceID is the ID in the path of a request for something other than a payment, such as a subscription.
+type AccessDenial struct {
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Permission string `json:"permission"`
+	ResourceID string `json:"resource_id,omitempty"`
+}
+
+// AuditQuery selects audit entries. zero values mean no restriction, and times are inclusive. entries are listed
+// after the entry with sequence After.
+type AuditQuery struct {
+	OrganisationID uuid.UUID
+	PaymentID      uuid.UUID
+	Actor          string
+	Action         string
+	Since          time.Time
+	Until          time.Time
+	After          int64
+	Limit          int
+}
+
+// AuditStore persists the audit trail. entries are only ever appended, never changed or removed.
+type AuditStore interface {
+	// AppendAudit adds an entry to the end of the trail, setting its Seq
+	AppendAudit(entry *AuditEntry) error
+
+	// ListAudit returns the entries matching the query, in the order they were appended
+	ListAudit(query AuditQuery) ([]AuditEntry, error)
+}
+
+// requestActor returns who made a request: the API key it was authenticated with, or without authentication whoever
+// is given by the X-Actor header
+func requestActor(r *http.Request) string {
+	if key, ok := requestAPIKey(r); ok {
+		return "api_key:" + key.ID.String()
+	}
+	if actor := strings.TrimSpace(r.Header.Get(actorHeader)); actor != "" {
+		return actor
+	}
+	return anonymousActor
+}
+
+// escapeJSONPointerToken escapes a member name for use in a JSON pointer
+func escapeJSONPointerToken(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// diffJSON adds the changes between two decoded JSON values to changes. a missing object or array is compared as an
+// empty one, so that every field of a created or deleted payment is listed.
+func diffJSON(pointer string, from, to interface{}, changes *[]FieldChange) {
+	fromObject, fromIsObject := from.(map[string]interface{})
+	toObject, toIsObject := to.(map[string]interface{})
+	if (fromIsObject || from == nil) && (toIsObject || to == nil) && (fromIsObject || toIsObject) {
+		names := map[string]bool{}
+		for name := range fromObject {
+			names[name] = true
+		}
+		for name := range toObject {
+			names[name] = true
+		}
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			diffJSON(pointer+"/"+escapeJSONPointerToken(name), fromObject[name], toObject[name], changes)
+		}
+		return
+	}
+
+	fromArray, fromIsArray := from.([]interface{})
+	toArray, toIsArray := to.([]interface{})
+	if (fromIsArray || from == nil) && (toIsArray || to == nil) && (fromIsArray || toIsArray) {
+		for i := 0; i < len(fromArray) || i < len(toArray); i++ {
+			var fromItem, toItem interface{}
+			if i < len(fromArray) {
+				fromItem = fromArray[i]
+			}
+			if i < len(toArray) {
+				toItem = toArray[i]
+			}
+			diffJSON(fmt.Sprintf("%s/%d", pointer, i), fromItem, toItem, changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, FieldChange{Path: pointer, From: from, To: to})
+	}
+}
+
+// diffPayments lists the fields that differ between two versions of a payment, as they appear in its JSON
+func diffPayments(before, after *Payment) ([]FieldChange, error) {
+	decode := func(payment *Payment) (interface{}, error) {
+		if payment == nil {
+			return nil, nil
+		}
+		encoded, err := json.Marshal(payment)
+		if err != nil {
+			return nil, err
+		}
+		return decodeJSONValue(encoded)
+	}
+	from, err := decode(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := decode(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := []FieldChange{}
+	diffJSON("", from, to, &changes)
+	return changes, nil
+}
+
+// newAuditEntry records a change to a payment, listing the fields that changed
+func newAuditEntry(action, actor, requestID string, before, after *Payment) (AuditEntry, error) {
+	changes, err := diffPayments(before, after)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	entry := AuditEntry{
+		ID:        uuid.NewV4(),
+		Action:    action,
+		Actor:     actor,
+		RequestID: requestID,
+		Timestamp: time.Now().UTC(),
+		Before:    before,
+		After:     after,
+		Changes:   changes,
+	}
+	if after != nil {
+		entry.PaymentID, entry.OrganisationID = after.ID, after.OrganisationID
+	} else {
+		entry.PaymentID, entry.OrganisationID = before.ID, before.OrganisationID
+	}
+	return entry, nil
+}
+
+// audit makes a change to a payment and records it in the audit trail in the same transaction, so that there is never
+// a change without its entry. the change is published as an event in the same transaction too. write makes the change
+// using the transactional store and returns the payment as it is afterwards.
+func (api *api) audit(store PaymentStore, r *http.Request, action string, before *Payment, write func(tx PaymentStore) (*Payment, error)) error {
+	return store.RunInTransaction(func(tx PaymentStore) error {
+		after, err := write(tx)
+		if err != nil {
+			return err
+		}
+		entry, err := newAuditEntry(action, requestActor(r), r.Header.Get(requestIDHeader), before, after)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, &entry)
+	})
+}
+
+// recordAudit appends an entry to the audit trail and publishes the event for it, if there is one, using the
+// transactional store the change was made with
+func recordAudit(tx PaymentStore, entry *AuditEntry) error {
+	if err := tx.AppendAudit(entry); err != nil {
+		return err
+	}
+	event, ok := newPaymentEvent(*entry)
+	if !ok {
+		return nil
+	}
+	if err := tx.AppendEvent(&event); err != nil {
+		return err
+	}
+	return enqueueWebhooks(tx, event)
+}
+
+// parse the filter and pagination parameters for GET /v1/audit
+func parseAuditQuery(values url.Values) (AuditQuery, []APIError) {
+	query := AuditQuery{Limit: defaultPageSize}
+	var errs []APIError
+	invalid := func(param, message string) {
+		errs = append(errs, APIError{Code: "invalid_parameter", Message: message, Parameter: param})
+	}
+
+	if size := values.Get("page[size]"); size != "" {
+		limit, err := strconv.Atoi(size)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			invalid("page[size]", fmt.Sprintf("Invalid page size, must be between 1 and %d", maxPageSize))
+		} else {
+			query.Limit = limit
+		}
+	}
+	if after := values.Get("page[after]"); after != "" {
+		seq, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || seq < 0 {
+			invalid("page[after]", errInvalidCursor.Error())
+		}
+		query.After = seq
+	}
+
+	if paymentID := values.Get("filter[payment_id]"); paymentID != "" {
+		id, err := uuid.FromString(paymentID)
+		if err != nil {
+			invalid("filter[payment_id]", "Invalid payment_id filter")
+		}
+		query.PaymentID = id
+	}
+	query.Actor = values.Get("filter[actor]")
+	query.Action = values.Get("filter[action]")
+
+	for _, timestamp := range []struct {
+		param  string
+		target *time.Time
+	}{
+		{"filter[since]", &query.Since},
+		{"filter[until]", &query.Until},
+	} {
+		if value := values.Get(timestamp.param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				invalid(timestamp.param, fmt.Sprintf("Invalid %s, must be an RFC 3339 timestamp", timestamp.param))
+			}
+			*timestamp.target = t
+		}
+	}
+
+	return query, errs
+}
+
+// writeAuditPage lists a page of audit entries, with a next link when there are more
+func (api *api) writeAuditPage(w http.ResponseWriter, r *http.Request, query AuditQuery) {
+
+	// one more entry than the page holds shows whether there is a next page
+	limit := query.Limit
+	query.Limit++
+	entries, err := api.storeFor(r).ListAudit(query)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	links := []Link{{Rel: "self", Href: r.URL.RequestURI()}}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		values := r.URL.Query()
+		values.Set("page[after]", strconv.FormatInt(entries[limit-1].Seq, 10))
+		links = append(links, Link{Rel: "next", Href: r.URL.Path + "?" + values.Encode()})
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	writeData(w, http.StatusOK, entries, links...)
+}
+
+// business logic for GET /v1/audit endpoint
+func (api *api) getAudit(w http.ResponseWriter, r *http.Request) {
+
+	query, errs := parseAuditQuery(r.URL.Query())
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusBadRequest, errs...)
+		return
+	}
+	api.writeAuditPage(w, r, query)
+}
+
+// business logic for GET /v1/payments/{id}/history endpoint. the history of a purged payment is still available.
+func (api *api) getPaymentHistory(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	query, errs := parseAuditQuery(r.URL.Query())
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusBadRequest, errs...)
+		return
+	}
+	query.PaymentID = id
+
+	// a payment that has no history must still exist, as it was created before the audit trail
+	store := api.storeFor(r)
+	if existing, err := store.ListAudit(AuditQuery{PaymentID: id, Limit: 1}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if len(existing) == 0 {
+		if _, err := store.GetIncludingDeleted(id); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+	api.writeAuditPage(w, r, query)
+}
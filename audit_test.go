@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendAs sends a request on behalf of an actor, returning the response
+func sendAs(t *testing.T, actor, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var encoded []byte
+	if body != nil {
+		var err error
+		encoded, err = json.Marshal(body)
+		require.Nil(t, err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(encoded))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, actor)
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func getAuditEntries(t *testing.T, path string) ([]AuditEntry, []Link) {
+	rw := sendAs(t, "", http.MethodGet, path, nil)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var entries []AuditEntry
+	require.Nil(t, json.Unmarshal(response.Data, &entries))
+	return entries, response.Links
+}
+
+func TestDiffPayments(t *testing.T) {
+
+	before := createExamplePayment()
+	after := before
+	after.Attributes.Reference = "changed"
+	after.Attributes.ChargesInformation.SenderCharges = before.Attributes.ChargesInformation.SenderCharges[:1]
+
+	changes, err := diffPayments(&before, &after)
+	require.Nil(t, err)
+	assert.Equal(t, []FieldChange{
+		{Path: "/attributes/charges_information/sender_charges/1/amount", From: "0.10", To: nil},
+		{Path: "/attributes/charges_information/sender_charges/1/currency", From: "USD", To: nil},
+		{Path: "/attributes/reference", From: "Payment for Em's mangoes", To: "changed"},
+	}, changes)
+
+	// every field of a created payment is listed
+	changes, err = diffPayments(nil, &after)
+	require.Nil(t, err)
+	assert.Contains(t, changes, FieldChange{Path: "/attributes/reference", From: nil, To: "changed"})
+	assert.Contains(t, changes, FieldChange{Path: "/id", From: nil, To: after.ID.String()})
+}
+
+func TestPaymentHistoryRecordsEveryChange(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	self := fmt.Sprintf("/v1/payments/%s", payment.ID)
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	payment.Attributes.Reference = "changed"
+	require.Equal(t, 201, sendAs(t, "bob", http.MethodPut, self, payment).Code)
+
+	// a write that fails leaves no trace
+	require.Equal(t, 400, sendAs(t, "mallory", http.MethodPost, "/v1/payments", payment).Code)
+
+	require.Equal(t, 200, sendAs(t, "carol", http.MethodDelete, self, nil).Code)
+
+	entries, _ := getAuditEntries(t, self+"/history")
+	require.Len(t, entries, 3)
+
+	var actions, actors []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+		actors = append(actors, entry.Actor)
+		assert.Equal(t, payment.ID, entry.PaymentID)
+		assert.NotEmpty(t, entry.RequestID)
+	}
+	assert.Equal(t, []string{AuditCreate, AuditUpdate, AuditDelete}, actions)
+	assert.Equal(t, []string{"alice", "bob", "carol"}, actors)
+
+	assert.Nil(t, entries[0].Before)
+	require.NotNil(t, entries[0].After)
+	assert.Equal(t, uint(0), entries[0].After.Version)
+
+	update := entries[1]
+	assert.Equal(t, "Payment for Em's mangoes", update.Before.Attributes.Reference)
+	assert.Equal(t, "changed", update.After.Attributes.Reference)
+	assert.Contains(t, update.Changes, FieldChange{Path: "/attributes/reference", From: "Payment for Em's mangoes", To: "changed"})
+
+	// a deleted payment is tombstoned rather than removed
+	assert.Nil(t, entries[2].Before.DeletedAt)
+	require.NotNil(t, entries[2].After)
+	assert.NotNil(t, entries[2].After.DeletedAt)
+	assert.Equal(t, []string{"/deleted_at", "/version"}, changedPaths(entries[2].Changes))
+}
+
+func changedPaths(changes []FieldChange) []string {
+	var paths []string
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+	return paths
+}
+
+func TestAuditRecordsRequestID(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	jsonBytes, err := json.Marshal(payment)
+	require.Nil(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", bytes.NewBuffer(jsonBytes))
+	req.Header.Set(requestIDHeader, "req-123")
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 201, rw.Code)
+	assert.Equal(t, "req-123", rw.Header().Get(requestIDHeader))
+
+	entries, _ := getAuditEntries(t, fmt.Sprintf("/v1/payments/%s/history", payment.ID))
+	require.Len(t, entries, 1)
+	assert.Equal(t, "req-123", entries[0].RequestID)
+	assert.Equal(t, anonymousActor, entries[0].Actor)
+
+	// requests without an ID are given one
+	rw = sendAs(t, "", http.MethodGet, "/v1/payments", nil)
+	_, err = uuid.FromString(rw.Header().Get(requestIDHeader))
+	assert.Nil(t, err)
+}
+
+func TestQueryAuditLog(t *testing.T) {
+
+	emptyDatabase(t)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", createExamplePayment()).Code)
+	}
+	payment := createExamplePayment()
+	require.Equal(t, 201, sendAs(t, "bob", http.MethodPost, "/v1/payments", payment).Code)
+	require.Equal(t, 200, sendAs(t, "bob", http.MethodPost, fmt.Sprintf("/v1/payments/%s/actions/%s", payment.ID, ActionSubmit), nil).Code)
+
+	entries, _ := getAuditEntries(t, "/v1/audit?filter[actor]=bob")
+	require.Len(t, entries, 2)
+
+	// transitions are recorded by their action
+	entries, _ = getAuditEntries(t, "/v1/audit?filter[action]=submit")
+	require.Len(t, entries, 1)
+	assert.Equal(t, payment.ID, entries[0].PaymentID)
+	assert.Equal(t, StatusCreated, entries[0].Before.Attributes.Status)
+	assert.Equal(t, StatusSubmitted, entries[0].After.Attributes.Status)
+
+	entries, _ = getAuditEntries(t, "/v1/audit?filter[since]=2000-01-01T00:00:00Z&filter[until]=2001-01-01T00:00:00Z")
+	assert.Empty(t, entries)
+
+	// page through everything two entries at a time
+	var all []AuditEntry
+	next := "/v1/audit?page[size]=2"
+	for next != "" {
+		entries, links := getAuditEntries(t, next)
+		all = append(all, entries...)
+		next = ""
+		for _, link := range links {
+			if link.Rel == "next" {
+				next = link.Href
+			}
+		}
+	}
+	require.Len(t, all, 5)
+	for i := 1; i < len(all); i++ {
+		assert.True(t, all[i].Seq > all[i-1].Seq)
+	}
+
+	rw := sendAs(t, "", http.MethodGet, "/v1/audit?filter[since]=yesterday", nil)
+	assert.Equal(t, 400, rw.Code)
+}
+
+func TestAuditQueryErrorsAreInParameterOrder(t *testing.T) {
+
+	values, err := url.ParseQuery("filter[since]=yesterday&filter[until]=today")
+	require.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		_, errs := parseAuditQuery(values)
+		require.Len(t, errs, 2)
+		assert.Equal(t, "filter[since]", errs[0].Parameter)
+		assert.Equal(t, "filter[until]", errs[1].Parameter)
+	}
+}
+
+func TestPaymentHistoryOfUnknownPayment(t *testing.T) {
+
+	emptyDatabase(t)
+
+	rw := sendAs(t, "", http.MethodGet, fmt.Sprintf("/v1/payments/%s/history", uuid.NewV4()), nil)
+	assert.Equal(t, 404, rw.Code)
+
+	// payments stored before the audit trail have an empty history
+	payment := createExamplePayment()
+	require.Nil(t, store.Create(&payment))
+	entries, _ := getAuditEntries(t, fmt.Sprintf("/v1/payments/%s/history", payment.ID))
+	assert.Empty(t, entries)
+}
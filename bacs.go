@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	SchemeBACS = "BACS"
+
+	// BACS transaction codes. a credit pays the destination account and a debit collects from it.
+	bacsCredit = "99"
+	bacsDebit  = "17"
+
+	// the largest amount in pence a record can hold
+	bacsMaxPence = 99999999999
+)
+
+var (
+	ErrSchemeFileNotFound = errors.New("scheme file not found")
+
+	serviceUserNumberPattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+	// the characters BACS allows in names and references
+	bacsDisallowed = regexp.MustCompile(`[^A-Z0-9.&/\- ]`)
+)
+
+// SchemeFile is a file generated to submit payments to a scheme, and the payments it includes. Content is the file.
+type SchemeFile struct {
+	tableName struct{} `sql:"scheme_files"`
+
+	ID                uuid.UUID             `json:"id" sql:",pk,type:uuid"`
+	OrganisationID    uuid.UUID             `json:"organisation_id" sql:",type:uuid,notnull"`
+	Scheme            string                `json:"scheme" sql:",notnull"`
+	ServiceUserNumber string                `json:"service_user_number" sql:",notnull"`
+	ProcessingDate    string                `json:"processing_date,omitempty"`
+	Sections          []SchemeFileSection   `json:"sections" sql:",notnull"`
+	Excluded          []SchemeFileExclusion `json:"excluded" sql:",notnull"`
+	CreatedBy         string                `json:"created_by" sql:",notnull"`
+	CreatedAt         time.Time             `json:"created_at" sql:",notnull"`
+	Content           string                `json:"-" sql:",notnull"`
+}
+
+// SchemeFileSection is the payments of one sponsor on one processing date, which a BACS file submits as a file
+// section with its own headers and trailer. the totals include the contra records that balance the section.
+type SchemeFileSection struct {
+	Sponsor        SponsorParty `json:"sponsor"`
+	ProcessingDate string       `json:"processing_date"`
+	PaymentIDs     []uuid.UUID  `json:"payment_ids"`
+	CreditCount    int          `json:"credit_count"`
+	CreditTotal    Decimal      `json:"credit_total"`
+	DebitCount     int          `json:"debit_count"`
+	DebitTotal     Decimal      `json:"debit_total"`
+}
+
+// SchemeFileExclusion is a payment that was due to be in a file, but couldn't be written to it. it is left for a
+// later file once it has been fixed.
+type SchemeFileExclusion struct {
+	PaymentID uuid.UUID `json:"payment_id"`
+	Reason    string    `json:"reason"`
+}
+
+// SchemeFileStore persists the files generated for schemes
+type SchemeFileStore interface {
+	// CreateSchemeFile stores a new file
+	CreateSchemeFile(file *SchemeFile) error
+
+	// GetSchemeFile returns the file with the given ID, or ErrSchemeFileNotFound
+	GetSchemeFile(id uuid.UUID) (SchemeFile, error)
+}
+
+// bacsFileRequest is the body of POST /v1/scheme-files/bacs
+type bacsFileRequest struct {
+	OrganisationID    uuid.UUID `json:"organisation_id"`
+	ServiceUserNumber string    `json:"service_user_number"`
+	ProcessingDate    string    `json:"processing_date"`
+}
+
+// bacsExclusion returns why a payment can't be written to a BACS file, or nothing if it can
+func bacsExclusion(payment Payment) string {
+	attributes := payment.Attributes
+	switch {
+	case attributes.Currency != "GBP":
+		return "BACS payments must be in GBP"
+	case attributes.PaymentType != "Credit" && attributes.PaymentType != "Debit":
+		return "BACS payments must be credits or debits"
+	case attributes.Amount.Sign() <= 0 || attributes.Amount.Scale() > 2 || bacsPence(attributes.Amount) > bacsMaxPence:
+		return "The amount can't be written to a BACS record"
+	case !isBACSAccount(attributes.DebtorParty.SponsorParty) || attributes.BeneficiaryParty.DebtorParty == nil ||
+		!isBACSAccount(attributes.BeneficiaryParty.DebtorParty.SponsorParty):
+		return "BACS payments must be between UK accounts with a sort code"
+	}
+	return ""
+}
+
+func isBACSAccount(account *SponsorParty) bool {
+	return account != nil && account.BankIDCode == "GBDSC" && isSortCode(account.BankID) && isUKAccountNumber(account.AccountNumber)
+}
+
+// bacsPence returns an amount with at most two decimal places in pence
+func bacsPence(amount Decimal) int64 {
+	pence := amount.unscaledAt(2)
+	if !pence.IsInt64() {
+		return bacsMaxPence + 1
+	}
+	return pence.Int64()
+}
+
+// bacsText makes a name or reference safe for a BACS record, and pads or truncates it to the width of its field
+func bacsText(text string, width int) string {
+	text = bacsDisallowed.ReplaceAllString(strings.ToUpper(text), " ")
+	if len(text) > width {
+		text = text[:width]
+	}
+	return fmt.Sprintf("%-*s", width, text)
+}
+
+// bacsDate formats a date as BACS does, a space followed by the year and day of the year
+func bacsDate(date time.Time) string {
+	return fmt.Sprintf(" %02d%03d", date.Year()%100, date.YearDay())
+}
+
+// bacsDetail is a standard 18 detail or contra record, which pays or collects an amount from the destination account
+// on behalf of the originating account
+type bacsDetail struct {
+	destination     SponsorParty
+	transactionCode string
+	originating     SponsorParty
+	pence           int64
+	narrative       string
+	reference       string
+	name            string
+}
+
+func (detail bacsDetail) String() string {
+	return detail.destination.BankID + detail.destination.AccountNumber + "0" + detail.transactionCode +
+		detail.originating.BankID + detail.originating.AccountNumber + "    " + fmt.Sprintf("%011d", detail.pence) +
+		bacsText(detail.narrative, 18) + bacsText(detail.reference, 18) + bacsText(detail.name, 18)
+}
+
+// bacsWriter writes the payments of a file as a standard 18 submission: a volume header, then for each sponsor and
+// processing date a file section of headers, the detail records, a contra record balancing each originating account
+// and trailers.
+type bacsWriter struct {
+	serviceUserNumber string
+	serial            string
+	created           time.Time
+	lines             []string
+}
+
+func (writer *bacsWriter) label(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	writer.lines = append(writer.lines, fmt.Sprintf("%-80s", line))
+}
+
+// header writes the HDR1 and HDR2 labels of a file section, or the EOF1 and EOF2 labels when name is EOF
+func (writer *bacsWriter) header(name string, section int) {
+	fileID := "A" + writer.serviceUserNumber + "S  1" + writer.serviceUserNumber
+	created := bacsDate(writer.created)
+	writer.label("%s1%s%s%04d%04d%6s%s%s %06d%20s", name, fileID, writer.serial, 1, section, "", created, created, 0, "")
+	writer.label("%s2F0200000100%35s00", name, "")
+}
+
+// section writes a file section, and returns its totals
+func (writer *bacsWriter) section(number int, sponsor SponsorParty, processingDate time.Time, payments []Payment) SchemeFileSection {
+	writer.header("HDR", number)
+	writer.label("UHL1%s999999    000000001 DAILY  %03d", bacsDate(processingDate), number)
+
+	var details []bacsDetail
+	var contras []bacsDetail
+	contraIndex := map[string]int{}
+	for _, payment := range payments {
+		attributes := payment.Attributes
+		debtor, beneficiary := attributes.DebtorParty, *attributes.BeneficiaryParty.DebtorParty
+		pence := bacsPence(attributes.Amount)
+
+		// a credit pays the beneficiary from the debtor's account, and a debit collects from the debtor for the
+		// beneficiary. the contra reverses the total from the originating account.
+		detail := bacsDetail{
+			destination:     *beneficiary.SponsorParty,
+			transactionCode: bacsCredit,
+			originating:     *debtor.SponsorParty,
+			pence:           pence,
+			narrative:       debtor.Name,
+			reference:       attributes.Reference,
+			name:            beneficiary.AccountName,
+		}
+		contra := bacsDetail{transactionCode: bacsDebit, name: debtor.AccountName}
+		if attributes.PaymentType == "Debit" {
+			detail.destination, detail.originating = *debtor.SponsorParty, *beneficiary.SponsorParty
+			detail.transactionCode, detail.narrative, detail.name = bacsDebit, beneficiary.Name, debtor.AccountName
+			contra.transactionCode, contra.name = bacsCredit, beneficiary.AccountName
+		}
+		details = append(details, detail)
+
+		key := detail.originating.BankID + detail.originating.AccountNumber + contra.transactionCode
+		i, ok := contraIndex[key]
+		if !ok {
+			contra.destination, contra.originating, contra.reference = detail.originating, detail.originating, "CONTRA"
+			contras = append(contras, contra)
+			i = len(contras) - 1
+			contraIndex[key] = i
+		}
+		contras[i].pence += pence
+	}
+
+	var credits, debits int64
+	summary := SchemeFileSection{Sponsor: sponsor, ProcessingDate: processingDate.Format("2006-01-02")}
+	for _, record := range append(details, contras...) {
+		writer.lines = append(writer.lines, record.String())
+		if record.transactionCode == bacsCredit {
+			summary.CreditCount++
+			credits += record.pence
+		} else {
+			summary.DebitCount++
+			debits += record.pence
+		}
+	}
+	for _, payment := range payments {
+		summary.PaymentIDs = append(summary.PaymentIDs, payment.ID)
+	}
+	summary.CreditTotal, summary.DebitTotal = NewDecimal(credits, 2), NewDecimal(debits, 2)
+
+	writer.header("EOF", number)
+	writer.label("UTL1%013d%013d%07d%07d", debits, credits, summary.DebitCount, summary.CreditCount)
+	return summary
+}
+
+// writeBACSFile writes the payments to a standard 18 file, one section for each sponsor and processing date. payments
+// that can't be written are returned as excluded instead.
+func writeBACSFile(file *SchemeFile, payments []Payment) {
+	file.Sections = []SchemeFileSection{}
+	file.Excluded = []SchemeFileExclusion{}
+
+	type sectionKey struct {
+		sponsor        SponsorParty
+		processingDate string
+	}
+	groups := map[sectionKey][]Payment{}
+	var keys []sectionKey
+	for _, payment := range payments {
+		if reason := bacsExclusion(payment); reason != "" {
+			file.Excluded = append(file.Excluded, SchemeFileExclusion{PaymentID: payment.ID, Reason: reason})
+			continue
+		}
+		key := sectionKey{sponsor: payment.Attributes.SponsorParty, processingDate: payment.Attributes.ProcessingDate}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], payment)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].processingDate != keys[j].processingDate {
+			return keys[i].processingDate < keys[j].processingDate
+		}
+		return keys[i].sponsor.BankID+keys[i].sponsor.AccountNumber < keys[j].sponsor.BankID+keys[j].sponsor.AccountNumber
+	})
+
+	writer := &bacsWriter{
+		serviceUserNumber: file.ServiceUserNumber,
+		serial:            strings.ToUpper(strings.Replace(file.ID.String(), "-", "", -1)[:6]),
+		created:           file.CreatedAt,
+	}
+	writer.label("VOL1%s %26s    %s    %28s1", writer.serial, "", file.ServiceUserNumber, "")
+	for i, key := range keys {
+		// processing dates have been validated as the payments were created
+		processingDate, _ := time.Parse("2006-01-02", key.processingDate)
+		file.Sections = append(file.Sections, writer.section(i+1, key.sponsor, processingDate, groups[key]))
+	}
+	file.Content = strings.Join(writer.lines, "\r\n") + "\r\n"
+}
+
+// bacsPayments returns the payments due to be written to a BACS file: the submitted BACS payments that aren't in a
+// file yet, for the processing date when one is given
+func bacsPayments(store PaymentStore, organisationID uuid.UUID, processingDate string) ([]Payment, error) {
+	query := PaymentQuery{}
+	query.Filter.OrganisationID = organisationID
+	query.Filter.PaymentScheme = SchemeBACS
+	query.Filter.ProcessingDateFrom, query.Filter.ProcessingDateTo = processingDate, processingDate
+	page, err := store.List(query)
+	if err != nil {
+		return nil, err
+	}
+	var due []Payment
+	for _, payment := range page.Payments {
+		if payment.currentStatus() == StatusSubmitted && payment.Attributes.SchemeFileID == nil {
+			due = append(due, payment)
+		}
+	}
+	return due, nil
+}
+
+// business logic for POST /v1/scheme-files/bacs endpoint, which writes the organisation's submitted BACS payments to
+// a standard 18 file and links each payment to it
+func (api *api) createBACSFile(w http.ResponseWriter, r *http.Request) {
+
+	var request bacsFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	// files are for the organisation of the API key unless another is given, which is refused
+	if organisationID, ok := requestOrganisation(r); ok && request.OrganisationID == uuid.Nil {
+		request.OrganisationID = organisationID
+	}
+	if !checkOrganisation(w, r, Payment{OrganisationID: request.OrganisationID}) {
+		return
+	}
+	var errs []APIError
+	if request.OrganisationID == uuid.Nil {
+		errs = append(errs, APIError{Code: codeRequired, Message: "organisation_id is required", Pointer: "/organisation_id"})
+	}
+	if !serviceUserNumberPattern.MatchString(request.ServiceUserNumber) {
+		errs = append(errs, APIError{Code: codeInvalidFormat, Message: "service_user_number must be 6 digits", Pointer: "/service_user_number"})
+	}
+	if _, err := time.Parse("2006-01-02", request.ProcessingDate); request.ProcessingDate != "" && err != nil {
+		errs = append(errs, APIError{Code: codeInvalidFormat, Message: "processing_date must be a YYYY-MM-DD date", Pointer: "/processing_date"})
+	}
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+
+	file := SchemeFile{
+		ID:                uuid.NewV4(),
+		OrganisationID:    request.OrganisationID,
+		Scheme:            SchemeBACS,
+		ServiceUserNumber: request.ServiceUserNumber,
+		ProcessingDate:    request.ProcessingDate,
+		CreatedBy:         requestActor(r),
+		CreatedAt:         time.Now().UTC(),
+	}
+
+	// the file and the links to it are written together, and a payment changed meanwhile fails the whole file, so
+	// that no payment is ever in two files
+	var empty bool
+	store := api.storeFor(r)
+	err := store.RunInTransaction(func(tx PaymentStore) error {
+		payments, err := bacsPayments(tx, file.OrganisationID, file.ProcessingDate)
+		if err != nil {
+			return err
+		}
+		writeBACSFile(&file, payments)
+		if empty = len(file.Sections) == 0; empty {
+			return nil
+		}
+		if err := tx.CreateSchemeFile(&file); err != nil {
+			return err
+		}
+		listed := map[uuid.UUID]Payment{}
+		for _, payment := range payments {
+			listed[payment.ID] = payment
+		}
+		for _, section := range file.Sections {
+			for _, id := range section.PaymentIDs {
+				if err := api.linkSchemeFile(tx, r, listed[id], file.ID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if empty {
+		writeErrors(w, http.StatusUnprocessableEntity, APIError{Code: "no_payments", Message: fmt.Sprintf("There are no submitted BACS payments that can be written to a file, %d were excluded", len(file.Excluded))})
+		return
+	}
+
+	self := "/v1/scheme-files/" + file.ID.String()
+	w.Header().Set("Location", self)
+	writeData(w, http.StatusCreated, file, schemeFileLinks(file)...)
+}
+
+// linkSchemeFile records that a payment is in a scheme file. the payment is the version written to the file, so if it
+// has been changed since, this fails with ErrVersionConflict.
+func (api *api) linkSchemeFile(store PaymentStore, r *http.Request, payment Payment, fileID uuid.UUID) error {
+	before := payment
+	payment.Attributes.SchemeFileID = &fileID
+	return api.audit(store, r, AuditUpdate, &before, func(tx PaymentStore) (*Payment, error) {
+		return &payment, tx.Update(&payment)
+	})
+}
+
+// business logic for GET /v1/scheme-files/{id} endpoint
+func (api *api) getSchemeFile(w http.ResponseWriter, r *http.Request) {
+
+	file, ok := api.schemeFileFromRequest(w, r)
+	if !ok {
+		return
+	}
+	writeData(w, http.StatusOK, file, schemeFileLinks(file)...)
+}
+
+// business logic for GET /v1/scheme-files/{id}/content endpoint, which returns the file to submit to the scheme
+func (api *api) getSchemeFileContent(w http.ResponseWriter, r *http.Request) {
+
+	file, ok := api.schemeFileFromRequest(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=us-ascii")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.txt"`, strings.ToLower(file.Scheme), file.ID))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(file.Content))
+}
+
+// read the scheme file the request is for. if it can't be read, an error response is written and ok is false.
+func (api *api) schemeFileFromRequest(w http.ResponseWriter, r *http.Request) (file SchemeFile, ok bool) {
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return file, false
+	}
+	file, err := api.storeFor(r).GetSchemeFile(id)
+	if err == ErrSchemeFileNotFound {
+		writeError(w, http.StatusNotFound, "not_found", "Scheme file not found")
+		return file, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return file, false
+	}
+	return file, true
+}
+
+func schemeFileLinks(file SchemeFile) []Link {
+	self := "/v1/scheme-files/" + file.ID.String()
+	return []Link{{Rel: "self", Href: self}, {Rel: "content", Href: self + "/content"}}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createBACSPayment returns an example payment made through BACS
+func createBACSPayment(organisationID uuid.UUID, amount string) Payment {
+	payment := createExamplePayment()
+	payment.OrganisationID = organisationID
+	payment.Attributes.PaymentScheme = SchemeBACS
+	payment.Attributes.SchemePaymentType = "ForwardDatedPayment"
+	payment.Attributes.Reference = "Em's mangoes"
+	payment.Attributes.Amount = MustParseDecimal(amount)
+	return payment
+}
+
+func TestWriteBACSFile(t *testing.T) {
+
+	organisationID := uuid.NewV4()
+	first := createBACSPayment(organisationID, "100.21")
+	second := createBACSPayment(organisationID, "0.79")
+	collection := createBACSPayment(organisationID, "12.00")
+	collection.Attributes.PaymentType = "Debit"
+	later := createBACSPayment(organisationID, "5.00")
+	later.Attributes.ProcessingDate = "2017-01-19"
+	euros := createBACSPayment(organisationID, "1.00")
+	euros.Attributes.Currency = "EUR"
+
+	file := SchemeFile{ID: uuid.NewV4(), ServiceUserNumber: "123456", CreatedAt: time.Date(2017, 1, 17, 9, 0, 0, 0, time.UTC)}
+	writeBACSFile(&file, []Payment{later, first, euros, second, collection})
+
+	assert.Equal(t, []SchemeFileExclusion{{PaymentID: euros.ID, Reason: "BACS payments must be in GBP"}}, file.Excluded)
+	require.Len(t, file.Sections, 2)
+	section := file.Sections[0]
+	assert.Equal(t, "2017-01-18", section.ProcessingDate)
+	assert.Equal(t, first.Attributes.SponsorParty, section.Sponsor)
+	assert.Equal(t, []uuid.UUID{first.ID, second.ID, collection.ID}, section.PaymentIDs)
+	assert.Equal(t, 3, section.CreditCount)
+	assert.Equal(t, 2, section.DebitCount)
+	assert.Equal(t, "113.00", section.CreditTotal.String())
+	assert.Equal(t, section.CreditTotal.String(), section.DebitTotal.String())
+	assert.Equal(t, []uuid.UUID{later.ID}, file.Sections[1].PaymentIDs)
+
+	lines := strings.Split(strings.TrimSuffix(file.Content, "\r\n"), "\r\n")
+	var types []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "20330") {
+			assert.Len(t, line, 100, line)
+			types = append(types, line[15:17])
+			continue
+		}
+		assert.Len(t, line, 80, line)
+		types = append(types, line[:4])
+	}
+	assert.Equal(t, []string{
+		"VOL1",
+		"HDR1", "HDR2", "UHL1", "99", "99", "17", "17", "99", "EOF1", "EOF2", "UTL1",
+		"HDR1", "HDR2", "UHL1", "99", "17", "EOF1", "EOF2", "UTL1",
+	}, types)
+
+	assert.Equal(t, "VOL1"+strings.ToUpper(strings.Replace(file.ID.String(), "-", "", -1)[:6]), lines[0][:10])
+	assert.Equal(t, "    123456    ", lines[0][37:51])
+	assert.Equal(t, "HDR1A123456S  1123456", lines[1][:21])
+	assert.Equal(t, " 17017 17017", lines[1][41:53])
+	assert.Equal(t, "UHL1 17018999999    000000001 DAILY  001", lines[3][:40])
+
+	// the debtor's account pays the beneficiary, and a collection debits the debtor for the beneficiary
+	assert.Equal(t, "2033011234567809920330177777777    00000010021MANGOES INCORPORATEM S MANGOES      L GALVIN          ", lines[4])
+	assert.Equal(t, "2033017777777701720330112345678    00000001200LIAM GALVIN       EM S MANGOES      MANGOES INC       ", lines[6])
+
+	// each originating account is balanced by a contra, debiting it for credits and crediting it for collections
+	assert.Equal(t, "2033017777777701720330177777777    00000010100                  CONTRA            MANGOES INC       ", lines[7])
+	assert.Equal(t, "2033011234567809920330112345678    00000001200                  CONTRA            L GALVIN          ", lines[8])
+	assert.Equal(t, "UTL1"+"0000000011300"+"0000000011300"+"0000002"+"0000003", lines[11][:44])
+	assert.Equal(t, "UHL1 17019999999    000000001 DAILY  002", lines[14][:40])
+}
+
+func TestCreateBACSFile(t *testing.T) {
+
+	emptyDatabase(t)
+
+	organisationID := uuid.NewV4()
+	var submitted []Payment
+	for _, amount := range []string{"10.00", "20.50"} {
+		payment := createBACSPayment(organisationID, amount)
+		require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+		require.Equal(t, 200, postAction(t, payment, ActionSubmit).Code)
+		submitted = append(submitted, payment)
+	}
+
+	// payments that haven't been submitted, or are for another scheme, aren't written
+	unsubmitted := createBACSPayment(organisationID, "1.00")
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", unsubmitted).Code)
+	faster := createExamplePayment()
+	faster.OrganisationID = organisationID
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", faster).Code)
+	require.Equal(t, 200, postAction(t, faster, ActionSubmit).Code)
+
+	request := map[string]interface{}{"organisation_id": organisationID, "service_user_number": "123456"}
+	rw := sendAs(t, "bob", http.MethodPost, "/v1/scheme-files/bacs", request)
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var file SchemeFile
+	require.Nil(t, json.Unmarshal(response.Data, &file))
+	assert.Equal(t, "/v1/scheme-files/"+file.ID.String(), rw.Header().Get("Location"))
+	assert.Equal(t, SchemeBACS, file.Scheme)
+	assert.Equal(t, "bob", file.CreatedBy)
+	require.Len(t, file.Sections, 1)
+	assert.Equal(t, []uuid.UUID{submitted[0].ID, submitted[1].ID}, file.Sections[0].PaymentIDs)
+	assert.Equal(t, "30.50", file.Sections[0].CreditTotal.String())
+
+	for _, payment := range submitted {
+		rw := sendAs(t, "", http.MethodGet, "/v1/payments/"+payment.ID.String(), nil)
+		require.Equal(t, 200, rw.Code)
+		linked, rels := decodePaymentResponse(t, rw)
+		require.NotNil(t, linked.Attributes.SchemeFileID)
+		assert.Equal(t, file.ID, *linked.Attributes.SchemeFileID)
+		assert.Contains(t, rels, "scheme_file")
+	}
+	stored, err := store.Get(unsubmitted.ID)
+	require.Nil(t, err)
+	assert.Nil(t, stored.Attributes.SchemeFileID)
+
+	rw = sendAs(t, "", http.MethodGet, "/v1/scheme-files/"+file.ID.String()+"/content", nil)
+	require.Equal(t, 200, rw.Code)
+	assert.Equal(t, "text/plain; charset=us-ascii", rw.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(rw.Body.String(), "VOL1"))
+	assert.Contains(t, rw.Body.String(), "0000000003050")
+	assert.Equal(t, 200, sendAs(t, "", http.MethodGet, "/v1/scheme-files/"+file.ID.String(), nil).Code)
+	assert.Equal(t, 404, sendAs(t, "", http.MethodGet, "/v1/scheme-files/"+uuid.NewV4().String(), nil).Code)
+
+	// payments are only ever written to one file
+	rw = sendAs(t, "bob", http.MethodPost, "/v1/scheme-files/bacs", request)
+	assert.Equal(t, 422, rw.Code)
+	assert.Contains(t, rw.Body.String(), "no_payments")
+
+	// the file can't be changed by patching the payment
+	rw = sendAs(t, "alice", http.MethodPatch, "/v1/payments/"+submitted[0].ID.String(), json.RawMessage(`{"attributes":{"scheme_file_id":null}}`))
+	assert.NotEqual(t, 200, rw.Code)
+}
+
+func TestPaymentsChangedAfterBeingWrittenArentLinked(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createBACSPayment(uuid.NewV4(), "10.00")
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	require.Equal(t, 200, postAction(t, payment, ActionSubmit).Code)
+	listed, err := bacsPayments(store, payment.OrganisationID, "")
+	require.Nil(t, err)
+	require.Len(t, listed, 1)
+
+	// the payment changes after it was written to the file
+	changed, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	changed.Attributes.Reference = "changed"
+	require.Nil(t, store.Update(&changed))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/scheme-files/bacs", nil)
+	assert.Equal(t, ErrVersionConflict, newAPI(store).linkSchemeFile(store, req, listed[0], uuid.NewV4()))
+	stored, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Nil(t, stored.Attributes.SchemeFileID)
+	assert.Equal(t, "changed", stored.Attributes.Reference)
+}
+
+func TestCreateBACSFileIsForTheKeysOrganisation(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createBACSPayment(uuid.NewV4(), "10.00")
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	require.Equal(t, 200, postAction(t, payment, ActionSubmit).Code)
+	_, key := createAPIKey(t, payment.OrganisationID)
+	_, other := createAPIKey(t, uuid.NewV4())
+
+	rw := sendWithKey(t, key, http.MethodPost, "/v1/scheme-files/bacs", mustMarshal(t, map[string]string{"service_user_number": "12345"}))
+	assert.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/service_user_number": codeInvalidFormat}, errorPointers(response.Errors))
+
+	rw = sendWithKey(t, other, http.MethodPost, "/v1/scheme-files/bacs", mustMarshal(t, map[string]interface{}{"organisation_id": payment.OrganisationID, "service_user_number": "123456"}))
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, 422, sendWithKey(t, other, http.MethodPost, "/v1/scheme-files/bacs", mustMarshal(t, map[string]string{"service_user_number": "123456"})).Code)
+
+	rw = sendWithKey(t, key, http.MethodPost, "/v1/scheme-files/bacs", mustMarshal(t, map[string]string{"service_user_number": "123456", "processing_date": payment.Attributes.ProcessingDate}))
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	response = APIResponse{}
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var file SchemeFile
+	require.Nil(t, json.Unmarshal(response.Data, &file))
+	assert.Equal(t, payment.OrganisationID, file.OrganisationID)
+
+	assert.Equal(t, 404, sendWithKey(t, other, http.MethodGet, "/v1/scheme-files/"+file.ID.String(), nil).Code)
+	assert.Equal(t, 200, sendWithKey(t, key, http.MethodGet, "/v1/scheme-files/"+file.ID.String(), nil).Code)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// the modes a batch can be created in. an atomic batch creates all of its payments or none of them, a best effort batch
+// creates every payment that it can.
+const (
+	BatchModeAtomic     = "atomic"
+	BatchModeBestEffort = "best_effort"
+)
+
+// the outcome of a batch, and of each payment in it
+const (
+	BatchStatusCompleted = "completed"
+	BatchStatusPartial   = "partially_completed"
+	BatchStatusFailed    = "failed"
+
+	BatchItemCreated    = "created"
+	BatchItemFailed     = "failed"
+	BatchItemRolledBack = "rolled_back"
+)
+
+// the most payments accepted in one batch
+const maxBatchSize = 1000
+
+var (
+	ErrBatchNotFound = errors.New("payment batch not found")
+	ErrBatchExists   = errors.New("payment batch already exists")
+
+	// returned from an atomic batch's transaction to roll it back
+	errBatchItemFailed = errors.New("batch item failed")
+)
+
+// PaymentBatch is the record of a POST /v1/payment-batches request and the outcome of each payment in it
+type PaymentBatch struct {
+	tableName struct{} `sql:"payment_batches"`
+
+	ID             uuid.UUID   `json:"id" sql:",pk,type:uuid"`
+	OrganisationID uuid.UUID   `json:"organisation_id" sql:",type:uuid"`
+	Mode           string      `json:"mode" sql:",notnull"`
+	Status         string      `json:"status" sql:",notnull"`
+	Total          int         `json:"total" sql:",notnull"`
+	Created        int         `json:"created" sql:",notnull"`
+	Failed         int         `json:"failed" sql:",notnull"`
+	Items          []BatchItem `json:"items" sql:",notnull"`
+	CreatedAt      time.Time   `json:"created_at" sql:",notnull"`
+
+	// the current status of the batch's payments, which is worked out when the batch is fetched
+	PaymentStatuses map[string]int `json:"payment_statuses,omitempty" sql:"-"`
+}
+
+// BatchItem is the outcome of one payment in a batch. StatusCode and Errors are what POST /v1/payments would have
+// responded with for the payment, and Links locate the payment when it was created.
+type BatchItem struct {
+	Index      int        `json:"index"`
+	PaymentID  string     `json:"payment_id,omitempty"`
+	Status     string     `json:"status"`
+	StatusCode int        `json:"status_code"`
+	Errors     []APIError `json:"errors,omitempty"`
+	Links      []Link     `json:"links,omitempty"`
+}
+
+// BatchStore persists payment batches, so that their outcome can be fetched later
+type BatchStore interface {
+	// GetBatch returns the batch with the given ID, or ErrBatchNotFound
+	GetBatch(id uuid.UUID) (PaymentBatch, error)
+
+	// CreateBatch inserts a new batch, or returns ErrBatchExists if one already exists with the same ID
+	CreateBatch(batch *PaymentBatch) error
+}
+
+// tally counts the items that were created and sets the status of the batch from them
+func (batch *PaymentBatch) tally() {
+	batch.Total, batch.Created, batch.Failed = len(batch.Items), 0, 0
+	for _, item := range batch.Items {
+		if item.Status == BatchItemCreated {
+			batch.Created++
+		} else {
+			batch.Failed++
+		}
+	}
+	switch {
+	case batch.Failed == 0:
+		batch.Status = BatchStatusCompleted
+	case batch.Created == 0:
+		batch.Status = BatchStatusFailed
+	default:
+		batch.Status = BatchStatusPartial
+	}
+}
+
+// createBatchItem creates one payment of a batch exactly as POST /v1/payments would, and records the response
+func (api *api) createBatchItem(store PaymentStore, r *http.Request, index int, body json.RawMessage) BatchItem {
+	item := BatchItem{Index: index}
+
+	// the ID is reported even when the payment can't be created, if it can be found
+	var identified struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(body, &identified)
+	item.PaymentID = identified.ID
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/payments", bytes.NewReader(body))
+	if err != nil {
+		item.Status, item.StatusCode = BatchItemFailed, http.StatusInternalServerError
+		return item
+	}
+
+	// the payment is created by the same actor and organisation, in the same request, as the batch
+	req = req.WithContext(r.Context())
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, r.Header.Get(actorHeader))
+	req.Header.Set(requestIDHeader, r.Header.Get(requestIDHeader))
+	recorder := newResponseRecorder()
+	api.insertPayment(store, recorder, req)
+
+	item.StatusCode = recorder.status
+	if recorder.status != http.StatusCreated {
+		item.Status = BatchItemFailed
+		var response APIResponse
+		if err := json.Unmarshal(recorder.body.Bytes(), &response); err == nil {
+			item.Errors = response.Errors
+		}
+		return item
+	}
+	item.Status = BatchItemCreated
+	item.Links = []Link{{Rel: "self", Href: recorder.header.Get("Location")}}
+	return item
+}
+
+// business logic for POST /v1/payment-batches endpoint. retries with the same Idempotency-Key get the original response.
+func (api *api) createBatch(w http.ResponseWriter, r *http.Request) {
+	api.withIdempotencyKey(w, r, api.insertBatch)
+}
+
+// create the POSTed batch of payments using the given store
+func (api *api) insertBatch(store PaymentStore, w http.ResponseWriter, r *http.Request) {
+
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = BatchModeAtomic
+	case BatchModeAtomic, BatchModeBestEffort:
+	default:
+		writeErrors(w, http.StatusBadRequest, APIError{
+			Code:      "invalid_parameter",
+			Message:   fmt.Sprintf("mode must be %s or %s", BatchModeAtomic, BatchModeBestEffort),
+			Parameter: "mode",
+		})
+		return
+	}
+
+	// the payments are in the same shape as a list of payments. each is decoded when it is created, so that a
+	// malformed payment is reported against its item rather than failing the whole batch.
+	var request struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if len(request.Data) == 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, APIError{Code: codeRequired, Message: "data must contain at least one payment", Pointer: "/data"})
+		return
+	}
+	if len(request.Data) > maxBatchSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "batch_too_large", fmt.Sprintf("A batch can contain at most %d payments", maxBatchSize))
+		return
+	}
+
+	api.processBatch(store, w, r, mode, request.Data)
+}
+
+// processBatch creates a batch of payments, each given as the JSON body POST /v1/payments takes, and writes the batch
+// as the response
+func (api *api) processBatch(store PaymentStore, w http.ResponseWriter, r *http.Request, mode string, payments []json.RawMessage) {
+
+	batch := PaymentBatch{
+		ID:        uuid.NewV4(),
+		Mode:      mode,
+		CreatedAt: time.Now().UTC(),
+	}
+	createItems := func(store PaymentStore) {
+		for i, body := range payments {
+			batch.Items = append(batch.Items, api.createBatchItem(store, r, i, body))
+		}
+	}
+
+	if mode == BatchModeAtomic {
+		// every payment is still tried, so that all of the problems are reported at once
+		err := store.RunInTransaction(func(tx PaymentStore) error {
+			batch.Items = nil
+			createItems(tx)
+			for _, item := range batch.Items {
+				if item.Status != BatchItemCreated {
+					return errBatchItemFailed
+				}
+			}
+			return nil
+		})
+		switch err {
+		case nil:
+		case errBatchItemFailed:
+			for i := range batch.Items {
+				if batch.Items[i].Status == BatchItemCreated {
+					batch.Items[i].Status = BatchItemRolledBack
+					batch.Items[i].StatusCode = http.StatusFailedDependency
+					batch.Items[i].Links = nil
+				}
+			}
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	} else {
+		createItems(store)
+	}
+	batch.tally()
+
+	if err := store.CreateBatch(&batch); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the batch was processed even if none of its payments were created, but that is reported as a failure
+	status := http.StatusCreated
+	if batch.Status == BatchStatusFailed {
+		status = http.StatusUnprocessableEntity
+	}
+	self := fmt.Sprintf("/v1/payment-batches/%s", batch.ID)
+	w.Header().Set("Location", self)
+	writeData(w, status, batch, Link{Rel: "self", Href: self})
+}
+
+// business logic for GET /v1/payment-batches/{id} endpoint
+func (api *api) getBatch(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	store := api.storeFor(r)
+	batch, err := store.GetBatch(id)
+	if err != nil {
+		if err == ErrBatchNotFound {
+			writeError(w, http.StatusNotFound, "not_found", "Payment batch not found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the payments may have moved on since the batch created them, or been deleted
+	batch.PaymentStatuses = map[string]int{}
+	for _, item := range batch.Items {
+		if item.Status != BatchItemCreated {
+			continue
+		}
+		payment, err := store.Get(uuid.FromStringOrNil(item.PaymentID))
+		switch err {
+		case nil:
+			batch.PaymentStatuses[payment.currentStatus()]++
+		case ErrPaymentNotFound:
+			batch.PaymentStatuses["deleted"]++
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeData(w, http.StatusOK, batch, Link{Rel: "self", Href: fmt.Sprintf("/v1/payment-batches/%s", batch.ID)})
+}
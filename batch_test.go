@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postBatch(t *testing.T, query string, payments []Payment, headers map[string]string) (*httptest.ResponseRecorder, PaymentBatch) {
+	body, err := json.Marshal(map[string]interface{}{"data": payments})
+	require.Nil(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/v1/payment-batches"+query, bytes.NewBuffer(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+
+	var batch PaymentBatch
+	var response APIResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err == nil && response.Data != nil {
+		require.Nil(t, json.Unmarshal(response.Data, &batch))
+	}
+	return rw, batch
+}
+
+func itemStatuses(batch PaymentBatch) []string {
+	var statuses []string
+	for _, item := range batch.Items {
+		statuses = append(statuses, item.Status)
+	}
+	return statuses
+}
+
+func TestBestEffortBatchCreatesValidPayments(t *testing.T) {
+
+	emptyDatabase(t)
+
+	valid := createExamplePayment()
+	invalid := createExamplePayment()
+	invalid.Attributes.Amount = Decimal{}
+
+	rw, batch := postBatch(t, "?mode=best_effort", []Payment{valid, invalid, valid}, nil)
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	assert.Equal(t, fmt.Sprintf("/v1/payment-batches/%s", batch.ID), rw.Header().Get("Location"))
+
+	assert.Equal(t, BatchStatusPartial, batch.Status)
+	assert.Equal(t, 3, batch.Total)
+	assert.Equal(t, 1, batch.Created)
+	assert.Equal(t, 2, batch.Failed)
+	assert.Equal(t, []string{BatchItemCreated, BatchItemFailed, BatchItemFailed}, itemStatuses(batch))
+
+	assert.Equal(t, valid.ID.String(), batch.Items[0].PaymentID)
+	assert.Equal(t, 201, batch.Items[0].StatusCode)
+	assert.Equal(t, []Link{{Rel: "self", Href: fmt.Sprintf("/v1/payments/%s", valid.ID)}}, batch.Items[0].Links)
+
+	assert.Equal(t, 422, batch.Items[1].StatusCode)
+	assert.Equal(t, map[string]string{"/attributes/amount": codeRequired}, errorPointers(batch.Items[1].Errors))
+
+	// the same payment twice in one batch
+	assert.Equal(t, 400, batch.Items[2].StatusCode)
+	assert.Equal(t, "already_exists", batch.Items[2].Errors[0].Code)
+
+	_, err := store.Get(valid.ID)
+	assert.Nil(t, err)
+}
+
+func TestAtomicBatchCreatesAllOrNothing(t *testing.T) {
+
+	emptyDatabase(t)
+
+	first, second := createExamplePayment(), createExamplePayment()
+	invalid := createExamplePayment()
+	invalid.Attributes.Currency = "ABC"
+
+	rw, batch := postBatch(t, "", []Payment{first, invalid, second}, nil)
+	require.Equal(t, 422, rw.Code, rw.Body.String())
+	assert.Equal(t, BatchModeAtomic, batch.Mode)
+	assert.Equal(t, BatchStatusFailed, batch.Status)
+	assert.Equal(t, []string{BatchItemRolledBack, BatchItemFailed, BatchItemRolledBack}, itemStatuses(batch))
+	assert.Empty(t, batch.Items[0].Links)
+
+	for _, payment := range []Payment{first, second} {
+		_, err := store.Get(payment.ID)
+		assert.Equal(t, ErrPaymentNotFound, err)
+	}
+
+	rw, batch = postBatch(t, "?mode=atomic", []Payment{first, second}, nil)
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	assert.Equal(t, BatchStatusCompleted, batch.Status)
+	assert.Equal(t, 2, batch.Created)
+}
+
+func TestGetBatchReportsPaymentStatuses(t *testing.T) {
+
+	emptyDatabase(t)
+
+	first, second, third := createExamplePayment(), createExamplePayment(), createExamplePayment()
+	rw, batch := postBatch(t, "", []Payment{first, second, third}, nil)
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+
+	require.Equal(t, 200, postAction(t, second, ActionSubmit).Code)
+	require.Nil(t, store.Delete(third.ID, 0))
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v1/payment-batches/%s", batch.ID), nil)
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 200, rw.Code)
+
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var fetched PaymentBatch
+	require.Nil(t, json.Unmarshal(response.Data, &fetched))
+	assert.Equal(t, batch.Items, fetched.Items)
+	assert.Equal(t, BatchStatusCompleted, fetched.Status)
+	assert.Equal(t, map[string]int{StatusCreated: 1, StatusSubmitted: 1, "deleted": 1}, fetched.PaymentStatuses)
+
+	req = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v1/payment-batches/%s", uuid.NewV4()), nil)
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestBatchRequestErrors(t *testing.T) {
+
+	emptyDatabase(t)
+
+	rw, _ := postBatch(t, "?mode=sometimes", []Payment{createExamplePayment()}, nil)
+	assert.Equal(t, 400, rw.Code)
+
+	rw, _ = postBatch(t, "", []Payment{}, nil)
+	assert.Equal(t, 422, rw.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/payment-batches", bytes.NewBufferString(`{"data": [`))
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 400, rw.Code)
+
+	// a payment that isn't even a payment fails on its own
+	req = httptest.NewRequest(http.MethodPost, "/v1/payment-batches?mode=best_effort", bytes.NewBufferString(`{"data": [42]}`))
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var batch PaymentBatch
+	require.Nil(t, json.Unmarshal(response.Data, &batch))
+	assert.Equal(t, "invalid_json", batch.Items[0].Errors[0].Code)
+}
+
+func TestBatchWithIdempotencyKeyIsReplayed(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payments := []Payment{createExamplePayment(), createExamplePayment()}
+	headers := map[string]string{"Idempotency-Key": "batch-1"}
+
+	rw, batch := postBatch(t, "", payments, headers)
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+
+	rw, replayed := postBatch(t, "", payments, headers)
+	require.Equal(t, 201, rw.Code)
+	assert.Equal(t, "true", rw.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, batch.ID, replayed.ID)
+	assert.Equal(t, BatchStatusCompleted, replayed.Status)
+}
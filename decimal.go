@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// payment messages allow at most 18 digits in an amount, which always fits in the unscaled int64
+const maxDecimalDigits = 18
+
+var (
+	ErrDecimalOverflow = errors.New("decimal overflow")
+	ErrDivisionByZero  = errors.New("division by zero")
+)
+
+// RoundingMode decides which way a decimal is rounded when it has more decimal places than are wanted
+type RoundingMode int
+
+const (
+	// RoundHalfEven rounds to the nearest value, and halves to the even neighbour. this is banker's rounding.
+	RoundHalfEven RoundingMode = iota
+	// RoundHalfUp rounds to the nearest value, and halves away from zero
+	RoundHalfUp
+	// RoundDown truncates towards zero
+	RoundDown
+	// RoundUp rounds away from zero
+	RoundUp
+)
+
+// Decimal is an exact fixed-point number, the unscaled value divided by 10^scale. the scale is kept as it was given, so
+// "100.00" is written back as "100.00" rather than "100". the zero value is empty, for amounts that were not given, and
+// counts as zero in arithmetic.
+type Decimal struct {
+	unscaled int64
+	scale    int32
+	set      bool
+
+	// the text of a JSON value that isn't a decimal, kept so that validation can report which field it was in
+	invalid string
+}
+
+// NewDecimal returns the decimal unscaled / 10^scale
+func NewDecimal(unscaled int64, scale int32) Decimal {
+	return Decimal{unscaled: unscaled, scale: scale, set: true}
+}
+
+// ParseDecimal parses a plain decimal such as "100.00" or "-0.5". exponents are not accepted. an empty string is the
+// empty decimal.
+func ParseDecimal(s string) (Decimal, error) {
+	if s == "" {
+		return Decimal{}, nil
+	}
+	invalid := fmt.Errorf("invalid decimal %q", s)
+
+	digits := strings.TrimPrefix(s, "-")
+	integer, fraction := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		integer, fraction = digits[:i], digits[i+1:]
+		if fraction == "" {
+			return Decimal{}, invalid
+		}
+	}
+	if integer == "" {
+		return Decimal{}, invalid
+	}
+	for _, c := range integer + fraction {
+		if c < '0' || c > '9' {
+			return Decimal{}, invalid
+		}
+	}
+	if len(strings.TrimLeft(integer+fraction, "0")) > maxDecimalDigits {
+		return Decimal{}, ErrDecimalOverflow
+	}
+
+	unscaled, _ := new(big.Int).SetString(integer+fraction, 10)
+	if digits != s {
+		unscaled.Neg(unscaled)
+	}
+	return decimalFromBig(unscaled, int32(len(fraction)))
+}
+
+// MustParseDecimal is like ParseDecimal but panics if the decimal is invalid. it is for constants.
+func MustParseDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func decimalFromBig(unscaled *big.Int, scale int32) (Decimal, error) {
+	if !unscaled.IsInt64() {
+		return Decimal{}, ErrDecimalOverflow
+	}
+	return NewDecimal(unscaled.Int64(), scale), nil
+}
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// unscaledAt returns the unscaled value of the decimal at a scale at least as large as its own
+func (d Decimal) unscaledAt(scale int32) *big.Int {
+	unscaled := big.NewInt(d.unscaled)
+	return unscaled.Mul(unscaled, pow10(scale-d.scale))
+}
+
+// IsEmpty reports whether the decimal was not given
+func (d Decimal) IsEmpty() bool {
+	return !d.set && d.invalid == ""
+}
+
+// IsValid reports whether the decimal was read from a valid JSON value, or is empty
+func (d Decimal) IsValid() bool {
+	return d.invalid == ""
+}
+
+// Scale returns the number of decimal places
+func (d Decimal) Scale() int32 {
+	return d.scale
+}
+
+// Sign returns -1, 0 or 1 depending on whether the decimal is negative, zero or positive
+func (d Decimal) Sign() int {
+	switch {
+	case d.unscaled < 0:
+		return -1
+	case d.unscaled > 0:
+		return 1
+	}
+	return 0
+}
+
+// Cmp compares the values of two decimals regardless of their scales, returning -1, 0 or 1
+func (d Decimal) Cmp(other Decimal) int {
+	scale := maxScale(d, other)
+	return d.unscaledAt(scale).Cmp(other.unscaledAt(scale))
+}
+
+// Equal reports whether two decimals have the same value, so 1.5 equals 1.50
+func (d Decimal) Equal(other Decimal) bool {
+	return d.Cmp(other) == 0
+}
+
+func maxScale(a, b Decimal) int32 {
+	if a.scale > b.scale {
+		return a.scale
+	}
+	return b.scale
+}
+
+// Add returns d + other, at the larger of their scales
+func (d Decimal) Add(other Decimal) (Decimal, error) {
+	scale := maxScale(d, other)
+	return decimalFromBig(new(big.Int).Add(d.unscaledAt(scale), other.unscaledAt(scale)), scale)
+}
+
+// Sub returns d - other, at the larger of their scales
+func (d Decimal) Sub(other Decimal) (Decimal, error) {
+	scale := maxScale(d, other)
+	return decimalFromBig(new(big.Int).Sub(d.unscaledAt(scale), other.unscaledAt(scale)), scale)
+}
+
+// Neg returns -d
+func (d Decimal) Neg() Decimal {
+	if !d.set {
+		return d
+	}
+	return NewDecimal(-d.unscaled, d.scale)
+}
+
+// Mul returns d * other, rounded to the given scale
+func (d Decimal) Mul(other Decimal, scale int32, mode RoundingMode) (Decimal, error) {
+	product := new(big.Int).Mul(big.NewInt(d.unscaled), big.NewInt(other.unscaled))
+	productScale := d.scale + other.scale
+	if scale >= productScale {
+		return decimalFromBig(product.Mul(product, pow10(scale-productScale)), scale)
+	}
+	return decimalFromBig(roundQuo(product, pow10(productScale-scale), mode), scale)
+}
+
+// Quo returns d / other, rounded to the given scale
+func (d Decimal) Quo(other Decimal, scale int32, mode RoundingMode) (Decimal, error) {
+	if other.unscaled == 0 {
+		return Decimal{}, ErrDivisionByZero
+	}
+	// d / other at the scale is (d.unscaled * 10^(scale + other.scale - d.scale)) / other.unscaled
+	numerator := big.NewInt(d.unscaled)
+	denominator := big.NewInt(other.unscaled)
+	if shift := scale + other.scale - d.scale; shift >= 0 {
+		numerator.Mul(numerator, pow10(shift))
+	} else {
+		denominator.Mul(denominator, pow10(-shift))
+	}
+	return decimalFromBig(roundQuo(numerator, denominator, mode), scale)
+}
+
+// Round returns the decimal with at most the given number of decimal places. decimals that already have no more are
+// returned as they are, so trailing zeros are kept.
+func (d Decimal) Round(scale int32, mode RoundingMode) Decimal {
+	if scale >= d.scale || !d.set {
+		return d
+	}
+	// rounding away digits can't overflow, the result has fewer of them
+	rounded, _ := decimalFromBig(roundQuo(big.NewInt(d.unscaled), pow10(d.scale-scale), mode), scale)
+	return rounded
+}
+
+// roundQuo returns n / div, rounded by the mode
+func roundQuo(n, div *big.Int, mode RoundingMode) *big.Int {
+	quo, rem := new(big.Int).QuoRem(n, div, new(big.Int))
+	if rem.Sign() == 0 {
+		return quo
+	}
+
+	// the sign of the exact result, which is the direction to round away from zero
+	sign := int64(n.Sign() * div.Sign())
+	away := false
+	switch mode {
+	case RoundUp:
+		away = true
+	case RoundHalfUp, RoundHalfEven:
+		half := new(big.Int).Abs(rem)
+		half.Mul(half, big.NewInt(2))
+		switch half.Cmp(new(big.Int).Abs(div)) {
+		case 1:
+			away = true
+		case 0:
+			away = mode == RoundHalfUp || quo.Bit(0) == 1
+		}
+	}
+	if away {
+		quo.Add(quo, big.NewInt(sign))
+	}
+	return quo
+}
+
+// String returns the decimal in plain notation with all of its decimal places, or "" if it is empty. an invalid
+// decimal is returned as it was given.
+func (d Decimal) String() string {
+	if !d.set {
+		return d.invalid
+	}
+	digits := big.NewInt(d.unscaled)
+	sign := ""
+	if digits.Sign() < 0 {
+		sign = "-"
+		digits.Neg(digits)
+	}
+	s := digits.String()
+	if d.scale <= 0 {
+		return sign + s + strings.Repeat("0", int(-d.scale))
+	}
+	if len(s) <= int(d.scale) {
+		s = strings.Repeat("0", int(d.scale)-len(s)+1) + s
+	}
+	point := len(s) - int(d.scale)
+	return sign + s[:point] + "." + s[point:]
+}
+
+// MarshalJSON writes the decimal as a JSON string, which is how amounts have always been represented in the API
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads a decimal from a JSON string, or leniently from a JSON number. a value that isn't a decimal
+// doesn't fail decoding, it is kept as invalid so that validation can report every bad field at once.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		*d = Decimal{}
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseDecimal(s)
+	if err != nil {
+		*d = Decimal{invalid: s}
+		return nil
+	}
+	*d = parsed
+	return nil
+}
+
+// Value stores the decimal as a NUMERIC, or NULL if it is empty
+func (d Decimal) Value() (driver.Value, error) {
+	if !d.IsValid() {
+		return nil, fmt.Errorf("invalid decimal %q", d.invalid)
+	}
+	if !d.set {
+		return nil, nil
+	}
+	return d.String(), nil
+}
+
+// Scan reads the decimal from a NUMERIC column
+func (d *Decimal) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		*d = Decimal{}
+		return nil
+	case []byte:
+		return d.Scan(string(src))
+	case string:
+		parsed, err := ParseDecimal(src)
+		if err != nil {
+			return err
+		}
+		*d = parsed
+		return nil
+	}
+	return fmt.Errorf("can't scan %T into a decimal", src)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDecimalKeepsScale(t *testing.T) {
+
+	for _, s := range []string{"100.00", "0.5", "-12.345", "7", "0.00001", "999999999999999999"} {
+		d, err := ParseDecimal(s)
+		require.Nil(t, err, s)
+		assert.Equal(t, s, d.String())
+	}
+
+	d, err := ParseDecimal("")
+	require.Nil(t, err)
+	assert.True(t, d.IsEmpty())
+	assert.Equal(t, "", d.String())
+
+	for _, s := range []string{"abc", "1.", ".5", "1e5", "+1", "1.2.3", "--1"} {
+		_, err := ParseDecimal(s)
+		assert.NotNil(t, err, s)
+	}
+
+	_, err = ParseDecimal("1000000000000000000")
+	assert.Equal(t, ErrDecimalOverflow, err)
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+
+	sum, err := MustParseDecimal("0.1").Add(MustParseDecimal("0.20"))
+	require.Nil(t, err)
+	assert.Equal(t, "0.30", sum.String())
+
+	difference, err := MustParseDecimal("5").Sub(MustParseDecimal("7.25"))
+	require.Nil(t, err)
+	assert.Equal(t, "-2.25", difference.String())
+
+	product, err := MustParseDecimal("200.42").Mul(MustParseDecimal("0.50000"), 2, RoundHalfEven)
+	require.Nil(t, err)
+	assert.Equal(t, "100.21", product.String())
+
+	quotient, err := MustParseDecimal("200.42").Quo(MustParseDecimal("2.00000"), 2, RoundHalfEven)
+	require.Nil(t, err)
+	assert.Equal(t, "100.21", quotient.String())
+
+	quotient, err = MustParseDecimal("1").Quo(MustParseDecimal("3"), 4, RoundHalfEven)
+	require.Nil(t, err)
+	assert.Equal(t, "0.3333", quotient.String())
+
+	_, err = MustParseDecimal("1").Quo(MustParseDecimal("0.00"), 2, RoundHalfEven)
+	assert.Equal(t, ErrDivisionByZero, err)
+
+	_, err = MustParseDecimal("999999999999999999").Mul(MustParseDecimal("100"), 0, RoundHalfEven)
+	assert.Equal(t, ErrDecimalOverflow, err)
+
+	assert.Equal(t, 0, MustParseDecimal("1.5").Cmp(MustParseDecimal("1.50")))
+	assert.Equal(t, -1, MustParseDecimal("-3").Cmp(MustParseDecimal("2.1")))
+	assert.True(t, MustParseDecimal("10").Equal(MustParseDecimal("10.000")))
+}
+
+func TestDecimalRounding(t *testing.T) {
+
+	cases := []struct {
+		value    string
+		mode     RoundingMode
+		expected string
+	}{
+		{"2.345", RoundHalfEven, "2.34"},
+		{"2.355", RoundHalfEven, "2.36"},
+		{"2.345", RoundHalfUp, "2.35"},
+		{"-2.345", RoundHalfUp, "-2.35"},
+		{"2.349", RoundDown, "2.34"},
+		{"-2.349", RoundDown, "-2.34"},
+		{"2.341", RoundUp, "2.35"},
+		{"-2.341", RoundUp, "-2.35"},
+		{"2.3", RoundUp, "2.3"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, MustParseDecimal(c.value).Round(2, c.mode).String(), c.value)
+	}
+}
+
+func TestDecimalJSON(t *testing.T) {
+
+	var charge Charge
+	require.Nil(t, json.Unmarshal([]byte(`{"amount": "10.50", "currency": "GBP"}`), &charge))
+	assert.Equal(t, MustParseDecimal("10.50"), charge.Amount)
+
+	encoded, err := json.Marshal(charge)
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"amount": "10.50", "currency": "GBP"}`, string(encoded))
+
+	// numbers are accepted too, and missing amounts stay empty
+	require.Nil(t, json.Unmarshal([]byte(`{"amount": 3.25}`), &charge))
+	assert.Equal(t, "3.25", charge.Amount.String())
+	charge = Charge{}
+	require.Nil(t, json.Unmarshal([]byte(`{"currency": "GBP"}`), &charge))
+	assert.True(t, charge.Amount.IsEmpty())
+
+	// anything else is kept for validation to report
+	require.Nil(t, json.Unmarshal([]byte(`{"amount": "ten"}`), &charge))
+	assert.False(t, charge.Amount.IsValid())
+	assert.False(t, charge.Amount.IsEmpty())
+	assert.Equal(t, "ten", charge.Amount.String())
+}
+
+func TestDecimalSQL(t *testing.T) {
+
+	value, err := MustParseDecimal("100.21").Value()
+	require.Nil(t, err)
+	assert.Equal(t, "100.21", value)
+
+	value, err = Decimal{}.Value()
+	require.Nil(t, err)
+	assert.Nil(t, value)
+
+	var d Decimal
+	require.Nil(t, d.Scan([]byte("42.10")))
+	assert.Equal(t, MustParseDecimal("42.10"), d)
+	require.Nil(t, d.Scan(nil))
+	assert.True(t, d.IsEmpty())
+}
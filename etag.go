@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// versionETag returns the entity tag for a payment version
+func versionETag(version uint) string {
+	return `"` + strconv.FormatUint(uint64(version), 10) + `"`
+}
+
+// etagListMatches reports whether an If-Match or If-None-Match header value matches the version. weak comparison
+// ignores the W/ prefix, as required for If-None-Match.
+func etagListMatches(header string, version uint, weak bool) bool {
+	etag := versionETag(version)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates the If-Match and If-None-Match headers against the current version of a payment. if
+// they fail, it returns false along with the status code to respond with.
+func checkPreconditions(r *http.Request, version uint) (int, bool) {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagListMatches(ifMatch, version, false) {
+		return http.StatusPreconditionFailed, false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagListMatches(ifNoneMatch, version, true) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return http.StatusNotModified, false
+		}
+		return http.StatusPreconditionFailed, false
+	}
+	return 0, true
+}
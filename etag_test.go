@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestETagListMatches(t *testing.T) {
+
+	assert.True(t, etagListMatches(`"3"`, 3, false))
+	assert.True(t, etagListMatches(`"1", "3"`, 3, false))
+	assert.True(t, etagListMatches(`*`, 3, false))
+	assert.False(t, etagListMatches(`"4"`, 3, false))
+	assert.False(t, etagListMatches(`W/"3"`, 3, false))
+	assert.True(t, etagListMatches(`W/"3"`, 3, true))
+}
+
+func putPayment(t *testing.T, payment Payment, headers map[string]string) *httptest.ResponseRecorder {
+	jsonBytes, err := json.Marshal(payment)
+	require.Nil(t, err)
+
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/v1/payments/%s", payment.ID), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestGetPaymentWithETag(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v1/payments/%s", examplePayment.ID), nil)
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 200, rw.Code)
+	etag := rw.Header().Get("ETag")
+	assert.Equal(t, `"0"`, etag)
+
+	// unchanged since the client last fetched it
+	req.Header.Set("If-None-Match", etag)
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 304, rw.Code)
+	assert.Empty(t, rw.Body.String())
+
+	// only if it is a version the client doesn't know about
+	req.Header.Del("If-None-Match")
+	req.Header.Set("If-Match", `"7"`)
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 412, rw.Code)
+}
+
+func TestUpdatePaymentWithStaleVersionConflicts(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	// two clients both read version 0 and then update it
+	first := examplePayment
+	first.Attributes.Reference = "first"
+	rw := putPayment(t, first, nil)
+	require.Equal(t, 201, rw.Code)
+
+	second := examplePayment
+	second.Attributes.Reference = "second"
+	rw = putPayment(t, second, nil)
+	assert.Equal(t, 409, rw.Code)
+
+	// the first update is kept
+	actualPayment, err := store.Get(examplePayment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, "first", actualPayment.Attributes.Reference)
+	assert.Equal(t, uint(1), actualPayment.Version)
+}
+
+func TestUpdatePaymentWithIfMatch(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	rw := putPayment(t, examplePayment, map[string]string{"If-Match": `"5"`})
+	assert.Equal(t, 412, rw.Code)
+
+	rw = putPayment(t, examplePayment, map[string]string{"If-Match": `"0"`})
+	require.Equal(t, 201, rw.Code)
+	assert.Equal(t, `"1"`, rw.Header().Get("ETag"))
+
+	// If-Match takes precedence over the stale version in the body
+	rw = putPayment(t, examplePayment, map[string]string{"If-Match": `"1"`})
+	require.Equal(t, 201, rw.Code)
+	assert.Equal(t, `"2"`, rw.Header().Get("ETag"))
+}
+
+func TestDeletePaymentWithIfMatch(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/v1/payments/%s", examplePayment.ID), nil)
+	req.Header.Set("If-Match", `"1"`)
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 412, rw.Code)
+
+	req.Header.Set("If-Match", `"0"`)
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	_, err := store.Get(examplePayment.ID)
+	assert.Equal(t, ErrPaymentNotFound, err)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// the types of payment event. changes of status are published as payment.<status>, such as payment.submitted.
+const (
+	EventPaymentCreated  = "payment.created"
+	EventPaymentUpdated  = "payment.updated"
+	EventPaymentDeleted  = "payment.deleted"
+	EventPaymentRestored = "payment.restored"
+	EventPaymentPurged   = "payment.purged"
+)
+
+// PaymentEvent announces a committed change to a payment. its ID is that of the audit entry recording the change, and
+// Seq orders the events in the order they were committed, so that a reader can resume after the last event it saw.
+// Data is the payment after the change, or nil once it has been purged.
+type PaymentEvent struct {
+	tableName struct{} `sql:"payment_events"`
+
+	Seq            int64     `json:"seq"`
+	ID             uuid.UUID `json:"id" sql:",pk,type:uuid"`
+	Type           string    `json:"type" sql:",notnull"`
+	OrganisationID uuid.UUID `json:"organisation_id" sql:",type:uuid,notnull"`
+	PaymentID      uuid.UUID `json:"payment_id" sql:",type:uuid,notnull"`
+	CreatedAt      time.Time `json:"created_at" sql:",notnull"`
+	Data           *Payment  `json:"data"`
+}
+
+// EventQuery selects payment events. zero values mean no restriction. events are listed after the event with
+// sequence After.
+type EventQuery struct {
+	OrganisationID uuid.UUID
+	Types          []string
+	After          int64
+	Limit          int
+}
+
+// EventStore persists payment events
+type EventStore interface {
+	// AppendEvent adds an event after every event already committed, setting its Seq
+	AppendEvent(event *PaymentEvent) error
+
+	// ListEvents returns the events matching the query, in sequence order
+	ListEvents(query EventQuery) ([]PaymentEvent, error)
+
+	// LatestEventSeq returns the sequence of the last event, or 0 if there are none
+	LatestEventSeq() (int64, error)
+
+	// LockRelayOffset returns the sequence of the last event published to a sink, or 0 if none have been, and locks
+	// it until the transaction ends. ok is false if another transaction has it locked.
+	LockRelayOffset(sink string) (seq int64, ok bool, err error)
+
+	// SetRelayOffset records the sequence of the last event published to a sink
+	SetRelayOffset(sink string, seq int64) error
+}
+
+// paymentEventTypes lists every event type, in the order they are documented
+func paymentEventTypes() []string {
+	types := []string{EventPaymentCreated, EventPaymentUpdated, EventPaymentDeleted, EventPaymentRestored, EventPaymentPurged}
+	seen := map[string]bool{}
+	for _, transition := range paymentTransitions {
+		if !seen[transition.To] {
+			seen[transition.To] = true
+			types = append(types, "payment."+transition.To)
+		}
+	}
+	return types
+}
+
+// newPaymentEvent returns the event for the change an audit entry records. denied requests aren't published.
+func newPaymentEvent(entry AuditEntry) (PaymentEvent, bool) {
+	event := PaymentEvent{
+		ID:             entry.ID,
+		OrganisationID: entry.OrganisationID,
+		PaymentID:      entry.PaymentID,
+		CreatedAt:      entry.Timestamp,
+		Data:           entry.After,
+	}
+	switch entry.Action {
+	case AuditCreate:
+		event.Type = EventPaymentCreated
+	case AuditUpdate, AuditApprove, AuditRejectApproval:
+		event.Type = EventPaymentUpdated
+	case AuditDelete:
+		event.Type = EventPaymentDeleted
+	case AuditRestore:
+		event.Type = EventPaymentRestored
+	case AuditPurge:
+		event.Type = EventPaymentPurged
+	default:
+		if _, ok := findTransition(entry.Action); !ok || entry.After == nil {
+			return PaymentEvent{}, false
+		}
+		event.Type = "payment." + entry.After.Attributes.Status
+	}
+	return event, true
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	defaultFXQuoteTTL = 30 * time.Minute
+
+	// the number of decimal places of exchange rates that are derived from the inverse rate
+	fxRateScale = 5
+)
+
+var (
+	ErrFXQuoteNotFound = errors.New("fx quote not found")
+	ErrFXQuoteExists   = errors.New("fx quote already exists")
+)
+
+// fxRoundingModes are the names of the rounding modes that can be configured for currency conversion
+var fxRoundingModes = map[string]RoundingMode{
+	"half-even": RoundHalfEven,
+	"half-up":   RoundHalfUp,
+	"down":      RoundDown,
+	"up":        RoundUp,
+}
+
+func parseRoundingMode(name string) (RoundingMode, error) {
+	mode, ok := fxRoundingModes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown rounding mode: %s", name)
+	}
+	return mode, nil
+}
+
+// FXRounding describes how converted amounts are rounded to the minor unit of their currency, and how many minor units
+// a payment amount may differ from its converted original amount by
+type FXRounding struct {
+	Mode      RoundingMode
+	Tolerance int64
+}
+
+// FXRate is the amount of the quote currency that one unit of the base currency buys
+type FXRate struct {
+	tableName struct{} `sql:"fx_rates"`
+
+	BaseCurrency  string  `json:"base_currency" sql:",pk"`
+	QuoteCurrency string  `json:"quote_currency" sql:",pk"`
+	Rate          Decimal `json:"rate" sql:",type:numeric,notnull"`
+}
+
+// FXRateStore persists the exchange rates. there is one set of rates, shared by every organisation and every replica.
+type FXRateStore interface {
+	// ListFXRates returns every rate, ordered by currency pair
+	ListFXRates() ([]FXRate, error)
+
+	// ReplaceFXRates swaps every rate for the given ones, which must already be valid
+	ReplaceFXRates(rates []FXRate) error
+}
+
+// fxRateTable looks up exchange rates. a rate can be used in either direction.
+type fxRateTable struct {
+	mu    sync.RWMutex
+	rates map[string]FXRate
+}
+
+func newFXRateTable() *fxRateTable {
+	return &fxRateTable{rates: map[string]FXRate{}}
+}
+
+func fxPair(base, quote string) string {
+	return base + "/" + quote
+}
+
+// validateFXRates checks a list of rates, returning an error for each one that can't be used
+func validateFXRates(rates []FXRate) []APIError {
+	var errs []APIError
+	seen := map[string]bool{}
+	for i, rate := range rates {
+		pointer := fmt.Sprintf("/%d", i)
+		for _, currency := range []struct{ field, code string }{
+			{"base_currency", rate.BaseCurrency},
+			{"quote_currency", rate.QuoteCurrency},
+		} {
+			if _, ok := currencyExponent(currency.code); !ok {
+				errs = append(errs, APIError{Code: codeInvalidCurrency, Message: fmt.Sprintf("%s must be an ISO 4217 currency code", currency.field), Pointer: pointer + "/" + currency.field})
+			}
+		}
+		if rate.BaseCurrency == rate.QuoteCurrency {
+			errs = append(errs, APIError{Code: codeInvalidValue, Message: "base_currency and quote_currency must be different", Pointer: pointer + "/quote_currency"})
+		}
+		if !rate.Rate.IsValid() || rate.Rate.Sign() <= 0 {
+			errs = append(errs, APIError{Code: codeInvalidValue, Message: "rate must be a decimal greater than zero", Pointer: pointer + "/rate"})
+		}
+		pair, inverse := fxPair(rate.BaseCurrency, rate.QuoteCurrency), fxPair(rate.QuoteCurrency, rate.BaseCurrency)
+		if seen[pair] || seen[inverse] {
+			errs = append(errs, APIError{Code: codeInvalidValue, Message: fmt.Sprintf("there is already a rate for %s", pair), Pointer: pointer})
+		}
+		seen[pair] = true
+	}
+	return errs
+}
+
+// Replace swaps the whole table for the given rates, which must already be valid
+func (table *fxRateTable) Replace(rates []FXRate) {
+	replacement := make(map[string]FXRate, len(rates))
+	for _, rate := range rates {
+		replacement[fxPair(rate.BaseCurrency, rate.QuoteCurrency)] = rate
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.rates = replacement
+}
+
+// Rates returns every rate in the table, ordered by currency pair
+func (table *fxRateTable) Rates() []FXRate {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	rates := make([]FXRate, 0, len(table.rates))
+	for _, rate := range table.rates {
+		rates = append(rates, rate)
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return fxPair(rates[i].BaseCurrency, rates[i].QuoteCurrency) < fxPair(rates[j].BaseCurrency, rates[j].QuoteCurrency)
+	})
+	return rates
+}
+
+// Rate returns the amount of the target currency that one unit of the source currency buys. when only the opposite
+// rate is in the table, it is inverted and rounded to fxRateScale decimal places.
+func (table *fxRateTable) Rate(source, target string, mode RoundingMode) (Decimal, bool) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	if rate, ok := table.rates[fxPair(source, target)]; ok {
+		return rate.Rate, true
+	}
+	if rate, ok := table.rates[fxPair(target, source)]; ok {
+		inverse, err := NewDecimal(1, 0).Quo(rate.Rate, fxRateScale, mode)
+		return inverse, err == nil
+	}
+	return Decimal{}, false
+}
+
+// currentFXRates returns a table of the stored rates
+func currentFXRates(store FXRateStore) (*fxRateTable, error) {
+	rates, err := store.ListFXRates()
+	if err != nil {
+		return nil, err
+	}
+	table := newFXRateTable()
+	table.Replace(rates)
+	return table, nil
+}
+
+// seedFXRates stores the rates if there are none yet. replicas starting with the same file then don't undo rates
+// replaced since with PUT /v1/fx/rates.
+func seedFXRates(store FXRateStore, rates []FXRate) error {
+	stored, err := store.ListFXRates()
+	if err != nil || len(stored) > 0 {
+		return err
+	}
+	return store.ReplaceFXRates(rates)
+}
+
+// loadFXRates reads a JSON list of rates from a file, in the same form accepted by PUT /v1/fx/rates
+func loadFXRates(path string) ([]FXRate, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rates []FXRate
+	if err := json.NewDecoder(file).Decode(&rates); err != nil {
+		return nil, err
+	}
+	if errs := validateFXRates(rates); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid rate at %s: %s", errs[0].Pointer, errs[0].Message)
+	}
+	return rates, nil
+}
+
+// convert returns the amount multiplied by the rate, rounded to the minor unit of the target currency
+func convert(amount, rate Decimal, target string, mode RoundingMode) (Decimal, error) {
+	exponent, ok := currencyExponent(target)
+	if !ok {
+		return Decimal{}, ErrUnknownCurrency
+	}
+	return amount.Mul(rate, int32(exponent), mode)
+}
+
+// FXQuote is a conversion at a fixed rate, which a payment of the organisation can refer to by its contract reference
+// until it expires
+type FXQuote struct {
+	tableName struct{} `sql:"fx_quotes"`
+
+	ContractReference string    `json:"contract_reference" sql:",pk"`
+	OrganisationID    uuid.UUID `json:"organisation_id" sql:",type:uuid,notnull"`
+	SourceCurrency    string    `json:"source_currency" sql:",notnull"`
+	SourceAmount      Decimal   `json:"source_amount" sql:",type:numeric,notnull"`
+	TargetCurrency    string    `json:"target_currency" sql:",notnull"`
+	TargetAmount      Decimal   `json:"target_amount" sql:",type:numeric,notnull"`
+	ExchangeRate      Decimal   `json:"exchange_rate" sql:",type:numeric,notnull"`
+	CreatedAt         time.Time `json:"created_at" sql:",notnull"`
+	ExpiresAt         time.Time `json:"expires_at" sql:",notnull"`
+}
+
+// FXQuoteStore persists the quotes given out by POST /v1/fx/quotes, so that payments can be checked against them
+type FXQuoteStore interface {
+	// GetFXQuote returns the quote with the contract reference, or ErrFXQuoteNotFound
+	GetFXQuote(contractReference string) (FXQuote, error)
+
+	// CreateFXQuote stores a new quote, or returns ErrFXQuoteExists
+	CreateFXQuote(quote *FXQuote) error
+}
+
+// fxQuoteRequest is the body of POST /v1/fx/quotes
+type fxQuoteRequest struct {
+	OrganisationID uuid.UUID `json:"organisation_id"`
+	SourceCurrency string    `json:"source_currency"`
+	SourceAmount   Decimal   `json:"source_amount"`
+	TargetCurrency string    `json:"target_currency"`
+}
+
+// checkFXConsistency checks that the payment amount is its original amount converted at its exchange rate. payments
+// without FX details, or with FX details that didn't validate, are not checked.
+func checkFXConsistency(payment Payment, rounding FXRounding) []APIError {
+	attributes := payment.Attributes
+	fx := attributes.FX
+	if fx.ExchangeRate.IsEmpty() || fx.OriginalAmount.IsEmpty() || !fx.ExchangeRate.IsValid() || !fx.OriginalAmount.IsValid() {
+		return nil
+	}
+	exponent, ok := currencyExponent(attributes.Currency)
+	if !ok {
+		return nil
+	}
+
+	expected, err := convert(fx.OriginalAmount, fx.ExchangeRate, attributes.Currency, rounding.Mode)
+	if err != nil {
+		return []APIError{{Code: codeInvalidValue, Message: "original_amount converted at exchange_rate is too large", Pointer: "/attributes/fx/original_amount"}}
+	}
+	difference, err := expected.Sub(attributes.Amount)
+	if err != nil {
+		return nil
+	}
+	if difference.Sign() < 0 {
+		difference = difference.Neg()
+	}
+	if difference.Cmp(NewDecimal(rounding.Tolerance, int32(exponent))) > 0 {
+		return []APIError{{
+			Code:    "fx_mismatch",
+			Message: fmt.Sprintf("amount must be %s %s, the original amount converted at the exchange rate", expected, attributes.Currency),
+			Pointer: "/attributes/amount",
+		}}
+	}
+	return nil
+}
+
+// checkFXQuote checks a payment against the quote it refers to, if its contract reference is one of its organisation's
+// quotes. references from elsewhere are left alone. expiry is only checked when the reference is new to the payment, so that payments can
+// still be updated after their quote has expired.
+func checkFXQuote(store FXQuoteStore, payment Payment, previousReference string, now time.Time) ([]APIError, error) {
+	attributes := payment.Attributes
+	reference := attributes.FX.ContractReference
+	if reference == "" {
+		return nil, nil
+	}
+	quote, err := store.GetFXQuote(reference)
+	if err == ErrFXQuoteNotFound || (err == nil && quote.OrganisationID != payment.OrganisationID) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []APIError
+	mismatch := func(pointer, field, expected string) {
+		errs = append(errs, APIError{Code: "quote_mismatch", Message: fmt.Sprintf("%s must be %s, as quoted", field, expected), Pointer: pointer})
+	}
+	if reference != previousReference && now.After(quote.ExpiresAt) {
+		errs = append(errs, APIError{Code: "quote_expired", Message: "The quote for this contract_reference has expired", Pointer: "/attributes/fx/contract_reference"})
+	}
+	if attributes.FX.OriginalCurrency != quote.SourceCurrency {
+		mismatch("/attributes/fx/original_currency", "original_currency", quote.SourceCurrency)
+	}
+	if !attributes.FX.OriginalAmount.Equal(quote.SourceAmount) {
+		mismatch("/attributes/fx/original_amount", "original_amount", quote.SourceAmount.String())
+	}
+	if !attributes.FX.ExchangeRate.Equal(quote.ExchangeRate) {
+		mismatch("/attributes/fx/exchange_rate", "exchange_rate", quote.ExchangeRate.String())
+	}
+	if attributes.Currency != quote.TargetCurrency {
+		mismatch("/attributes/currency", "currency", quote.TargetCurrency)
+	}
+	if !attributes.Amount.Equal(quote.TargetAmount) {
+		mismatch("/attributes/amount", "amount", quote.TargetAmount.String())
+	}
+	return errs, nil
+}
+
+// checkFX runs the FX checks for a payment being written, writing an error response if they fail. previousReference is
+// the contract reference the payment had before, if it is being updated.
+func (api *api) checkFX(store FXQuoteStore, w http.ResponseWriter, payment Payment, previousReference string) bool {
+	errs := checkFXConsistency(payment, api.fxRounding)
+	quoteErrs, err := checkFXQuote(store, payment, previousReference, time.Now().UTC())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	errs = append(errs, quoteErrs...)
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return false
+	}
+	return true
+}
+
+// business logic for GET /v1/fx/rates endpoint
+func (api *api) getFXRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := api.store.ListFXRates()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, rates, Link{Rel: "self", Href: "/v1/fx/rates"})
+}
+
+// business logic for PUT /v1/fx/rates endpoint. the whole table is replaced, so rates left out are removed.
+func (api *api) replaceFXRates(w http.ResponseWriter, r *http.Request) {
+
+	var rates []FXRate
+	if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if errs := validateFXRates(rates); len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+
+	if err := api.store.ReplaceFXRates(rates); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.getFXRates(w, r)
+}
+
+// business logic for POST /v1/fx/quotes endpoint
+func (api *api) createFXQuote(w http.ResponseWriter, r *http.Request) {
+
+	var request fxQuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	// quotes are for the organisation of the API key unless another is given, which is refused
+	if organisationID, ok := requestOrganisation(r); ok && request.OrganisationID == uuid.Nil {
+		request.OrganisationID = organisationID
+	}
+	if !checkOrganisation(w, r, Payment{OrganisationID: request.OrganisationID}) {
+		return
+	}
+
+	v := &paymentValidator{}
+	if request.OrganisationID == uuid.Nil {
+		v.add("/organisation_id", codeRequired, "organisation_id is required")
+	}
+	v.currency("/source_currency", request.SourceCurrency)
+	v.currency("/target_currency", request.TargetCurrency)
+	v.amount("/source_amount", request.SourceAmount, request.SourceCurrency, false)
+	if len(v.errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, v.errs...)
+		return
+	}
+
+	rates, err := currentFXRates(api.store)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rate, ok := rates.Rate(request.SourceCurrency, request.TargetCurrency, api.fxRounding.Mode)
+	if !ok {
+		writeError(w, http.StatusUnprocessableEntity, "rate_unavailable", fmt.Sprintf("There is no exchange rate from %s to %s", request.SourceCurrency, request.TargetCurrency))
+		return
+	}
+	targetAmount, err := convert(request.SourceAmount, rate, request.TargetCurrency, api.fxRounding.Mode)
+	if err != nil {
+		writeErrors(w, http.StatusUnprocessableEntity, APIError{Code: codeInvalidValue, Message: "source_amount is too large to convert", Pointer: "/source_amount"})
+		return
+	}
+
+	now := time.Now().UTC()
+	quote := FXQuote{
+		ContractReference: "FXQ-" + strings.ToUpper(strings.Replace(uuid.NewV4().String(), "-", "", -1)),
+		OrganisationID:    request.OrganisationID,
+		SourceCurrency:    request.SourceCurrency,
+		SourceAmount:      request.SourceAmount,
+		TargetCurrency:    request.TargetCurrency,
+		TargetAmount:      targetAmount,
+		ExchangeRate:      rate,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(api.fxQuoteTTL),
+	}
+	if err := api.storeFor(r).CreateFXQuote(&quote); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeData(w, http.StatusCreated, quote)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendJSON(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	return rw
+}
+
+// createFXPayment returns the example payment converted from US dollars
+func createFXPayment(originalAmount, rate, amount string) Payment {
+	payment := createExamplePayment()
+	payment.Attributes.Amount = MustParseDecimal(amount)
+	payment.Attributes.FX = FX{
+		ContractReference: "FX123",
+		ExchangeRate:      MustParseDecimal(rate),
+		OriginalAmount:    MustParseDecimal(originalAmount),
+		OriginalCurrency:  "USD",
+	}
+	return payment
+}
+
+func TestCheckFXConsistency(t *testing.T) {
+
+	rounding := FXRounding{Mode: RoundHalfEven}
+
+	assert.Empty(t, checkFXConsistency(createFXPayment("200.42", "0.50000", "100.21"), rounding))
+	assert.Empty(t, checkFXConsistency(createExamplePayment(), rounding))
+
+	errs := checkFXConsistency(createFXPayment("200.42", "0.50000", "100.22"), rounding)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "fx_mismatch", errs[0].Code)
+	assert.Equal(t, "/attributes/amount", errs[0].Pointer)
+
+	// 0.125 rounds to even, or up, depending on the configuration
+	assert.Empty(t, checkFXConsistency(createFXPayment("0.25", "0.50000", "0.12"), rounding))
+	assert.NotEmpty(t, checkFXConsistency(createFXPayment("0.25", "0.50000", "0.12"), FXRounding{Mode: RoundHalfUp}))
+
+	// a tolerance allows for a provider that rounds differently
+	assert.Empty(t, checkFXConsistency(createFXPayment("200.42", "0.50000", "100.22"), FXRounding{Mode: RoundHalfEven, Tolerance: 1}))
+}
+
+func TestFXRateTable(t *testing.T) {
+
+	table := newFXRateTable()
+	table.Replace([]FXRate{{BaseCurrency: "GBP", QuoteCurrency: "USD", Rate: MustParseDecimal("1.25")}})
+
+	rate, ok := table.Rate("GBP", "USD", RoundHalfEven)
+	require.True(t, ok)
+	assert.Equal(t, "1.25", rate.String())
+
+	// the opposite direction uses the inverse rate
+	rate, ok = table.Rate("USD", "GBP", RoundHalfEven)
+	require.True(t, ok)
+	assert.Equal(t, "0.80000", rate.String())
+
+	_, ok = table.Rate("GBP", "EUR", RoundHalfEven)
+	assert.False(t, ok)
+
+	errs := validateFXRates([]FXRate{
+		{BaseCurrency: "GBP", QuoteCurrency: "GBP", Rate: MustParseDecimal("1")},
+		{BaseCurrency: "EUR", QuoteCurrency: "USD", Rate: MustParseDecimal("0")},
+		{BaseCurrency: "USD", QuoteCurrency: "EUR", Rate: MustParseDecimal("1")},
+	})
+	assert.Equal(t, map[string]string{
+		"/0/quote_currency": codeInvalidValue,
+		"/1/rate":           codeInvalidValue,
+		"/2":                codeInvalidValue,
+	}, errorPointers(errs))
+
+	// errors are reported in the order of the fields
+	errs = validateFXRates([]FXRate{{BaseCurrency: "XXX", QuoteCurrency: "YYY", Rate: MustParseDecimal("1")}})
+	require.Len(t, errs, 2)
+	assert.Equal(t, "/0/base_currency", errs[0].Pointer)
+	assert.Equal(t, "/0/quote_currency", errs[1].Pointer)
+}
+
+func TestLoadFXRates(t *testing.T) {
+
+	file, err := os.CreateTemp("", "rates")
+	require.Nil(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`[{"base_currency": "EUR", "quote_currency": "GBP", "rate": "0.86000"}]`)
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+
+	rates, err := loadFXRates(file.Name())
+	require.Nil(t, err)
+	assert.Equal(t, []FXRate{{BaseCurrency: "EUR", QuoteCurrency: "GBP", Rate: MustParseDecimal("0.86000")}}, rates)
+}
+
+func TestReplaceFXRatesEndpoint(t *testing.T) {
+
+	emptyDatabase(t)
+
+	rw := sendJSON(t, http.MethodPut, "/v1/fx/rates", `[{"base_currency": "GBP", "quote_currency": "XXX", "rate": "1.2"}]`)
+	assert.Equal(t, 422, rw.Code)
+
+	rw = sendJSON(t, http.MethodPut, "/v1/fx/rates", `[{"base_currency": "GBP", "quote_currency": "USD", "rate": "1.25"}]`)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	rw = sendJSON(t, http.MethodGet, "/v1/fx/rates", "")
+	require.Equal(t, 200, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var rates []FXRate
+	require.Nil(t, json.Unmarshal(response.Data, &rates))
+	assert.Equal(t, []FXRate{{BaseCurrency: "GBP", QuoteCurrency: "USD", Rate: MustParseDecimal("1.25")}}, rates)
+}
+
+func TestFXRatesAreSharedByEveryReplica(t *testing.T) {
+
+	emptyDatabase(t)
+
+	// each request is served by a new API, as if by a different replica
+	_, platform := createAPIKey(t, platformOrganisation, RolePlatform)
+	rw := sendWithKey(t, platform, http.MethodPut, "/v1/fx/rates", []byte(`[{"base_currency": "GBP", "quote_currency": "USD", "rate": "2.00000"}]`))
+	require.Equal(t, 200, rw.Code)
+
+	payment := createExamplePayment()
+	_, operator := createAPIKey(t, payment.OrganisationID, RoleOperator)
+	rw = sendWithKey(t, operator, http.MethodPost, "/v1/fx/quotes", []byte(`{"source_currency": "USD", "source_amount": "200.42", "target_currency": "GBP"}`))
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	assert.Contains(t, rw.Body.String(), `"target_amount":"100.21"`)
+
+	// rates from a file only fill an empty table, so a restart doesn't undo them
+	require.Nil(t, seedFXRates(store, []FXRate{{BaseCurrency: "EUR", QuoteCurrency: "GBP", Rate: MustParseDecimal("0.86000")}}))
+	rates, err := store.ListFXRates()
+	require.Nil(t, err)
+	assert.Equal(t, []FXRate{{BaseCurrency: "GBP", QuoteCurrency: "USD", Rate: MustParseDecimal("2.00000")}}, rates)
+
+	emptyDatabase(t)
+	require.Nil(t, seedFXRates(store, []FXRate{{BaseCurrency: "EUR", QuoteCurrency: "GBP", Rate: MustParseDecimal("0.86000")}}))
+	rates, err = store.ListFXRates()
+	require.Nil(t, err)
+	assert.Len(t, rates, 1)
+}
+
+func TestCreateFXQuoteAndAttachToPayment(t *testing.T) {
+
+	emptyDatabase(t)
+
+	rw := sendJSON(t, http.MethodPut, "/v1/fx/rates", `[{"base_currency": "GBP", "quote_currency": "USD", "rate": "2.00000"}]`)
+	require.Equal(t, 200, rw.Code)
+
+	payment := createFXPayment("200.42", "0.50000", "100.21")
+	rw = sendJSON(t, http.MethodPost, "/v1/fx/quotes", `{"source_currency": "USD", "source_amount": "200.42", "target_currency": "GBP"}`)
+	require.Equal(t, 422, rw.Code)
+	assert.Contains(t, rw.Body.String(), "/organisation_id")
+
+	rw = sendJSON(t, http.MethodPost, "/v1/fx/quotes", `{"organisation_id": "`+payment.OrganisationID.String()+`", "source_currency": "USD", "source_amount": "200.42", "target_currency": "GBP"}`)
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var quote FXQuote
+	require.Nil(t, json.Unmarshal(response.Data, &quote))
+	assert.NotEmpty(t, quote.ContractReference)
+	assert.Equal(t, payment.OrganisationID, quote.OrganisationID)
+	assert.Equal(t, "0.50000", quote.ExchangeRate.String())
+	assert.Equal(t, "100.21", quote.TargetAmount.String())
+	assert.True(t, quote.ExpiresAt.After(time.Now()))
+
+	// a payment using the quote must match it
+	payment.Attributes.FX.ContractReference = quote.ContractReference
+	assert.Equal(t, 201, postPaymentWithKey(t, payment, "fx-quote").Code)
+
+	other := createFXPayment("100.00", "0.50000", "50.00")
+	other.OrganisationID = payment.OrganisationID
+	other.Attributes.FX.ContractReference = quote.ContractReference
+	rw = postPaymentWithKey(t, other, "fx-quote-mismatch")
+	require.Equal(t, 422, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{
+		"/attributes/fx/original_amount": "quote_mismatch",
+		"/attributes/amount":             "quote_mismatch",
+	}, errorPointers(response.Errors))
+
+	// there is no rate between these currencies
+	rw = sendJSON(t, http.MethodPost, "/v1/fx/quotes", `{"organisation_id": "`+payment.OrganisationID.String()+`", "source_currency": "USD", "source_amount": "1.00", "target_currency": "JPY"}`)
+	assert.Equal(t, 422, rw.Code)
+}
+
+func TestFXQuotesAreTheirOrganisations(t *testing.T) {
+
+	emptyDatabase(t)
+
+	quote := FXQuote{
+		ContractReference: "FXQ-OURS",
+		OrganisationID:    uuid.NewV4(),
+		SourceCurrency:    "USD",
+		SourceAmount:      MustParseDecimal("200.42"),
+		TargetCurrency:    "GBP",
+		TargetAmount:      MustParseDecimal("100.21"),
+		ExchangeRate:      MustParseDecimal("0.50000"),
+		CreatedAt:         time.Now().UTC(),
+		ExpiresAt:         time.Now().UTC().Add(time.Hour),
+	}
+	require.Nil(t, store.CreateFXQuote(&quote))
+
+	// to another organisation the contract reference is one from elsewhere, so its payment isn't held to the quote
+	payment := createFXPayment("100.00", "0.50000", "50.00")
+	payment.Attributes.FX.ContractReference = quote.ContractReference
+	_, key := createAPIKey(t, payment.OrganisationID, RoleOperator)
+	require.Equal(t, 201, sendWithKey(t, key, http.MethodPost, "/v1/payments", mustMarshal(t, payment)).Code)
+	_, err := (&organisationStore{PaymentStore: store, organisationID: payment.OrganisationID}).GetFXQuote(quote.ContractReference)
+	assert.Equal(t, ErrFXQuoteNotFound, err)
+
+	// and quotes can only be made for the organisation of the API key
+	rw := sendWithKey(t, key, http.MethodPost, "/v1/fx/quotes", []byte(`{"organisation_id": "`+quote.OrganisationID.String()+`", "source_currency": "USD", "source_amount": "1.00", "target_currency": "GBP"}`))
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestExpiredFXQuoteCannotBeAttached(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createFXPayment("200.42", "0.50000", "100.21")
+	payment.Attributes.FX.ContractReference = "FXQ-EXPIRED"
+	past := time.Now().UTC().Add(-time.Hour)
+	require.Nil(t, store.CreateFXQuote(&FXQuote{
+		ContractReference: "FXQ-EXPIRED",
+		OrganisationID:    payment.OrganisationID,
+		SourceCurrency:    "USD",
+		SourceAmount:      MustParseDecimal("200.42"),
+		TargetCurrency:    "GBP",
+		TargetAmount:      MustParseDecimal("100.21"),
+		ExchangeRate:      MustParseDecimal("0.50000"),
+		CreatedAt:         past.Add(-time.Hour),
+		ExpiresAt:         past,
+	}))
+
+	rw := postPaymentWithKey(t, payment, "fx-expired")
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/attributes/fx/contract_reference": "quote_expired"}, errorPointers(response.Errors))
+}
+
+func TestCreatePaymentWithInconsistentFX(t *testing.T) {
+
+	emptyDatabase(t)
+
+	rw := postPaymentWithKey(t, createFXPayment("200.42", "0.50000", "99.00"), "fx-inconsistent")
+	assert.Equal(t, 422, rw.Code)
+
+	rw = postPaymentWithKey(t, createFXPayment("200.42", "0.50000", "100.21"), "fx-consistent")
+	assert.Equal(t, 201, rw.Code)
+}
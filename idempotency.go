@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultIdempotencyRetention     = 24 * time.Hour
+	defaultIdempotencySweepInterval = time.Hour
+	maxIdempotencyKeyLength         = 255
+)
+
+var (
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+	ErrIdempotencyKeyExists   = errors.New("idempotency key already exists")
+
+	// returned from a transaction to roll it back without storing the idempotency key, when the request failed
+	errIdempotentRequestFailed = errors.New("idempotent request failed")
+)
+
+// IdempotencyRecord is the stored outcome of a request made with an Idempotency-Key header
+type IdempotencyRecord struct {
+	tableName struct{} `sql:"idempotency_keys"`
+
+	Key         string      `sql:",pk"`
+	RequestHash string      `sql:",notnull"`
+	StatusCode  int         `sql:",notnull"`
+	Header      http.Header `sql:",notnull"`
+	Body        []byte
+	CreatedAt   time.Time `sql:",notnull"`
+}
+
+// IdempotencyKeyStore persists the outcomes of idempotent requests, so that retries can be answered with the original response
+type IdempotencyKeyStore interface {
+	// GetIdempotencyKey returns the record for the key, or ErrIdempotencyKeyNotFound
+	GetIdempotencyKey(key string) (IdempotencyRecord, error)
+
+	// CreateIdempotencyKey stores a new record, or returns ErrIdempotencyKeyExists
+	CreateIdempotencyKey(record *IdempotencyRecord) error
+
+	// DeleteIdempotencyKey removes the record for the key, if there is one
+	DeleteIdempotencyKey(key string) error
+
+	// DeleteIdempotencyKeysBefore removes all records created before the cutoff, returning how many were removed
+	DeleteIdempotencyKeysBefore(cutoff time.Time) (int, error)
+}
+
+// idempotentHandler handles a request using the given store, which is transactional when an Idempotency-Key is used
+type idempotentHandler func(store PaymentStore, w http.ResponseWriter, r *http.Request)
+
+// responseRecorder captures a response so that it can be stored before it is written to the client
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: http.Header{}}
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+func (rec *responseRecorder) record(key, requestHash string) IdempotencyRecord {
+	rec.WriteHeader(http.StatusOK)
+	return IdempotencyRecord{
+		Key:         key,
+		RequestHash: requestHash,
+		StatusCode:  rec.status,
+		Header:      rec.header,
+		Body:        rec.body.Bytes(),
+		CreatedAt:   time.Now().UTC(),
+	}
+}
+
+// write a stored response to the client
+func writeRecordedResponse(w http.ResponseWriter, record IdempotencyRecord, replayed bool) {
+	for name, values := range record.Header {
+		w.Header()[name] = values
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.Body)
+}
+
+// hash the parts of a request that must be the same when it is retried with the same Idempotency-Key
+func idempotencyRequestHash(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.Path+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// withIdempotencyKey runs the handler for a request, honouring the Idempotency-Key header if there is one. the handler
+// and the storing of its response share a transaction, so a retry either sees the complete original outcome or
+// nothing at all. responses with a 5xx status are not stored, so those requests can be retried.
+func (api *api) withIdempotencyKey(w http.ResponseWriter, r *http.Request, handler idempotentHandler) {
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		handler(api.storeFor(r), w, r)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		writeError(w, http.StatusBadRequest, "invalid_idempotency_key", "Idempotency-Key is too long")
+		return
+	}
+
+	// the body is needed both for the hash and for the handler. it is limited to the largest body any handler accepts,
+	// and the handler applies its own limit too.
+	body, ok := readBody(w, r, maxImportBodySize, "invalid_body")
+	if !ok {
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	requestHash := idempotencyRequestHash(r, body)
+
+	recorder := newResponseRecorder()
+	var previous *IdempotencyRecord
+	store := api.storeFor(r)
+	err := store.RunInTransaction(func(tx PaymentStore) error {
+		existing, err := tx.GetIdempotencyKey(key)
+		switch {
+		case err == nil && existing.CreatedAt.After(time.Now().Add(-api.idempotencyRetention)):
+			previous = &existing
+			return nil
+		case err == nil:
+			// expired but not swept yet, so the key can be reused
+			if err := tx.DeleteIdempotencyKey(key); err != nil {
+				return err
+			}
+		case err != ErrIdempotencyKeyNotFound:
+			return err
+		}
+
+		handler(tx, recorder, r)
+		if recorder.status >= 500 {
+			return errIdempotentRequestFailed
+		}
+
+		record := recorder.record(key, requestHash)
+		return tx.CreateIdempotencyKey(&record)
+	})
+
+	switch err {
+	case nil:
+	case errIdempotentRequestFailed:
+		writeRecordedResponse(w, recorder.record(key, requestHash), false)
+		return
+	case ErrIdempotencyKeyExists:
+		// a concurrent request with the same key got there first, so answer with its outcome
+		existing, err := store.GetIdempotencyKey(key)
+		if err != nil {
+			writeError(w, http.StatusConflict, "idempotency_key_in_use", "A request with this Idempotency-Key is already in progress")
+			return
+		}
+		previous = &existing
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if previous == nil {
+		writeRecordedResponse(w, recorder.record(key, requestHash), false)
+		return
+	}
+
+	if previous.RequestHash != requestHash {
+		writeError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key has already been used for a different request")
+		return
+	}
+	writeRecordedResponse(w, *previous, true)
+}
+
+// sweepIdempotencyKeys removes keys older than the retention period every interval, until done is closed. a nil done
+// channel sweeps forever.
+func sweepIdempotencyKeys(store IdempotencyKeyStore, retention, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			removed, err := store.DeleteIdempotencyKeysBefore(time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("failed to sweep idempotency keys: %s", err)
+				continue
+			}
+			if removed > 0 {
+				log.Printf("swept %d expired idempotency keys", removed)
+			}
+		}
+	}
+}
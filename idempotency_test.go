@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postPaymentWithKey(t *testing.T, payment Payment, key string) *httptest.ResponseRecorder {
+	jsonBytes, err := json.Marshal(payment)
+	require.Nil(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestCreatePaymentRetryWithIdempotencyKeyReplaysResponse(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+
+	first := postPaymentWithKey(t, examplePayment, "retry-key")
+	require.Equal(t, 201, first.Code)
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	// without the key this would be rejected because the payment already exists
+	retry := postPaymentWithKey(t, examplePayment, "retry-key")
+	assert.Equal(t, 201, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Header().Get("Location"), retry.Header().Get("Location"))
+	assert.Equal(t, first.Header().Get("ETag"), retry.Header().Get("ETag"))
+}
+
+func TestCreatePaymentWithReusedIdempotencyKeyAndDifferentBody(t *testing.T) {
+
+	emptyDatabase(t)
+
+	rw := postPaymentWithKey(t, createExamplePayment(), "reused-key")
+	require.Equal(t, 201, rw.Code)
+
+	other := createExamplePayment()
+	rw = postPaymentWithKey(t, other, "reused-key")
+	assert.Equal(t, 422, rw.Code)
+
+	_, err := store.Get(other.ID)
+	assert.Equal(t, ErrPaymentNotFound, err)
+}
+
+func TestCreatePaymentReplaysClientErrors(t *testing.T) {
+
+	emptyDatabase(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", bytes.NewBufferString("{ bad json }"))
+	req.Header.Set("Idempotency-Key", "bad-json")
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 400, rw.Code)
+
+	record, err := store.GetIdempotencyKey("bad-json")
+	require.Nil(t, err)
+	assert.Equal(t, 400, record.StatusCode)
+	assert.Equal(t, rw.Body.Bytes(), record.Body)
+}
+
+func TestIdempotentRequestBodiesAreLimited(t *testing.T) {
+
+	emptyDatabase(t)
+
+	// the body is read before the handler sees it, so it is limited even for handlers that don't limit it themselves
+	body := bytes.Repeat([]byte(" "), maxImportBodySize+1)
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "too-large")
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 413, rw.Code)
+	assert.Contains(t, rw.Body.String(), "body_too_large")
+
+	_, err := store.GetIdempotencyKey("too-large")
+	assert.Equal(t, ErrIdempotencyKeyNotFound, err)
+}
+
+func TestCreatePaymentWithExpiredIdempotencyKey(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	jsonBytes, err := json.Marshal(examplePayment)
+	require.Nil(t, err)
+
+	// a key used for a different request, long enough ago that it has expired
+	require.Nil(t, store.CreateIdempotencyKey(&IdempotencyRecord{
+		Key:         "old-key",
+		RequestHash: "something else",
+		StatusCode:  201,
+		Header:      http.Header{},
+		CreatedAt:   time.Now().Add(-defaultIdempotencyRetention - time.Minute),
+	}))
+
+	rw := postPaymentWithKey(t, examplePayment, "old-key")
+	assert.Equal(t, 201, rw.Code)
+
+	record, err := store.GetIdempotencyKey("old-key")
+	require.Nil(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", nil)
+	assert.Equal(t, idempotencyRequestHash(req, jsonBytes), record.RequestHash)
+}
+
+func TestCreatePaymentConcurrentlyWithSameIdempotencyKey(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+
+	var wg sync.WaitGroup
+	codes := make([]int, 20)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = postPaymentWithKey(t, examplePayment, "concurrent-key").Code
+		}(i)
+	}
+	wg.Wait()
+
+	// every request sees the outcome of the one that created the payment
+	for _, code := range codes {
+		assert.Equal(t, 201, code)
+	}
+}
+
+func TestDeleteIdempotencyKeysBefore(t *testing.T) {
+
+	emptyDatabase(t)
+
+	now := time.Now()
+	require.Nil(t, store.CreateIdempotencyKey(&IdempotencyRecord{Key: "old", RequestHash: "a", StatusCode: 201, Header: http.Header{}, CreatedAt: now.Add(-2 * time.Hour)}))
+	require.Nil(t, store.CreateIdempotencyKey(&IdempotencyRecord{Key: "new", RequestHash: "b", StatusCode: 201, Header: http.Header{}, CreatedAt: now}))
+
+	removed, err := store.DeleteIdempotencyKeysBefore(now.Add(-time.Hour))
+	require.Nil(t, err)
+	assert.Equal(t, 1, removed)
+
+	_, err = store.GetIdempotencyKey("old")
+	assert.Equal(t, ErrIdempotencyKeyNotFound, err)
+	_, err = store.GetIdempotencyKey("new")
+	assert.Nil(t, err)
+}
+
+func TestSweepIdempotencyKeys(t *testing.T) {
+
+	memory := newMemoryStore()
+	require.Nil(t, memory.CreateIdempotencyKey(&IdempotencyRecord{Key: "old", Header: http.Header{}, CreatedAt: time.Now().Add(-time.Hour)}))
+
+	done := make(chan struct{})
+	go sweepIdempotencyKeys(memory, time.Minute, time.Millisecond, done)
+	defer close(done)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := memory.GetIdempotencyKey("old")
+		if err == ErrIdempotencyKeyNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expired idempotency key was not swept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
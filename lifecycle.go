@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// payment statuses. a payment starts as created and moves through the lifecycle by actions.
+const (
+	StatusCreated         = "created"
+	StatusPendingApproval = "pending_approval"
+	StatusSubmitted       = "submitted"
+	StatusAccepted        = "accepted"
+	StatusRejected        = "rejected"
+	StatusSettled         = "settled"
+	StatusReturned        = "returned"
+)
+
+// actions that move a payment between statuses, in the order their links are listed
+const (
+	ActionRequestApproval = "request_approval"
+	ActionSubmit          = "submit"
+	ActionAccept          = "accept"
+	ActionReject          = "reject"
+	ActionSettle          = "settle"
+	ActionReturn          = "return"
+)
+
+// recorded as the action for the initial status of a payment
+const actionCreate = "create"
+
+var (
+	errUnknownAction        = errors.New("unknown action")
+	errTransitionNotAllowed = errors.New("transition not allowed")
+)
+
+// paymentTransition describes an action: the statuses it can be taken from and the status it leads to
+type paymentTransition struct {
+	Action string
+	From   []string
+	To     string
+}
+
+// paymentTransitions is the lifecycle of a payment. any transition not listed here is rejected.
+var paymentTransitions = []paymentTransition{
+	{Action: ActionRequestApproval, From: []string{StatusCreated}, To: StatusPendingApproval},
+	{Action: ActionSubmit, From: []string{StatusCreated, StatusPendingApproval}, To: StatusSubmitted},
+	{Action: ActionAccept, From: []string{StatusSubmitted}, To: StatusAccepted},
+	{Action: ActionReject, From: []string{StatusSubmitted}, To: StatusRejected},
+	{Action: ActionSettle, From: []string{StatusAccepted}, To: StatusSettled},
+	{Action: ActionReturn, From: []string{StatusAccepted, StatusSettled}, To: StatusReturned},
+}
+
+// StatusTransition records a change of status, and when it happened
+type StatusTransition struct {
+	Action    string    `json:"action"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// currentStatus returns the status of the payment. payments stored before statuses existed are treated as created.
+func (payment Payment) currentStatus() string {
+	if payment.Attributes.Status == "" {
+		return StatusCreated
+	}
+	return payment.Attributes.Status
+}
+
+// isEditable reports whether the payment can still be replaced or deleted. once submitted it belongs to the scheme.
+func (payment Payment) isEditable() bool {
+	status := payment.currentStatus()
+	return status == StatusCreated || status == StatusPendingApproval
+}
+
+// initialiseStatus puts a new payment in the created status, which hasn't been sent to the scheme or reported on
+func initialiseStatus(payment *Payment, now time.Time) {
+	payment.Attributes.Status = StatusCreated
+	payment.Attributes.SchemeStatus = nil
+	payment.Attributes.SchemeFileID = nil
+	payment.Attributes.StatusHistory = []StatusTransition{
+		{Action: actionCreate, To: StatusCreated, Timestamp: now},
+	}
+}
+
+func findTransition(action string) (paymentTransition, bool) {
+	for _, transition := range paymentTransitions {
+		if transition.Action == action {
+			return transition, true
+		}
+	}
+	return paymentTransition{}, false
+}
+
+// applyTransition moves the payment to a new status by taking an action, recording when it happened
+func applyTransition(payment *Payment, action string, now time.Time) error {
+	transition, ok := findTransition(action)
+	if !ok {
+		return errUnknownAction
+	}
+	from := payment.currentStatus()
+	for _, allowed := range transition.From {
+		if allowed == from {
+			payment.Attributes.Status = transition.To
+			payment.Attributes.StatusHistory = append(payment.Attributes.StatusHistory, StatusTransition{
+				Action:    action,
+				From:      from,
+				To:        transition.To,
+				Timestamp: now,
+			})
+			return nil
+		}
+	}
+	return errTransitionNotAllowed
+}
+
+// availableActions returns the actions that can be taken from the given status
+func availableActions(status string) []string {
+	actions := []string{}
+	for _, transition := range paymentTransitions {
+		for _, from := range transition.From {
+			if from == status {
+				actions = append(actions, transition.Action)
+				break
+			}
+		}
+	}
+	return actions
+}
+
+// paymentLinks returns the HATEOAS links for a payment: itself, the actions that can currently be taken on it and
+// whether it can be approved. the only thing that can be done with a deleted payment is to restore it.
+func paymentLinks(payment Payment) []Link {
+	self := fmt.Sprintf("/v1/payments/%s", payment.ID.String())
+	links := []Link{Link{Rel: "self", Href: self}}
+	if payment.DeletedAt != nil {
+		return append(links, Link{Rel: "restore", Href: self + "/restore"})
+	}
+	for _, action := range availableActions(payment.currentStatus()) {
+		if action != ActionRequestApproval && payment.awaitingApproval() {
+			continue
+		}
+		links = append(links, Link{Rel: action, Href: fmt.Sprintf("%s/actions/%s", self, action)})
+	}
+	links = append(links, approvalLinks(payment)...)
+	if payment.Attributes.SchemeFileID != nil {
+		links = append(links, Link{Rel: "scheme_file", Href: "/v1/scheme-files/" + payment.Attributes.SchemeFileID.String()})
+	}
+	return links
+}
+
+// business logic for POST /v1/payments/{id}/actions/{action} endpoint
+func (api *api) transitionPayment(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	action := mux.Vars(r)["action"]
+	if _, ok := findTransition(action); !ok {
+		writeError(w, http.StatusNotFound, "unknown_action", "Unknown action")
+		return
+	}
+
+	store := api.storeFor(r)
+	payment, err := store.Get(id)
+	if err != nil {
+		if err == ErrPaymentNotFound {
+			writeError(w, http.StatusNotFound, "not_found", "Payment not found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if status, ok := checkPreconditions(r, payment.Version); !ok {
+		writeError(w, status, "version_mismatch", "Payment version does not match")
+		return
+	}
+
+	// a payment that needs approving can't go any further until it has been approved
+	if action != ActionRequestApproval && payment.awaitingApproval() {
+		approval := payment.Attributes.Approval
+		message := fmt.Sprintf("Payment needs %d approvals and has %d", approval.Required, len(approval.Approvals))
+		if approval.Status == ApprovalRejected {
+			message = "Payment was rejected, change it to start its approval again"
+		}
+		writeError(w, http.StatusConflict, "approval_required", message)
+		return
+	}
+
+	before := payment
+	if err := applyTransition(&payment, action, time.Now().UTC()); err != nil {
+		writeError(w, http.StatusConflict, "invalid_transition", fmt.Sprintf("Cannot %s a payment that is %s", action, payment.currentStatus()))
+		return
+	}
+
+	// the version check makes sure the status hasn't changed since it was read
+	err = api.audit(store, r, action, &before, func(tx PaymentStore) (*Payment, error) {
+		return &payment, tx.Update(&payment)
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(payment.Version))
+	writeData(w, http.StatusOK, payment, paymentLinks(payment)...)
+}
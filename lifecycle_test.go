@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postAction(t *testing.T, payment Payment, action string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/v1/payments/%s/actions/%s", payment.ID, action), nil)
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestApplyTransitionFollowsLifecycle(t *testing.T) {
+
+	payment := createExamplePayment()
+	now := time.Date(2017, 1, 18, 9, 0, 0, 0, time.UTC)
+	initialiseStatus(&payment, now)
+
+	for _, action := range []string{ActionRequestApproval, ActionSubmit, ActionAccept, ActionSettle, ActionReturn} {
+		require.Nil(t, applyTransition(&payment, action, now), action)
+	}
+	assert.Equal(t, StatusReturned, payment.Attributes.Status)
+	require.Len(t, payment.Attributes.StatusHistory, 6)
+	assert.Equal(t, StatusTransition{Action: ActionSettle, From: StatusAccepted, To: StatusSettled, Timestamp: now}, payment.Attributes.StatusHistory[4])
+
+	// returned is terminal
+	assert.Empty(t, availableActions(StatusReturned))
+	assert.Equal(t, errTransitionNotAllowed, applyTransition(&payment, ActionSubmit, now))
+	assert.Equal(t, errUnknownAction, applyTransition(&payment, "teleport", now))
+}
+
+func TestLegacyPaymentWithoutStatusIsCreated(t *testing.T) {
+
+	payment := createExamplePayment()
+	assert.Equal(t, StatusCreated, payment.currentStatus())
+	assert.True(t, payment.isEditable())
+	assert.Nil(t, applyTransition(&payment, ActionSubmit, time.Now()))
+	assert.Equal(t, StatusCreated, payment.Attributes.StatusHistory[0].From)
+}
+
+func TestTransitionPaymentEndpoint(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	rw := postAction(t, examplePayment, ActionSubmit)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	assert.Equal(t, `"1"`, rw.Header().Get("ETag"))
+
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var payment Payment
+	require.Nil(t, json.Unmarshal(response.Data, &payment))
+	assert.Equal(t, StatusSubmitted, payment.Attributes.Status)
+	require.Len(t, payment.Attributes.StatusHistory, 1)
+	assert.False(t, payment.Attributes.StatusHistory[0].Timestamp.IsZero())
+
+	// the links now offer the actions available to a submitted payment
+	self := fmt.Sprintf("/v1/payments/%s", examplePayment.ID)
+	assert.EqualValues(t, []Link{
+		{Rel: "self", Href: self},
+		{Rel: "accept", Href: self + "/actions/accept"},
+		{Rel: "reject", Href: self + "/actions/reject"},
+	}, response.Links)
+
+	// submitting twice is not a valid transition
+	rw = postAction(t, examplePayment, ActionSubmit)
+	assert.Equal(t, 409, rw.Code)
+
+	rw = postAction(t, examplePayment, "teleport")
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestSubmittedPaymentCannotBeUpdatedOrDeleted(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+	require.Equal(t, 200, postAction(t, examplePayment, ActionSubmit).Code)
+
+	examplePayment.Version = 1
+	examplePayment.Attributes.Reference = "changed after submission"
+	rw := putPayment(t, examplePayment, nil)
+	assert.Equal(t, 409, rw.Code)
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/v1/payments/%s", examplePayment.ID), nil)
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 409, rw.Code)
+
+	_, err := store.Get(examplePayment.ID)
+	assert.Nil(t, err)
+}
+
+func TestUpdatePaymentKeepsStatus(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+	require.Equal(t, 200, postAction(t, examplePayment, ActionRequestApproval).Code)
+
+	// clients can't skip the lifecycle by putting a different status
+	examplePayment.Version = 1
+	examplePayment.Attributes.Status = StatusSettled
+	rw := putPayment(t, examplePayment, nil)
+	require.Equal(t, 201, rw.Code)
+
+	actualPayment, err := store.Get(examplePayment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusPendingApproval, actualPayment.Attributes.Status)
+	assert.Len(t, actualPayment.Attributes.StatusHistory, 1)
+}
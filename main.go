@@ -2,8 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/go-pg/pg"
@@ -14,7 +21,16 @@ import (
 type APIResponse struct {
 	Data   json.RawMessage `json:"data,omitempty"`
 	Links  []Link          `json:"links,omitempty"`
-	Errors []string        `json:"errors,omitempty"`
+	Errors []APIError      `json:"errors,omitempty"`
+}
+
+// APIError describes one problem with a request. Code is stable for clients to match on, Pointer is a JSON pointer
+// to the offending field of the request body and Parameter the offending query parameter, when there is one.
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Pointer   string `json:"pointer,omitempty"`
+	Parameter string `json:"parameter,omitempty"`
 }
 
 type Link struct {
@@ -23,12 +39,163 @@ type Link struct {
 }
 
 type api struct {
-	dataSource *pg.DB
-	router     *mux.Router
+	store  PaymentStore
+	router *mux.Router
+
+	// how long Idempotency-Key responses are kept for replaying
+	idempotencyRetention time.Duration
+
+	// how converted amounts are rounded and how long quotes last. the rates are in the store.
+	fxRounding FXRounding
+	fxQuoteTTL time.Duration
+
+	// the modulus weight table UK account numbers are checked against, nothing is checked when it is nil
+	sortCodeRules *sortCodeRules
+
+	// the rule sets of each payment scheme, payments are only checked by validatePayment when it is nil
+	schemeRules *schemeRuleBook
+
+	// whether requests need an API key. without one every organisation's payments can be seen and changed.
+	authenticate bool
+
+	// how often the payment stream checks for new events, and how often it sends a heartbeat when there are none
+	streamPollInterval time.Duration
+	streamHeartbeat    time.Duration
 }
 
 func main() {
 
+	storeType := flag.String("store", "postgres", "payment store backend: postgres or memory")
+	idempotencyRetention := flag.Duration("idempotency-retention", defaultIdempotencyRetention, "how long Idempotency-Key responses are kept")
+	idempotencySweepInterval := flag.Duration("idempotency-sweep-interval", defaultIdempotencySweepInterval, "how often expired Idempotency-Keys are removed")
+	fxRatesPath := flag.String("fx-rates", "", "JSON file of exchange rates to store on startup, if there are none yet")
+	fxRoundingMode := flag.String("fx-rounding", "half-even", "how converted amounts are rounded: half-even, half-up, down or up")
+	fxTolerance := flag.Int64("fx-tolerance", 0, "how many minor units a payment amount may differ from its converted original amount")
+	fxQuoteTTL := flag.Duration("fx-quote-ttl", defaultFXQuoteTTL, "how long FX quotes can be used for")
+	deletedRetention := flag.Duration("deleted-retention", defaultDeletedRetention, "how long deleted payments can be restored before they are purged, 0 keeps them forever")
+	retentionSweepInterval := flag.Duration("retention-sweep-interval", defaultRetentionSweepInterval, "how often the retention policy is applied")
+	webhookInterval := flag.Duration("webhook-interval", defaultWebhookInterval, "how often the webhook outbox is checked for deliveries that are due")
+	webhookMaxAttempts := flag.Int("webhook-max-attempts", defaultWebhookMaxAttempts, "how many times a webhook delivery is tried before it is dead")
+	relayInterval := flag.Duration("relay-interval", defaultRelayInterval, "how often payment events are published from the outbox")
+	eventLogPath := flag.String("event-log", "", "file to append payment events to as newline delimited JSON")
+	statusReportDir := flag.String("status-report-dir", "", "directory that pacs.002 status reports are dropped into as .xml files")
+	statusReportInterval := flag.Duration("status-report-interval", defaultStatusReportInterval, "how often the status report directory is checked for reports")
+	authenticate := flag.Bool("auth", true, "require an API key on every request, only disable for local development")
+	sortCodeRulesPath := flag.String("sort-code-rules", "", "VocaLink modulus weight table (valacdos.txt) to check UK account numbers against")
+	sortCodeSubstitutionsPath := flag.String("sort-code-substitutions", "", "VocaLink sort code substitution table (scsubtab.txt) for the rules with exception 5")
+	schemeRulesPath := flag.String("scheme-rules", "", "directory of scheme rule set .json files to use instead of the built in ones")
+	flag.Parse()
+
+	// `api migrate ...` manages the database schema and `api keys ...` the API keys, instead of serving the API
+	if args := flag.Args(); len(args) > 0 {
+		var err error
+		switch args[0] {
+		case "migrate":
+			err = runMigrateCommand(openDatabase(), args[1:], os.Stdout)
+		case "keys":
+			err = runKeysCommand(newPostgresStore(openDatabase()), args[1:], os.Stdout)
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var store PaymentStore
+	switch *storeType {
+	case "memory":
+		// everything is lost when the process exits, useful for local development without a database container
+		store = newMemoryStore()
+	case "postgres":
+		db := openDatabase()
+
+		// bring the schema up to date. replicas starting together are serialised by the migration lock.
+		m, err := newMigrator(db)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := m.Up(); err != nil {
+			panic(err)
+		}
+
+		store = newPostgresStore(db)
+	default:
+		panic(fmt.Sprintf("unknown store: %s", *storeType))
+	}
+
+	// remove expired idempotency keys in the background
+	go sweepIdempotencyKeys(store, *idempotencyRetention, *idempotencySweepInterval, nil)
+
+	// purge deleted payments once they are past their retention period
+	go sweepRetention(store, RetentionPolicy{DeletedPayments: *deletedRetention}, *retentionSweepInterval, nil)
+
+	// send webhooks from the outbox
+	dispatcher := newWebhookDispatcher(store)
+	dispatcher.maxAttempts = *webhookMaxAttempts
+	go dispatcher.run(*webhookInterval, nil)
+
+	// publish payment events from the outbox. projections in this process subscribe to the bus.
+	bus := newEventBus()
+	relay := newEventRelay(store)
+	relay.addLocal(bus)
+	if *eventLogPath != "" {
+		relay.add(newFileSink(*eventLogPath))
+	}
+	go relay.run(*relayInterval, nil)
+
+	api := newAPI(store)
+	api.authenticate = *authenticate
+	api.idempotencyRetention = *idempotencyRetention
+	api.fxQuoteTTL = *fxQuoteTTL
+	api.fxRounding.Tolerance = *fxTolerance
+	mode, err := parseRoundingMode(*fxRoundingMode)
+	if err != nil {
+		panic(err)
+	}
+	api.fxRounding.Mode = mode
+	if *fxRatesPath != "" {
+		rates, err := loadFXRates(*fxRatesPath)
+		if err != nil {
+			panic(err)
+		}
+		if err := seedFXRates(store, rates); err != nil {
+			panic(err)
+		}
+	}
+	if *sortCodeRulesPath != "" {
+		rules, err := loadSortCodeRules(*sortCodeRulesPath, *sortCodeSubstitutionsPath)
+		if err != nil {
+			panic(err)
+		}
+		api.sortCodeRules = rules
+	}
+	log.Print(api.sortCodeRules.describe())
+	if *schemeRulesPath != "" {
+		rules, err := loadSchemeRules(os.DirFS(*schemeRulesPath), ".")
+		if err != nil {
+			panic(err)
+		}
+		api.schemeRules = rules
+	}
+
+	// apply the status reports dropped into the directory to payments
+	if *statusReportDir != "" {
+		watcher := &statusReportWatcher{api: api, dir: *statusReportDir}
+		go watcher.run(*statusReportInterval, nil)
+	}
+
+	// create a new HTTP server in which all requests are handled by the API
+	server := &http.Server{Addr: ":8080", Handler: api}
+
+	// serve continually
+	panic(server.ListenAndServe())
+}
+
+func openDatabase() *pg.DB {
 	// set up database connection. these should eventually live in a config file but are left here for simplicity.
 	db := pg.Connect(&pg.Options{
 		User:     "form3",
@@ -39,16 +206,7 @@ func main() {
 	// continually retry until the database connection is successful. once successful, the go-pg package will maintain the connection.
 	connectToDatabase(db)
 
-	// provision the database if required.
-	if err := provisionDatabase(db); err != nil {
-		panic(err)
-	}
-
-	// create a new HTTP server in which all requests are handled by the API
-	server := &http.Server{Addr: ":8080", Handler: newAPI(nil)}
-
-	// serve continually
-	panic(server.ListenAndServe())
+	return db
 }
 
 func connectToDatabase(db *pg.DB) {
@@ -64,273 +222,496 @@ func connectToDatabase(db *pg.DB) {
 }
 
 // create the api struct and set up the various handler routes
-func newAPI(dataSource *pg.DB) *api {
-	api := &api{}
+func newAPI(store PaymentStore) *api {
+	api := &api{
+		idempotencyRetention: defaultIdempotencyRetention,
+		fxRounding:           FXRounding{Mode: RoundHalfEven},
+		fxQuoteTTL:           defaultFXQuoteTTL,
+		schemeRules:          mustLoadEmbeddedSchemeRules(),
+		authenticate:         true,
+		streamPollInterval:   defaultStreamPollInterval,
+		streamHeartbeat:      defaultStreamHeartbeat,
+	}
 
-	// create a new mux router and assign handlers to various routes
+	// create a new mux router and assign handlers to various routes, along with the permission each needs
 	api.router = mux.NewRouter()
-	api.router.HandleFunc("/v1/payments", api.getPayments).Methods(http.MethodGet)
-	api.router.HandleFunc("/v1/payments/{id}", api.getPayment).Methods(http.MethodGet)
-	api.router.HandleFunc("/v1/payments", api.createPayment).Methods(http.MethodPost)
-	api.router.HandleFunc("/v1/payments/{id}", api.updatePayment).Methods(http.MethodPut)
-	api.router.HandleFunc("/v1/payments/{id}", api.deletePayment).Methods(http.MethodDelete)
-
-	// set the db connection on the api
-	api.dataSource = dataSource
+	api.handle(http.MethodGet, "/v1/payments", PermPaymentsRead, api.getPayments)
+	api.handle(http.MethodGet, "/v1/payments/stream", PermPaymentsRead, api.streamPayments)
+	api.handle(http.MethodGet, "/v1/payments/{id}", PermPaymentsRead, api.getPayment)
+	api.handle(http.MethodGet, "/v1/payments/{id}/mt103", PermPaymentsRead, api.getPaymentMT103)
+	api.handle(http.MethodPost, "/v1/payments", PermPaymentsWrite, api.createPayment)
+	api.handle(http.MethodPost, "/v1/payments/validate", PermPaymentsWrite, api.dryRunPayment)
+	api.handle(http.MethodPost, "/v1/payments/import/pacs008", PermPaymentsWrite, api.importPacs008)
+	api.handle(http.MethodPost, "/v1/payments/import/mt103", PermPaymentsWrite, api.importMT103)
+	api.handle(http.MethodPut, "/v1/payments/{id}", PermPaymentsWrite, api.updatePayment)
+	api.handle(http.MethodPatch, "/v1/payments/{id}", PermPaymentsWrite, api.patchPayment)
+	api.handle(http.MethodDelete, "/v1/payments/{id}", PermPaymentsDelete, api.deletePayment)
+	for _, transition := range paymentTransitions {
+		api.handle(http.MethodPost, "/v1/payments/{id}/actions/{action:"+transition.Action+"}", actionPermission(transition.Action), api.transitionPayment)
+	}
+	api.handle(http.MethodPost, "/v1/payments/{id}/actions/{action}", PermPaymentsWrite, api.transitionPayment)
+	api.handle(http.MethodPost, "/v1/payments/{id}/restore", PermPaymentsDelete, api.restorePayment)
+	api.handle(http.MethodPost, "/v1/payments/{id}/approvals", PermPaymentsApprove, api.approvePayment)
+	api.handle(http.MethodPost, "/v1/payments/{id}/rejections", PermPaymentsApprove, api.rejectPayment)
+	api.handle(http.MethodGet, "/v1/payments/{id}/history", PermAuditRead, api.getPaymentHistory)
+	api.handle(http.MethodGet, "/v1/audit", PermAuditRead, api.getAudit)
+	api.handle(http.MethodPost, "/v1/payment-batches", PermPaymentsWrite, api.createBatch)
+	api.handle(http.MethodGet, "/v1/payment-batches/{id}", PermPaymentsRead, api.getBatch)
+	api.handle(http.MethodGet, "/v1/fx/rates", PermFXRead, api.getFXRates)
+	api.handle(http.MethodPut, "/v1/fx/rates", PermFXWrite, api.replaceFXRates)
+	api.handle(http.MethodPost, "/v1/fx/quotes", PermPaymentsWrite, api.createFXQuote)
+	api.handle(http.MethodPost, "/v1/subscriptions", PermWebhooksManage, api.createSubscription)
+	api.handle(http.MethodGet, "/v1/subscriptions", PermWebhooksManage, api.getSubscriptions)
+	api.handle(http.MethodGet, "/v1/subscriptions/{id}", PermWebhooksManage, api.getSubscription)
+	api.handle(http.MethodDelete, "/v1/subscriptions/{id}", PermWebhooksManage, api.deleteSubscription)
+	api.handle(http.MethodGet, "/v1/subscriptions/{id}/deliveries", PermWebhooksManage, api.getDeliveries)
+	api.handle(http.MethodPost, "/v1/status-reports", PermStatusReports, api.postStatusReport)
+	api.handle(http.MethodGet, "/v1/status-reports/exceptions", PermStatusReports, api.getStatusExceptions)
+	api.handle(http.MethodGet, "/v1/status-reports/exceptions/{id}", PermStatusReports, api.getStatusException)
+	api.handle(http.MethodPost, "/v1/status-reports/exceptions/{id}/resolve", PermStatusReports, api.resolveStatusException)
+	api.handle(http.MethodPost, "/v1/scheme-files/bacs", PermSchemeFiles, api.createBACSFile)
+	api.handle(http.MethodGet, "/v1/scheme-files/{id}", PermSchemeFiles, api.getSchemeFile)
+	api.handle(http.MethodGet, "/v1/scheme-files/{id}/content", PermSchemeFiles, api.getSchemeFileContent)
+	api.handle(http.MethodGet, "/v1/admin/roles", PermRolesManage, api.getRoles)
+	api.handle(http.MethodPut, "/v1/admin/roles/{name}", PermRolesManage, api.putRole)
+	api.handle(http.MethodDelete, "/v1/admin/roles/{name}", PermRolesManage, api.deleteRole)
+	api.handle(http.MethodGet, "/v1/admin/api-keys", PermRolesManage, api.getAPIKeys)
+	api.handle(http.MethodPut, "/v1/admin/api-keys/{id}/roles", PermRolesManage, api.putAPIKeyRoles)
+	api.handle(http.MethodGet, "/v1/admin/approval-policies", PermPoliciesManage, api.getApprovalPolicies)
+	api.handle(http.MethodPut, "/v1/admin/approval-policies/{currency}", PermPoliciesManage, api.putApprovalPolicy)
+	api.handle(http.MethodDelete, "/v1/admin/approval-policies/{currency}", PermPoliciesManage, api.deleteApprovalPolicy)
+
+	// every route needs an API key, which decides the organisation whose payments can be used
+	api.router.Use(api.authenticateRequest)
+
+	// set the payment store on the api
+	api.store = store
 
 	return api
 }
 
 // implement the http.Handler interface, this just calls the underlying mux handlers serve method
 func (api *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// every request has an ID, which is returned to the client and recorded in the audit trail
+	if r.Header.Get(requestIDHeader) == "" {
+		r.Header.Set(requestIDHeader, uuid.NewV4().String())
+	}
+	w.Header().Set(requestIDHeader, r.Header.Get(requestIDHeader))
+
 	api.router.ServeHTTP(w, r)
 }
 
-// business logic for GET /v1/payments endpoint
-func (api *api) getPayments(w http.ResponseWriter, r *http.Request) {
-	payments := []Payment{}
-
-	// select all payments
-	if err := api.dataSource.Model(&payments).Select(); err != nil {
+// write an API response as JSON with the given status code
+func writeResponse(w http.ResponseWriter, status int, response APIResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// write an API response containing the given errors
+func writeErrors(w http.ResponseWriter, status int, errors ...APIError) {
+	writeResponse(w, status, APIResponse{Errors: errors})
+}
 
-	// jsonify the results
-	data, err := json.Marshal(payments)
+// write an API response containing a single error that isn't about a particular field
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrors(w, status, APIError{Code: code, Message: message})
+}
+
+// write an API response containing the JSON encoded data and HATEOAS links
+func writeData(w http.ResponseWriter, status int, data interface{}, links ...Link) {
+	encoded, err := json.Marshal(data)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	writeResponse(w, status, APIResponse{Data: encoded, Links: links})
+}
+
+// write the error response for a failed payment store write. a version conflict is a failed precondition when the
+// client made the request conditional with If-Match, and a conflict otherwise.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case err == ErrPaymentNotFound:
+		writeError(w, http.StatusNotFound, "not_found", "Payment not found")
+	case err == ErrOrganisationForbidden:
+		writeError(w, http.StatusForbidden, "forbidden_organisation", "Payments can only be made for the organisation of the API key")
+	case err == ErrVersionConflict && r.Header.Get("If-Match") != "":
+		writeError(w, http.StatusPreconditionFailed, "version_mismatch", "Payment version does not match")
+	case err == ErrVersionConflict:
+		writeError(w, http.StatusConflict, "version_conflict", "Payment has been modified, fetch the latest version and try again")
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// read and parse the payment ID from the mux vars. if it is missing or invalid, an error response is written and ok is false.
+func paymentIDFromRequest(w http.ResponseWriter, r *http.Request) (id uuid.UUID, ok bool) {
+	vars := mux.Vars(r)
+	rawID, ok := vars["id"]
+	if !ok { // the muxer should not assign a handler if the id is missing, so internal error
+		w.WriteHeader(http.StatusInternalServerError)
+		return uuid.Nil, false
+	}
+
+	id, err := uuid.FromString(rawID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_uuid", "Invalid UUID")
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// readBody reads a request body of at most limit bytes. if it is too large or can't be read, an error response with
+// the given code is written and ok is false.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64, code string) (body []byte, ok bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("The request body can be at most %d bytes", limit))
+		return nil, false
+	case err != nil:
+		writeError(w, http.StatusBadRequest, code, "The request body could not be read")
+		return nil, false
+	}
+	return body, true
+}
+
+// read a payment from the JSON request body. a value of the wrong type, such as a string for a number, is reported
+// against its field. if the payment can't be read, an error response is written and ok is false.
+func decodePayment(w http.ResponseWriter, r *http.Request) (payment Payment, ok bool) {
+	return readPayment(w, r.Body)
+}
 
-	// build the API response (with HATEOAS links)
-	response, err := json.Marshal(APIResponse{Data: data, Links: []Link{Link{Rel: "self", Href: "/v1/payments"}}})
+// read a payment from JSON, as decodePayment does
+func readPayment(w http.ResponseWriter, body io.Reader) (payment Payment, ok bool) {
+	err := json.NewDecoder(body).Decode(&payment)
+	if typeErr, isTypeErr := err.(*json.UnmarshalTypeError); isTypeErr && typeErr.Field != "" {
+		pointer := "/" + strings.Replace(typeErr.Field, ".", "/", -1)
+		message := fmt.Sprintf("%s must be of type %s", path.Base(pointer), typeErr.Type)
+		writeErrors(w, http.StatusUnprocessableEntity, APIError{Code: codeInvalidFormat, Message: message, Pointer: pointer})
+		return Payment{}, false
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return Payment{}, false
+	}
+	return payment, true
+}
+
+// business logic for GET /v1/payments endpoint
+func (api *api) getPayments(w http.ResponseWriter, r *http.Request) {
+
+	// read the pagination, filter and sort parameters
+	query, errs := parsePaymentQuery(r.URL.Query())
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusBadRequest, errs...)
+		return
+	}
+
+	// select the requested page of payments
+	page, err := api.storeFor(r).List(query)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// write the response
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(response)
+	// write the response (with HATEOAS links, including next/prev when there are more pages)
+	writeData(w, http.StatusOK, page.Payments, paymentPageLinks(r, page)...)
 }
 
 // business logic for GET /v1/payments/{id} endpoint
 func (api *api) getPayment(w http.ResponseWriter, r *http.Request) {
 
-	// read the ID from the mux vars
-	vars := mux.Vars(r)
-	id, ok := vars["id"]
-	if !ok { // this should not be possible as muxer will only route requests with an ID
-		w.WriteHeader(http.StatusInternalServerError)
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
 		return
 	}
 
-	// parse the supplied UUID
-	uuid, err := uuid.FromString(id)
+	includeDeleted, err := parseIncludeDeleted(r.URL.Query())
 	if err != nil {
-		// write an error response indicating the UUID was invalid
-		if response, err := json.Marshal(APIResponse{Errors: []string{"Invalid UUID"}}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Header().Add("Content-Type", "application/json")
-			w.Write(response)
-		}
+		writeErrors(w, http.StatusBadRequest, APIError{Code: "invalid_parameter", Message: err.Error(), Parameter: "include_deleted"})
 		return
 	}
 
-	payment := Payment{
-		ID: uuid,
+	// select the requested payment from the store
+	store := api.storeFor(r)
+	get := store.Get
+	if includeDeleted {
+		get = store.GetIncludingDeleted
 	}
-
-	// select the requested payment from the db
-	if err := api.dataSource.Select(&payment); err != nil {
-		if err == pg.ErrNoRows {
-			if response, err := json.Marshal(APIResponse{Errors: []string{"Payment not found"}}); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-			} else {
-				w.WriteHeader(http.StatusNotFound)
-				w.Header().Add("Content-Type", "application/json")
-				w.Write(response)
-			}
+	payment, err := get(id)
+	if err != nil {
+		if err == ErrPaymentNotFound {
+			writeError(w, http.StatusNotFound, "not_found", "Payment not found")
 			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// encode the query result
-	data, err := json.Marshal(payment)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	// the version is the entity tag, so clients can make conditional requests
+	w.Header().Set("ETag", versionETag(payment.Version))
+	if status, ok := checkPreconditions(r, payment.Version); !ok {
+		w.WriteHeader(status)
 		return
 	}
 
-	// build the API response (with HATEOAS links)
-	response, err := json.Marshal(APIResponse{Data: data, Links: []Link{Link{Rel: "self", Href: fmt.Sprintf("/v1/payments/%s", payment.ID.String())}}})
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	// partner banks can ask for the payment as an ISO 20022 message instead
+	if acceptsPacs008(r) {
+		writePacs008(w, payment)
 		return
 	}
 
-	// write the response
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(response)
+	// write the response (with HATEOAS links, including the actions that can be taken)
+	writeData(w, http.StatusOK, payment, paymentLinks(payment)...)
 }
 
-// business logic for POST /v1/payments endpoint
+// business logic for POST /v1/payments endpoint. retries with the same Idempotency-Key get the original response.
 func (api *api) createPayment(w http.ResponseWriter, r *http.Request) {
+	api.withIdempotencyKey(w, r, api.insertPayment)
+}
+
+// create the POSTed payment using the given store
+func (api *api) insertPayment(store PaymentStore, w http.ResponseWriter, r *http.Request) {
 
 	// read the POSTed payment by decoding it from JSON
-	var payment Payment
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&payment); err != nil {
-		if response, err := json.Marshal(APIResponse{Errors: []string{"Invalid JSON"}}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Header().Add("Content-Type", "application/json")
-			w.Write(response)
-		}
+	payment, ok := decodePayment(w, r)
+	if !ok {
+		return
+	}
+	if !checkOrganisation(w, r, payment) {
 		return
 	}
 
-	// select the requested payment from the db
-	if err := api.dataSource.Select(&payment); err != pg.ErrNoRows {
-		if response, err := json.Marshal(APIResponse{Errors: []string{"Payment already exists with that ID"}}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Header().Add("Content-Type", "application/json")
-			w.Write(response)
-		}
+	// check every field, so that the client can fix all of the problems at once
+	if errs := api.checkPayment(payment); len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+	if !api.checkFX(store, w, payment, "") {
 		return
 	}
 
-	// insert the record into the db
-	if err := api.dataSource.Insert(&payment); err != nil {
+	// every payment starts at version 0, which is incremented on each update, and in the created status
+	payment.Version = 0
+	payment.DeletedAt = nil
+	payment.CreatedBy = requestActor(r)
+	initialiseStatus(&payment, time.Now().UTC())
+	approval, err := requiredApproval(store, payment)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	payment.Attributes.Approval = approval
+
+	// insert the payment, the store reports if it already exists
+	err = api.audit(store, r, AuditCreate, nil, func(tx PaymentStore) (*Payment, error) {
+		return &payment, tx.Create(&payment)
+	})
+	if err != nil {
+		if err == ErrPaymentExists {
+			writeError(w, http.StatusBadRequest, "already_exists", "Payment already exists with that ID")
+			return
+		}
+		writeStoreError(w, r, err)
+		return
+	}
 
 	// write response
-	w.WriteHeader(http.StatusCreated)
 	w.Header().Add("Location", fmt.Sprintf("/v1/payments/%s", payment.ID.String()))
+	w.Header().Set("ETag", versionETag(payment.Version))
+	w.WriteHeader(http.StatusCreated)
 }
 
 // business logic for PUT /v1/payments/{id} endpoint
 func (api *api) updatePayment(w http.ResponseWriter, r *http.Request) {
 
-	// grab ID
-	vars := mux.Vars(r)
-	id, ok := vars["id"]
-	if !ok { // the muxer should not assign this handler if the id is missing, so internal error
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// parse ID as UUID
-	uuid, err := uuid.FromString(id)
-	if err != nil {
-		if response, err := json.Marshal(APIResponse{Errors: []string{"Invalid UUID"}}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(response)
-		}
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
 		return
 	}
 
-	var payment Payment
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&payment); err != nil {
-		if response, err := json.Marshal(APIResponse{Errors: []string{"Invalid JSON"}}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(response)
-		}
+	payment, ok := decodePayment(w, r)
+	if !ok {
 		return
 	}
 
 	// ensure the payment being updated matches the one specified in the URL
-	if payment.ID.String() != uuid.String() {
-		if response, err := json.Marshal(APIResponse{Errors: []string{"Mismatching IDs"}}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(response)
-		}
+	if payment.ID != id {
+		writeError(w, http.StatusBadRequest, "mismatching_ids", "Mismatching IDs")
 		return
 	}
-
-	// check the payment exists before editing/replacing it
-	existingPayment := Payment{
-		ID: uuid,
+	if !checkOrganisation(w, r, payment) {
+		return
 	}
-	if err := api.dataSource.Select(&existingPayment); err != nil {
-		if response, err := json.Marshal(APIResponse{Errors: []string{"Payment not found"}}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write(response)
-		}
+	if errs := api.checkPayment(payment); len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
 		return
 	}
 
-	// update the payment in the database
-	if err := api.dataSource.Update(&payment); err != nil {
+	// check the payment exists and that any conditions in the request hold for its current version
+	existingPayment, err := api.storeFor(r).Get(id)
+	if err != nil {
+		if err == ErrPaymentNotFound {
+			writeError(w, http.StatusNotFound, "not_found", "Payment not found")
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if status, ok := checkPreconditions(r, existingPayment.Version); !ok {
+		writeError(w, status, "version_mismatch", "Payment version does not match")
+		return
+	}
+	if !api.savePayment(w, r, &payment, existingPayment) {
+		return
+	}
 
 	// write response
-	w.WriteHeader(http.StatusCreated)
 	w.Header().Add("Location", fmt.Sprintf("/v1/payments/%s", payment.ID.String()))
+	w.Header().Set("ETag", versionETag(payment.Version))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// savePayment replaces an existing payment with a changed version of it, which has been validated. if it can't be saved,
+// an error response is written and false is returned.
+func (api *api) savePayment(w http.ResponseWriter, r *http.Request, payment *Payment, existingPayment Payment) bool {
+	if !existingPayment.isEditable() {
+		writeError(w, http.StatusConflict, "not_editable", fmt.Sprintf("Payment cannot be changed once it is %s", existingPayment.currentStatus()))
+		return false
+	}
+	store := api.storeFor(r)
+	if !api.checkFX(store, w, *payment, existingPayment.Attributes.FX.ContractReference) {
+		return false
+	}
+
+	// the status is managed by actions and status reports, so it is kept as it is rather than taken from the body
+	payment.Attributes.Status = existingPayment.Attributes.Status
+	payment.Attributes.StatusHistory = existingPayment.Attributes.StatusHistory
+	payment.Attributes.SchemeStatus = existingPayment.Attributes.SchemeStatus
+	payment.Attributes.SchemeFileID = existingPayment.Attributes.SchemeFileID
+	payment.DeletedAt = existingPayment.DeletedAt
+	payment.CreatedBy = existingPayment.CreatedBy
+
+	// approvals are for the payment as it was, so changing it starts its approval again, and whoever changed it can't
+	// approve their own change
+	approval, err := requiredApproval(store, *payment)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if approval != nil {
+		approval.ModifiedBy = requestActor(r)
+	}
+	payment.Attributes.Approval = approval
+
+	// the version to compare against comes from If-Match when given, otherwise from the payment in the body
+	if r.Header.Get("If-Match") != "" {
+		payment.Version = existingPayment.Version
+	}
+
+	// update the payment, the store increments the version if it has not changed in the meantime
+	err = api.audit(store, r, AuditUpdate, &existingPayment, func(tx PaymentStore) (*Payment, error) {
+		return payment, tx.Update(payment)
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return false
+	}
+	return true
 }
 
 // business logic for DELETE /v1/payments/{id} endpoint
 func (api *api) deletePayment(w http.ResponseWriter, r *http.Request) {
 
-	vars := mux.Vars(r)
-	id, ok := vars["id"]
-	if !ok { // the muxer should not assign this handler if the id is missing, so internal error
-		w.WriteHeader(http.StatusInternalServerError)
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
 		return
 	}
 
-	// parse ID as UUID
-	uuid, err := uuid.FromString(id)
+	// check the payment exists and that any conditions in the request hold for its current version
+	store := api.storeFor(r)
+	payment, err := store.Get(id)
 	if err != nil {
-		if response, err := json.Marshal(APIResponse{Errors: []string{"Invalid UUID"}}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(response)
+		if err == ErrPaymentNotFound {
+			writeError(w, http.StatusNotFound, "not_found", "Payment not found")
+			return
 		}
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	// check the payment exists before attempting to delete it
-	payment := Payment{
-		ID: uuid,
+	if status, ok := checkPreconditions(r, payment.Version); !ok {
+		writeError(w, status, "version_mismatch", "Payment version does not match")
+		return
 	}
-	if err := api.dataSource.Select(&payment); err != nil {
-		if response, err := json.Marshal(APIResponse{Errors: []string{"Payment not found"}}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write(response)
-		}
+	if !payment.isEditable() {
+		writeError(w, http.StatusConflict, "not_editable", fmt.Sprintf("Payment cannot be deleted once it is %s", payment.currentStatus()))
 		return
 	}
 
-	// delete the payment
-	if err := api.dataSource.Delete(&payment); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	// tombstone the payment, as long as it has not been changed since it was checked. it can be restored until the
+	// retention policy purges it.
+	err = api.audit(store, r, AuditDelete, &payment, func(tx PaymentStore) (*Payment, error) {
+		if err := tx.Delete(id, payment.Version); err != nil {
+			return nil, err
+		}
+		deleted, err := tx.GetIncludingDeleted(id)
+		return &deleted, err
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
 		return
 	}
 
 	//default to 200 response code
 }
+
+// business logic for POST /v1/payments/{id}/restore endpoint, which undoes a delete
+func (api *api) restorePayment(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	store := api.storeFor(r)
+	payment, err := store.GetIncludingDeleted(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if payment.DeletedAt == nil {
+		writeError(w, http.StatusConflict, "not_deleted", "Payment has not been deleted")
+		return
+	}
+	if status, ok := checkPreconditions(r, payment.Version); !ok {
+		writeError(w, status, "version_mismatch", "Payment version does not match")
+		return
+	}
+
+	// restore the payment, as long as it has not been changed since it was checked
+	var restored Payment
+	err = api.audit(store, r, AuditRestore, &payment, func(tx PaymentStore) (*Payment, error) {
+		if err := tx.Restore(id, payment.Version); err != nil {
+			return nil, err
+		}
+		restored, err = tx.Get(id)
+		return &restored, err
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(restored.Version))
+	writeData(w, http.StatusOK, restored, paymentLinks(restored)...)
+}
@@ -18,30 +18,57 @@ import (
 )
 
 var server *http.Server
+var store PaymentStore
 var db *pg.DB
 
 func TestMain(m *testing.M) {
 
-	// connect to the database, create the required tables and run the API server to test against
+	// run against postgres when a database address is supplied (as it is in docker-compose), otherwise use the in-memory store
 
-	db = pg.Connect(&pg.Options{
-		User:     "form3",
-		Password: "form3",
-		Addr:     "database:5432",
-	})
+	if addr := os.Getenv("DATABASE_ADDR"); addr != "" {
+		db = pg.Connect(&pg.Options{
+			User:     "form3",
+			Password: "form3",
+			Addr:     addr,
+		})
 
-	connectToDatabase(db)
+		connectToDatabase(db)
 
-	provisionDatabase(db)
+		m, err := newMigrator(db)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := m.Up(); err != nil {
+			panic(err)
+		}
 
-	server = &http.Server{Addr: ":8080", Handler: newAPI(db)}
+		store = newPostgresStore(db)
+	} else {
+		store = newMemoryStore()
+	}
+
+	server = &http.Server{Addr: ":8080", Handler: newTestAPI(store)}
 	code := m.Run()
 
 	os.Exit(code)
 }
 
+// newTestAPI creates an API that doesn't need API keys, so that tests can make payments for any organisation
+func newTestAPI(store PaymentStore) *api {
+	api := newAPI(store)
+	api.authenticate = false
+	return api
+}
+
 func emptyDatabase(t *testing.T) {
 
+	if db == nil {
+		// start again with a fresh in-memory store
+		store = newMemoryStore()
+		server.Handler = newTestAPI(store)
+		return
+	}
+
 	// remove all rows from all of the tables
 
 	models := []interface{}{
@@ -53,6 +80,19 @@ func emptyDatabase(t *testing.T) {
 		&ChargesInformation{},
 		&Charge{},
 		&FX{},
+		&IdempotencyRecord{},
+		&FXQuote{},
+		&FXRate{},
+		&PaymentBatch{},
+		&APIKey{},
+		&Role{},
+		&ApprovalPolicy{},
+		&WebhookDelivery{},
+		&Subscription{},
+		&PaymentEvent{},
+		&RelayOffset{},
+		&StatusReportException{},
+		&SchemeFile{},
 	}
 
 	for _, model := range models {
@@ -60,6 +100,11 @@ func emptyDatabase(t *testing.T) {
 			t.Fatalf("Failed to empty table: %s", err)
 		}
 	}
+
+	// the audit log refuses deletes, but can still be truncated
+	if _, err := db.Exec(`TRUNCATE "audit_log"`); err != nil {
+		t.Fatalf("Failed to empty audit log: %s", err)
+	}
 }
 
 func createExamplePayment() Payment {
@@ -69,7 +114,7 @@ func createExamplePayment() Payment {
 		Version:        0,
 		OrganisationID: uuid.NewV1(),
 		Attributes: Attributes{
-			Amount: "100.00",
+			Amount: MustParseDecimal("100.00"),
 			BeneficiaryParty: BeneficiaryParty{
 				DebtorParty: &DebtorParty{
 					SponsorParty: &SponsorParty{
@@ -78,7 +123,7 @@ func createExamplePayment() Payment {
 						BankIDCode:    "GBDSC",
 					},
 					AccountName:       "L Galvin",
-					AccountNumberCode: "IBAN",
+					AccountNumberCode: "BBAN",
 					Name:              "Liam Galvin",
 					Address:           "123 Main Street",
 				},
@@ -88,15 +133,15 @@ func createExamplePayment() Payment {
 				BearerCode: "SHAR",
 				SenderCharges: []Charge{
 					{
-						Amount:   "0.50",
+						Amount:   MustParseDecimal("0.50"),
 						Currency: "GBP",
 					},
 					{
-						Amount:   "0.10",
+						Amount:   MustParseDecimal("0.10"),
 						Currency: "USD",
 					},
 				},
-				ReceiverChargesAmount:   "1.00",
+				ReceiverChargesAmount:   MustParseDecimal("1.00"),
 				ReceiverChargesCurrency: "GBP",
 			},
 			Currency: "GBP",
@@ -107,7 +152,7 @@ func createExamplePayment() Payment {
 					BankIDCode:    "GBDSC",
 				},
 				AccountName:       "Mangoes Inc",
-				AccountNumberCode: "IBAN",
+				AccountNumberCode: "BBAN",
 				Name:              "Mangoes Incorporated",
 				Address:           "124 Main Street",
 			},
@@ -167,7 +212,7 @@ func TestGetPaymentsWithOneExistingPayment(t *testing.T) {
 
 	// populate table with example payment
 	examplePayment := createExamplePayment()
-	if err := db.Insert(&examplePayment); err != nil {
+	if err := store.Create(&examplePayment); err != nil {
 		t.Fatal(err)
 	}
 
@@ -212,7 +257,7 @@ func TestGetPaymentsWithMultipleExistingPayments(t *testing.T) {
 			Version:        0,
 			OrganisationID: uuid.NewV1(),
 			Attributes: Attributes{
-				Amount: "100.00",
+				Amount: MustParseDecimal("100.00"),
 				BeneficiaryParty: BeneficiaryParty{
 					DebtorParty: &DebtorParty{
 						SponsorParty: &SponsorParty{
@@ -231,15 +276,15 @@ func TestGetPaymentsWithMultipleExistingPayments(t *testing.T) {
 					BearerCode: "SHAR",
 					SenderCharges: []Charge{
 						{
-							Amount:   "0.50",
+							Amount:   MustParseDecimal("0.50"),
 							Currency: "GBP",
 						},
 						{
-							Amount:   "0.10",
+							Amount:   MustParseDecimal("0.10"),
 							Currency: "USD",
 						},
 					},
-					ReceiverChargesAmount:   "1.00",
+					ReceiverChargesAmount:   MustParseDecimal("1.00"),
 					ReceiverChargesCurrency: "GBP",
 				},
 				Currency: "GBP",
@@ -272,8 +317,10 @@ func TestGetPaymentsWithMultipleExistingPayments(t *testing.T) {
 			},
 		},
 	}
-	if err := db.Insert(&examplePayments); err != nil {
-		t.Fatal(err)
+	for i := range examplePayments {
+		if err := store.Create(&examplePayments[i]); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	req := httptest.NewRequest(http.MethodGet, "/v1/payments", nil)
@@ -310,7 +357,7 @@ func TestGetSinglePaymentWithOneExistingPayment(t *testing.T) {
 
 	// populate table with example payment
 	examplePayment := createExamplePayment()
-	if err := db.Insert(&examplePayment); err != nil {
+	if err := store.Create(&examplePayment); err != nil {
 		t.Fatal(err)
 	}
 
@@ -338,7 +385,13 @@ func TestGetSinglePaymentWithOneExistingPayment(t *testing.T) {
 
 	assert.EqualValues(t, examplePayment, payment)
 
-	assert.EqualValues(t, []Link{Link{Rel: "self", Href: fmt.Sprintf("/v1/payments/%s", examplePayment.ID.String())}}, response.Links)
+	// the actions that can be taken on a created payment are linked too
+	self := fmt.Sprintf("/v1/payments/%s", examplePayment.ID.String())
+	assert.EqualValues(t, []Link{
+		Link{Rel: "self", Href: self},
+		Link{Rel: "request_approval", Href: self + "/actions/request_approval"},
+		Link{Rel: "submit", Href: self + "/actions/submit"},
+	}, response.Links)
 }
 
 func TestGetSinglePaymentForNonExistingPayment(t *testing.T) {
@@ -356,7 +409,7 @@ func TestGetSinglePaymentForNonExistingPayment(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to decode API response: %s", err)
 	}
-	assert.EqualValues(t, []string{"Payment not found"}, response.Errors)
+	assert.EqualValues(t, []APIError{{Code: "not_found", Message: "Payment not found"}}, response.Errors)
 }
 
 func TestGetSinglePaymentForInvalidUUID(t *testing.T) {
@@ -374,7 +427,7 @@ func TestGetSinglePaymentForInvalidUUID(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to decode API response: %s", err)
 	}
-	assert.EqualValues(t, []string{"Invalid UUID"}, response.Errors)
+	assert.EqualValues(t, []APIError{{Code: "invalid_uuid", Message: "Invalid UUID"}}, response.Errors)
 }
 
 func TestGetSinglePaymentForNonExistingPaymentWhenOtherPaymentExists(t *testing.T) {
@@ -383,7 +436,7 @@ func TestGetSinglePaymentForNonExistingPaymentWhenOtherPaymentExists(t *testing.
 
 	// populate table with example payment
 	examplePayment := createExamplePayment()
-	if err := db.Insert(&examplePayment); err != nil {
+	if err := store.Create(&examplePayment); err != nil {
 		t.Fatal(err)
 	}
 
@@ -398,7 +451,7 @@ func TestGetSinglePaymentForNonExistingPaymentWhenOtherPaymentExists(t *testing.
 	if err != nil {
 		t.Fatalf("Failed to decode API response: %s", err)
 	}
-	assert.EqualValues(t, []string{"Payment not found"}, response.Errors)
+	assert.EqualValues(t, []APIError{{Code: "not_found", Message: "Payment not found"}}, response.Errors)
 }
 
 func TestCreateSinglePayment(t *testing.T) {
@@ -420,12 +473,20 @@ func TestCreateSinglePayment(t *testing.T) {
 	}
 	assert.Equal(t, fmt.Sprintf("/v1/payments/%s", examplePayment.ID.String()), rw.Header().Get("Location"))
 
-	actualPayment := Payment{
-		ID: examplePayment.ID,
-	}
-	err = db.Select(&actualPayment)
+	actualPayment, err := store.Get(examplePayment.ID)
 	require.Nil(t, err)
 
+	// new payments start in the created status
+	assert.Equal(t, StatusCreated, actualPayment.Attributes.Status)
+	require.Len(t, actualPayment.Attributes.StatusHistory, 1)
+	assert.Equal(t, StatusCreated, actualPayment.Attributes.StatusHistory[0].To)
+	examplePayment.Attributes.Status = actualPayment.Attributes.Status
+	examplePayment.Attributes.StatusHistory = actualPayment.Attributes.StatusHistory
+
+	// and remember who created them
+	assert.Equal(t, anonymousActor, actualPayment.CreatedBy)
+	examplePayment.CreatedBy = actualPayment.CreatedBy
+
 	assert.EqualValues(t, examplePayment, actualPayment)
 }
 
@@ -470,7 +531,7 @@ func TestCreateSinglePaymentWithInvalidJSON(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to decode API response: %s", err)
 	}
-	assert.EqualValues(t, []string{"Invalid JSON"}, response.Errors)
+	assert.EqualValues(t, []APIError{{Code: "invalid_json", Message: "Invalid JSON"}}, response.Errors)
 }
 
 func TestUpdatePayment(t *testing.T) {
@@ -479,7 +540,7 @@ func TestUpdatePayment(t *testing.T) {
 
 	// populate table with example payment
 	examplePayment := createExamplePayment()
-	if err := db.Insert(&examplePayment); err != nil {
+	if err := store.Create(&examplePayment); err != nil {
 		t.Fatal(err)
 	}
 
@@ -497,12 +558,13 @@ func TestUpdatePayment(t *testing.T) {
 	}
 	assert.Equal(t, fmt.Sprintf("/v1/payments/%s", examplePayment.ID.String()), rw.Header().Get("Location"))
 
-	actualPayment := Payment{
-		ID: examplePayment.ID,
-	}
-	err = db.Select(&actualPayment)
+	assert.Equal(t, `"1"`, rw.Header().Get("ETag"))
+
+	actualPayment, err := store.Get(examplePayment.ID)
 	require.Nil(t, err)
 
+	// the update increments the version
+	examplePayment.Version = 1
 	assert.EqualValues(t, examplePayment, actualPayment)
 }
 
@@ -512,7 +574,7 @@ func TestUpdateSinglePaymentWithIDThatDoesNotMatchURL(t *testing.T) {
 
 	// populate table with example payment
 	examplePayment := createExamplePayment()
-	if err := db.Insert(&examplePayment); err != nil {
+	if err := store.Create(&examplePayment); err != nil {
 		t.Fatal(err)
 	}
 
@@ -530,7 +592,7 @@ func TestUpdateSinglePaymentWithIDThatDoesNotMatchURL(t *testing.T) {
 	if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
 		t.Fatalf("Failed to decode API response: %s", err)
 	}
-	assert.EqualValues(t, []string{"Mismatching IDs"}, response.Errors)
+	assert.EqualValues(t, []APIError{{Code: "mismatching_ids", Message: "Mismatching IDs"}}, response.Errors)
 }
 
 func TestUpdateNonExistentPayment(t *testing.T) {
@@ -554,7 +616,7 @@ func TestUpdateNonExistentPayment(t *testing.T) {
 	if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
 		t.Fatalf("Failed to decode API response: %s", err)
 	}
-	assert.EqualValues(t, []string{"Payment not found"}, response.Errors)
+	assert.EqualValues(t, []APIError{{Code: "not_found", Message: "Payment not found"}}, response.Errors)
 }
 
 func TestUpdateSinglePaymentWithInvalidJSON(t *testing.T) {
@@ -563,7 +625,7 @@ func TestUpdateSinglePaymentWithInvalidJSON(t *testing.T) {
 
 	// populate table with example payment
 	examplePayment := createExamplePayment()
-	if err := db.Insert(&examplePayment); err != nil {
+	if err := store.Create(&examplePayment); err != nil {
 		t.Fatal(err)
 	}
 
@@ -580,7 +642,7 @@ func TestUpdateSinglePaymentWithInvalidJSON(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to decode API response: %s", err)
 	}
-	assert.EqualValues(t, []string{"Invalid JSON"}, response.Errors)
+	assert.EqualValues(t, []APIError{{Code: "invalid_json", Message: "Invalid JSON"}}, response.Errors)
 }
 
 func TestDeletePayment(t *testing.T) {
@@ -589,7 +651,7 @@ func TestDeletePayment(t *testing.T) {
 
 	// populate table with example payment
 	examplePayment := createExamplePayment()
-	if err := db.Insert(&examplePayment); err != nil {
+	if err := store.Create(&examplePayment); err != nil {
 		t.Fatal(err)
 	}
 
@@ -600,11 +662,8 @@ func TestDeletePayment(t *testing.T) {
 		t.Fatalf("Status code was not 200: %d\n", rw.Code)
 	}
 
-	actualPayment := Payment{
-		ID: examplePayment.ID,
-	}
-	err := db.Select(&actualPayment)
-	assert.Equal(t, pg.ErrNoRows, err)
+	_, err := store.Get(examplePayment.ID)
+	assert.Equal(t, ErrPaymentNotFound, err)
 }
 
 func TestDeleteNonExistingPayment(t *testing.T) {
@@ -622,6 +681,85 @@ func TestDeleteNonExistingPayment(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to decode API response: %s", err)
 	}
-	assert.EqualValues(t, []string{"Payment not found"}, response.Errors)
+	assert.EqualValues(t, []APIError{{Code: "not_found", Message: "Payment not found"}}, response.Errors)
+
+}
+
+func TestDeletedPaymentIsHidden(t *testing.T) {
+
+	emptyDatabase(t)
+
+	deleted, kept := createExamplePayment(), createExamplePayment()
+	require.Nil(t, store.Create(&deleted))
+	require.Nil(t, store.Create(&kept))
+
+	self := fmt.Sprintf("/v1/payments/%s", deleted.ID)
+	require.Equal(t, 200, sendAs(t, "", http.MethodDelete, self, nil).Code)
+	assert.Equal(t, 404, sendAs(t, "", http.MethodGet, self, nil).Code)
+	assert.Equal(t, 404, sendAs(t, "", http.MethodPut, self, deleted).Code)
+	assert.Equal(t, 404, sendAs(t, "", http.MethodDelete, self, nil).Code)
+
+	// the tombstone can still be fetched when asked for
+	rw := sendAs(t, "", http.MethodGet, self+"?include_deleted=true", nil)
+	require.Equal(t, 200, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var tombstone Payment
+	require.Nil(t, json.Unmarshal(response.Data, &tombstone))
+	assert.NotNil(t, tombstone.DeletedAt)
+	assert.Equal(t, uint(1), tombstone.Version)
+	assert.Equal(t, []Link{{Rel: "self", Href: self}, {Rel: "restore", Href: self + "/restore"}}, response.Links)
+
+	listed := func(path string) []Payment {
+		rw := sendAs(t, "", http.MethodGet, path, nil)
+		require.Equal(t, 200, rw.Code)
+		var response APIResponse
+		require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+		var payments []Payment
+		require.Nil(t, json.Unmarshal(response.Data, &payments))
+		return payments
+	}
+	payments := listed("/v1/payments")
+	require.Len(t, payments, 1)
+	assert.Equal(t, kept.ID, payments[0].ID)
+	assert.Len(t, listed("/v1/payments?include_deleted=true"), 2)
+
+	assert.Equal(t, 400, sendAs(t, "", http.MethodGet, "/v1/payments?include_deleted=maybe", nil).Code)
+	assert.Equal(t, 400, sendAs(t, "", http.MethodGet, self+"?include_deleted=maybe", nil).Code)
+}
+
+func TestRestorePayment(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	require.Nil(t, store.Create(&payment))
+	self := fmt.Sprintf("/v1/payments/%s", payment.ID)
+
+	// only deleted payments can be restored
+	rw := sendAs(t, "", http.MethodPost, self+"/restore", nil)
+	require.Equal(t, 409, rw.Code)
+	require.Equal(t, 200, sendAs(t, "", http.MethodDelete, self, nil).Code)
+
+	req := httptest.NewRequest(http.MethodPost, self+"/restore", nil)
+	req.Header.Set("If-Match", `"0"`)
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 412, rw.Code)
+
+	rw = sendAs(t, "dave", http.MethodPost, self+"/restore", nil)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	assert.Equal(t, `"2"`, rw.Header().Get("ETag"))
+
+	stored, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Nil(t, stored.DeletedAt)
+	assert.Equal(t, uint(2), stored.Version)
+
+	entries, _ := getAuditEntries(t, self+"/history?filter[action]=restore")
+	require.Len(t, entries, 1)
+	assert.Equal(t, "dave", entries[0].Actor)
 
+	rw = sendAs(t, "", http.MethodPost, fmt.Sprintf("/v1/payments/%s/restore", uuid.NewV4()), nil)
+	assert.Equal(t, 404, rw.Code)
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// the SQL migrations are compiled into the binary. each version has a pair of files named
+// NNNN_description.up.sql and NNNN_description.down.sql
+//
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+// migrationLockID is the postgres advisory lock key held while migrating, so that API replicas starting at the same
+// time apply each migration exactly once
+const migrationLockID = 3300591
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// schemaMigration is a row in the schema_migrations table, recording an applied migration
+type schemaMigration struct {
+	tableName struct{} `sql:"schema_migrations"`
+
+	Version   int       `sql:",pk"`
+	Name      string    `sql:",notnull"`
+	AppliedAt time.Time `sql:",notnull"`
+}
+
+// migrationStatus describes a known migration and when it was applied, if it has been
+type migrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+type migrator struct {
+	db         *pg.DB
+	migrations []migration
+}
+
+func newMigrator(db *pg.DB) (*migrator, error) {
+	migrations, err := loadMigrations(embeddedMigrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, migrations: migrations}, nil
+}
+
+// read and pair up the up/down SQL files in dir, returning them ordered by version. versions must start at 1 and have no gaps.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		filename := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(filename, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(filename, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected file in migrations: %s", filename)
+		}
+
+		base := strings.TrimSuffix(filename, "."+direction+".sql")
+		separator := strings.Index(base, "_")
+		if separator < 1 {
+			return nil, fmt.Errorf("migration file has no version prefix: %s", filename)
+		}
+		version, err := strconv.Atoi(base[:separator])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration file has an invalid version: %s", filename)
+		}
+		name := base[separator+1:]
+
+		sql, err := fs.ReadFile(fsys, path.Join(dir, filename))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has mismatching names: %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	migrations := []migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d must have both up and down files", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be sequential, expected %d but found %d", i+1, m.Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// run fn in a transaction holding the migration lock, making sure the schema_migrations table exists first
+func (m *migrator) withLock(fn func(tx *pg.Tx) error) error {
+	return m.db.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS "schema_migrations" ("version" bigint PRIMARY KEY, "name" text NOT NULL, "applied_at" timestamptz NOT NULL)`); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+func appliedMigrations(tx *pg.Tx) (map[int]schemaMigration, error) {
+	var rows []schemaMigration
+	if err := tx.Model(&rows).Select(); err != nil {
+		return nil, err
+	}
+	applied := map[int]schemaMigration{}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// Up applies all pending migrations in order, each in its own transaction, and returns the migrations it applied
+func (m *migrator) Up() ([]migration, error) {
+	done := []migration{}
+	for _, next := range m.migrations {
+		var ran bool
+		err := m.withLock(func(tx *pg.Tx) error {
+			// another replica may have applied it while we were waiting for the lock
+			applied, err := appliedMigrations(tx)
+			if err != nil {
+				return err
+			}
+			if _, ok := applied[next.Version]; ok {
+				return nil
+			}
+			if _, err := tx.Exec(next.Up); err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %s", next.Version, next.Name, err)
+			}
+			ran = true
+			return tx.Insert(&schemaMigration{Version: next.Version, Name: next.Name, AppliedAt: time.Now().UTC()})
+		})
+		if err != nil {
+			return done, err
+		}
+		if ran {
+			done = append(done, next)
+		}
+	}
+	return done, nil
+}
+
+// Down reverts the most recently applied migrations, up to the given number of steps, and returns the migrations it reverted
+func (m *migrator) Down(steps int) ([]migration, error) {
+	done := []migration{}
+	for i := 0; i < steps; i++ {
+		var reverted *migration
+		err := m.withLock(func(tx *pg.Tx) error {
+			applied, err := appliedMigrations(tx)
+			if err != nil {
+				return err
+			}
+			for j := len(m.migrations) - 1; j >= 0; j-- {
+				if _, ok := applied[m.migrations[j].Version]; ok {
+					reverted = &m.migrations[j]
+					break
+				}
+			}
+			if reverted == nil {
+				return nil
+			}
+			if _, err := tx.Exec(reverted.Down); err != nil {
+				return fmt.Errorf("reverting migration %d (%s) failed: %s", reverted.Version, reverted.Name, err)
+			}
+			return tx.Delete(&schemaMigration{Version: reverted.Version})
+		})
+		if err != nil {
+			return done, err
+		}
+		if reverted == nil {
+			break
+		}
+		done = append(done, *reverted)
+	}
+	return done, nil
+}
+
+// Status returns every known migration along with when it was applied
+func (m *migrator) Status() ([]migrationStatus, error) {
+	statuses := []migrationStatus{}
+	err := m.withLock(func(tx *pg.Tx) error {
+		applied, err := appliedMigrations(tx)
+		if err != nil {
+			return err
+		}
+		for _, known := range m.migrations {
+			status := migrationStatus{Version: known.Version, Name: known.Name}
+			if row, ok := applied[known.Version]; ok {
+				appliedAt := row.AppliedAt
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// runMigrateCommand implements the `migrate up`, `migrate down [steps]` and `migrate status` subcommands
+func runMigrateCommand(db *pg.DB, args []string, out io.Writer) error {
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := m.Up()
+		for _, done := range applied {
+			fmt.Fprintf(out, "applied %04d %s\n", done.Version, done.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(out, "no pending migrations")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+		}
+		reverted, err := m.Down(steps)
+		for _, done := range reverted {
+			fmt.Fprintf(out, "reverted %04d %s\n", done.Version, done.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Fprintln(out, "no applied migrations")
+		}
+		return err
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.AppliedAt == nil {
+				fmt.Fprintf(out, "%04d %s pending\n", status.Version, status.Name)
+			} else {
+				fmt.Fprintf(out, "%04d %s applied %s\n", status.Version, status.Name, status.AppliedAt.Format(time.RFC3339))
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown migrate command: %s", args[0])
+}
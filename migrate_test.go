@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+
+	migrations, err := loadMigrations(embeddedMigrations, "migrations")
+	require.Nil(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Name)
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+}
+
+func TestLoadMigrationsOrdersByVersion(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"m/0002_second.up.sql":   {Data: []byte("up 2")},
+		"m/0002_second.down.sql": {Data: []byte("down 2")},
+		"m/0001_first.up.sql":    {Data: []byte("up 1")},
+		"m/0001_first.down.sql":  {Data: []byte("down 1")},
+	}
+
+	migrations, err := loadMigrations(fsys, "m")
+	require.Nil(t, err)
+	assert.EqualValues(t, []migration{
+		{Version: 1, Name: "first", Up: "up 1", Down: "down 1"},
+		{Version: 2, Name: "second", Up: "up 2", Down: "down 2"},
+	}, migrations)
+}
+
+func TestLoadMigrationsRejectsInvalidSets(t *testing.T) {
+
+	invalid := map[string]fstest.MapFS{
+		"missing down": {
+			"m/0001_first.up.sql": {Data: []byte("up")},
+		},
+		"gap in versions": {
+			"m/0001_first.up.sql":   {Data: []byte("up")},
+			"m/0001_first.down.sql": {Data: []byte("down")},
+			"m/0003_third.up.sql":   {Data: []byte("up")},
+			"m/0003_third.down.sql": {Data: []byte("down")},
+		},
+		"no version": {
+			"m/first.up.sql":   {Data: []byte("up")},
+			"m/first.down.sql": {Data: []byte("down")},
+		},
+		"mismatching names": {
+			"m/0001_first.up.sql":   {Data: []byte("up")},
+			"m/0001_other.down.sql": {Data: []byte("down")},
+		},
+		"unexpected file": {
+			"m/README.md": {Data: []byte("docs")},
+		},
+	}
+
+	for name, fsys := range invalid {
+		_, err := loadMigrations(fsys, "m")
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestMigrationsCreateTables(t *testing.T) {
+
+	if db == nil {
+		t.Skip("no database configured, set DATABASE_ADDR to run against postgres")
+	}
+
+	m, err := newMigrator(db)
+	require.Nil(t, err)
+
+	// TestMain has already migrated, so running again must be a no-op
+	applied, err := m.Up()
+	require.Nil(t, err)
+	assert.Empty(t, applied)
+
+	models := []interface{}{
+		&[]Payment{},
+		&[]Attributes{},
+		&[]BeneficiaryParty{},
+		&[]DebtorParty{},
+		&[]SponsorParty{},
+		&[]ChargesInformation{},
+		&[]Charge{},
+		&[]FX{},
+	}
+
+	// now check the required tables were created by querying them - this should result in no result and no error
+	for _, model := range models {
+		if err := db.Model(model).Select(); err != nil {
+			t.Errorf("Table was not created for %s", reflect.TypeOf(model).Elem().Elem().Name())
+		}
+	}
+
+	statuses, err := m.Status()
+	require.Nil(t, err)
+	for _, status := range statuses {
+		assert.NotNil(t, status.AppliedAt, "migration %d should be applied", status.Version)
+	}
+}
+
+func TestMigrateCommandDownAndUp(t *testing.T) {
+
+	if db == nil {
+		t.Skip("no database configured, set DATABASE_ADDR to run against postgres")
+	}
+
+	var out bytes.Buffer
+	require.Nil(t, runMigrateCommand(db, []string{"down", "1000"}, &out))
+	require.Nil(t, runMigrateCommand(db, []string{"status"}, &out))
+	assert.Contains(t, out.String(), "pending")
+
+	out.Reset()
+	require.Nil(t, runMigrateCommand(db, []string{"up"}, &out))
+	assert.Contains(t, out.String(), "applied 0001")
+
+	assert.NotNil(t, runMigrateCommand(db, []string{"sideways"}, &out))
+}
@@ -0,0 +1,9 @@
+-- matches the tables previously created by provisionDatabase, so existing databases can adopt migrations as-is
+CREATE TABLE IF NOT EXISTS "payments" ("type" text, "id" uuid, "version" bigint, "organisation_id" uuid, "attributes" jsonb, PRIMARY KEY ("id"));
+CREATE TABLE IF NOT EXISTS "attributes" ("amount" text, "beneficiary_party" jsonb, "charges_information" jsonb, "currency" text, "debtor_party" jsonb, "end_to_end_reference" text, "fx" jsonb, "numeric_reference" text, "payment_id" text, "payment_purpose" text, "payment_scheme" text, "payment_type" text, "processing_date" text, "reference" text, "scheme_payment_sub_type" text, "scheme_payment_type" text, "sponsor_party" jsonb);
+CREATE TABLE IF NOT EXISTS "beneficiary_parties" ("account_number" text, "bank_id" text, "bank_id_code" text, "account_name" text, "account_number_code" text, "address" text, "name" text, "account_type" bigint);
+CREATE TABLE IF NOT EXISTS "debtor_parties" ("account_number" text, "bank_id" text, "bank_id_code" text, "account_name" text, "account_number_code" text, "address" text, "name" text);
+CREATE TABLE IF NOT EXISTS "sponsor_parties" ("account_number" text, "bank_id" text, "bank_id_code" text);
+CREATE TABLE IF NOT EXISTS "charges_informations" ("bearer_code" text, "sender_charges" jsonb, "receiver_charges_amount" text, "receiver_charges_currency" text);
+CREATE TABLE IF NOT EXISTS "charges" ("amount" text, "currency" text);
+CREATE TABLE IF NOT EXISTS "fxes" ("contract_reference" text, "exchange_rate" text, "original_amount" text, "original_currency" text);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS "payments_amount_idx";
+DROP INDEX IF EXISTS "payments_processing_date_idx";
+DROP INDEX IF EXISTS "payments_payment_scheme_idx";
+DROP INDEX IF EXISTS "payments_currency_idx";
+DROP INDEX IF EXISTS "payments_organisation_id_idx";
+DROP INDEX IF EXISTS "payments_seq_idx";
+ALTER TABLE "payments" DROP COLUMN IF EXISTS "seq";
@@ -0,0 +1,12 @@
+-- seq records the order payments were created in, and breaks ties between equal sort keys when paginating
+ALTER TABLE "payments" ADD COLUMN "seq" bigserial NOT NULL;
+CREATE UNIQUE INDEX "payments_seq_idx" ON "payments" ("seq");
+
+-- filters
+CREATE INDEX "payments_organisation_id_idx" ON "payments" ("organisation_id", "seq");
+CREATE INDEX "payments_currency_idx" ON "payments" ((attributes->>'currency'), "seq");
+CREATE INDEX "payments_payment_scheme_idx" ON "payments" ((attributes->>'payment_scheme'), "seq");
+
+-- filters and sort keys. these expressions must match those used by the postgres store.
+CREATE INDEX "payments_processing_date_idx" ON "payments" ((COALESCE(attributes->>'processing_date', '')), "seq");
+CREATE INDEX "payments_amount_idx" ON "payments" ((COALESCE(CASE WHEN attributes->>'amount' ~ '^-?[0-9]+(\.[0-9]+)?$' THEN (attributes->>'amount')::numeric END, 0)), "seq");
@@ -0,0 +1,2 @@
+ALTER TABLE "payments" ALTER COLUMN "version" DROP NOT NULL;
+ALTER TABLE "payments" ALTER COLUMN "version" DROP DEFAULT;
@@ -0,0 +1,4 @@
+-- go-pg inserts zero values as DEFAULT, which left version 0 stored as NULL. versions are now compared on every write.
+UPDATE "payments" SET "version" = 0 WHERE "version" IS NULL;
+ALTER TABLE "payments" ALTER COLUMN "version" SET DEFAULT 0;
+ALTER TABLE "payments" ALTER COLUMN "version" SET NOT NULL;
@@ -0,0 +1,4 @@
+CREATE TABLE "idempotency_keys" ("key" text, "request_hash" text NOT NULL, "status_code" bigint NOT NULL, "header" jsonb NOT NULL, "body" bytea, "created_at" timestamptz NOT NULL, PRIMARY KEY ("key"));
+
+-- used by the sweeper to find expired keys
+CREATE INDEX "idempotency_keys_created_at_idx" ON "idempotency_keys" ("created_at");
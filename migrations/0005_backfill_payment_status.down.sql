@@ -0,0 +1 @@
+UPDATE "payments" SET "attributes" = "attributes" - 'status' - 'status_history';
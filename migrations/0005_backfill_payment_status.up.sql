@@ -0,0 +1,2 @@
+-- payments created before the lifecycle existed start out as created
+UPDATE "payments" SET "attributes" = jsonb_set("attributes", '{status}', '"created"') WHERE COALESCE("attributes"->>'status', '') = '';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS "payments_amount_idx";
+CREATE INDEX "payments_amount_idx" ON "payments" ((COALESCE(CASE WHEN attributes->>'amount' ~ '^-?[0-9]+(\.[0-9]+)?$' THEN (attributes->>'amount')::numeric END, 0)), "seq");
+ALTER TABLE "payments" DROP COLUMN IF EXISTS "amount";
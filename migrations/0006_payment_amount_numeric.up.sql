@@ -0,0 +1,6 @@
+-- the amount is copied out of the attributes into a NUMERIC column, so that it can be filtered, sorted and summed exactly
+ALTER TABLE "payments" ADD COLUMN "amount" numeric;
+UPDATE "payments" SET "amount" = (attributes->>'amount')::numeric WHERE attributes->>'amount' ~ '^-?[0-9]+(\.[0-9]+)?$';
+
+DROP INDEX IF EXISTS "payments_amount_idx";
+CREATE INDEX "payments_amount_idx" ON "payments" ((COALESCE("amount", 0)), "seq");
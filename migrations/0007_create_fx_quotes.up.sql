@@ -0,0 +1 @@
+CREATE TABLE "fx_quotes" ("contract_reference" text, "source_currency" text NOT NULL, "source_amount" numeric NOT NULL, "target_currency" text NOT NULL, "target_amount" numeric NOT NULL, "exchange_rate" numeric NOT NULL, "created_at" timestamptz NOT NULL, "expires_at" timestamptz NOT NULL, PRIMARY KEY ("contract_reference"));
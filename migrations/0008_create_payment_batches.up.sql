@@ -0,0 +1 @@
+CREATE TABLE "payment_batches" ("id" uuid, "mode" text NOT NULL, "status" text NOT NULL, "total" bigint NOT NULL, "created" bigint NOT NULL, "failed" bigint NOT NULL, "items" jsonb NOT NULL, "created_at" timestamptz NOT NULL, PRIMARY KEY ("id"));
@@ -0,0 +1,14 @@
+CREATE TABLE "audit_log" ("id" uuid, "seq" bigserial NOT NULL UNIQUE, "payment_id" uuid NOT NULL, "action" text NOT NULL, "actor" text NOT NULL, "request_id" text NOT NULL, "timestamp" timestamptz NOT NULL, "before" jsonb, "after" jsonb, "changes" jsonb NOT NULL, PRIMARY KEY ("id"));
+
+-- history of a payment, and the global audit query by time
+CREATE INDEX "audit_log_payment_id_seq_idx" ON "audit_log" ("payment_id", "seq");
+CREATE INDEX "audit_log_timestamp_idx" ON "audit_log" ("timestamp");
+
+-- the audit log is append-only
+CREATE FUNCTION "audit_log_append_only"() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER "audit_log_append_only" BEFORE UPDATE OR DELETE ON "audit_log" FOR EACH ROW EXECUTE PROCEDURE "audit_log_append_only"();
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS "payments_deleted_at_idx";
+ALTER TABLE "payments" DROP COLUMN IF EXISTS "deleted_at";
@@ -0,0 +1,3 @@
+ALTER TABLE "payments" ADD COLUMN "deleted_at" timestamptz;
+-- the retention policy looks for tombstones older than its period
+CREATE INDEX "payments_deleted_at_idx" ON "payments" ("deleted_at") WHERE "deleted_at" IS NOT NULL;
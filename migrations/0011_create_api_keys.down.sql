@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS "audit_log_organisation_idx";
+ALTER TABLE "payment_batches" DROP COLUMN IF EXISTS "organisation_id";
+DROP TABLE IF EXISTS "api_keys";
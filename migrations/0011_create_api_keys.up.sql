@@ -0,0 +1,8 @@
+CREATE TABLE "api_keys" ("id" uuid, "organisation_id" uuid NOT NULL, "name" text NOT NULL DEFAULT '', "hash" text NOT NULL UNIQUE, "created_at" timestamptz NOT NULL, "revoked_at" timestamptz, PRIMARY KEY ("id"));
+CREATE INDEX "api_keys_organisation_id_idx" ON "api_keys" ("organisation_id", "created_at");
+
+-- batches created before API keys belong to no organisation
+ALTER TABLE "payment_batches" ADD COLUMN "organisation_id" uuid NOT NULL DEFAULT '00000000-0000-0000-0000-000000000000';
+
+-- the audit trail of an organisation. this expression must match the one used by the postgres store.
+CREATE INDEX "audit_log_organisation_idx" ON "audit_log" ((COALESCE("after", "before")->>'organisation_id'), "seq");
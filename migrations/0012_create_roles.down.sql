@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS "audit_log_organisation_id_seq_idx";
+CREATE INDEX IF NOT EXISTS "audit_log_organisation_idx" ON "audit_log" ((COALESCE("after", "before")->>'organisation_id'), "seq");
+ALTER TABLE "audit_log" DROP COLUMN IF EXISTS "denied";
+ALTER TABLE "audit_log" DROP COLUMN IF EXISTS "organisation_id";
+ALTER TABLE "api_keys" DROP COLUMN IF EXISTS "roles";
+DROP TABLE IF EXISTS "roles";
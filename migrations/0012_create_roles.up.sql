@@ -0,0 +1,17 @@
+CREATE TABLE "roles" ("organisation_id" uuid, "name" text, "description" text NOT NULL, "permissions" jsonb NOT NULL, PRIMARY KEY ("organisation_id", "name"));
+
+-- keys made before roles existed keep full access
+ALTER TABLE "api_keys" ADD COLUMN "roles" jsonb;
+UPDATE "api_keys" SET "roles" = '["admin"]';
+ALTER TABLE "api_keys" ALTER COLUMN "roles" SET NOT NULL;
+
+-- audit entries record their organisation directly, as entries for denied requests may have no payment
+ALTER TABLE "audit_log" ADD COLUMN "organisation_id" uuid;
+ALTER TABLE "audit_log" ADD COLUMN "denied" jsonb;
+ALTER TABLE "audit_log" DISABLE TRIGGER "audit_log_append_only";
+UPDATE "audit_log" SET "organisation_id" = (COALESCE("after", "before")->>'organisation_id')::uuid;
+ALTER TABLE "audit_log" ENABLE TRIGGER "audit_log_append_only";
+ALTER TABLE "audit_log" ALTER COLUMN "organisation_id" SET NOT NULL;
+
+DROP INDEX IF EXISTS "audit_log_organisation_idx";
+CREATE INDEX "audit_log_organisation_id_seq_idx" ON "audit_log" ("organisation_id", "seq");
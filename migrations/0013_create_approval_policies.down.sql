@@ -0,0 +1,2 @@
+ALTER TABLE "payments" DROP COLUMN IF EXISTS "created_by";
+DROP TABLE IF EXISTS "approval_policies";
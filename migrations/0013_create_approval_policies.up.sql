@@ -0,0 +1,4 @@
+CREATE TABLE "approval_policies" ("organisation_id" uuid, "currency" text, "threshold" numeric NOT NULL, "approvals" bigint NOT NULL, PRIMARY KEY ("organisation_id", "currency"));
+
+-- who created a payment isn't known for payments made before approvals, so anyone can approve them
+ALTER TABLE "payments" ADD COLUMN "created_by" text NOT NULL DEFAULT '';
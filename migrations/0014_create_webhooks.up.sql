@@ -0,0 +1,7 @@
+CREATE TABLE "subscriptions" ("id" uuid, "organisation_id" uuid NOT NULL, "callback_url" text NOT NULL, "event_types" jsonb NOT NULL, "secret" text NOT NULL, "created_at" timestamptz NOT NULL, PRIMARY KEY ("id"));
+CREATE INDEX "subscriptions_organisation_id_idx" ON "subscriptions" ("organisation_id", "created_at");
+
+-- the outbox. deliveries are written in the same transaction as the change they announce.
+CREATE TABLE "webhook_deliveries" ("id" uuid, "subscription_id" uuid NOT NULL REFERENCES "subscriptions" ("id") ON DELETE CASCADE, "event_id" uuid NOT NULL, "event_type" text NOT NULL, "event" jsonb NOT NULL, "status" text NOT NULL, "attempts" jsonb NOT NULL, "next_attempt_at" timestamptz NOT NULL, "created_at" timestamptz NOT NULL, "delivered_at" timestamptz, PRIMARY KEY ("id"));
+CREATE INDEX "webhook_deliveries_due_idx" ON "webhook_deliveries" ("next_attempt_at") WHERE "status" = 'pending';
+CREATE INDEX "webhook_deliveries_subscription_id_idx" ON "webhook_deliveries" ("subscription_id", "created_at");
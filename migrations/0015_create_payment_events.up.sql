@@ -0,0 +1,3 @@
+-- seq orders events by when they were committed, which readers of the payment stream resume from
+CREATE TABLE "payment_events" ("seq" bigserial NOT NULL UNIQUE, "id" uuid, "type" text NOT NULL, "organisation_id" uuid NOT NULL, "payment_id" uuid NOT NULL, "created_at" timestamptz NOT NULL, "data" jsonb, PRIMARY KEY ("id"));
+CREATE INDEX "payment_events_organisation_id_seq_idx" ON "payment_events" ("organisation_id", "seq");
@@ -0,0 +1 @@
+CREATE TABLE "relay_offsets" ("sink" text, "seq" bigint NOT NULL, "updated_at" timestamptz NOT NULL, PRIMARY KEY ("sink"));
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS "payments_end_to_end_reference_idx";
+DROP TABLE IF EXISTS "status_report_exceptions";
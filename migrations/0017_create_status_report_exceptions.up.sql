@@ -0,0 +1,6 @@
+CREATE TABLE "status_report_exceptions" ("id" uuid, "organisation_id" uuid NOT NULL, "reason" text NOT NULL, "message" text NOT NULL, "payment_id" uuid, "source" text NOT NULL, "message_id" text NOT NULL, "transaction" jsonb NOT NULL, "received_at" timestamptz NOT NULL, "resolved_at" timestamptz, PRIMARY KEY ("id"));
+-- the queue is the unresolved exceptions, newest first
+CREATE INDEX "status_report_exceptions_queue_idx" ON "status_report_exceptions" ("organisation_id", "received_at") WHERE "resolved_at" IS NULL;
+
+-- status reports match payments by their references when they don't give the UETR
+CREATE INDEX "payments_end_to_end_reference_idx" ON "payments" ((attributes->>'end_to_end_reference'));
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS "scheme_files";
@@ -0,0 +1,2 @@
+CREATE TABLE "scheme_files" ("id" uuid, "organisation_id" uuid NOT NULL, "scheme" text NOT NULL, "service_user_number" text NOT NULL, "processing_date" text, "sections" jsonb NOT NULL, "excluded" jsonb NOT NULL, "created_by" text NOT NULL, "created_at" timestamptz NOT NULL, "content" text NOT NULL, PRIMARY KEY ("id"));
+CREATE INDEX "scheme_files_organisation_id_idx" ON "scheme_files" ("organisation_id", "created_at");
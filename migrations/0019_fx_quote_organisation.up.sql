@@ -0,0 +1,7 @@
+ALTER TABLE "fx_quotes" ADD COLUMN "organisation_id" uuid;
+-- quotes already used by a payment belong to its organisation. the others are short lived and can't be attributed,
+-- so they are removed rather than left usable by every organisation.
+UPDATE "fx_quotes" SET "organisation_id" = "payments"."organisation_id" FROM "payments"
+WHERE "payments"."attributes"->'fx'->>'contract_reference' = "fx_quotes"."contract_reference";
+DELETE FROM "fx_quotes" WHERE "organisation_id" IS NULL;
+ALTER TABLE "fx_quotes" ALTER COLUMN "organisation_id" SET NOT NULL;
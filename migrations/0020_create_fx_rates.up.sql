@@ -0,0 +1,2 @@
+-- the exchange rates every replica quotes from, replaced as a whole by PUT /v1/fx/rates
+CREATE TABLE "fx_rates" ("base_currency" text, "quote_currency" text, "rate" numeric NOT NULL, PRIMARY KEY ("base_currency", "quote_currency"));
@@ -1,6 +1,10 @@
 package main
 
-import uuid "github.com/satori/go.uuid"
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
 
 type Payment struct {
 	Type           string     `json:"type"`
@@ -8,10 +12,16 @@ type Payment struct {
 	Version        uint       `json:"version"`
 	OrganisationID uuid.UUID  `json:"organisation_id" sql:",type:uuid"`
 	Attributes     Attributes `json:"attributes"`
+
+	// the actor who created the payment, who can't also approve it
+	CreatedBy string `json:"created_by,omitempty"`
+
+	// set when the payment is deleted. the tombstone is kept, hidden, until the retention policy purges it.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type Attributes struct {
-	Amount               string             `json:"amount"`
+	Amount               Decimal            `json:"amount"`
 	BeneficiaryParty     BeneficiaryParty   `json:"beneficiary_party"`
 	ChargesInformation   ChargesInformation `json:"charges_information"`
 	Currency             string             `json:"currency"`
@@ -28,6 +38,11 @@ type Attributes struct {
 	SchemePaymentSubType string             `json:"scheme_payment_sub_type"`
 	SchemePaymentType    string             `json:"scheme_payment_type"`
 	SponsorParty         SponsorParty       `json:"sponsor_party"`
+	Status               string             `json:"status"`
+	StatusHistory        []StatusTransition `json:"status_history"`
+	Approval             *Approval          `json:"approval,omitempty"`
+	SchemeStatus         *SchemeStatus      `json:"scheme_status,omitempty"`
+	SchemeFileID         *uuid.UUID         `json:"scheme_file_id,omitempty"`
 }
 
 type BeneficiaryParty struct {
@@ -52,18 +67,18 @@ type SponsorParty struct {
 type ChargesInformation struct {
 	BearerCode              string   `json:"bearer_code"`
 	SenderCharges           []Charge `json:"sender_charges"`
-	ReceiverChargesAmount   string   `json:"receiver_charges_amount"`
+	ReceiverChargesAmount   Decimal  `json:"receiver_charges_amount"`
 	ReceiverChargesCurrency string   `json:"receiver_charges_currency"`
 }
 
 type Charge struct {
-	Amount   string `json:"amount"`
-	Currency string `json:"currency"`
+	Amount   Decimal `json:"amount"`
+	Currency string  `json:"currency"`
 }
 
 type FX struct {
-	ContractReference string `json:"contract_reference"`
-	ExchangeRate      string `json:"exchange_rate"`
-	OriginalAmount    string `json:"original_amount"`
-	OriginalCurrency  string `json:"original_currency"`
+	ContractReference string  `json:"contract_reference"`
+	ExchangeRate      Decimal `json:"exchange_rate"`
+	OriginalAmount    Decimal `json:"original_amount"`
+	OriginalCurrency  string  `json:"original_currency"`
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrExcessPrecision  = errors.New("more decimal places than the currency allows")
+	ErrCurrencyMismatch = errors.New("currencies do not match")
+)
+
+// Money is an amount in a currency, with no more decimal places than the minor unit of the currency
+type Money struct {
+	Amount   Decimal
+	Currency string
+}
+
+// NewMoney returns the amount in the currency, or ErrUnknownCurrency or ErrExcessPrecision
+func NewMoney(amount Decimal, currency string) (Money, error) {
+	exponent, ok := currencyExponent(currency)
+	if !ok {
+		return Money{}, ErrUnknownCurrency
+	}
+	if amount.Scale() > int32(exponent) {
+		return Money{}, ErrExcessPrecision
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// RoundMoney rounds the amount to the minor unit of the currency, for amounts that have been calculated
+func RoundMoney(amount Decimal, currency string, mode RoundingMode) (Money, error) {
+	exponent, ok := currencyExponent(currency)
+	if !ok {
+		return Money{}, ErrUnknownCurrency
+	}
+	return Money{Amount: amount.Round(int32(exponent), mode), Currency: currency}, nil
+}
+
+// Add returns the sum of two amounts in the same currency
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	sum, err := m.Amount.Add(other.Amount)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+// Sub returns the difference between two amounts in the same currency
+func (m Money) Sub(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	difference, err := m.Amount.Sub(other.Amount)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: difference, Currency: m.Currency}, nil
+}
+
+func (m Money) String() string {
+	return fmt.Sprintf("%s %s", m.Amount, m.Currency)
+}
+
+// totalCharges sums charges by currency, leaving out charges with an unknown currency or too many decimal places
+func totalCharges(charges []Charge) map[string]Money {
+	totals := map[string]Money{}
+	for _, charge := range charges {
+		amount, err := NewMoney(charge.Amount, charge.Currency)
+		if err != nil {
+			continue
+		}
+		if total, ok := totals[charge.Currency]; ok {
+			if amount, err = total.Add(amount); err != nil {
+				continue
+			}
+		}
+		totals[charge.Currency] = amount
+	}
+	return totals
+}
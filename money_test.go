@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMoneyChecksMinorUnits(t *testing.T) {
+
+	money, err := NewMoney(MustParseDecimal("100.21"), "GBP")
+	require.Nil(t, err)
+	assert.Equal(t, "100.21 GBP", money.String())
+
+	_, err = NewMoney(MustParseDecimal("100.5"), "JPY")
+	assert.Equal(t, ErrExcessPrecision, err)
+
+	_, err = NewMoney(MustParseDecimal("1.000"), "BHD")
+	assert.Nil(t, err)
+
+	_, err = NewMoney(MustParseDecimal("1"), "ABC")
+	assert.Equal(t, ErrUnknownCurrency, err)
+
+	rounded, err := RoundMoney(MustParseDecimal("100.215"), "GBP", RoundHalfUp)
+	require.Nil(t, err)
+	assert.Equal(t, "100.22", rounded.Amount.String())
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+
+	a, _ := NewMoney(MustParseDecimal("10.50"), "GBP")
+	b, _ := NewMoney(MustParseDecimal("0.75"), "GBP")
+
+	sum, err := a.Add(b)
+	require.Nil(t, err)
+	assert.Equal(t, "11.25 GBP", sum.String())
+
+	difference, err := b.Sub(a)
+	require.Nil(t, err)
+	assert.Equal(t, "-9.75 GBP", difference.String())
+
+	dollars, _ := NewMoney(MustParseDecimal("1.00"), "USD")
+	_, err = a.Add(dollars)
+	assert.Equal(t, ErrCurrencyMismatch, err)
+}
+
+func TestTotalCharges(t *testing.T) {
+
+	totals := totalCharges([]Charge{
+		{Amount: MustParseDecimal("5.00"), Currency: "GBP"},
+		{Amount: MustParseDecimal("10.00"), Currency: "USD"},
+		{Amount: MustParseDecimal("0.25"), Currency: "GBP"},
+	})
+	assert.Equal(t, "5.25 GBP", totals["GBP"].String())
+	assert.Equal(t, "10.00 USD", totals["USD"].String())
+}
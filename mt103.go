@@ -0,0 +1,770 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	mt103ContentType = "text/plain; charset=us-ascii"
+
+	// the width of a line of a multi-line field
+	mtLineWidth = 35
+)
+
+var (
+	// the SWIFT x character set, which every field is written in
+	mtCharacters = regexp.MustCompile(`^[A-Za-z0-9/\-?:().,'+ \n]*$`)
+
+	mtBasicHeader       = regexp.MustCompile(`^F01([A-Z0-9]{12})[0-9]{10}$`)
+	mtApplicationHeader = regexp.MustCompile(`^[IO]([0-9]{3})`)
+	mtFieldStart        = regexp.MustCompile(`^:([0-9]{2}[A-Z]?):`)
+	mtUserField         = regexp.MustCompile(`\{([0-9]{3}):([^{}]*)\}`)
+	mtReference         = regexp.MustCompile(`^[A-Za-z0-9/\-?:().,'+ ]{1,16}$`)
+	mtValueDateAmount   = regexp.MustCompile(`^([0-9]{6})([A-Z]{3})([0-9][0-9,]{0,14})$`)
+	mtCurrencyAmount    = regexp.MustCompile(`^([A-Z]{3})([0-9][0-9,]{0,14})$`)
+	mtRate              = regexp.MustCompile(`^[0-9][0-9,]{0,11}$`)
+	mtDecimal           = regexp.MustCompile(`^[0-9]+,[0-9]*$`)
+	mtClearingID        = regexp.MustCompile(`^//([A-Z]{2})(.+)$`)
+	mtCodeWord          = regexp.MustCompile(`^/([A-Z]+)/(.*)$`)
+)
+
+// mtClearingCodes are the codes MT messages give national clearing systems in a party identifier, by bank ID code
+var mtClearingCodes = map[string]string{
+	"GBDSC": "SC",
+	"USABA": "FW",
+	"DEBLZ": "BL",
+	"CHBCC": "SW",
+	"AUBSB": "AU",
+	"CACPA": "CC",
+}
+
+// mtChargeCodes are the codes of field 71A for each bearer code. SLEV, following the scheme's rules, has no code.
+var mtChargeCodes = map[string]string{
+	"SHAR": "SHA",
+	"DEBT": "OUR",
+	"CRED": "BEN",
+}
+
+// mtBankOperationCodes are the values field 23B can take
+var mtBankOperationCodes = []string{"CRED", "CRTS", "SPAY", "SPRI", "SSTD"}
+
+// mt103Fields are the options of each MT103 field that can be imported. other options of these fields are reported
+// as errors, and any other fields, such as 23E or 77B, are ignored.
+var mt103Fields = map[string][]string{
+	"20": {""},
+	"23": {"B", "E"},
+	"32": {"A"},
+	"33": {"B"},
+	"36": {""},
+	"50": {"K"},
+	"52": {"A", "D"},
+	"56": {"A", "C"},
+	"57": {"A", "C"},
+	"59": {""},
+	"70": {""},
+	"71": {"A", "F", "G"},
+	"72": {""},
+}
+
+// the fields every MT103 must have
+var mt103RequiredFields = []string{"20", "23B", "32A", "50K", "59", "71A"}
+
+// mtField is a field of the text block of an MT message. lines of multi-line values are separated by newlines.
+type mtField struct {
+	Tag   string
+	Value string
+}
+
+// mt103Message is an MT103 single customer credit transfer
+type mt103Message struct {
+	Sender   string
+	Receiver string
+	UETR     string
+	Fields   []mtField
+}
+
+// String writes the message in its blocks, with the lines of the text block ending in CRLF
+func (message mt103Message) String() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "{1:F01%s0000000000}{2:I103%sN}{3:{121:%s}}{4:\r\n", message.Sender, message.Receiver, message.UETR)
+	for _, field := range message.Fields {
+		fmt.Fprintf(&text, ":%s:%s\r\n", field.Tag, strings.Replace(field.Value, "\n", "\r\n", -1))
+	}
+	text.WriteString("-}")
+	return text.String()
+}
+
+// mtAddress returns the logical terminal address of a BIC, which MT headers use
+func mtAddress(bic string) string {
+	branch := "XXX"
+	if len(bic) == 11 {
+		branch = bic[8:]
+	}
+	return bic[:8] + "X" + branch
+}
+
+// mtAmount writes an amount as MT fields do, with a decimal comma
+func mtAmount(amount Decimal) string {
+	s := amount.String()
+	if !strings.Contains(s, ".") {
+		return s + ","
+	}
+	return strings.Replace(s, ".", ",", 1)
+}
+
+// mtDecimalOf reads an amount or rate with a decimal comma. a value that isn't one is kept as invalid, so that
+// validation reports it against its field.
+func mtDecimalOf(s string) Decimal {
+	if !mtDecimal.MatchString(s) {
+		return Decimal{invalid: s}
+	}
+	return decimalOf(strings.TrimSuffix(strings.Replace(s, ",", ".", 1), "."))
+}
+
+// mtLines wraps text at spaces into lines of at most width characters, splitting words that are longer
+func mtLines(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		for len(word) > width {
+			if line != "" {
+				lines, line = append(lines, line), ""
+			}
+			lines, word = append(lines, word[:width]), word[width:]
+		}
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= width:
+			line += " " + word
+		default:
+			lines, line = append(lines, line), word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// mt103Writer builds the fields of an MT103 from a payment, collecting an error against each attribute that can't be
+// written
+type mt103Writer struct {
+	v      *paymentValidator
+	fields []mtField
+}
+
+func (writer *mt103Writer) field(tag, value, pointer string) {
+	if !mtCharacters.MatchString(value) {
+		writer.v.add(pointer, codeInvalidFormat, fmt.Sprintf("field %s can only contain SWIFT characters", tag))
+	}
+	writer.fields = append(writer.fields, mtField{Tag: tag, Value: value})
+}
+
+// party writes a debtor or beneficiary as its account followed by its name and address
+func (writer *mt103Writer) party(tag string, party DebtorParty, pointer string) {
+	lines := []string{"/" + party.AccountNumber}
+	if len(party.Name) > mtLineWidth {
+		writer.v.add(pointer+"/name", codeInvalidValue, fmt.Sprintf("name must be at most %d characters to be written to field %s", mtLineWidth, tag))
+	}
+	lines = append(lines, party.Name)
+	address := mtLines(party.Address, mtLineWidth)
+	if len(address) > 3 {
+		writer.v.add(pointer+"/address", codeInvalidValue, fmt.Sprintf("address must fit on 3 lines of %d characters to be written to field %s", mtLineWidth, tag))
+	}
+	writer.field(tag, strings.Join(append(lines, address...), "\n"), pointer)
+}
+
+// bank writes a bank as option A, its BIC, or as its national clearing code with the given option. account is the
+// account at the bank, which is written first when there is one.
+func (writer *mt103Writer) bank(tag, clearingOption string, account string, bank *SponsorParty, pointer string) {
+	prefix := ""
+	if account != "" {
+		prefix = "/" + account + "\n"
+	}
+	if bank.BankIDCode == "SWBIC" {
+		writer.field(tag+"A", prefix+bank.BankID, pointer)
+		return
+	}
+	code, ok := mtClearingCodes[bank.BankIDCode]
+	if !ok {
+		writer.v.add(pointer+"/bank_id_code", codeInvalidValue, fmt.Sprintf("bank_id_code must be SWBIC or a national clearing code to be written to field %s", tag))
+		return
+	}
+	writer.field(tag+clearingOption, prefix+"//"+code+bank.BankID, pointer)
+}
+
+// marshalMT103 writes a payment as an MT103 message. attributes that can't be written are reported as errors
+// against them, in the same way as validation errors.
+func marshalMT103(payment Payment) (string, []APIError) {
+	attributes := payment.Attributes
+	debtor := partyOf(&attributes.DebtorParty)
+	beneficiary := partyOf(attributes.BeneficiaryParty.DebtorParty)
+	writer := &mt103Writer{v: &paymentValidator{}}
+	v := writer.v
+
+	if attributes.PaymentType != "Credit" {
+		v.add("/attributes/payment_type", codeInvalidValue, "Only credit transfers can be MT103 messages")
+	}
+
+	// the message is sent by the debtor's bank, or the sponsor it reaches the network through, to the beneficiary's
+	message := mt103Message{UETR: payment.ID.String()}
+	switch {
+	case debtor.BankIDCode == "SWBIC" && isBIC(debtor.BankID):
+		message.Sender = mtAddress(debtor.BankID)
+	case attributes.SponsorParty.BankIDCode == "SWBIC" && isBIC(attributes.SponsorParty.BankID):
+		message.Sender = mtAddress(attributes.SponsorParty.BankID)
+	default:
+		v.add("/attributes/debtor_party/bank_id_code", codeInvalidValue, "The debtor's bank or the sponsor must have a BIC to send an MT103")
+	}
+	if beneficiary.BankIDCode == "SWBIC" && isBIC(beneficiary.BankID) {
+		message.Receiver = mtAddress(beneficiary.BankID)
+	} else {
+		v.add("/attributes/beneficiary_party/bank_id_code", codeInvalidValue, "The beneficiary's bank must have a BIC to be sent an MT103")
+	}
+
+	if reference := attributes.NumericReference; !mtReference.MatchString(reference) || strings.HasPrefix(reference, "/") ||
+		strings.HasSuffix(reference, "/") || strings.Contains(reference, "//") {
+		v.add("/attributes/numeric_reference", codeInvalidFormat, "numeric_reference must be 1 to 16 SWIFT characters, without leading, trailing or double slashes, to be field 20")
+	}
+	writer.field("20", attributes.NumericReference, "/attributes/numeric_reference")
+	writer.field("23B", "CRED", "")
+	date, err := time.Parse("2006-01-02", attributes.ProcessingDate)
+	if err != nil {
+		v.add("/attributes/processing_date", codeInvalidFormat, "processing_date must be a YYYY-MM-DD date")
+	}
+	writer.field("32A", date.Format("060102")+attributes.Currency+mtAmount(attributes.Amount), "/attributes/amount")
+
+	// the instructed amount is needed whenever there are charges. without a conversion it is the amount itself.
+	charges := attributes.ChargesInformation
+	if fx := attributes.FX; !fx.OriginalAmount.IsEmpty() {
+		writer.field("33B", fx.OriginalCurrency+mtAmount(fx.OriginalAmount), "/attributes/fx/original_amount")
+		if !fx.ExchangeRate.IsEmpty() {
+			writer.field("36", mtAmount(fx.ExchangeRate), "/attributes/fx/exchange_rate")
+		}
+	} else if len(charges.SenderCharges) > 0 || !charges.ReceiverChargesAmount.IsEmpty() {
+		writer.field("33B", attributes.Currency+mtAmount(attributes.Amount), "/attributes/amount")
+	}
+
+	writer.party("50K", debtor, "/attributes/debtor_party")
+	writer.bank("52", "D", "", debtor.SponsorParty, "/attributes/debtor_party")
+	if sponsor := attributes.SponsorParty; sponsor != (SponsorParty{}) {
+		writer.bank("56", "C", sponsor.AccountNumber, &sponsor, "/attributes/sponsor_party")
+	}
+	writer.bank("57", "C", "", beneficiary.SponsorParty, "/attributes/beneficiary_party")
+	writer.party("59", beneficiary, "/attributes/beneficiary_party")
+
+	// the end to end reference is the first line of the remittance information, as the ordering customer's reference
+	var remittance []string
+	if attributes.EndToEndReference != "" {
+		remittance = mtLines("/ROC/"+attributes.EndToEndReference, mtLineWidth)
+	}
+	remittance = append(remittance, mtLines(attributes.Reference, mtLineWidth)...)
+	if len(remittance) > 4 {
+		v.add("/attributes/reference", codeInvalidValue, fmt.Sprintf("end_to_end_reference and reference must fit on 4 lines of %d characters to be field 70", mtLineWidth))
+	}
+	if len(remittance) > 0 {
+		writer.field("70", strings.Join(remittance, "\n"), "/attributes/reference")
+	}
+
+	// sender charges can't be given when the debtor pays every charge, receiver charges only can, and the
+	// beneficiary paying every charge needs the sender's charges
+	chargeCode, ok := mtChargeCodes[charges.BearerCode]
+	if !ok {
+		v.add("/attributes/charges_information/bearer_code", codeInvalidValue, "bearer_code must be SHAR, DEBT or CRED to be field 71A")
+	}
+	switch {
+	case chargeCode == "OUR" && len(charges.SenderCharges) > 0:
+		v.add("/attributes/charges_information/sender_charges", codeInvalidValue, "sender_charges can't be given with bearer_code DEBT, field 71F isn't allowed with 71A OUR")
+	case chargeCode == "BEN" && len(charges.SenderCharges) == 0:
+		v.add("/attributes/charges_information/sender_charges", codeRequired, "sender_charges are required with bearer_code CRED, field 71F is required with 71A BEN")
+	}
+	if chargeCode != "OUR" && !charges.ReceiverChargesAmount.IsEmpty() {
+		v.add("/attributes/charges_information/receiver_charges_amount", codeInvalidValue, "receiver_charges_amount can only be given with bearer_code DEBT, field 71G is only allowed with 71A OUR")
+	}
+	writer.field("71A", chargeCode, "/attributes/charges_information/bearer_code")
+	for i, charge := range charges.SenderCharges {
+		writer.field("71F", charge.Currency+mtAmount(charge.Amount), fmt.Sprintf("/attributes/charges_information/sender_charges/%d", i))
+	}
+	if !charges.ReceiverChargesAmount.IsEmpty() {
+		writer.field("71G", charges.ReceiverChargesCurrency+mtAmount(charges.ReceiverChargesAmount), "/attributes/charges_information/receiver_charges_amount")
+	}
+
+	// the attributes MT103 has no field for are sent to the receiver as code words, continued on lines starting //
+	var information []string
+	for _, codeWord := range []struct{ code, value string }{
+		{"PAYID", attributes.PaymentID},
+		{"PURP", attributes.PaymentPurpose},
+		{"FXREF", attributes.FX.ContractReference},
+	} {
+		if codeWord.value == "" {
+			continue
+		}
+		line := "/" + codeWord.code + "/" + codeWord.value
+		for len(line) > mtLineWidth {
+			information, line = append(information, line[:mtLineWidth]), "//"+line[mtLineWidth:]
+		}
+		information = append(information, line)
+	}
+	if len(information) > 6 {
+		v.add("/attributes/payment_id", codeInvalidValue, fmt.Sprintf("payment_id, payment_purpose and the FX contract_reference must fit on 6 lines of %d characters to be field 72", mtLineWidth))
+	}
+	if len(information) > 0 {
+		writer.field("72", strings.Join(information, "\n"), "/attributes/payment_id")
+	}
+
+	if len(v.errs) > 0 {
+		return "", v.errs
+	}
+	message.Fields = writer.fields
+	return message.String(), nil
+}
+
+// mtError reports a problem with a block or field of the message at index i
+func mtError(i int, location, code, message string) APIError {
+	pointer := fmt.Sprintf("/messages/%d", i)
+	if location != "" {
+		pointer += "/" + location
+	}
+	return APIError{Code: code, Message: message, Pointer: pointer}
+}
+
+// splitMTBlocks reads the blocks of the MT messages in body, which may be separated by whitespace. each message
+// starts with its basic header block, and blocks are returned by their number.
+func splitMTBlocks(body string) ([]map[string]string, []APIError) {
+	var messages []map[string]string
+	for i := 0; i < len(body); {
+		c := body[i]
+		if c == ' ' || c == '\r' || c == '\n' || c == '\t' || c == '$' {
+			i++
+			continue
+		}
+		if c != '{' {
+			return nil, []APIError{mtError(len(messages), "", codeInvalidFormat, fmt.Sprintf("Expected a block at character %d", i))}
+		}
+		colon := strings.IndexByte(body[i:], ':')
+		if colon < 0 {
+			return nil, []APIError{mtError(len(messages), "", codeInvalidFormat, fmt.Sprintf("The block at character %d has no name", i))}
+		}
+		name := body[i+1 : i+colon]
+		if name == "1" || len(messages) == 0 {
+			messages = append(messages, map[string]string{})
+		}
+		index := len(messages) - 1
+
+		// blocks end at the matching brace, as those of the user header and trailer contain blocks of their own
+		depth, end := 0, -1
+		for j := i; j < len(body) && end < 0; j++ {
+			switch body[j] {
+			case '{':
+				depth++
+			case '}':
+				if depth--; depth == 0 {
+					end = j
+				}
+			}
+		}
+		if end < 0 || i+colon > end {
+			return nil, []APIError{mtError(index, "block"+name, codeInvalidFormat, fmt.Sprintf("Block %s isn't closed", name))}
+		}
+		if _, ok := messages[index][name]; ok {
+			return nil, []APIError{mtError(index, "block"+name, codeInvalidFormat, fmt.Sprintf("Block %s appears more than once", name))}
+		}
+		messages[index][name] = body[i+colon+1 : end]
+		i = end + 1
+	}
+	return messages, nil
+}
+
+// parseMT103 reads the MT103 messages in body. a problem with a block or field is reported as an error pointing at
+// it within its message, such as /messages/0/block4/32A.
+func parseMT103(body string) ([]mt103Message, []APIError) {
+	messages, errs := splitMTBlocks(body)
+	if errs != nil {
+		return nil, errs
+	}
+	if len(messages) == 0 {
+		return nil, []APIError{{Code: codeRequired, Message: "The body must contain at least one MT103 message", Pointer: "/messages"}}
+	}
+
+	parsed := make([]mt103Message, len(messages))
+	for i, blocks := range messages {
+		message := &parsed[i]
+		for _, name := range []string{"1", "2", "4"} {
+			if _, ok := blocks[name]; !ok {
+				errs = append(errs, mtError(i, "block"+name, codeRequired, fmt.Sprintf("Block %s is required", name)))
+			}
+		}
+		if basic, ok := blocks["1"]; ok {
+			if match := mtBasicHeader.FindStringSubmatch(basic); match != nil {
+				message.Sender = match[1]
+			} else {
+				errs = append(errs, mtError(i, "block1", codeInvalidFormat, "The basic header must be F01, the sender's address and the session and sequence numbers"))
+			}
+		}
+		if application, ok := blocks["2"]; ok {
+			match := mtApplicationHeader.FindStringSubmatch(application)
+			switch {
+			case match == nil:
+				errs = append(errs, mtError(i, "block2", codeInvalidFormat, "The application header must start with I or O and the message type"))
+			case match[1] != "103":
+				errs = append(errs, mtError(i, "block2", codeInvalidValue, fmt.Sprintf("The message is an MT%s, not an MT103", match[1])))
+			case application[0] == 'I' && len(application) >= 16:
+				message.Receiver = application[4:16]
+			}
+		}
+		for _, match := range mtUserField.FindAllStringSubmatch(blocks["3"], -1) {
+			if match[1] == "121" {
+				message.UETR = match[2]
+			}
+		}
+
+		text, ok := blocks["4"]
+		if !ok {
+			continue
+		}
+		text = strings.Replace(text, "\r\n", "\n", -1)
+		if len(text) < len("\n\n-") || !strings.HasPrefix(text, "\n") || !strings.HasSuffix(text, "\n-") {
+			errs = append(errs, mtError(i, "block4", codeInvalidFormat, "The text block must start with a new line and end with a line of -"))
+			continue
+		}
+		for _, line := range strings.Split(text[1:len(text)-2], "\n") {
+			if match := mtFieldStart.FindStringSubmatch(line); match != nil {
+				message.Fields = append(message.Fields, mtField{Tag: match[1], Value: line[len(match[0]):]})
+				continue
+			}
+			if len(message.Fields) == 0 {
+				errs = append(errs, mtError(i, "block4", codeInvalidFormat, "The text block must start with a field"))
+				break
+			}
+			message.Fields[len(message.Fields)-1].Value += "\n" + line
+		}
+	}
+	return parsed, errs
+}
+
+// mt103Reader reads the fields of a message into a payment, collecting an error against each field that isn't valid
+type mt103Reader struct {
+	index int
+	errs  []APIError
+}
+
+func (reader *mt103Reader) add(tag, code, message string) {
+	reader.errs = append(reader.errs, mtError(reader.index, "block4/"+tag, code, message))
+}
+
+// lines splits a multi-line field, checking it has at most max lines of the line width
+func (reader *mt103Reader) lines(field mtField, max int) []string {
+	lines := strings.Split(field.Value, "\n")
+	if len(lines) > max {
+		reader.add(field.Tag, codeInvalidFormat, fmt.Sprintf("Field %s can have at most %d lines", field.Tag, max))
+	}
+	for _, line := range lines {
+		if len(line) > mtLineWidth {
+			reader.add(field.Tag, codeInvalidFormat, fmt.Sprintf("The lines of field %s can be at most %d characters", field.Tag, mtLineWidth))
+			break
+		}
+	}
+	return lines
+}
+
+// party reads a debtor or beneficiary from its account, name and address
+func (reader *mt103Reader) party(field mtField, party *DebtorParty) {
+	lines := reader.lines(field, 5)
+	if strings.HasPrefix(lines[0], "/") {
+		party.AccountNumber, lines = lines[0][1:], lines[1:]
+		party.AccountNumberCode = "BBAN"
+		if checkIBAN(party.AccountNumber) == nil {
+			party.AccountNumberCode = "IBAN"
+		}
+	}
+	if len(lines) == 0 || lines[0] == "" {
+		reader.add(field.Tag, codeRequired, fmt.Sprintf("Field %s must have a name", field.Tag))
+		return
+	}
+
+	// MT103 has no account name, so it is the name of the party
+	party.Name, party.AccountName = lines[0], lines[0]
+	party.Address = strings.Join(lines[1:], " ")
+}
+
+// bank reads a bank identified by its BIC or by a national clearing code, and the account at the bank if given
+func (reader *mt103Reader) bank(field mtField, bank *SponsorParty) (account string) {
+	lines := reader.lines(field, 2)
+	if strings.HasSuffix(field.Tag, "A") {
+		if len(lines) == 2 && strings.HasPrefix(lines[0], "/") {
+			account, lines = lines[0][1:], lines[1:]
+		}
+		if !isBIC(lines[0]) {
+			reader.add(field.Tag, codeInvalidFormat, fmt.Sprintf("Field %s must be a BIC", field.Tag))
+		}
+		bank.BankIDCode, bank.BankID = "SWBIC", lines[0]
+		return account
+	}
+
+	if len(lines) == 2 && strings.HasPrefix(lines[0], "/") && !strings.HasPrefix(lines[0], "//") {
+		account, lines = lines[0][1:], lines[1:]
+	}
+	match := mtClearingID.FindStringSubmatch(lines[0])
+	if match != nil {
+		for bankIDCode, code := range mtClearingCodes {
+			if code == match[1] {
+				bank.BankIDCode, bank.BankID = bankIDCode, match[2]
+				return account
+			}
+		}
+	}
+	reader.add(field.Tag, codeInvalidValue, fmt.Sprintf("Field %s must be a national clearing code, such as //SC and a sort code", field.Tag))
+	return account
+}
+
+// currencyAmount reads a field of a currency and an amount
+func (reader *mt103Reader) currencyAmount(field mtField) (string, Decimal) {
+	match := mtCurrencyAmount.FindStringSubmatch(field.Value)
+	if match == nil || !mtDecimal.MatchString(match[2]) {
+		reader.add(field.Tag, codeInvalidFormat, fmt.Sprintf("Field %s must be a currency and an amount with a decimal comma", field.Tag))
+		return "", Decimal{}
+	}
+	return match[1], mtDecimalOf(match[2])
+}
+
+// unmarshalMT103 reads a payment from the fields of an MT103 message, for an organisation. the payment's ID is the
+// UETR of the message, or a new one if it has none. the payment is checked when it is created, not here.
+func unmarshalMT103(message mt103Message, index int, organisationID uuid.UUID) (Payment, []APIError) {
+	reader := &mt103Reader{index: index}
+	payment := Payment{Type: "Payment", ID: uuid.NewV4(), OrganisationID: organisationID}
+	if message.UETR != "" {
+		id, err := uuid.FromString(message.UETR)
+		if err != nil {
+			reader.errs = append(reader.errs, mtError(index, "block3/121", codeInvalidFormat, "The UETR must be a UUID"))
+		}
+		payment.ID = id
+	}
+
+	attributes := &payment.Attributes
+	attributes.PaymentScheme = "SWIFT"
+	attributes.PaymentType = "Credit"
+	attributes.DebtorParty = DebtorParty{SponsorParty: &SponsorParty{}}
+	attributes.BeneficiaryParty = BeneficiaryParty{DebtorParty: &DebtorParty{SponsorParty: &SponsorParty{}}}
+	charges := &attributes.ChargesInformation
+	charges.SenderCharges = []Charge{}
+
+	seen := map[string]bool{}
+	for _, field := range message.Fields {
+		number, option := field.Tag[:2], field.Tag[2:]
+		options, known := mt103Fields[number]
+		if !known {
+			continue
+		}
+		supported := false
+		for _, supportedOption := range options {
+			supported = supported || option == supportedOption
+		}
+		switch {
+		case !supported:
+			reader.add(field.Tag, codeInvalidValue, fmt.Sprintf("Option %s of field %s isn't supported", option, number))
+			continue
+		case seen[field.Tag] && field.Tag != "71F":
+			reader.add(field.Tag, codeInvalidFormat, fmt.Sprintf("Field %s appears more than once", field.Tag))
+			continue
+		case !mtCharacters.MatchString(field.Value):
+			reader.add(field.Tag, codeInvalidFormat, fmt.Sprintf("Field %s can only contain SWIFT characters", field.Tag))
+			continue
+		}
+		seen[field.Tag] = true
+
+		switch field.Tag {
+		case "20":
+			if !mtReference.MatchString(field.Value) || strings.HasPrefix(field.Value, "/") || strings.HasSuffix(field.Value, "/") || strings.Contains(field.Value, "//") {
+				reader.add(field.Tag, codeInvalidFormat, "Field 20 must be 1 to 16 characters, without leading, trailing or double slashes")
+			}
+			attributes.NumericReference = field.Value
+		case "23B":
+			known := false
+			for _, code := range mtBankOperationCodes {
+				known = known || field.Value == code
+			}
+			if !known {
+				reader.add(field.Tag, codeInvalidValue, "Field 23B must be one of "+strings.Join(mtBankOperationCodes, ", "))
+			}
+		case "32A":
+			match := mtValueDateAmount.FindStringSubmatch(field.Value)
+			if match == nil || !mtDecimal.MatchString(match[3]) {
+				reader.add(field.Tag, codeInvalidFormat, "Field 32A must be a YYMMDD date, a currency and an amount with a decimal comma")
+				break
+			}
+			date, err := time.Parse("060102", match[1])
+			if err != nil {
+				reader.add(field.Tag, codeInvalidFormat, "The value date of field 32A isn't a date")
+			}
+			attributes.ProcessingDate = date.Format("2006-01-02")
+			attributes.Currency, attributes.Amount = match[2], mtDecimalOf(match[3])
+		case "33B":
+			attributes.FX.OriginalCurrency, attributes.FX.OriginalAmount = reader.currencyAmount(field)
+		case "36":
+			if !mtRate.MatchString(field.Value) || !mtDecimal.MatchString(field.Value) {
+				reader.add(field.Tag, codeInvalidFormat, "Field 36 must be a rate with a decimal comma")
+				break
+			}
+			attributes.FX.ExchangeRate = mtDecimalOf(field.Value)
+		case "50K":
+			reader.party(field, &attributes.DebtorParty)
+		case "59":
+			reader.party(field, attributes.BeneficiaryParty.DebtorParty)
+		case "52A", "52D":
+			reader.bank(field, attributes.DebtorParty.SponsorParty)
+		case "56A", "56C":
+			attributes.SponsorParty.AccountNumber = reader.bank(field, &attributes.SponsorParty)
+		case "57A", "57C":
+			reader.bank(field, attributes.BeneficiaryParty.DebtorParty.SponsorParty)
+		case "70":
+			lines := reader.lines(field, 4)
+			if strings.HasPrefix(lines[0], "/ROC/") {
+				attributes.EndToEndReference, lines = strings.TrimPrefix(lines[0], "/ROC/"), lines[1:]
+			}
+			attributes.Reference = strings.Join(lines, " ")
+		case "71A":
+			for bearerCode, code := range mtChargeCodes {
+				if code == field.Value {
+					charges.BearerCode = bearerCode
+				}
+			}
+			if charges.BearerCode == "" {
+				reader.add(field.Tag, codeInvalidValue, "Field 71A must be SHA, OUR or BEN")
+			}
+		case "71F":
+			currency, amount := reader.currencyAmount(field)
+			charges.SenderCharges = append(charges.SenderCharges, Charge{Amount: amount, Currency: currency})
+		case "71G":
+			charges.ReceiverChargesCurrency, charges.ReceiverChargesAmount = reader.currencyAmount(field)
+		case "72":
+			reader.information(field, attributes)
+		}
+	}
+	for _, tag := range mt103RequiredFields {
+		if !seen[tag] {
+			reader.add(tag, codeRequired, fmt.Sprintf("Field %s is required", tag))
+		}
+	}
+
+	// the charges fields that can be given depend on who bears the charges, and need the instructed amount
+	switch chargeCode := mtChargeCodes[charges.BearerCode]; {
+	case chargeCode == "OUR" && seen["71F"]:
+		reader.add("71F", codeInvalidValue, "Field 71F isn't allowed with 71A OUR")
+	case chargeCode == "BEN" && !seen["71F"]:
+		reader.add("71F", codeRequired, "Field 71F is required with 71A BEN")
+	}
+	if seen["71G"] && seen["71A"] && mtChargeCodes[charges.BearerCode] != "OUR" {
+		reader.add("71G", codeInvalidValue, "Field 71G is only allowed with 71A OUR")
+	}
+	if (seen["71F"] || seen["71G"]) && !seen["33B"] {
+		reader.add("33B", codeRequired, "Field 33B is required with 71F or 71G")
+	}
+
+	// without an exchange rate the instructed amount in the payment currency isn't a conversion
+	if fx := &attributes.FX; fx.ExchangeRate.IsEmpty() && fx.OriginalCurrency == attributes.Currency {
+		fx.OriginalCurrency, fx.OriginalAmount = "", Decimal{}
+	}
+	return payment, reader.errs
+}
+
+// information reads the code words of the sender to receiver information, each continued on lines starting //
+func (reader *mt103Reader) information(field mtField, attributes *Attributes) {
+	values := map[string]*string{
+		"PAYID": &attributes.PaymentID,
+		"PURP":  &attributes.PaymentPurpose,
+		"FXREF": &attributes.FX.ContractReference,
+	}
+	var value *string
+	for _, line := range reader.lines(field, 6) {
+		if strings.HasPrefix(line, "//") {
+			if value != nil {
+				*value += line[2:]
+			}
+			continue
+		}
+		value = nil
+		if match := mtCodeWord.FindStringSubmatch(line); match != nil {
+			if value = values[match[1]]; value != nil {
+				*value = match[2]
+			}
+		}
+	}
+}
+
+// business logic for GET /v1/payments/{id}/mt103 endpoint, which returns the payment as an MT103 message. attributes
+// that can't be written to one are reported as errors against them.
+func (api *api) getPaymentMT103(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	payment, err := api.storeFor(r).Get(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	message, errs := marshalMT103(payment)
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+	w.Header().Set("Content-Type", mt103ContentType)
+	w.Header().Set("ETag", versionETag(payment.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(message))
+}
+
+// business logic for POST /v1/payments/import/mt103 endpoint. retries with the same Idempotency-Key get the original
+// response.
+func (api *api) importMT103(w http.ResponseWriter, r *http.Request) {
+	api.withIdempotencyKey(w, r, api.insertMT103)
+}
+
+// create a payment from each MT103 message in the body, as an atomic batch, so that the messages are imported
+// completely or not at all. the payments are for the organisation of the API key, or the organisation_id parameter.
+func (api *api) insertMT103(store PaymentStore, w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := importOrganisation(w, r)
+	if !ok {
+		return
+	}
+
+	body, ok := readBody(w, r, maxImportBodySize, "invalid_body")
+	if !ok {
+		return
+	}
+	messages, errs := parseMT103(string(body))
+	if len(messages) > maxBatchSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "batch_too_large", fmt.Sprintf("A request can contain at most %d messages", maxBatchSize))
+		return
+	}
+	payments := make([]Payment, len(messages))
+	for i, message := range messages {
+		var messageErrs []APIError
+		payments[i], messageErrs = unmarshalMT103(message, i, organisationID)
+		errs = append(errs, messageErrs...)
+	}
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+
+	items := make([]json.RawMessage, len(payments))
+	for i, payment := range payments {
+		var err error
+		if items[i], err = json.Marshal(payment); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	api.processBatch(store, w, r, BatchModeAtomic, items)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createSWIFTPayment returns an example cross-border payment, between banks identified by their BICs
+func createSWIFTPayment() Payment {
+	payment := createExamplePayment()
+	attributes := &payment.Attributes
+	attributes.PaymentScheme = "SWIFT"
+	attributes.Currency = "USD"
+	attributes.Amount = MustParseDecimal("1234.50")
+	attributes.SchemePaymentType = ""
+	attributes.SchemePaymentSubType = ""
+	attributes.DebtorParty.SponsorParty = &SponsorParty{AccountNumber: "GB29NWBK60161331926819", BankID: "NWBKGB2L", BankIDCode: "SWBIC"}
+	attributes.DebtorParty.AccountNumberCode = "IBAN"
+	attributes.BeneficiaryParty.SponsorParty = &SponsorParty{AccountNumber: "12345678", BankID: "CHASUS33XXX", BankIDCode: "SWBIC"}
+	attributes.FX = FX{ContractReference: "FX123", ExchangeRate: MustParseDecimal("1.23450"), OriginalAmount: MustParseDecimal("1000.00"), OriginalCurrency: "GBP"}
+
+	// the charges are shared, so only the sender's are given
+	attributes.ChargesInformation.ReceiverChargesAmount = Decimal{}
+	attributes.ChargesInformation.ReceiverChargesCurrency = ""
+	return payment
+}
+
+// sendMT103 imports MT103 messages as the payments of an organisation
+func sendMT103(t *testing.T, query, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments/import/mt103"+query, bytes.NewBufferString(body))
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestMarshalMT103(t *testing.T) {
+
+	payment := createSWIFTPayment()
+	message, errs := marshalMT103(payment)
+	require.Empty(t, errs)
+
+	assert.Equal(t, "{1:F01NWBKGB2LXXXX0000000000}{2:I103CHASUS33XXXXN}{3:{121:"+payment.ID.String()+"}}{4:\r\n"+
+		":20:1012321\r\n"+
+		":23B:CRED\r\n"+
+		":32A:170118USD1234,50\r\n"+
+		":33B:GBP1000,00\r\n"+
+		":36:1,23450\r\n"+
+		":50K:/GB29NWBK60161331926819\r\nMangoes Incorporated\r\n124 Main Street\r\n"+
+		":52A:NWBKGB2L\r\n"+
+		":56C:/10101010\r\n//SC203302\r\n"+
+		":57A:CHASUS33XXX\r\n"+
+		":59:/12345678\r\nLiam Galvin\r\n123 Main Street\r\n"+
+		":70:/ROC/payment for mangoes\r\nPayment for Em's mangoes\r\n"+
+		":71A:SHA\r\n"+
+		":71F:GBP0,50\r\n"+
+		":71F:USD0,10\r\n"+
+		":72:/PAYID/123456789012345678\r\n/PURP/Paying for goods/services\r\n/FXREF/FX123\r\n"+
+		"-}", message)
+}
+
+func TestMarshalMT103ChargeCodes(t *testing.T) {
+
+	for bearerCode, code := range map[string]string{"SHAR": "SHA", "DEBT": "OUR", "CRED": "BEN"} {
+		payment := createSWIFTPayment()
+		payment.Attributes.ChargesInformation.BearerCode = bearerCode
+		if bearerCode == "DEBT" {
+			payment.Attributes.ChargesInformation.SenderCharges = []Charge{}
+		}
+		message, errs := marshalMT103(payment)
+		require.Empty(t, errs)
+		assert.Contains(t, message, "\r\n:71A:"+code+"\r\n")
+	}
+}
+
+func TestMarshalMT103ChargeFields(t *testing.T) {
+
+	for name, test := range map[string]struct {
+		bearerCode      string
+		senderCharges   bool
+		receiverCharges bool
+		pointers        map[string]string
+		fields          []string
+	}{
+		"the debtor's bank can give receiver charges": {
+			bearerCode:      "DEBT",
+			receiverCharges: true,
+			fields:          []string{":71A:OUR", ":71G:GBP1,00"},
+		},
+		"the debtor bears every charge": {
+			bearerCode:    "DEBT",
+			senderCharges: true,
+			pointers:      map[string]string{"/attributes/charges_information/sender_charges": codeInvalidValue},
+		},
+		"receiver charges are only for the debtor": {
+			bearerCode:      "SHAR",
+			senderCharges:   true,
+			receiverCharges: true,
+			pointers:        map[string]string{"/attributes/charges_information/receiver_charges_amount": codeInvalidValue},
+		},
+		"the beneficiary is told what the sender charged": {
+			bearerCode: "CRED",
+			pointers:   map[string]string{"/attributes/charges_information/sender_charges": codeRequired},
+		},
+		"there may be no charges": {
+			bearerCode: "SHAR",
+			fields:     []string{":71A:SHA\r\n:72:"},
+		},
+	} {
+		payment := createSWIFTPayment()
+		payment.Attributes.FX = FX{}
+		charges := &payment.Attributes.ChargesInformation
+		charges.BearerCode = test.bearerCode
+		if !test.senderCharges {
+			charges.SenderCharges = []Charge{}
+		}
+		if test.receiverCharges {
+			charges.ReceiverChargesAmount, charges.ReceiverChargesCurrency = MustParseDecimal("1.00"), "GBP"
+		}
+		message, errs := marshalMT103(payment)
+		if test.pointers == nil {
+			test.pointers = map[string]string{}
+		}
+		assert.Equal(t, test.pointers, errorPointers(errs), name)
+		for _, field := range test.fields {
+			assert.Contains(t, message, field, name)
+		}
+
+		// charges need the instructed amount, which is the amount when it isn't converted
+		if len(errs) == 0 {
+			assert.Equal(t, test.senderCharges || test.receiverCharges, strings.Contains(message, ":33B:USD1234,50\r\n"), name)
+		}
+	}
+}
+
+func TestMarshalMT103ReportsAttributesItCantWrite(t *testing.T) {
+
+	payment := createSWIFTPayment()
+	payment.Attributes.ChargesInformation.BearerCode = "SLEV"
+	payment.Attributes.NumericReference = "/12345678901234567"
+	payment.Attributes.BeneficiaryParty.SponsorParty = &SponsorParty{AccountNumber: "12345678", BankID: "203301", BankIDCode: "GBDSC"}
+	payment.Attributes.DebtorParty.Name = "Mangoes & Co"
+	_, errs := marshalMT103(payment)
+
+	assert.Equal(t, map[string]string{
+		"/attributes/charges_information/bearer_code": codeInvalidValue,
+		"/attributes/numeric_reference":               codeInvalidFormat,
+		"/attributes/beneficiary_party/bank_id_code":  codeInvalidValue,
+		"/attributes/debtor_party":                    codeInvalidFormat,
+	}, errorPointers(errs))
+
+	payment = createSWIFTPayment()
+	payment.Attributes.PaymentType = "Debit"
+	_, errs = marshalMT103(payment)
+	assert.Equal(t, map[string]string{"/attributes/payment_type": codeInvalidValue}, errorPointers(errs))
+}
+
+func TestMT103RoundTrips(t *testing.T) {
+
+	payment := createSWIFTPayment()
+	payment.Attributes.Reference = strings.Repeat("a long reference ", 6)
+	payment.Attributes.PaymentPurpose = "A purpose that needs more than one line of field 72"
+	message, errs := marshalMT103(payment)
+	require.Empty(t, errs)
+
+	messages, errs := parseMT103(message)
+	require.Empty(t, errs)
+	require.Len(t, messages, 1)
+	parsed, errs := unmarshalMT103(messages[0], 0, payment.OrganisationID)
+	require.Empty(t, errs)
+
+	expected := payment.Attributes
+	expected.Reference = strings.TrimSpace(expected.Reference)
+	expected.DebtorParty.AccountName = expected.DebtorParty.Name
+	expected.BeneficiaryParty.AccountName = expected.BeneficiaryParty.Name
+	expected.BeneficiaryParty.AccountNumberCode = "BBAN"
+	assert.Equal(t, payment.ID, parsed.ID)
+	assert.Equal(t, payment.OrganisationID, parsed.OrganisationID)
+	assert.Equal(t, mustMarshal(t, expected), mustMarshal(t, parsed.Attributes))
+}
+
+func TestParseMT103Errors(t *testing.T) {
+
+	message, errs := marshalMT103(createSWIFTPayment())
+	require.Empty(t, errs)
+
+	// the messages can be separated by whitespace, and their text blocks can use LF line endings
+	_, errs = parseMT103(message + "\n" + strings.Replace(message, "\r\n", "\n", -1) + "\n")
+	assert.Empty(t, errs)
+
+	for name, test := range map[string]struct {
+		message  string
+		pointers map[string]string
+	}{
+		"unclosed block": {
+			message:  strings.TrimSuffix(message, "}"),
+			pointers: map[string]string{"/messages/0/block4": codeInvalidFormat},
+		},
+		"empty text block": {
+			message: "{1:F01AAAAGB2LAXXX0000000000}{2:I103BBBBGB2LXXXXN}{4:\n-}",
+			pointers: map[string]string{
+				"/messages/0/block4":     codeInvalidFormat,
+				"/messages/0/block4/20":  codeRequired,
+				"/messages/0/block4/23B": codeRequired,
+				"/messages/0/block4/32A": codeRequired,
+				"/messages/0/block4/50K": codeRequired,
+				"/messages/0/block4/59":  codeRequired,
+				"/messages/0/block4/71A": codeRequired,
+			},
+		},
+		"not an MT103": {
+			message:  strings.Replace(message, "{2:I103", "{2:I202", 1),
+			pointers: map[string]string{"/messages/0/block2": codeInvalidValue},
+		},
+		"missing blocks": {
+			message:  message[strings.Index(message, "{3:"):],
+			pointers: map[string]string{"/messages/0/block1": codeRequired, "/messages/0/block2": codeRequired},
+		},
+		"invalid UETR": {
+			message:  strings.Replace(message, "{121:", "{121:x", 1),
+			pointers: map[string]string{"/messages/0/block3/121": codeInvalidFormat},
+		},
+		"invalid fields": {
+			message: strings.NewReplacer(
+				":32A:170118USD1234,50", ":32A:171318USD1234,50",
+				":71A:SHA", ":71A:XYZ",
+				":20:1012321\r\n", "",
+				":59:/12345678", ":59F:/12345678",
+				":71F:GBP0,50", ":71F:GBP0.50",
+			).Replace(message),
+			pointers: map[string]string{
+				"/messages/0/block4/20":  codeRequired,
+				"/messages/0/block4/32A": codeInvalidFormat,
+				"/messages/0/block4/59":  codeRequired,
+				"/messages/0/block4/59F": codeInvalidValue,
+				"/messages/0/block4/71A": codeInvalidValue,
+				"/messages/0/block4/71F": codeInvalidFormat,
+			},
+		},
+		"charges for the wrong bearer": {
+			message: strings.NewReplacer(
+				":71A:SHA", ":71A:OUR",
+				":72:", ":71G:GBP1,00\r\n:72:",
+			).Replace(message),
+			pointers: map[string]string{"/messages/0/block4/71F": codeInvalidValue},
+		},
+		"receiver charges without OUR": {
+			message:  strings.Replace(message, ":72:", ":71G:GBP1,00\r\n:72:", 1),
+			pointers: map[string]string{"/messages/0/block4/71G": codeInvalidValue},
+		},
+		"BEN without sender charges": {
+			message:  strings.NewReplacer(":71A:SHA", ":71A:BEN", ":71F:GBP0,50\r\n", "", ":71F:USD0,10\r\n", "").Replace(message),
+			pointers: map[string]string{"/messages/0/block4/71F": codeRequired},
+		},
+		"charges without the instructed amount": {
+			message:  strings.NewReplacer(":33B:GBP1000,00\r\n", "", ":36:1,23450\r\n", "").Replace(message),
+			pointers: map[string]string{"/messages/0/block4/33B": codeRequired},
+		},
+	} {
+		messages, errs := parseMT103(test.message)
+		for i, parsed := range messages {
+			_, messageErrs := unmarshalMT103(parsed, i, uuid.NewV4())
+			errs = append(errs, messageErrs...)
+		}
+		assert.Equal(t, test.pointers, errorPointers(errs), name)
+	}
+}
+
+func TestGetPaymentMT103(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createSWIFTPayment()
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	rw := sendAs(t, "", http.MethodGet, "/v1/payments/"+payment.ID.String()+"/mt103", nil)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	assert.Equal(t, "text/plain; charset=us-ascii", rw.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(rw.Body.String(), "{1:F01NWBKGB2LXXXX"))
+
+	// a payment without BICs, or with receiver charges when the charges are shared, can't be sent over SWIFT, which is
+	// reported against its attributes
+	faster := createExamplePayment()
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", faster).Code)
+	rw = sendAs(t, "", http.MethodGet, "/v1/payments/"+faster.ID.String()+"/mt103", nil)
+	assert.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{
+		"/attributes/debtor_party/bank_id_code":                   codeInvalidValue,
+		"/attributes/beneficiary_party/bank_id_code":              codeInvalidValue,
+		"/attributes/charges_information/receiver_charges_amount": codeInvalidValue,
+	}, errorPointers(response.Errors))
+
+	assert.Equal(t, 404, sendAs(t, "", http.MethodGet, "/v1/payments/"+uuid.NewV4().String()+"/mt103", nil).Code)
+}
+
+func TestImportMT103(t *testing.T) {
+
+	emptyDatabase(t)
+
+	first, second := createSWIFTPayment(), createSWIFTPayment()
+	second.Attributes.Amount = MustParseDecimal("20.00")
+	second.Attributes.FX = FX{}
+	var body []string
+	for _, payment := range []Payment{first, second} {
+		message, errs := marshalMT103(payment)
+		require.Empty(t, errs)
+		body = append(body, message)
+	}
+
+	organisationID := uuid.NewV4()
+	rw := sendMT103(t, "?organisation_id="+organisationID.String(), strings.Join(body, "\r\n"))
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var batch PaymentBatch
+	require.Nil(t, json.Unmarshal(response.Data, &batch))
+	assert.Equal(t, BatchModeAtomic, batch.Mode)
+	assert.Equal(t, 2, batch.Created)
+
+	rw = sendAs(t, "", http.MethodGet, "/v1/payments/"+second.ID.String(), nil)
+	require.Equal(t, 200, rw.Code)
+	payment, _ := decodePaymentResponse(t, rw)
+	assert.Equal(t, organisationID, payment.OrganisationID)
+	assert.Equal(t, "SWIFT", payment.Attributes.PaymentScheme)
+	assert.Equal(t, "20.00", payment.Attributes.Amount.String())
+	assert.Equal(t, "SHAR", payment.Attributes.ChargesInformation.BearerCode)
+	assert.True(t, payment.Attributes.FX.ExchangeRate.IsEmpty())
+
+	// a message with invalid fields imports nothing, and its errors point at the fields
+	message := strings.Replace(body[0], ":23B:CRED", ":23B:XXXX", 1)
+	rw = sendMT103(t, "?organisation_id="+organisationID.String(), body[1]+message)
+	assert.Equal(t, 422, rw.Code)
+	response = APIResponse{}
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/messages/1/block4/23B": codeInvalidValue}, errorPointers(response.Errors))
+
+	assert.Equal(t, 400, sendMT103(t, "", body[0]).Code)
+}
+
+func TestImportMT103IsForTheKeysOrganisation(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createSWIFTPayment()
+	message, errs := marshalMT103(payment)
+	require.Empty(t, errs)
+	_, key := createAPIKey(t, payment.OrganisationID, RoleOperator)
+
+	assert.Equal(t, 403, sendWithKey(t, key, http.MethodPost, "/v1/payments/import/mt103?organisation_id="+uuid.NewV4().String(), []byte(message)).Code)
+	require.Equal(t, 201, sendWithKey(t, key, http.MethodPost, "/v1/payments/import/mt103", []byte(message)).Code)
+	stored, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, payment.OrganisationID, stored.OrganisationID)
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// payments are exchanged with partner banks as ISO 20022 FIToFICustomerCreditTransfer messages, version 08
+const (
+	pacs008Profile   = "pacs.008"
+	pacs008MediaType = "application/xml; profile=" + pacs008Profile
+)
+
+// pacs008Document is a pacs.008 message. each transaction is a payment.
+type pacs008Document struct {
+	XMLName      xml.Name             `xml:"urn:iso:std:iso:20022:tech:xsd:pacs.008.001.08 Document"`
+	GroupHeader  pacs008GroupHeader   `xml:"FIToFICstmrCdtTrf>GrpHdr"`
+	Transactions []pacs008Transaction `xml:"FIToFICstmrCdtTrf>CdtTrfTxInf"`
+}
+
+type pacs008GroupHeader struct {
+	MessageID            string            `xml:"MsgId"`
+	CreatedAt            string            `xml:"CreDtTm"`
+	NumberOfTransactions string            `xml:"NbOfTxs"`
+	Settlement           pacs008Settlement `xml:"SttlmInf"`
+}
+
+// pacs008Settlement is how the payments are settled, which is through the clearing system of their payment scheme
+type pacs008Settlement struct {
+	Method         string              `xml:"SttlmMtd"`
+	ClearingSystem *pacs008Proprietary `xml:"ClrSys,omitempty"`
+}
+
+type pacs008Transaction struct {
+	PaymentID           pacs008PaymentID      `xml:"PmtId"`
+	PaymentType         *pacs008PaymentType   `xml:"PmtTpInf,omitempty"`
+	SettlementAmount    pacs008Amount         `xml:"IntrBkSttlmAmt"`
+	SettlementDate      string                `xml:"IntrBkSttlmDt,omitempty"`
+	InstructedAmount    *pacs008Amount        `xml:"InstdAmt,omitempty"`
+	ExchangeRate        string                `xml:"XchgRate,omitempty"`
+	ChargeBearer        string                `xml:"ChrgBr"`
+	Charges             []pacs008Charge       `xml:"ChrgsInf"`
+	Intermediary        *pacs008Agent         `xml:"IntrmyAgt1,omitempty"`
+	IntermediaryAccount *pacs008Account       `xml:"IntrmyAgt1Acct,omitempty"`
+	Debtor              pacs008Party          `xml:"Dbtr"`
+	DebtorAccount       pacs008Account        `xml:"DbtrAcct"`
+	DebtorAgent         pacs008Agent          `xml:"DbtrAgt"`
+	CreditorAgent       pacs008Agent          `xml:"CdtrAgt"`
+	Creditor            pacs008Party          `xml:"Cdtr"`
+	CreditorAccount     pacs008Account        `xml:"CdtrAcct"`
+	Purpose             *pacs008Proprietary   `xml:"Purp,omitempty"`
+	Remittance          *pacs008Remittance    `xml:"RmtInf,omitempty"`
+	Supplementary       *pacs008Supplementary `xml:"SplmtryData,omitempty"`
+}
+
+type pacs008PaymentID struct {
+	InstructionID string `xml:"InstrId,omitempty"`
+	EndToEndID    string `xml:"EndToEndId"`
+	TransactionID string `xml:"TxId,omitempty"`
+	UETR          string `xml:"UETR,omitempty"`
+}
+
+type pacs008PaymentType struct {
+	LocalInstrument *pacs008Proprietary `xml:"LclInstrm,omitempty"`
+	CategoryPurpose *pacs008Proprietary `xml:"CtgyPurp,omitempty"`
+}
+
+type pacs008Proprietary struct {
+	Proprietary string `xml:"Prtry"`
+}
+
+type pacs008Amount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type pacs008Charge struct {
+	Amount pacs008Amount `xml:"Amt"`
+	Agent  pacs008Agent  `xml:"Agt"`
+}
+
+type pacs008Party struct {
+	Name        string   `xml:"Nm,omitempty"`
+	AddressLine []string `xml:"PstlAdr>AdrLine,omitempty"`
+}
+
+type pacs008Account struct {
+	IBAN  string        `xml:"Id>IBAN,omitempty"`
+	Other *pacs008Other `xml:"Id>Othr,omitempty"`
+	Name  string        `xml:"Nm,omitempty"`
+}
+
+type pacs008Other struct {
+	ID     string `xml:"Id"`
+	Scheme string `xml:"SchmeNm>Cd,omitempty"`
+}
+
+// pacs008Agent is a bank, identified by its BIC or by its member ID in a clearing system, such as a sort code
+type pacs008Agent struct {
+	BIC            string                 `xml:"FinInstnId>BICFI,omitempty"`
+	ClearingSystem *pacs008ClearingMember `xml:"FinInstnId>ClrSysMmbId,omitempty"`
+}
+
+type pacs008ClearingMember struct {
+	SystemCode string `xml:"ClrSysId>Cd"`
+	MemberID   string `xml:"MmbId"`
+}
+
+type pacs008Remittance struct {
+	Unstructured string `xml:"Ustrd"`
+}
+
+type pacs008Supplementary struct {
+	Envelope pacs008Attributes `xml:"Envlp>PmtAttrs"`
+}
+
+// pacs008Attributes are the payment attributes that pacs.008 has no element for, sent as supplementary data in a
+// namespace of our own
+type pacs008Attributes struct {
+	XMLName                xml.Name `xml:"urn:form3:payments:pacs.008 PmtAttrs"`
+	FXContractReference    string   `xml:"FxCtrctRef,omitempty"`
+	BeneficiaryAccountType int      `xml:"BnfcryAcctTp"`
+
+	// the position, from 1, of the ChrgsInf that is the receiver's charges. the agents can't tell when the debtor and
+	// beneficiary have the same bank.
+	ReceiverCharges int `xml:"RcvrChrgs,omitempty"`
+}
+
+// acceptsPacs008 reports whether a request asks for payments as pacs.008 messages
+func acceptsPacs008(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == "application/xml" && params["profile"] == pacs008Profile {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalPacs008 writes a payment as a pacs.008 message with a single transaction. the lifecycle of the payment, such
+// as its status and approval, isn't part of the message.
+func marshalPacs008(payment Payment, now time.Time) ([]byte, error) {
+	attributes := payment.Attributes
+	debtor := partyOf(&attributes.DebtorParty)
+	beneficiary := partyOf(attributes.BeneficiaryParty.DebtorParty)
+
+	transaction := pacs008Transaction{
+		PaymentID: pacs008PaymentID{
+			InstructionID: attributes.NumericReference,
+			EndToEndID:    attributes.EndToEndReference,
+			TransactionID: attributes.PaymentID,
+			UETR:          payment.ID.String(),
+		},
+		SettlementAmount: pacs008Amount{Currency: attributes.Currency, Value: attributes.Amount.String()},
+		SettlementDate:   attributes.ProcessingDate,
+		ChargeBearer:     attributes.ChargesInformation.BearerCode,
+		Debtor:           pacs008PartyOf(debtor),
+		DebtorAccount:    pacs008AccountOf(debtor.AccountNumberCode, debtor.AccountNumber, debtor.AccountName),
+		DebtorAgent:      pacs008AgentOf(debtor.BankIDCode, debtor.BankID),
+		CreditorAgent:    pacs008AgentOf(beneficiary.BankIDCode, beneficiary.BankID),
+		Creditor:         pacs008PartyOf(beneficiary),
+		CreditorAccount:  pacs008AccountOf(beneficiary.AccountNumberCode, beneficiary.AccountNumber, beneficiary.AccountName),
+		Supplementary: &pacs008Supplementary{Envelope: pacs008Attributes{
+			FXContractReference:    attributes.FX.ContractReference,
+			BeneficiaryAccountType: attributes.BeneficiaryParty.AccountType,
+		}},
+	}
+	if transaction.PaymentID.EndToEndID == "" {
+		// the end to end ID is required, and this is what the standard says to send when there is none
+		transaction.PaymentID.EndToEndID = "NOTPROVIDED"
+	}
+	if attributes.SchemePaymentType != "" || attributes.SchemePaymentSubType != "" {
+		transaction.PaymentType = &pacs008PaymentType{
+			LocalInstrument: proprietaryOf(attributes.SchemePaymentType),
+			CategoryPurpose: proprietaryOf(attributes.SchemePaymentSubType),
+		}
+	}
+	if fx := attributes.FX; !fx.OriginalAmount.IsEmpty() {
+		transaction.InstructedAmount = &pacs008Amount{Currency: fx.OriginalCurrency, Value: fx.OriginalAmount.String()}
+		transaction.ExchangeRate = fx.ExchangeRate.String()
+	}
+
+	// sender charges are taken by the debtor's bank and receiver charges by the beneficiary's
+	charges := attributes.ChargesInformation
+	for _, charge := range charges.SenderCharges {
+		transaction.Charges = append(transaction.Charges, pacs008Charge{
+			Amount: pacs008Amount{Currency: charge.Currency, Value: charge.Amount.String()},
+			Agent:  transaction.DebtorAgent,
+		})
+	}
+	if !charges.ReceiverChargesAmount.IsEmpty() {
+		transaction.Charges = append(transaction.Charges, pacs008Charge{
+			Amount: pacs008Amount{Currency: charges.ReceiverChargesCurrency, Value: charges.ReceiverChargesAmount.String()},
+			Agent:  transaction.CreditorAgent,
+		})
+		transaction.Supplementary.Envelope.ReceiverCharges = len(transaction.Charges)
+	}
+
+	// the sponsor is the bank the debtor's bank reaches the scheme through
+	if sponsor := attributes.SponsorParty; sponsor != (SponsorParty{}) {
+		agent := pacs008AgentOf(sponsor.BankIDCode, sponsor.BankID)
+		transaction.Intermediary = &agent
+		transaction.IntermediaryAccount = &pacs008Account{Other: &pacs008Other{ID: sponsor.AccountNumber}}
+	}
+	transaction.Purpose = proprietaryOf(attributes.PaymentPurpose)
+	if attributes.Reference != "" {
+		transaction.Remittance = &pacs008Remittance{Unstructured: attributes.Reference}
+	}
+
+	document := pacs008Document{
+		GroupHeader: pacs008GroupHeader{
+			MessageID:            strings.Replace(payment.ID.String(), "-", "", -1),
+			CreatedAt:            now.UTC().Format(time.RFC3339),
+			NumberOfTransactions: "1",
+			Settlement: pacs008Settlement{
+				Method:         "CLRG",
+				ClearingSystem: proprietaryOf(attributes.PaymentScheme),
+			},
+		},
+		Transactions: []pacs008Transaction{transaction},
+	}
+	body, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// unmarshalPacs008 reads the payments of a pacs.008 message, for an organisation. each payment's ID is the UETR of
+// its transaction, or a new one if it has none. the payments are checked when they are created, not here.
+func unmarshalPacs008(body []byte, organisationID uuid.UUID) ([]Payment, error) {
+	var document pacs008Document
+	if err := xml.Unmarshal(body, &document); err != nil {
+		return nil, err
+	}
+
+	var payments []Payment
+	for i, transaction := range document.Transactions {
+		id := uuid.NewV4()
+		if transaction.PaymentID.UETR != "" {
+			var err error
+			if id, err = uuid.FromString(transaction.PaymentID.UETR); err != nil {
+				return nil, fmt.Errorf("the UETR of transaction %d is not a UUID", i)
+			}
+		}
+
+		payment := Payment{Type: "Payment", ID: id, OrganisationID: organisationID}
+		attributes := &payment.Attributes
+		attributes.Amount = decimalOf(transaction.SettlementAmount.Value)
+		attributes.Currency = transaction.SettlementAmount.Currency
+		attributes.EndToEndReference = transaction.PaymentID.EndToEndID
+		if attributes.EndToEndReference == "NOTPROVIDED" {
+			attributes.EndToEndReference = ""
+		}
+		attributes.NumericReference = transaction.PaymentID.InstructionID
+		attributes.PaymentID = transaction.PaymentID.TransactionID
+		attributes.PaymentType = "Credit"
+		attributes.PaymentScheme = proprietaryValue(document.GroupHeader.Settlement.ClearingSystem)
+		attributes.ProcessingDate = transaction.SettlementDate
+		if paymentType := transaction.PaymentType; paymentType != nil {
+			attributes.SchemePaymentType = proprietaryValue(paymentType.LocalInstrument)
+			attributes.SchemePaymentSubType = proprietaryValue(paymentType.CategoryPurpose)
+		}
+		attributes.PaymentPurpose = proprietaryValue(transaction.Purpose)
+		if transaction.Remittance != nil {
+			attributes.Reference = transaction.Remittance.Unstructured
+		}
+
+		attributes.DebtorParty = debtorPartyOf(transaction.Debtor, transaction.DebtorAccount, transaction.DebtorAgent)
+		beneficiary := debtorPartyOf(transaction.Creditor, transaction.CreditorAccount, transaction.CreditorAgent)
+		attributes.BeneficiaryParty = BeneficiaryParty{DebtorParty: &beneficiary}
+		if transaction.Intermediary != nil {
+			attributes.SponsorParty.BankIDCode, attributes.SponsorParty.BankID = transaction.Intermediary.bank()
+			if account := transaction.IntermediaryAccount; account != nil && account.Other != nil {
+				attributes.SponsorParty.AccountNumber = account.Other.ID
+			}
+		}
+
+		if instructed := transaction.InstructedAmount; instructed != nil {
+			attributes.FX.OriginalAmount = decimalOf(instructed.Value)
+			attributes.FX.OriginalCurrency = instructed.Currency
+			attributes.FX.ExchangeRate = decimalOf(transaction.ExchangeRate)
+		}
+
+		// the receiver's charges are marked in messages from us. in others they are those taken by the beneficiary's
+		// bank alone.
+		receiver := 0
+		if supplementary := transaction.Supplementary; supplementary != nil && supplementary.Envelope.ReceiverCharges > 0 {
+			receiver = supplementary.Envelope.ReceiverCharges
+		} else {
+			for i, charge := range transaction.Charges {
+				if charge.Agent.is(transaction.CreditorAgent) && !charge.Agent.is(transaction.DebtorAgent) {
+					receiver = i + 1
+				}
+			}
+		}
+		charges := &attributes.ChargesInformation
+		charges.BearerCode = transaction.ChargeBearer
+		charges.SenderCharges = []Charge{}
+		for i, charge := range transaction.Charges {
+			if i+1 == receiver {
+				charges.ReceiverChargesAmount = decimalOf(charge.Amount.Value)
+				charges.ReceiverChargesCurrency = charge.Amount.Currency
+				continue
+			}
+			charges.SenderCharges = append(charges.SenderCharges, Charge{Amount: decimalOf(charge.Amount.Value), Currency: charge.Amount.Currency})
+		}
+
+		if supplementary := transaction.Supplementary; supplementary != nil {
+			attributes.FX.ContractReference = supplementary.Envelope.FXContractReference
+			attributes.BeneficiaryParty.AccountType = supplementary.Envelope.BeneficiaryAccountType
+		}
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+// partyOf returns a debtor or beneficiary with its account, which are empty if it has none
+func partyOf(party *DebtorParty) DebtorParty {
+	if party == nil {
+		return DebtorParty{SponsorParty: &SponsorParty{}}
+	}
+	copied := *party
+	if copied.SponsorParty == nil {
+		copied.SponsorParty = &SponsorParty{}
+	}
+	return copied
+}
+
+func pacs008PartyOf(party DebtorParty) pacs008Party {
+	converted := pacs008Party{Name: party.Name}
+	if party.Address != "" {
+		converted.AddressLine = []string{party.Address}
+	}
+	return converted
+}
+
+// pacs008AccountOf identifies an account by its IBAN, or by its number in the scheme given by its account number code
+func pacs008AccountOf(accountNumberCode, accountNumber, name string) pacs008Account {
+	if accountNumberCode == "IBAN" {
+		return pacs008Account{IBAN: accountNumber, Name: name}
+	}
+	return pacs008Account{Other: &pacs008Other{ID: accountNumber, Scheme: accountNumberCode}, Name: name}
+}
+
+func pacs008AgentOf(bankIDCode, bankID string) pacs008Agent {
+	if bankIDCode == "SWBIC" {
+		return pacs008Agent{BIC: bankID}
+	}
+	return pacs008Agent{ClearingSystem: &pacs008ClearingMember{SystemCode: bankIDCode, MemberID: bankID}}
+}
+
+// bank returns the bank ID code and bank ID of an agent
+func (agent pacs008Agent) bank() (string, string) {
+	if agent.BIC != "" {
+		return "SWBIC", agent.BIC
+	}
+	if agent.ClearingSystem != nil {
+		return agent.ClearingSystem.SystemCode, agent.ClearingSystem.MemberID
+	}
+	return "", ""
+}
+
+// is reports whether two agents are the same bank
+func (agent pacs008Agent) is(other pacs008Agent) bool {
+	code, id := agent.bank()
+	otherCode, otherID := other.bank()
+	return code == otherCode && id == otherID
+}
+
+// debtorPartyOf returns the debtor or beneficiary described by a party, its account and its bank
+func debtorPartyOf(party pacs008Party, account pacs008Account, agent pacs008Agent) DebtorParty {
+	converted := DebtorParty{
+		SponsorParty: &SponsorParty{},
+		AccountName:  account.Name,
+		Address:      strings.Join(party.AddressLine, " "),
+		Name:         party.Name,
+	}
+	switch {
+	case account.IBAN != "":
+		converted.AccountNumberCode, converted.AccountNumber = "IBAN", account.IBAN
+	case account.Other != nil:
+		converted.AccountNumberCode, converted.AccountNumber = account.Other.Scheme, account.Other.ID
+	}
+	converted.BankIDCode, converted.BankID = agent.bank()
+	return converted
+}
+
+func proprietaryOf(value string) *pacs008Proprietary {
+	if value == "" {
+		return nil
+	}
+	return &pacs008Proprietary{Proprietary: value}
+}
+
+func proprietaryValue(value *pacs008Proprietary) string {
+	if value == nil {
+		return ""
+	}
+	return value.Proprietary
+}
+
+// decimalOf parses an amount or rate from a message. a value that isn't a decimal is kept as invalid, so that
+// validation reports it against its field.
+func decimalOf(s string) Decimal {
+	d, err := ParseDecimal(strings.TrimSpace(s))
+	if err != nil {
+		return Decimal{invalid: s}
+	}
+	return d
+}
+
+// writePacs008 writes a payment as a pacs.008 message, which can only describe credit transfers
+func writePacs008(w http.ResponseWriter, payment Payment) {
+	if payment.Attributes.PaymentType != "Credit" {
+		writeError(w, http.StatusNotAcceptable, "not_acceptable", "Only credit transfers can be represented as pacs.008 messages")
+		return
+	}
+	body, err := marshalPacs008(payment, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", pacs008MediaType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// the largest message body accepted by an import, which leaves plenty of room for a full batch of payments
+const maxImportBodySize = 16 << 20
+
+// importOrganisation returns the organisation imported payments are for, which is that of the API key, or the
+// organisation_id parameter when authentication is off. it writes an error and returns false when there is none.
+func importOrganisation(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	organisationID, authenticated := requestOrganisation(r)
+	if param := r.URL.Query().Get("organisation_id"); param != "" {
+		id, err := uuid.FromString(param)
+		if err != nil {
+			writeErrors(w, http.StatusBadRequest, APIError{Code: "invalid_parameter", Message: "organisation_id must be a UUID", Parameter: "organisation_id"})
+			return uuid.Nil, false
+		}
+		if authenticated && id != organisationID {
+			writeError(w, http.StatusForbidden, "forbidden_organisation", "Payments can only be made for the organisation of the API key")
+			return uuid.Nil, false
+		}
+		organisationID = id
+	}
+	if organisationID == uuid.Nil {
+		writeErrors(w, http.StatusBadRequest, APIError{Code: codeRequired, Message: "organisation_id is required", Parameter: "organisation_id"})
+		return uuid.Nil, false
+	}
+	return organisationID, true
+}
+
+// business logic for POST /v1/payments/import/pacs008 endpoint. retries with the same Idempotency-Key get the original
+// response.
+func (api *api) importPacs008(w http.ResponseWriter, r *http.Request) {
+	api.withIdempotencyKey(w, r, api.insertPacs008)
+}
+
+// create the payments of the POSTed pacs.008 message as an atomic batch, so that a message is imported completely or
+// not at all. the payments are for the organisation of the API key, or the organisation_id parameter.
+func (api *api) insertPacs008(store PaymentStore, w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := importOrganisation(w, r)
+	if !ok {
+		return
+	}
+
+	body, ok := readBody(w, r, maxImportBodySize, "invalid_xml")
+	if !ok {
+		return
+	}
+	payments, err := unmarshalPacs008(body, organisationID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_xml", "Invalid pacs.008 message: "+err.Error())
+		return
+	}
+	if len(payments) == 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, APIError{Code: codeRequired, Message: "the message must contain at least one transaction", Pointer: "/data"})
+		return
+	}
+	if len(payments) > maxBatchSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "batch_too_large", fmt.Sprintf("A message can contain at most %d transactions", maxBatchSize))
+		return
+	}
+
+	items := make([]json.RawMessage, len(payments))
+	for i, payment := range payments {
+		if items[i], err = json.Marshal(payment); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	api.processBatch(store, w, r, BatchModeAtomic, items)
+}
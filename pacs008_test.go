@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readSamplePayments reads the example payments in sample.json
+func readSamplePayments(t *testing.T) []Payment {
+	file, err := os.Open("sample.json")
+	require.Nil(t, err)
+	defer file.Close()
+	var sample struct {
+		Data []Payment `json:"data"`
+	}
+	require.Nil(t, json.NewDecoder(file).Decode(&sample))
+	require.NotEmpty(t, sample.Data)
+	return sample.Data
+}
+
+// readCreatableSamplePayments reads the example payments, with an exchange rate that converts their original amount
+// to their amount so that they can be created
+func readCreatableSamplePayments(t *testing.T) []Payment {
+	payments := readSamplePayments(t)
+	for i := range payments {
+		payments[i].Attributes.FX.ExchangeRate = MustParseDecimal("0.50000")
+	}
+	return payments
+}
+
+// sendPacs008 POSTs a pacs.008 message to the import endpoint
+func sendPacs008(t *testing.T, query string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments/import/pacs008"+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", pacs008MediaType)
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestPacs008RoundTripsSamplePayments(t *testing.T) {
+
+	for _, payment := range readSamplePayments(t) {
+		body, err := marshalPacs008(payment, time.Now())
+		require.Nil(t, err)
+		assert.Contains(t, string(body), `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pacs.008.001.08">`)
+
+		payments, err := unmarshalPacs008(body, payment.OrganisationID)
+		require.Nil(t, err)
+		require.Len(t, payments, 1)
+		assert.Equal(t, mustMarshal(t, payment), mustMarshal(t, payments[0]), string(body))
+	}
+}
+
+func TestPacs008RoundTripsReceiverChargesAtTheSameBank(t *testing.T) {
+
+	payment := readSamplePayments(t)[0]
+	beneficiary := payment.Attributes.BeneficiaryParty.DebtorParty
+	beneficiary.BankID, beneficiary.BankIDCode = payment.Attributes.DebtorParty.BankID, payment.Attributes.DebtorParty.BankIDCode
+	require.False(t, payment.Attributes.ChargesInformation.ReceiverChargesAmount.IsEmpty())
+
+	body, err := marshalPacs008(payment, time.Now())
+	require.Nil(t, err)
+	payments, err := unmarshalPacs008(body, payment.OrganisationID)
+	require.Nil(t, err)
+	require.Len(t, payments, 1)
+	assert.Equal(t, mustMarshal(t, payment.Attributes.ChargesInformation), mustMarshal(t, payments[0].Attributes.ChargesInformation))
+
+	// messages from elsewhere don't mark them, so only charges taken by the beneficiary's bank alone are receiver charges
+	unmarked := bytes.Replace(body, []byte("<RcvrChrgs>"), []byte("<Ignored>"), 1)
+	unmarked = bytes.Replace(unmarked, []byte("</RcvrChrgs>"), []byte("</Ignored>"), 1)
+	payments, err = unmarshalPacs008(unmarked, payment.OrganisationID)
+	require.Nil(t, err)
+	assert.True(t, payments[0].Attributes.ChargesInformation.ReceiverChargesAmount.IsEmpty())
+}
+
+func TestImportPacs008BodiesAreLimited(t *testing.T) {
+
+	payment := readCreatableSamplePayments(t)[0]
+	body := bytes.Repeat([]byte(" "), maxImportBodySize+1)
+	rw := sendPacs008(t, "?organisation_id="+payment.OrganisationID.String(), body)
+	assert.Equal(t, 413, rw.Code)
+	assert.Contains(t, rw.Body.String(), "body_too_large")
+}
+
+func TestPacs008MapsTheSamplePaymentToISOElements(t *testing.T) {
+
+	payment := readSamplePayments(t)[0]
+	body, err := marshalPacs008(payment, time.Date(2017, 1, 18, 9, 0, 0, 0, time.UTC))
+	require.Nil(t, err)
+	xml := string(body)
+
+	for _, element := range []string{
+		"<CreDtTm>2017-01-18T09:00:00Z</CreDtTm>",
+		"<NbOfTxs>1</NbOfTxs>",
+		"<ClrSys>\n          <Prtry>FPS</Prtry>",
+		"<EndToEndId>Wil piano Jan</EndToEndId>",
+		"<UETR>" + payment.ID.String() + "</UETR>",
+		`<IntrBkSttlmAmt Ccy="GBP">100.21</IntrBkSttlmAmt>`,
+		"<IntrBkSttlmDt>2017-01-18</IntrBkSttlmDt>",
+		`<InstdAmt Ccy="USD">200.42</InstdAmt>`,
+		"<XchgRate>2.00000</XchgRate>",
+		"<ChrgBr>SHAR</ChrgBr>",
+		`<Amt Ccy="GBP">5.00</Amt>`,
+		"<IBAN>GB83XABC10161234567801</IBAN>",
+		"<Cd>GBDSC</Cd>",
+		"<MmbId>203301</MmbId>",
+		"<Nm>Wilfred Jeremiah Owens</Nm>",
+		"<AdrLine>1 The Beneficiary Localtown SE2</AdrLine>",
+		"<Ustrd>Payment for Em&#39;s piano lessons</Ustrd>",
+		`<PmtAttrs xmlns="urn:form3:payments:pacs.008">`,
+	} {
+		assert.Contains(t, xml, element)
+	}
+}
+
+func TestGetPaymentAsPacs008(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := readCreatableSamplePayments(t)[0]
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/payments/"+payment.ID.String(), nil)
+	req.Header.Set("Accept", "application/json;q=0.5, "+pacs008MediaType)
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+
+	require.Equal(t, 200, rw.Code)
+	assert.Equal(t, pacs008MediaType, rw.Header().Get("Content-Type"))
+	assert.Equal(t, versionETag(0), rw.Header().Get("ETag"))
+
+	imported, err := unmarshalPacs008(rw.Body.Bytes(), payment.OrganisationID)
+	require.Nil(t, err)
+	require.Len(t, imported, 1)
+	assert.Equal(t, payment.Attributes.EndToEndReference, imported[0].Attributes.EndToEndReference)
+
+	// plain XML isn't a profile the API knows, so JSON is sent as before
+	req = httptest.NewRequest(http.MethodGet, "/v1/payments/"+payment.ID.String(), nil)
+	req.Header.Set("Accept", "application/xml")
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+
+	// only credit transfers are pacs.008 messages
+	debit := createBACSPayment(uuid.NewV1(), "100.00")
+	debit.Attributes.PaymentType = "Debit"
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", debit).Code)
+	req = httptest.NewRequest(http.MethodGet, "/v1/payments/"+debit.ID.String(), nil)
+	req.Header.Set("Accept", pacs008MediaType)
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 406, rw.Code)
+	assert.Contains(t, rw.Body.String(), "not_acceptable")
+}
+
+func TestImportPacs008(t *testing.T) {
+
+	emptyDatabase(t)
+
+	samples := readCreatableSamplePayments(t)
+	first, err := marshalPacs008(samples[0], time.Now())
+	require.Nil(t, err)
+	second, err := marshalPacs008(samples[1], time.Now())
+	require.Nil(t, err)
+
+	// a message with both transactions
+	start := strings.Index(string(second), "<CdtTrfTxInf>")
+	end := strings.Index(string(second), "</FIToFICstmrCdtTrf>")
+	message := strings.Replace(string(first), "</FIToFICstmrCdtTrf>", string(second[start:end])+"</FIToFICstmrCdtTrf>", 1)
+
+	organisationID := uuid.NewV4()
+	rw := sendPacs008(t, "?organisation_id="+organisationID.String(), []byte(message))
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var batch PaymentBatch
+	require.Nil(t, json.Unmarshal(response.Data, &batch))
+	assert.Equal(t, BatchModeAtomic, batch.Mode)
+	assert.Equal(t, 2, batch.Created)
+
+	for _, sample := range samples[:2] {
+		rw := sendAs(t, "", http.MethodGet, "/v1/payments/"+sample.ID.String(), nil)
+		require.Equal(t, 200, rw.Code)
+		payment, _ := decodePaymentResponse(t, rw)
+		assert.Equal(t, organisationID, payment.OrganisationID)
+		assert.Equal(t, StatusCreated, payment.Attributes.Status)
+		assert.Equal(t, sample.Attributes.Amount.String(), payment.Attributes.Amount.String())
+		assert.Equal(t, sample.Attributes.BeneficiaryParty, payment.Attributes.BeneficiaryParty)
+	}
+
+	// importing the message again fails, as its payments already exist, and creates nothing
+	rw = sendPacs008(t, "?organisation_id="+organisationID.String(), []byte(message))
+	assert.Equal(t, 422, rw.Code)
+}
+
+func TestImportInvalidPacs008(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := readCreatableSamplePayments(t)[0]
+	body, err := marshalPacs008(payment, time.Now())
+	require.Nil(t, err)
+	organisation := "?organisation_id=" + payment.OrganisationID.String()
+
+	rw := sendPacs008(t, organisation, []byte("<Document>"))
+	assert.Equal(t, 400, rw.Code)
+	assert.Contains(t, rw.Body.String(), "invalid_xml")
+
+	// messages of other versions of pacs.008 aren't understood
+	rw = sendPacs008(t, organisation, bytes.Replace(body, []byte("pacs.008.001.08"), []byte("pacs.008.001.02"), 1))
+	assert.Equal(t, 400, rw.Code)
+
+	rw = sendPacs008(t, "", body)
+	assert.Equal(t, 400, rw.Code)
+	assert.Contains(t, rw.Body.String(), "organisation_id")
+
+	rw = sendPacs008(t, organisation, bytes.Replace(body, []byte(payment.ID.String()), []byte("not-a-uuid"), 1))
+	assert.Equal(t, 400, rw.Code)
+	assert.Contains(t, rw.Body.String(), "UETR")
+
+	// the payments are validated as they are created, and reported against their JSON fields
+	rw = sendPacs008(t, organisation, bytes.Replace(body, []byte("<ChrgBr>SHAR</ChrgBr>"), []byte("<ChrgBr>XXXX</ChrgBr>"), 1))
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var batch PaymentBatch
+	require.Nil(t, json.Unmarshal(response.Data, &batch))
+	require.Len(t, batch.Items, 1)
+	assert.Equal(t, map[string]string{"/attributes/charges_information/bearer_code": codeInvalidValue}, errorPointers(batch.Items[0].Errors))
+	assert.Equal(t, 404, sendAs(t, "", http.MethodGet, "/v1/payments/"+payment.ID.String(), nil).Code)
+}
+
+func TestImportPacs008IsForTheKeysOrganisation(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := readCreatableSamplePayments(t)[0]
+	body, err := marshalPacs008(payment, time.Now())
+	require.Nil(t, err)
+	_, key := createAPIKey(t, payment.OrganisationID, RoleOperator)
+
+	send := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/payments/import/pacs008"+query, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		rw := httptest.NewRecorder()
+		newAPI(store).ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 403, send("?organisation_id="+uuid.NewV4().String()).Code)
+	require.Equal(t, 201, send("").Code)
+
+	stored, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, payment.OrganisationID, stored.OrganisationID)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// the patch formats accepted by PATCH /v1/payments/{id}
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// the largest patch accepted, in bytes
+const maxPatchBodySize = 1 << 20
+
+// immutablePaymentFields identify a payment, or are managed by its actions, approvals, status reports, scheme files and
+// by deleting and restoring it, so can't be patched
+var immutablePaymentFields = []string{"/id", "/organisation_id", "/type", "/attributes/status", "/attributes/status_history", "/attributes/approval", "/attributes/scheme_status", "/attributes/scheme_file_id", "/created_by", "/deleted_at"}
+
+var (
+	ErrPatchPathNotFound = errors.New("path not found")
+	ErrPatchTestFailed   = errors.New("test failed")
+)
+
+// jsonPatchOperation is an operation of a JSON Patch document (RFC 6902)
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// decodeJSONValue decodes any JSON value, keeping numbers as they were written
+func decodeJSONValue(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return value, nil
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396): objects are merged, nulls remove members and anything else
+// replaces the target
+func applyMergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = applyMergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// parseJSONPointer splits a JSON Pointer (RFC 6901) into its unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%q is not a JSON pointer", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses a reference token as an index into an array of the given length. the end of the array, "-", is
+// only allowed when adding.
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if adding && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, ErrPatchPathNotFound
+	}
+	if index > length || (index == length && !adding) {
+		return 0, ErrPatchPathNotFound
+	}
+	return index, nil
+}
+
+func jsonPointerGet(node interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, ErrPatchPathNotFound
+			}
+			node = child
+		case []interface{}:
+			index, err := arrayIndex(token, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[index]
+		default:
+			return nil, ErrPatchPathNotFound
+		}
+	}
+	return node, nil
+}
+
+// jsonPointerAdd adds a value at the location, returning the updated node. members of objects are replaced, and values
+// are inserted into arrays.
+func jsonPointerAdd(node interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	token, last := tokens[0], len(tokens) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if last {
+			n[token] = value
+			return n, nil
+		}
+		child, ok := n[token]
+		if !ok {
+			return nil, ErrPatchPathNotFound
+		}
+		child, err := jsonPointerAdd(child, tokens[1:], value)
+		n[token] = child
+		return n, err
+	case []interface{}:
+		index, err := arrayIndex(token, len(n), last)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			n = append(n, nil)
+			copy(n[index+1:], n[index:])
+			n[index] = value
+			return n, nil
+		}
+		child, err := jsonPointerAdd(n[index], tokens[1:], value)
+		n[index] = child
+		return n, err
+	}
+	return nil, ErrPatchPathNotFound
+}
+
+// jsonPointerRemove removes the value at the location, returning the updated node
+func jsonPointerRemove(node interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, ErrPatchPathNotFound
+	}
+	token, last := tokens[0], len(tokens) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[token]
+		if !ok {
+			return nil, ErrPatchPathNotFound
+		}
+		if last {
+			delete(n, token)
+			return n, nil
+		}
+		child, err := jsonPointerRemove(child, tokens[1:])
+		n[token] = child
+		return n, err
+	case []interface{}:
+		index, err := arrayIndex(token, len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			return append(n[:index], n[index+1:]...), nil
+		}
+		child, err := jsonPointerRemove(n[index], tokens[1:])
+		n[index] = child
+		return n, err
+	}
+	return nil, ErrPatchPathNotFound
+}
+
+// deepCopyJSON copies a decoded JSON value, so that a copied value isn't changed by later operations on the original
+func deepCopyJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for name, child := range v {
+			copied[name] = deepCopyJSON(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = deepCopyJSON(child)
+		}
+		return copied
+	}
+	return value
+}
+
+// applyJSONPatch applies the operations of a JSON Patch (RFC 6902) in order. if an operation fails, the index of the
+// operation is returned with the error and the document should be discarded.
+func applyJSONPatch(document interface{}, operations []jsonPatchOperation) (interface{}, int, error) {
+	for i, operation := range operations {
+		path, err := parseJSONPointer(operation.Path)
+		if err != nil {
+			return nil, i, err
+		}
+
+		var value, from interface{}
+		switch operation.Op {
+		case "add", "replace", "test":
+			if len(operation.Value) == 0 {
+				return nil, i, fmt.Errorf("%s operation must have a value", operation.Op)
+			}
+			if value, err = decodeJSONValue(operation.Value); err != nil {
+				return nil, i, err
+			}
+		case "move", "copy":
+			fromPath, err := parseJSONPointer(operation.From)
+			if err != nil {
+				return nil, i, err
+			}
+			if from, err = jsonPointerGet(document, fromPath); err != nil {
+				return nil, i, err
+			}
+			if operation.Op == "move" {
+				if strings.HasPrefix(operation.Path+"/", operation.From+"/") && operation.Path != operation.From {
+					return nil, i, errors.New("a value can't be moved into itself")
+				}
+				if document, err = jsonPointerRemove(document, fromPath); err != nil {
+					return nil, i, err
+				}
+			} else {
+				from = deepCopyJSON(from)
+			}
+		}
+
+		switch operation.Op {
+		case "add":
+			document, err = jsonPointerAdd(document, path, value)
+		case "remove":
+			document, err = jsonPointerRemove(document, path)
+		case "replace":
+			if _, err = jsonPointerGet(document, path); err == nil && len(path) > 0 {
+				document, err = jsonPointerRemove(document, path)
+			}
+			if err == nil {
+				document, err = jsonPointerAdd(document, path, value)
+			}
+		case "move", "copy":
+			document, err = jsonPointerAdd(document, path, from)
+		case "test":
+			var current interface{}
+			if current, err = jsonPointerGet(document, path); err == nil && !reflect.DeepEqual(current, value) {
+				err = ErrPatchTestFailed
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", operation.Op)
+		}
+		if err != nil {
+			return nil, i, err
+		}
+	}
+	return document, 0, nil
+}
+
+// business logic for PATCH /v1/payments/{id} endpoint. the patch is applied to the stored payment, and the result is
+// checked and saved as a PUT of the whole payment would be.
+func (api *api) patchPayment(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != mergePatchContentType && contentType != jsonPatchContentType {
+		w.Header().Set("Accept-Patch", mergePatchContentType+", "+jsonPatchContentType)
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("Content-Type must be %s or %s", mergePatchContentType, jsonPatchContentType))
+		return
+	}
+	body, ok := readBody(w, r, maxPatchBodySize, "invalid_body")
+	if !ok {
+		return
+	}
+
+	// the patch applies to the current version, so any conditions in the request are checked first
+	existingPayment, err := api.storeFor(r).Get(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if status, ok := checkPreconditions(r, existingPayment.Version); !ok {
+		writeError(w, status, "version_mismatch", "Payment version does not match")
+		return
+	}
+
+	// patch the JSON of the payment, just as the client would see it
+	encoded, err := json.Marshal(existingPayment)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	original, err := decodeJSONValue(encoded)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	document := deepCopyJSON(original)
+
+	if contentType == mergePatchContentType {
+		patch, err := decodeJSONValue(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+			return
+		}
+		document = applyMergePatch(document, patch)
+	} else {
+		var operations []jsonPatchOperation
+		if err := json.Unmarshal(body, &operations); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json", "JSON Patch must be an array of operations")
+			return
+		}
+		var index int
+		if document, index, err = applyJSONPatch(document, operations); err != nil {
+			status := http.StatusUnprocessableEntity
+			if err == ErrPatchTestFailed {
+				status = http.StatusConflict
+			}
+			writeErrors(w, status, APIError{Code: "patch_failed", Message: fmt.Sprintf("Operation %d failed: %s", index, err), Pointer: fmt.Sprintf("/%d", index)})
+			return
+		}
+	}
+
+	// fields that can't be changed are reported together, wherever in the patch they were changed
+	var errs []APIError
+	for _, pointer := range immutablePaymentFields {
+		tokens, _ := parseJSONPointer(pointer)
+		before, _ := jsonPointerGet(original, tokens)
+		after, _ := jsonPointerGet(document, tokens)
+		if !reflect.DeepEqual(before, after) {
+			errs = append(errs, APIError{Code: "immutable_field", Message: fmt.Sprintf("%s can't be changed", pointer[strings.LastIndex(pointer, "/")+1:]), Pointer: pointer})
+		}
+	}
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+
+	patched, err := json.Marshal(document)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payment, ok := readPayment(w, bytes.NewReader(patched))
+	if !ok {
+		return
+	}
+	if errs := api.checkPayment(payment); len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+	if !api.savePayment(w, r, &payment, existingPayment) {
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(payment.Version))
+	writeData(w, http.StatusOK, payment, paymentLinks(payment)...)
+}
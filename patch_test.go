@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendPatch(t *testing.T, payment Payment, contentType, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/v1/payments/%s", payment.ID), bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func mustDecodeJSONValue(t *testing.T, s string) interface{} {
+	value, err := decodeJSONValue([]byte(s))
+	require.Nil(t, err)
+	return value
+}
+
+func TestApplyMergePatch(t *testing.T) {
+
+	document := mustDecodeJSONValue(t, `{"a": "b", "c": {"d": "e", "f": "g"}, "list": [1, 2]}`)
+	patch := mustDecodeJSONValue(t, `{"a": "z", "c": {"f": null}, "list": [3], "new": {"x": 1}}`)
+
+	assert.Equal(t, mustDecodeJSONValue(t, `{"a": "z", "c": {"d": "e"}, "list": [3], "new": {"x": 1}}`), applyMergePatch(document, patch))
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+
+	document := mustDecodeJSONValue(t, `{"a": {"b": "c"}, "list": ["x", "z"]}`)
+	var operations []jsonPatchOperation
+	require.Nil(t, json.Unmarshal([]byte(`[
+		{"op": "test", "path": "/a/b", "value": "c"},
+		{"op": "add", "path": "/list/1", "value": "y"},
+		{"op": "add", "path": "/list/-", "value": "end"},
+		{"op": "replace", "path": "/a/b", "value": {"deep": true}},
+		{"op": "copy", "from": "/a", "path": "/copied"},
+		{"op": "move", "from": "/list/0", "path": "/first"},
+		{"op": "remove", "path": "/a/b/deep"}
+	]`), &operations))
+
+	patched, _, err := applyJSONPatch(document, operations)
+	require.Nil(t, err)
+	assert.Equal(t, mustDecodeJSONValue(t, `{"a": {"b": {}}, "copied": {"b": {"deep": true}}, "list": ["y", "z", "end"], "first": "x"}`), patched)
+
+	for _, c := range []struct {
+		patch string
+		err   error
+	}{
+		{`[{"op": "remove", "path": "/missing"}]`, ErrPatchPathNotFound},
+		{`[{"op": "replace", "path": "/list/5", "value": 1}]`, ErrPatchPathNotFound},
+		{`[{"op": "add", "path": "/missing/child", "value": 1}]`, ErrPatchPathNotFound},
+		{`[{"op": "test", "path": "/first", "value": "nope"}]`, ErrPatchTestFailed},
+	} {
+		operations = nil
+		require.Nil(t, json.Unmarshal([]byte(c.patch), &operations))
+		_, index, err := applyJSONPatch(deepCopyJSON(patched), operations)
+		assert.Equal(t, c.err, err, c.patch)
+		assert.Equal(t, 0, index)
+	}
+
+	operations = nil
+	require.Nil(t, json.Unmarshal([]byte(`[{"op": "add", "path": "/x", "value": 1}, {"op": "jump", "path": "/x"}]`), &operations))
+	_, index, err := applyJSONPatch(deepCopyJSON(patched), operations)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, index)
+}
+
+func TestMergePatchPayment(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	rw := sendPatch(t, examplePayment, mergePatchContentType, `{"attributes": {"reference": "patched", "amount": "250.00"}}`, nil)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	assert.Equal(t, `"1"`, rw.Header().Get("ETag"))
+
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var patched Payment
+	require.Nil(t, json.Unmarshal(response.Data, &patched))
+	assert.Equal(t, "patched", patched.Attributes.Reference)
+
+	stored, err := store.Get(examplePayment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, "patched", stored.Attributes.Reference)
+	assert.Equal(t, "250.00", stored.Attributes.Amount.String())
+	assert.Equal(t, examplePayment.Attributes.DebtorParty, stored.Attributes.DebtorParty)
+	assert.Equal(t, uint(1), stored.Version)
+}
+
+func TestJSONPatchPayment(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	rw := sendPatch(t, examplePayment, jsonPatchContentType, `[
+		{"op": "test", "path": "/attributes/currency", "value": "GBP"},
+		{"op": "remove", "path": "/attributes/charges_information/sender_charges/1"},
+		{"op": "replace", "path": "/attributes/beneficiary_party/name", "value": "Liam G"}
+	]`, map[string]string{"If-Match": `"0"`})
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	stored, err := store.Get(examplePayment.ID)
+	require.Nil(t, err)
+	assert.Len(t, stored.Attributes.ChargesInformation.SenderCharges, 1)
+	assert.Equal(t, "Liam G", stored.Attributes.BeneficiaryParty.Name)
+
+	// a failed test leaves the payment as it is
+	rw = sendPatch(t, stored, jsonPatchContentType, `[{"op": "test", "path": "/attributes/currency", "value": "USD"}]`, nil)
+	assert.Equal(t, 409, rw.Code)
+
+	rw = sendPatch(t, stored, jsonPatchContentType, `[{"op": "remove", "path": "/attributes/nothing"}]`, nil)
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/0": "patch_failed"}, errorPointers(response.Errors))
+}
+
+func TestPatchPaymentRejectsImmutableFields(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	rw := sendPatch(t, examplePayment, mergePatchContentType, `{"id": "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", "type": "Other", "attributes": {"status": "settled"}}`, nil)
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{
+		"/id":                "immutable_field",
+		"/type":              "immutable_field",
+		"/attributes/status": "immutable_field",
+	}, errorPointers(response.Errors))
+
+	rw = sendPatch(t, examplePayment, jsonPatchContentType, `[{"op": "move", "from": "/organisation_id", "path": "/attributes/reference"}]`, nil)
+	require.Equal(t, 422, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/organisation_id": "immutable_field"}, errorPointers(response.Errors))
+}
+
+func TestPatchBodiesAreLimited(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	reference := strings.Repeat("x", maxPatchBodySize)
+	rw := sendPatch(t, examplePayment, mergePatchContentType, `{"attributes": {"reference": "`+reference+`"}}`, nil)
+	assert.Equal(t, 413, rw.Code)
+	assert.Contains(t, rw.Body.String(), "body_too_large")
+}
+
+func TestPatchPaymentIsValidatedAndVersionChecked(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	rw := sendPatch(t, examplePayment, mergePatchContentType, `{"attributes": {"amount": null, "currency": "ABC"}}`, nil)
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, codeRequired, errorPointers(response.Errors)["/attributes/amount"])
+	assert.Equal(t, codeInvalidCurrency, errorPointers(response.Errors)["/attributes/currency"])
+
+	rw = sendPatch(t, examplePayment, mergePatchContentType, `{"attributes": {"reference": "stale"}}`, map[string]string{"If-Match": `"7"`})
+	assert.Equal(t, 412, rw.Code)
+
+	// without If-Match, a version in the patch must be the current one
+	rw = sendPatch(t, examplePayment, mergePatchContentType, `{"version": 3, "attributes": {"reference": "stale"}}`, nil)
+	assert.Equal(t, 409, rw.Code)
+
+	rw = sendPatch(t, examplePayment, "application/json", `{"attributes": {"reference": "plain"}}`, nil)
+	assert.Equal(t, 415, rw.Code)
+	assert.Contains(t, rw.Header().Get("Accept-Patch"), mergePatchContentType)
+
+	rw = sendPatch(t, examplePayment, mergePatchContentType, `{"attributes": `, nil)
+	assert.Equal(t, 400, rw.Code)
+
+	stored, err := store.Get(examplePayment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, uint(0), stored.Version)
+	assert.Equal(t, examplePayment.Attributes.Reference, stored.Attributes.Reference)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// fields that payments can be sorted by. created is the order in which payments were stored.
+const (
+	sortCreated        = "created"
+	sortProcessingDate = "processing_date"
+	sortAmount         = "amount"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// PaymentFilter restricts which payments are listed. zero values mean no restriction. dates are inclusive.
+type PaymentFilter struct {
+	OrganisationID     uuid.UUID
+	Currency           string
+	PaymentScheme      string
+	ProcessingDateFrom string
+	ProcessingDateTo   string
+	AmountMin          Decimal
+	AmountMax          Decimal
+
+	// the references that scheme status reports match payments by
+	EndToEndReference string
+	SchemePaymentID   string
+
+	// deleted payments are only listed when this is set
+	IncludeDeleted bool
+}
+
+type PaymentSort struct {
+	Field      string
+	Descending bool
+}
+
+// PaymentCursor identifies a position in a sorted list of payments. Key is the sort field value and Seq the creation
+// sequence of the payment at that position, which breaks ties between payments with the same key.
+type PaymentCursor struct {
+	Sort string `json:"o"`
+	Key  string `json:"k,omitempty"`
+	Seq  int64  `json:"s"`
+}
+
+// PaymentQuery describes a page of payments to list. at most one of After and Before may be set. a Limit of zero
+// means no limit.
+type PaymentQuery struct {
+	Filter PaymentFilter
+	Sort   PaymentSort
+	After  *PaymentCursor
+	Before *PaymentCursor
+	Limit  int
+}
+
+// PaymentPage is a page of listed payments. Next and Prev are set when there are more payments in that direction.
+type PaymentPage struct {
+	Payments []Payment
+	Next     *PaymentCursor
+	Prev     *PaymentCursor
+}
+
+var (
+	errInvalidCursor         = errors.New("Invalid cursor")
+	errInvalidIncludeDeleted = errors.New("Invalid include_deleted, must be true or false")
+)
+
+func (sort PaymentSort) String() string {
+	if sort.Descending {
+		return "-" + sort.Field
+	}
+	return sort.Field
+}
+
+func parsePaymentSort(value string) (PaymentSort, error) {
+	sort := PaymentSort{Field: sortCreated}
+	if value == "" {
+		return sort, nil
+	}
+	if strings.HasPrefix(value, "-") {
+		sort.Descending = true
+		value = value[1:]
+	}
+	switch value {
+	case sortCreated, sortProcessingDate, sortAmount:
+		sort.Field = value
+		return sort, nil
+	}
+	return sort, errors.New("Invalid sort")
+}
+
+// Encode returns the opaque string form of the cursor used in page[after] and page[before]
+func (cursor PaymentCursor) Encode() string {
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodePaymentCursor(value string) (*PaymentCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor PaymentCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, errInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// sortKey returns the value of the sort field for a payment, in the same form as a PaymentCursor key
+func sortKey(payment Payment, field string) string {
+	switch field {
+	case sortProcessingDate:
+		return payment.Attributes.ProcessingDate
+	case sortAmount:
+		// payments without an amount sort as zero
+		if payment.Attributes.Amount.IsEmpty() {
+			return "0"
+		}
+		return payment.Attributes.Amount.String()
+	}
+	return ""
+}
+
+// compareSortKeys compares two keys of the given sort field, returning -1, 0 or 1
+func compareSortKeys(field string, a, b string) int {
+	if field == sortAmount {
+		x, _ := new(big.Rat).SetString(a)
+		y, _ := new(big.Rat).SetString(b)
+		if x == nil || y == nil {
+			return strings.Compare(a, b)
+		}
+		return x.Cmp(y)
+	}
+	return strings.Compare(a, b)
+}
+
+// parse the pagination, filter and sort parameters for GET /v1/payments
+func parsePaymentQuery(values url.Values) (PaymentQuery, []APIError) {
+	query := PaymentQuery{Limit: defaultPageSize}
+	var errs []APIError
+	invalid := func(param, message string) {
+		errs = append(errs, APIError{Code: "invalid_parameter", Message: message, Parameter: param})
+	}
+
+	if size := values.Get("page[size]"); size != "" {
+		limit, err := strconv.Atoi(size)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			invalid("page[size]", fmt.Sprintf("Invalid page size, must be between 1 and %d", maxPageSize))
+		} else {
+			query.Limit = limit
+		}
+	}
+
+	sort, err := parsePaymentSort(values.Get("sort"))
+	if err != nil {
+		invalid("sort", err.Error())
+	}
+	query.Sort = sort
+
+	after, before := values.Get("page[after]"), values.Get("page[before]")
+	if after != "" && before != "" {
+		invalid("page[before]", "Only one of page[after] and page[before] may be given")
+	}
+	for _, cursor := range []struct {
+		param, raw string
+		target     **PaymentCursor
+	}{
+		{"page[after]", after, &query.After},
+		{"page[before]", before, &query.Before},
+	} {
+		if cursor.raw == "" {
+			continue
+		}
+		decoded, err := decodePaymentCursor(cursor.raw)
+		if err != nil || decoded.Sort != sort.String() {
+			invalid(cursor.param, errInvalidCursor.Error())
+			continue
+		}
+		*cursor.target = decoded
+	}
+
+	if organisationID := values.Get("filter[organisation_id]"); organisationID != "" {
+		id, err := uuid.FromString(organisationID)
+		if err != nil {
+			invalid("filter[organisation_id]", "Invalid organisation_id filter")
+		}
+		query.Filter.OrganisationID = id
+	}
+
+	query.Filter.Currency = values.Get("filter[currency]")
+	query.Filter.PaymentScheme = values.Get("filter[payment_scheme]")
+
+	// the parameters are checked in order, so that their errors always are too
+	for _, date := range []struct {
+		param  string
+		target *string
+	}{
+		{"filter[processing_date_from]", &query.Filter.ProcessingDateFrom},
+		{"filter[processing_date_to]", &query.Filter.ProcessingDateTo},
+	} {
+		if value := values.Get(date.param); value != "" {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				invalid(date.param, fmt.Sprintf("Invalid %s, must be a YYYY-MM-DD date", date.param))
+			}
+			*date.target = value
+		}
+	}
+
+	for _, amount := range []struct {
+		param  string
+		target *Decimal
+	}{
+		{"filter[amount_min]", &query.Filter.AmountMin},
+		{"filter[amount_max]", &query.Filter.AmountMax},
+	} {
+		parsed, err := ParseDecimal(values.Get(amount.param))
+		if err != nil {
+			invalid(amount.param, fmt.Sprintf("Invalid %s, must be a decimal amount", amount.param))
+		}
+		*amount.target = parsed
+	}
+
+	includeDeleted, err := parseIncludeDeleted(values)
+	if err != nil {
+		invalid("include_deleted", err.Error())
+	}
+	query.Filter.IncludeDeleted = includeDeleted
+
+	return query, errs
+}
+
+// parseIncludeDeleted reads the include_deleted parameter, which defaults to false
+func parseIncludeDeleted(values url.Values) (bool, error) {
+	value := values.Get("include_deleted")
+	if value == "" {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errInvalidIncludeDeleted
+	}
+	return include, nil
+}
+
+// build the HATEOAS links for a page of payments. next and prev keep the filters and sort of the current request.
+func paymentPageLinks(r *http.Request, page PaymentPage) []Link {
+	links := []Link{Link{Rel: "self", Href: r.URL.RequestURI()}}
+
+	pageLink := func(rel, param string, cursor *PaymentCursor) Link {
+		values := r.URL.Query()
+		values.Del("page[after]")
+		values.Del("page[before]")
+		values.Set(param, cursor.Encode())
+		return Link{Rel: rel, Href: r.URL.Path + "?" + values.Encode()}
+	}
+
+	if page.Next != nil {
+		links = append(links, pageLink("next", "page[after]", page.Next))
+	}
+	if page.Prev != nil {
+		links = append(links, pageLink("prev", "page[before]", page.Prev))
+	}
+	return links
+}
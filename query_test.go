@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// request a page of payments, returning the payments and the links keyed by rel
+func getPaymentsPage(t *testing.T, href string) ([]Payment, map[string]string) {
+	req := httptest.NewRequest(http.MethodGet, href, nil)
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+
+	var payments []Payment
+	require.Nil(t, json.Unmarshal(response.Data, &payments))
+
+	links := map[string]string{}
+	for _, link := range response.Links {
+		links[link.Rel] = link.Href
+	}
+	return payments, links
+}
+
+func createPaymentsWithAmounts(t *testing.T, amounts ...string) []Payment {
+	payments := []Payment{}
+	for _, amount := range amounts {
+		payment := createExamplePayment()
+		payment.Attributes.Amount = MustParseDecimal(amount)
+		require.Nil(t, store.Create(&payment))
+		payments = append(payments, payment)
+	}
+	return payments
+}
+
+func paymentIDs(payments []Payment) []uuid.UUID {
+	ids := []uuid.UUID{}
+	for _, payment := range payments {
+		ids = append(ids, payment.ID)
+	}
+	return ids
+}
+
+func TestGetPaymentsPagesForwardsAndBackwards(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayments := createPaymentsWithAmounts(t, "1.00", "2.00", "3.00", "4.00", "5.00")
+
+	first, links := getPaymentsPage(t, "/v1/payments?page[size]=2")
+	assert.EqualValues(t, paymentIDs(examplePayments[0:2]), paymentIDs(first))
+	assert.Equal(t, "/v1/payments?page[size]=2", links["self"])
+	assert.Empty(t, links["prev"])
+	require.NotEmpty(t, links["next"])
+
+	second, links := getPaymentsPage(t, links["next"])
+	assert.EqualValues(t, paymentIDs(examplePayments[2:4]), paymentIDs(second))
+	require.NotEmpty(t, links["next"])
+	require.NotEmpty(t, links["prev"])
+	prev := links["prev"]
+
+	third, links := getPaymentsPage(t, links["next"])
+	assert.EqualValues(t, paymentIDs(examplePayments[4:5]), paymentIDs(third))
+	assert.Empty(t, links["next"])
+
+	// going back from the second page should return the first page, with no further prev link
+	back, links := getPaymentsPage(t, prev)
+	assert.EqualValues(t, paymentIDs(examplePayments[0:2]), paymentIDs(back))
+	assert.Empty(t, links["prev"])
+	assert.NotEmpty(t, links["next"])
+}
+
+func TestGetPaymentsSortedByAmountDescending(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayments := createPaymentsWithAmounts(t, "10.00", "9.50", "100.00", "9.50")
+
+	payments, links := getPaymentsPage(t, "/v1/payments?sort=-amount&page[size]=3")
+	assert.EqualValues(t, paymentIDs([]Payment{examplePayments[2], examplePayments[0], examplePayments[3]}), paymentIDs(payments))
+
+	// the next page keeps the sort order and breaks the tie between the equal amounts
+	next, err := url.Parse(links["next"])
+	require.Nil(t, err)
+	assert.Equal(t, "-amount", next.Query().Get("sort"))
+	payments, _ = getPaymentsPage(t, links["next"])
+	assert.EqualValues(t, paymentIDs([]Payment{examplePayments[1]}), paymentIDs(payments))
+}
+
+func TestGetPaymentsWithFilters(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayments := createPaymentsWithAmounts(t, "5.00", "50.00", "500.00")
+	examplePayments[1].Attributes.Currency = "EUR"
+	examplePayments[1].Attributes.ProcessingDate = "2017-02-01"
+	require.Nil(t, store.Update(&examplePayments[1]))
+	examplePayments[2].Attributes.PaymentScheme = "BACS"
+	require.Nil(t, store.Update(&examplePayments[2]))
+
+	filters := map[string][]Payment{
+		"filter[organisation_id]=" + examplePayments[0].OrganisationID.String(): {examplePayments[0]},
+		"filter[currency]=EUR":                        {examplePayments[1]},
+		"filter[payment_scheme]=BACS":                 {examplePayments[2]},
+		"filter[processing_date_from]=2017-01-19":     {examplePayments[1]},
+		"filter[processing_date_to]=2017-01-18":       {examplePayments[0], examplePayments[2]},
+		"filter[amount_min]=10&filter[amount_max]=60": {examplePayments[1]},
+		"filter[amount_min]=1000":                     {},
+	}
+
+	for filter, expected := range filters {
+		payments, _ := getPaymentsPage(t, "/v1/payments?"+filter)
+		assert.EqualValues(t, paymentIDs(expected), paymentIDs(payments), filter)
+	}
+}
+
+func TestGetPaymentsWithInvalidParameters(t *testing.T) {
+
+	emptyDatabase(t)
+
+	invalid := []string{
+		"page[size]=0",
+		"page[size]=100000",
+		"page[size]=abc",
+		"sort=colour",
+		"page[after]=not-a-cursor",
+		"page[after]=" + PaymentCursor{Sort: "amount", Seq: 1}.Encode() + "&sort=-amount",
+		"filter[organisation_id]=blah",
+		"filter[processing_date_from]=18/01/2017",
+		"filter[amount_min]=ten",
+	}
+
+	for _, query := range invalid {
+		req := httptest.NewRequest(http.MethodGet, "/v1/payments?"+query, nil)
+		rw := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, 400, rw.Code, query)
+	}
+}
+
+func TestPaymentQueryErrorsAreInParameterOrder(t *testing.T) {
+
+	values, err := url.ParseQuery("page[after]=x&page[before]=y&filter[processing_date_from]=x&filter[processing_date_to]=y" +
+		"&filter[amount_min]=x&filter[amount_max]=y")
+	require.Nil(t, err)
+
+	// repeated, because the order of map iteration changes from run to run
+	for i := 0; i < 20; i++ {
+		_, errs := parsePaymentQuery(values)
+		var params []string
+		for _, err := range errs {
+			params = append(params, err.Parameter)
+		}
+		require.Equal(t, []string{
+			"page[before]", "page[after]", "page[before]",
+			"filter[processing_date_from]", "filter[processing_date_to]",
+			"filter[amount_min]", "filter[amount_max]",
+		}, params)
+	}
+}
+
+func TestPaymentCursorRoundTrip(t *testing.T) {
+
+	cursor := PaymentCursor{Sort: "-processing_date", Key: "2017-01-18", Seq: 42}
+	decoded, err := decodePaymentCursor(cursor.Encode())
+	require.Nil(t, err)
+	assert.Equal(t, cursor, *decoded)
+}
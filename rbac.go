@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+// permissions that roles grant. each route needs exactly one of them.
+const (
+	PermPaymentsRead    = "payments:read"
+	PermPaymentsWrite   = "payments:write"
+	PermPaymentsApprove = "payments:approve"
+	PermPaymentsDelete  = "payments:delete"
+	PermAuditRead       = "audit:read"
+	PermFXRead          = "fx:read"
+	PermFXWrite         = "fx:write"
+	PermRolesManage     = "roles:manage"
+	PermPoliciesManage  = "policies:manage"
+	PermWebhooksManage  = "webhooks:manage"
+	PermStatusReports   = "status_reports:manage"
+	PermSchemeFiles     = "scheme_files:manage"
+)
+
+// organisationPermissions lists the permissions an organisation's roles can grant, in the order they are documented.
+// fx:write changes what every organisation shares, so only platform keys have it.
+var organisationPermissions = []string{
+	PermPaymentsRead,
+	PermPaymentsWrite,
+	PermPaymentsApprove,
+	PermPaymentsDelete,
+	PermAuditRead,
+	PermFXRead,
+	PermRolesManage,
+	PermPoliciesManage,
+	PermWebhooksManage,
+	PermStatusReports,
+	PermSchemeFiles,
+}
+
+// the built in roles, which every organisation has and which can't be changed
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleApprover = "approver"
+	RoleAuditor  = "auditor"
+)
+
+var builtinRoles = map[string]Role{
+	RoleAdmin: {
+		Name:        RoleAdmin,
+		Description: "Everything, including managing roles",
+		Permissions: organisationPermissions,
+	},
+	RoleOperator: {
+		Name:        RoleOperator,
+		Description: "Create, change and delete payments",
+		Permissions: []string{PermPaymentsRead, PermPaymentsWrite, PermPaymentsDelete, PermFXRead},
+	},
+	RoleApprover: {
+		Name:        RoleApprover,
+		Description: "Submit payments and record the scheme's response",
+		Permissions: []string{PermPaymentsRead, PermPaymentsApprove},
+	},
+	RoleAuditor: {
+		Name:        RoleAuditor,
+		Description: "Read payments and the audit trail",
+		Permissions: []string{PermPaymentsRead, PermAuditRead},
+	},
+}
+
+// platformOrganisation is what platform keys belong to instead of an organisation. they are for whoever runs the API,
+// and can only be given the platform roles.
+var platformOrganisation = uuid.Nil
+
+const RolePlatform = "platform"
+
+var platformRoles = map[string]Role{
+	RolePlatform: {
+		Name:        RolePlatform,
+		Description: "Replace the exchange rates every organisation uses",
+		Permissions: []string{PermFXRead, PermFXWrite},
+	},
+}
+
+// actionPermissions is the permission needed for each action. the others take a payment out of the organisation's
+// hands, so they need approval.
+var actionPermissions = map[string]string{
+	ActionRequestApproval: PermPaymentsWrite,
+}
+
+var ErrRoleNotFound = errors.New("role not found")
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+
+// Role is a named set of permissions that can be assigned to API keys. organisations define their own roles besides
+// the built in ones.
+type Role struct {
+	tableName struct{} `sql:"roles"`
+
+	OrganisationID uuid.UUID `json:"-" sql:",pk,type:uuid"`
+	Name           string    `json:"name" sql:",pk"`
+	Description    string    `json:"description" sql:",notnull"`
+	Permissions    []string  `json:"permissions" sql:",notnull"`
+	Builtin        bool      `json:"builtin" sql:"-"`
+}
+
+// RoleStore persists the roles organisations define
+type RoleStore interface {
+	// GetRole returns an organisation's role, or ErrRoleNotFound
+	GetRole(organisationID uuid.UUID, name string) (Role, error)
+
+	// ListRoles returns an organisation's roles, ordered by name
+	ListRoles(organisationID uuid.UUID) ([]Role, error)
+
+	// PutRole creates a role, or replaces the one with the same name
+	PutRole(role *Role) error
+
+	// DeleteRole removes an organisation's role, or returns ErrRoleNotFound
+	DeleteRole(organisationID uuid.UUID, name string) error
+}
+
+// actionPermission returns the permission needed to take an action
+func actionPermission(action string) string {
+	if permission, ok := actionPermissions[action]; ok {
+		return permission
+	}
+	return PermPaymentsApprove
+}
+
+// findRole returns a built in role or one of the organisation's own, or for platform keys a platform role
+func findRole(store RoleStore, organisationID uuid.UUID, name string) (Role, error) {
+	if organisationID == platformOrganisation {
+		role, ok := platformRoles[name]
+		if !ok {
+			return Role{}, ErrRoleNotFound
+		}
+		role.Builtin = true
+		return role, nil
+	}
+	if role, ok := builtinRoles[name]; ok {
+		role.Builtin = true
+		return role, nil
+	}
+	return store.GetRole(organisationID, name)
+}
+
+// keyPermissions returns the permissions granted by an API key's roles. roles that have since been deleted grant
+// nothing.
+func keyPermissions(store RoleStore, key APIKey) (map[string]bool, error) {
+	permissions := map[string]bool{}
+	for _, name := range key.Roles {
+		role, err := findRole(store, key.OrganisationID, name)
+		if err == ErrRoleNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, permission := range role.Permissions {
+			permissions[permission] = true
+		}
+	}
+	return permissions, nil
+}
+
+// handle registers a route that needs the given permission
+func (api *api) handle(method, path, permission string, handler http.HandlerFunc) {
+	api.router.Handle(path, api.requirePermission(permission, handler)).Methods(method)
+}
+
+// requirePermission only lets requests through whose API key has the permission. refused requests are recorded in
+// the audit trail. without authentication there is no key, and everything is allowed.
+func (api *api) requirePermission(permission string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := requestAPIKey(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		permissions, err := keyPermissions(api.store, key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !permissions[permission] {
+			api.recordDenial(r, key, permission)
+			writeError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("The API key does not have the %s permission", permission))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordDenial adds a refused request to the audit trail. the request is refused whether or not it can be recorded.
+// only requests for a payment are recorded against it, so the IDs of other resources are kept with the denial.
+func (api *api) recordDenial(r *http.Request, key APIKey, permission string) {
+	entry := AuditEntry{
+		ID:             uuid.NewV4(),
+		OrganisationID: key.OrganisationID,
+		Action:         AuditAccessDenied,
+		Actor:          requestActor(r),
+		RequestID:      r.Header.Get(requestIDHeader),
+		Timestamp:      time.Now().UTC(),
+		Changes:        []FieldChange{},
+		Denied: &AccessDenial{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Permission: permission,
+		},
+	}
+	if id, ok := mux.Vars(r)["id"]; ok {
+		paymentID, err := uuid.FromString(id)
+		if route := mux.CurrentRoute(r); err == nil && route != nil && isPaymentRoute(route) {
+			entry.PaymentID = paymentID
+		} else {
+			entry.Denied.ResourceID = id
+		}
+	}
+	if err := api.store.AppendAudit(&entry); err != nil {
+		log.Printf("failed to record denied request %s: %s", entry.RequestID, err)
+	}
+}
+
+// isPaymentRoute reports whether a route is for a single payment, whose ID is its id variable
+func isPaymentRoute(route *mux.Route) bool {
+	template, err := route.GetPathTemplate()
+	return err == nil && strings.HasPrefix(template, "/v1/payments/{id}")
+}
+
+// adminOrganisation returns the organisation the admin API manages, which is that of the API key. without
+// authentication there is none, so an error response is written and ok is false.
+func adminOrganisation(w http.ResponseWriter, r *http.Request) (organisationID uuid.UUID, ok bool) {
+	organisationID, ok = requestOrganisation(r)
+	if !ok {
+		writeError(w, http.StatusForbidden, "api_key_required", "The admin API can only be used with an API key")
+	}
+	return organisationID, ok
+}
+
+// business logic for GET /v1/admin/roles endpoint, listing the built in roles and then the organisation's own
+func (api *api) getRoles(w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := adminOrganisation(w, r)
+	if !ok {
+		return
+	}
+
+	roles := []Role{}
+	for _, name := range []string{RoleAdmin, RoleOperator, RoleApprover, RoleAuditor} {
+		role, _ := findRole(api.store, organisationID, name)
+		roles = append(roles, role)
+	}
+	custom, err := api.store.ListRoles(organisationID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	roles = append(roles, custom...)
+
+	writeData(w, http.StatusOK, roles, Link{Rel: "self", Href: "/v1/admin/roles"})
+}
+
+// business logic for PUT /v1/admin/roles/{name} endpoint, which creates or replaces one of the organisation's roles
+func (api *api) putRole(w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := adminOrganisation(w, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if _, builtin := builtinRoles[name]; builtin {
+		writeError(w, http.StatusConflict, "builtin_role", "Built in roles can't be changed")
+		return
+	}
+
+	var role Role
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	role.OrganisationID, role.Name = organisationID, name
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+
+	var errs []APIError
+	if !roleNamePattern.MatchString(name) {
+		errs = append(errs, APIError{Code: codeInvalidFormat, Message: "name must be lowercase letters, digits, - and _", Pointer: "/name"})
+	}
+	known := map[string]bool{}
+	for _, permission := range organisationPermissions {
+		known[permission] = true
+	}
+	for i, permission := range role.Permissions {
+		if !known[permission] {
+			errs = append(errs, APIError{Code: codeInvalidValue, Message: fmt.Sprintf("unknown permission %s", permission), Pointer: fmt.Sprintf("/permissions/%d", i)})
+		}
+	}
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+	sort.Strings(role.Permissions)
+
+	if err := api.store.PutRole(&role); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, role, Link{Rel: "self", Href: "/v1/admin/roles/" + name})
+}
+
+// business logic for DELETE /v1/admin/roles/{name} endpoint. keys that were assigned the role lose its permissions.
+func (api *api) deleteRole(w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := adminOrganisation(w, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if _, builtin := builtinRoles[name]; builtin {
+		writeError(w, http.StatusConflict, "builtin_role", "Built in roles can't be changed")
+		return
+	}
+
+	if err := api.store.DeleteRole(organisationID, name); err != nil {
+		if err == ErrRoleNotFound {
+			writeError(w, http.StatusNotFound, "not_found", "Role not found")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	//default to 200 response code
+}
+
+// business logic for GET /v1/admin/api-keys endpoint, listing the organisation's keys and their roles
+func (api *api) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := adminOrganisation(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := api.store.ListAPIKeys(organisationID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, keys, Link{Rel: "self", Href: "/v1/admin/api-keys"})
+}
+
+// business logic for PUT /v1/admin/api-keys/{id}/roles endpoint, which replaces the roles assigned to a key
+func (api *api) putAPIKeyRoles(w http.ResponseWriter, r *http.Request) {
+
+	organisationID, ok := adminOrganisation(w, r)
+	if !ok {
+		return
+	}
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	// only the organisation's own keys can be changed
+	keys, err := api.store.ListAPIKeys(organisationID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var key *APIKey
+	for i := range keys {
+		if keys[i].ID == id {
+			key = &keys[i]
+		}
+	}
+	if key == nil {
+		writeError(w, http.StatusNotFound, "not_found", "API key not found")
+		return
+	}
+
+	var errs []APIError
+	for i, name := range request.Roles {
+		if _, err := findRole(api.store, organisationID, name); err == ErrRoleNotFound {
+			errs = append(errs, APIError{Code: codeInvalidValue, Message: fmt.Sprintf("unknown role %s", name), Pointer: fmt.Sprintf("/roles/%d", i)})
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+
+	key.Roles = append([]string{}, request.Roles...)
+	if err := api.store.SetAPIKeyRoles(id, key.Roles); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, key, Link{Rel: "self", Href: fmt.Sprintf("/v1/admin/api-keys/%s/roles", id)})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	encoded, err := json.Marshal(v)
+	require.Nil(t, err)
+	return encoded
+}
+
+func TestRoutesNeedPermissions(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	self := fmt.Sprintf("/v1/payments/%s", payment.ID)
+	_, operator := createAPIKey(t, payment.OrganisationID, RoleOperator)
+	_, approver := createAPIKey(t, payment.OrganisationID, RoleApprover)
+	auditorKey, auditor := createAPIKey(t, payment.OrganisationID, RoleAuditor)
+
+	assert.Equal(t, 403, sendWithKey(t, auditor, http.MethodPost, "/v1/payments", mustMarshal(t, payment)).Code)
+	require.Equal(t, 201, sendWithKey(t, operator, http.MethodPost, "/v1/payments", mustMarshal(t, payment)).Code)
+	assert.Equal(t, 200, sendWithKey(t, auditor, http.MethodGet, self, nil).Code)
+	assert.Equal(t, 403, sendWithKey(t, operator, http.MethodGet, self+"/history", nil).Code)
+
+	// asking for approval is part of writing a payment, but submitting it needs approval
+	require.Equal(t, 200, sendWithKey(t, operator, http.MethodPost, self+"/actions/request_approval", nil).Code)
+	assert.Equal(t, 403, sendWithKey(t, operator, http.MethodPost, self+"/actions/submit", nil).Code)
+	assert.Equal(t, 403, sendWithKey(t, approver, http.MethodDelete, self, nil).Code)
+	assert.Equal(t, 200, sendWithKey(t, approver, http.MethodPost, self+"/actions/submit", nil).Code)
+	assert.Equal(t, 404, sendWithKey(t, operator, http.MethodPost, self+"/actions/teleport", nil).Code)
+	subscriptionID := uuid.NewV4().String()
+	assert.Equal(t, 403, sendWithKey(t, operator, http.MethodGet, "/v1/subscriptions/"+subscriptionID, nil).Code)
+
+	// denied requests are in the audit trail
+	rw := sendWithKey(t, auditor, http.MethodGet, "/v1/audit?filter[action]="+AuditAccessDenied, nil)
+	require.Equal(t, 200, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var entries []AuditEntry
+	require.Nil(t, json.Unmarshal(response.Data, &entries))
+	require.Len(t, entries, 5)
+
+	assert.Equal(t, "api_key:"+auditorKey.ID.String(), entries[0].Actor)
+	assert.Equal(t, uuid.Nil, entries[0].PaymentID)
+	assert.Equal(t, payment.OrganisationID, entries[0].OrganisationID)
+	assert.Equal(t, &AccessDenial{Method: http.MethodPost, Path: "/v1/payments", Permission: PermPaymentsWrite}, entries[0].Denied)
+	assert.Equal(t, payment.ID, entries[1].PaymentID)
+	assert.Equal(t, PermAuditRead, entries[1].Denied.Permission)
+	assert.Equal(t, PermPaymentsApprove, entries[2].Denied.Permission)
+	assert.Equal(t, PermPaymentsDelete, entries[3].Denied.Permission)
+
+	// only requests for payments are recorded against them
+	assert.Equal(t, uuid.Nil, entries[4].PaymentID)
+	assert.Equal(t, subscriptionID, entries[4].Denied.ResourceID)
+	assert.Empty(t, entries[1].Denied.ResourceID)
+}
+
+func TestAdminManagesRolesAndAssignments(t *testing.T) {
+
+	emptyDatabase(t)
+
+	organisationID := uuid.NewV4()
+	_, admin := createAPIKey(t, organisationID)
+	readerKey, reader := createAPIKey(t, organisationID, "reader")
+
+	// a role that doesn't exist grants nothing
+	assert.Equal(t, 403, sendWithKey(t, reader, http.MethodGet, "/v1/payments", nil).Code)
+
+	rw := sendWithKey(t, admin, http.MethodPut, "/v1/admin/roles/reader", []byte(`{"description": "Reads", "permissions": ["payments:read"]}`))
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	assert.Equal(t, 200, sendWithKey(t, reader, http.MethodGet, "/v1/payments", nil).Code)
+	assert.Equal(t, 403, sendWithKey(t, reader, http.MethodGet, "/v1/admin/roles", nil).Code)
+
+	rw = sendWithKey(t, admin, http.MethodPut, "/v1/admin/roles/Bad_Name", []byte(`{"permissions": ["payments:fly"]}`))
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/name": codeInvalidFormat, "/permissions/0": codeInvalidValue}, errorPointers(response.Errors))
+	assert.Equal(t, 409, sendWithKey(t, admin, http.MethodPut, "/v1/admin/roles/admin", []byte(`{"permissions": []}`)).Code)
+	assert.Equal(t, 409, sendWithKey(t, admin, http.MethodDelete, "/v1/admin/roles/auditor", nil).Code)
+
+	rw = sendWithKey(t, admin, http.MethodGet, "/v1/admin/roles", nil)
+	require.Equal(t, 200, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var roles []Role
+	require.Nil(t, json.Unmarshal(response.Data, &roles))
+	var names []string
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	assert.Equal(t, []string{RoleAdmin, RoleOperator, RoleApprover, RoleAuditor, "reader"}, names)
+	assert.True(t, roles[0].Builtin)
+	assert.False(t, roles[4].Builtin)
+
+	// assignments
+	rolesPath := fmt.Sprintf("/v1/admin/api-keys/%s/roles", readerKey.ID)
+	rw = sendWithKey(t, admin, http.MethodPut, rolesPath, []byte(`{"roles": ["auditor", "nobody"]}`))
+	require.Equal(t, 422, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/roles/1": codeInvalidValue}, errorPointers(response.Errors))
+
+	require.Equal(t, 200, sendWithKey(t, admin, http.MethodPut, rolesPath, []byte(`{"roles": ["auditor"]}`)).Code)
+	assert.Equal(t, 200, sendWithKey(t, reader, http.MethodGet, "/v1/audit", nil).Code)
+
+	// other organisations' keys can't be changed
+	otherKey, _ := createAPIKey(t, uuid.NewV4())
+	rw = sendWithKey(t, admin, http.MethodPut, fmt.Sprintf("/v1/admin/api-keys/%s/roles", otherKey.ID), []byte(`{"roles": []}`))
+	assert.Equal(t, 404, rw.Code)
+
+	rw = sendWithKey(t, admin, http.MethodGet, "/v1/admin/api-keys", nil)
+	require.Equal(t, 200, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var keys []APIKey
+	require.Nil(t, json.Unmarshal(response.Data, &keys))
+	assert.Len(t, keys, 2)
+
+	assert.Equal(t, 200, sendWithKey(t, admin, http.MethodDelete, "/v1/admin/roles/reader", nil).Code)
+	assert.Equal(t, 404, sendWithKey(t, admin, http.MethodDelete, "/v1/admin/roles/reader", nil).Code)
+
+	// the admin API needs to know whose roles to manage
+	rw = sendAs(t, "", http.MethodGet, "/v1/admin/roles", nil)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestOnlyPlatformKeysReplaceFXRates(t *testing.T) {
+
+	emptyDatabase(t)
+
+	rates := []byte(`[{"base_currency": "GBP", "quote_currency": "USD", "rate": "1.25"}]`)
+	organisationID := uuid.NewV4()
+	_, admin := createAPIKey(t, organisationID)
+	assert.Equal(t, 200, sendWithKey(t, admin, http.MethodGet, "/v1/fx/rates", nil).Code)
+	assert.Equal(t, 403, sendWithKey(t, admin, http.MethodPut, "/v1/fx/rates", rates).Code)
+
+	// organisations can't grant the permission themselves
+	rw := sendWithKey(t, admin, http.MethodPut, "/v1/admin/roles/treasury", []byte(`{"permissions": ["fx:write"]}`))
+	require.Equal(t, 422, rw.Code)
+	_, other := createAPIKey(t, organisationID, RolePlatform)
+	assert.Equal(t, 403, sendWithKey(t, other, http.MethodPut, "/v1/fx/rates", rates).Code)
+
+	_, platform := createAPIKey(t, platformOrganisation, RolePlatform)
+	assert.Equal(t, 200, sendWithKey(t, platform, http.MethodPut, "/v1/fx/rates", rates).Code)
+	assert.Equal(t, 403, sendWithKey(t, platform, http.MethodGet, "/v1/payments", nil).Code)
+	_, platformAdmin := createAPIKey(t, platformOrganisation, RoleAdmin)
+	assert.Equal(t, 403, sendWithKey(t, platformAdmin, http.MethodGet, "/v1/payments", nil).Code)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRelayInterval = time.Second
+
+	// the most events published to a sink at a time
+	relayBatchSize = 100
+)
+
+// RelayOffset is the sequence of the last payment event published to a sink, which the relay resumes from
+type RelayOffset struct {
+	tableName struct{} `sql:"relay_offsets"`
+
+	Sink      string    `sql:",pk"`
+	Seq       int64     `sql:",notnull"`
+	UpdatedAt time.Time `sql:",notnull"`
+}
+
+// EventSink is somewhere payment events are published to by the relay
+type EventSink interface {
+	// Name identifies the sink's offset in the outbox, so it must not change between restarts
+	Name() string
+
+	// Publish publishes events in sequence order. if it fails, the events are published again later, so a sink can be
+	// sent an event more than once.
+	Publish(events []PaymentEvent) error
+}
+
+// eventRelay publishes the payment events in the outbox to sinks, at least once and in the order they were committed.
+// the offset of each durable sink is stored, so it carries on from where it stopped when the service restarts, and
+// only one replica publishes to it at a time. local sinks belong to this process, so every replica publishes to its
+// own, starting from the events committed after it started.
+type eventRelay struct {
+	store PaymentStore
+	sinks []*relaySink
+}
+
+type relaySink struct {
+	sink  EventSink
+	local bool
+
+	// the offset of a local sink, or -1 until it has been started from the latest event
+	after int64
+}
+
+func newEventRelay(store PaymentStore) *eventRelay {
+	return &eventRelay{store: store}
+}
+
+// add adds a durable sink, which is sent every event from the start of the outbox
+func (relay *eventRelay) add(sink EventSink) {
+	relay.sinks = append(relay.sinks, &relaySink{sink: sink})
+}
+
+// addLocal adds a sink that only this process publishes to
+func (relay *eventRelay) addLocal(sink EventSink) {
+	relay.sinks = append(relay.sinks, &relaySink{sink: sink, local: true, after: -1})
+}
+
+// relay publishes the events committed since each sink was last published to, and returns how many it published. a
+// sink that fails is left to try again next time, without holding up the others.
+func (relay *eventRelay) relay() (int, error) {
+	published := 0
+	var failed error
+	for _, sink := range relay.sinks {
+		var n int
+		var err error
+		if sink.local {
+			n, err = relay.relayLocal(sink)
+		} else {
+			n, err = relay.relayDurable(sink.sink)
+		}
+		published += n
+		if err != nil {
+			log.Printf("failed to publish payment events to %s: %s", sink.sink.Name(), err)
+			failed = err
+		}
+	}
+	return published, failed
+}
+
+func (relay *eventRelay) relayLocal(sink *relaySink) (int, error) {
+	if sink.after < 0 {
+		latest, err := relay.store.LatestEventSeq()
+		if err != nil {
+			return 0, err
+		}
+		sink.after = latest
+	}
+
+	published := 0
+	for {
+		events, err := relay.store.ListEvents(EventQuery{After: sink.after, Limit: relayBatchSize})
+		if err != nil || len(events) == 0 {
+			return published, err
+		}
+		if err := sink.sink.Publish(events); err != nil {
+			return published, err
+		}
+		sink.after = events[len(events)-1].Seq
+		published += len(events)
+		if len(events) < relayBatchSize {
+			return published, nil
+		}
+	}
+}
+
+func (relay *eventRelay) relayDurable(sink EventSink) (int, error) {
+	published := 0
+	for {
+		// the offset is locked until the batch is published and the offset moved on, so no other replica publishes it
+		// too. if publishing fails the offset stays where it was.
+		n := 0
+		err := relay.store.RunInTransaction(func(tx PaymentStore) error {
+			after, ok, err := tx.LockRelayOffset(sink.Name())
+			if err != nil || !ok {
+				return err
+			}
+			events, err := tx.ListEvents(EventQuery{After: after, Limit: relayBatchSize})
+			if err != nil || len(events) == 0 {
+				return err
+			}
+			if err := sink.Publish(events); err != nil {
+				return err
+			}
+			n = len(events)
+			return tx.SetRelayOffset(sink.Name(), events[n-1].Seq)
+		})
+		if err != nil {
+			return published, err
+		}
+		published += n
+		if n < relayBatchSize {
+			return published, nil
+		}
+	}
+}
+
+// run relays events every interval until done is closed
+func (relay *eventRelay) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// failures have been logged, and are retried next time
+			relay.relay()
+		}
+	}
+}
+
+// eventBus publishes payment events to handlers in this process, such as projections
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers map[int]func(PaymentEvent)
+	next     int
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{handlers: map[int]func(PaymentEvent){}}
+}
+
+// Subscribe calls handler with every event published from now on, until unsubscribe is called. handlers are called
+// one event at a time, so they should be quick.
+func (bus *eventBus) Subscribe(handler func(PaymentEvent)) (unsubscribe func()) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	id := bus.next
+	bus.next++
+	bus.handlers[id] = handler
+	return func() {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		delete(bus.handlers, id)
+	}
+}
+
+func (bus *eventBus) Name() string {
+	return "bus"
+}
+
+func (bus *eventBus) Publish(events []PaymentEvent) error {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	for _, event := range events {
+		for _, handler := range bus.handlers {
+			handler(event)
+		}
+	}
+	return nil
+}
+
+// fileSink appends payment events to a file as newline delimited JSON, one event per line
+type fileSink struct {
+	path string
+}
+
+func newFileSink(path string) *fileSink {
+	return &fileSink{path: path}
+}
+
+func (sink *fileSink) Name() string {
+	return "file:" + sink.path
+}
+
+func (sink *fileSink) Publish(events []PaymentEvent) error {
+	file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	// the events must be on disk before the offset moves past them
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Broker is a message broker, such as Kafka or NATS, that payment events can be published to. Publish returns once
+// the broker has accepted the message.
+type Broker interface {
+	Publish(topic, key string, message []byte) error
+}
+
+// brokerSink publishes payment events to a topic of a broker as JSON, keyed by payment, so that a broker that
+// partitions by key keeps each payment's events in order
+type brokerSink struct {
+	name   string
+	broker Broker
+	topic  string
+}
+
+func newBrokerSink(name string, broker Broker, topic string) *brokerSink {
+	return &brokerSink{name: name, broker: broker, topic: topic}
+}
+
+func (sink *brokerSink) Name() string {
+	return sink.name
+}
+
+func (sink *brokerSink) Publish(events []PaymentEvent) error {
+	for _, event := range events {
+		message, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if err := sink.broker.Publish(sink.topic, event.PaymentID.String(), message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
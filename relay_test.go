@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBroker records the messages published to it, or fails while err is set
+type fakeBroker struct {
+	err      error
+	topics   []string
+	keys     []string
+	messages [][]byte
+}
+
+func (broker *fakeBroker) Publish(topic, key string, message []byte) error {
+	if broker.err != nil {
+		return broker.err
+	}
+	broker.topics = append(broker.topics, topic)
+	broker.keys = append(broker.keys, key)
+	broker.messages = append(broker.messages, message)
+	return nil
+}
+
+// readEventLog reads the events a file sink has written
+func readEventLog(t *testing.T, path string) []PaymentEvent {
+	file, err := os.Open(path)
+	require.Nil(t, err)
+	defer file.Close()
+	var events []PaymentEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var event PaymentEvent
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.Nil(t, scanner.Err())
+	return events
+}
+
+func TestRelayPublishesToDurableSinksOnce(t *testing.T) {
+
+	emptyDatabase(t)
+
+	dir, err := os.MkdirTemp("", "relay")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+
+	payment := createExamplePayment()
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	require.Equal(t, 200, postAction(t, payment, "submit").Code)
+
+	relay := newEventRelay(store)
+	relay.add(newFileSink(path))
+	published, err := relay.relay()
+	require.Nil(t, err)
+	assert.Equal(t, 2, published)
+
+	events := readEventLog(t, path)
+	require.Len(t, events, 2)
+	assert.Equal(t, EventPaymentCreated, events[0].Type)
+	assert.Equal(t, "payment.submitted", events[1].Type)
+	assert.Equal(t, payment.ID, events[1].Data.ID)
+
+	// a relay started later, as after a restart, carries on from the stored offset
+	other := createExamplePayment()
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", other).Code)
+	relay = newEventRelay(store)
+	relay.add(newFileSink(path))
+	published, err = relay.relay()
+	require.Nil(t, err)
+	assert.Equal(t, 1, published)
+
+	events = readEventLog(t, path)
+	require.Len(t, events, 3)
+	assert.Equal(t, other.ID, events[2].PaymentID)
+	assert.True(t, events[1].Seq < events[2].Seq)
+
+	published, err = relay.relay()
+	require.Nil(t, err)
+	assert.Equal(t, 0, published)
+}
+
+func TestRelayRetriesFailedSinks(t *testing.T) {
+
+	emptyDatabase(t)
+
+	broker := &fakeBroker{err: errors.New("broker unavailable")}
+	bus := newEventBus()
+	var received []PaymentEvent
+	bus.Subscribe(func(event PaymentEvent) {
+		received = append(received, event)
+	})
+
+	relay := newEventRelay(store)
+	relay.add(newBrokerSink("broker", broker, "payments"))
+	relay.addLocal(bus)
+
+	// local sinks start from the events committed after the relay starts
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", createExamplePayment()).Code)
+	published, err := relay.relay()
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, published)
+	assert.Len(t, received, 0)
+
+	payment := createExamplePayment()
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	// the broker failing doesn't hold up the bus, and its events are published once it recovers
+	published, err = relay.relay()
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, published)
+	require.Len(t, received, 1)
+	assert.Equal(t, payment.ID, received[0].PaymentID)
+	assert.Len(t, broker.messages, 0)
+
+	broker.err = nil
+	published, err = relay.relay()
+	require.Nil(t, err)
+	assert.Equal(t, 2, published)
+	assert.Len(t, received, 1)
+	require.Len(t, broker.messages, 2)
+	assert.Equal(t, []string{"payments", "payments"}, broker.topics)
+	assert.Equal(t, payment.ID.String(), broker.keys[1])
+
+	var event PaymentEvent
+	require.Nil(t, json.Unmarshal(broker.messages[1], &event))
+	assert.Equal(t, EventPaymentCreated, event.Type)
+	assert.Equal(t, payment.ID, event.Data.ID)
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+
+	bus := newEventBus()
+	calls := 0
+	unsubscribe := bus.Subscribe(func(PaymentEvent) { calls++ })
+
+	require.Nil(t, bus.Publish([]PaymentEvent{{Type: EventPaymentCreated}, {Type: EventPaymentUpdated}}))
+	assert.Equal(t, 2, calls)
+
+	unsubscribe()
+	require.Nil(t, bus.Publish([]PaymentEvent{{Type: EventPaymentDeleted}}))
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	defaultDeletedRetention       = 30 * 24 * time.Hour
+	defaultRetentionSweepInterval = time.Hour
+)
+
+// recorded as the actor of the audit entries for purged payments
+const retentionActor = "retention-policy"
+
+// RetentionPolicy decides how long data is kept for. DeletedPayments is how long a deleted payment can still be
+// restored before it is purged. zero keeps deleted payments forever.
+type RetentionPolicy struct {
+	DeletedPayments time.Duration
+}
+
+// Apply purges the payments that have been deleted for longer than the policy allows, recording each in the audit
+// trail and publishing a payment.purged event for it, and returns how many were purged
+func (policy RetentionPolicy) Apply(store PaymentStore, now time.Time) (int, error) {
+	if policy.DeletedPayments <= 0 {
+		return 0, nil
+	}
+	purged := 0
+	err := store.RunInTransaction(func(tx PaymentStore) error {
+		payments, err := tx.PurgeDeleted(now.Add(-policy.DeletedPayments))
+		if err != nil {
+			return err
+		}
+		for i := range payments {
+			entry, err := newAuditEntry(AuditPurge, retentionActor, "", &payments[i], nil)
+			if err != nil {
+				return err
+			}
+			if err := recordAudit(tx, &entry); err != nil {
+				return err
+			}
+		}
+		purged = len(payments)
+		return nil
+	})
+	return purged, err
+}
+
+// sweepRetention applies the retention policy every interval, until done is closed. a nil done channel sweeps forever.
+func sweepRetention(store PaymentStore, policy RetentionPolicy, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			purged, err := policy.Apply(store, time.Now())
+			if err != nil {
+				log.Printf("failed to apply retention policy: %s", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("purged %d deleted payments", purged)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionPolicyPurgesOldTombstones(t *testing.T) {
+
+	emptyDatabase(t)
+
+	deleted, kept := createExamplePayment(), createExamplePayment()
+	require.Nil(t, store.Create(&deleted))
+	require.Nil(t, store.Create(&kept))
+	require.Nil(t, store.Delete(deleted.ID, 0))
+	subscription := Subscription{ID: uuid.NewV4(), OrganisationID: deleted.OrganisationID, CallbackURL: "https://example.com/hooks", EventTypes: []string{EventPaymentPurged}, CreatedAt: time.Now().UTC()}
+	require.Nil(t, store.CreateSubscription(&subscription))
+
+	// nothing is purged while it can still be restored, or when deleted payments are kept forever
+	policy := RetentionPolicy{DeletedPayments: 24 * time.Hour}
+	purged, err := policy.Apply(store, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	assert.Equal(t, 0, purged)
+	purged, err = RetentionPolicy{}.Apply(store, time.Now().Add(365*24*time.Hour))
+	require.Nil(t, err)
+	assert.Equal(t, 0, purged)
+
+	purged, err = policy.Apply(store, time.Now().Add(25*time.Hour))
+	require.Nil(t, err)
+	assert.Equal(t, 1, purged)
+
+	_, err = store.GetIncludingDeleted(deleted.ID)
+	assert.Equal(t, ErrPaymentNotFound, err)
+	_, err = store.Get(kept.ID)
+	assert.Nil(t, err)
+
+	// the purge is recorded, and the history outlives the payment
+	entries, err := store.ListAudit(AuditQuery{PaymentID: deleted.ID})
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, AuditPurge, entries[0].Action)
+	assert.Equal(t, retentionActor, entries[0].Actor)
+	assert.Equal(t, deleted.ID, entries[0].Before.ID)
+	assert.Nil(t, entries[0].After)
+
+	// and published, to the outbox and the organisation's webhooks
+	events, err := store.ListEvents(EventQuery{OrganisationID: deleted.OrganisationID, Types: []string{EventPaymentPurged}})
+	require.Nil(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, entries[0].ID, events[0].ID)
+	assert.Equal(t, deleted.ID, events[0].PaymentID)
+	assert.Nil(t, events[0].Data)
+	deliveries, err := store.ListDeliveries(subscription.ID, webhookBatchSize)
+	require.Nil(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, events[0].ID, deliveries[0].EventID)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// the rule sets of each scheme are compiled into the binary. each file is a JSON rule set for one version of a
+// scheme's rules, named scheme.vN.json
+//
+//go:embed schemes/*.json
+var embeddedSchemeRules embed.FS
+
+// SchemeRules are the limits a scheme puts on the payments it carries. lists that are empty and amounts that aren't
+// given don't limit anything.
+type SchemeRules struct {
+	Currencies            []string       `json:"currencies,omitempty"`
+	MinAmount             Decimal        `json:"min_amount"`
+	MaxAmount             Decimal        `json:"max_amount"`
+	PaymentTypes          []string       `json:"payment_types,omitempty"`
+	AccountNumberCodes    []string       `json:"account_number_codes,omitempty"`
+	BankIDCodes           []string       `json:"bank_id_codes,omitempty"`
+	SchemePaymentSubTypes []string       `json:"scheme_payment_sub_types,omitempty"`
+	MaxLengths            map[string]int `json:"max_lengths,omitempty"`
+}
+
+// SchemeRuleSet is a version of a scheme's rules, which applies to payments processed on or after EffectiveFrom.
+// rules for a scheme payment type override the scheme's own, and when there are any, the scheme payment type must
+// be one of them.
+type SchemeRuleSet struct {
+	Scheme        string `json:"scheme"`
+	Version       int    `json:"version"`
+	EffectiveFrom string `json:"effective_from,omitempty"`
+	SchemeRules
+	SchemePaymentTypes map[string]SchemeRules `json:"scheme_payment_types,omitempty"`
+}
+
+// schemeLengthFields are the attributes whose length a rule set can limit, by their path below /attributes
+var schemeLengthFields = map[string]func(Attributes) string{
+	"reference":                      func(a Attributes) string { return a.Reference },
+	"end_to_end_reference":           func(a Attributes) string { return a.EndToEndReference },
+	"numeric_reference":              func(a Attributes) string { return a.NumericReference },
+	"payment_id":                     func(a Attributes) string { return a.PaymentID },
+	"payment_purpose":                func(a Attributes) string { return a.PaymentPurpose },
+	"debtor_party/name":              func(a Attributes) string { return a.DebtorParty.Name },
+	"debtor_party/account_name":      func(a Attributes) string { return a.DebtorParty.AccountName },
+	"beneficiary_party/name":         func(a Attributes) string { return partyOf(a.BeneficiaryParty.DebtorParty).Name },
+	"beneficiary_party/account_name": func(a Attributes) string { return partyOf(a.BeneficiaryParty.DebtorParty).AccountName },
+}
+
+// a schemeRule checks a payment against one kind of limit of the rules of its scheme. new kinds of limit are added
+// to SchemeRules and checked by a rule in schemeRuleChecks.
+type schemeRule func(v *paymentValidator, rules SchemeRules, payment Payment)
+
+var schemeRuleChecks = []schemeRule{
+	checkSchemeCurrency,
+	checkSchemeAmount,
+	checkSchemePaymentType,
+	checkSchemeAccounts,
+	checkSchemeLengths,
+}
+
+// schemeRuleBook holds every version of the rule sets of each scheme, ordered by version
+type schemeRuleBook struct {
+	sets map[string][]SchemeRuleSet
+}
+
+// loadSchemeRules reads and checks the rule sets in the .json files of dir
+func loadSchemeRules(fsys fs.FS, dir string) (*schemeRuleBook, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	book := &schemeRuleBook{sets: map[string][]SchemeRuleSet{}}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var set SchemeRuleSet
+		if err := json.Unmarshal(content, &set); err != nil {
+			return nil, fmt.Errorf("%s: %s", entry.Name(), err)
+		}
+		if err := set.check(); err != nil {
+			return nil, fmt.Errorf("%s: %s", entry.Name(), err)
+		}
+		for _, existing := range book.sets[set.Scheme] {
+			if existing.Version == set.Version {
+				return nil, fmt.Errorf("%s: version %d of the %s rules is defined more than once", entry.Name(), set.Version, set.Scheme)
+			}
+		}
+		book.sets[set.Scheme] = append(book.sets[set.Scheme], set)
+	}
+	for _, sets := range book.sets {
+		sort.Slice(sets, func(i, j int) bool { return sets[i].Version < sets[j].Version })
+	}
+	return book, nil
+}
+
+// mustLoadEmbeddedSchemeRules reads the rule sets compiled into the binary, which are checked by the tests
+func mustLoadEmbeddedSchemeRules() *schemeRuleBook {
+	book, err := loadSchemeRules(embeddedSchemeRules, "schemes")
+	if err != nil {
+		panic(err)
+	}
+	return book
+}
+
+// check reports the first problem with a rule set, so that a bad rule set stops the API starting
+func (set SchemeRuleSet) check() error {
+	if !contains(paymentSchemes, set.Scheme) {
+		return fmt.Errorf("scheme must be one of %s", strings.Join(paymentSchemes, ", "))
+	}
+	if set.Version < 1 {
+		return fmt.Errorf("version must be at least 1")
+	}
+	if set.EffectiveFrom != "" {
+		if _, err := time.Parse("2006-01-02", set.EffectiveFrom); err != nil {
+			return fmt.Errorf("effective_from must be a YYYY-MM-DD date")
+		}
+	}
+	if err := set.SchemeRules.check(); err != nil {
+		return err
+	}
+	for schemePaymentType, rules := range set.SchemePaymentTypes {
+		if !contains(schemePaymentTypes, schemePaymentType) {
+			return fmt.Errorf("scheme payment type %s must be one of %s", schemePaymentType, strings.Join(schemePaymentTypes, ", "))
+		}
+		if err := rules.check(); err != nil {
+			return fmt.Errorf("%s: %s", schemePaymentType, err)
+		}
+	}
+	return nil
+}
+
+func (rules SchemeRules) check() error {
+	for _, currency := range rules.Currencies {
+		if _, ok := currencyExponent(currency); !ok {
+			return fmt.Errorf("currency %s must be an ISO 4217 currency code", currency)
+		}
+	}
+	for name, amount := range map[string]Decimal{"min_amount": rules.MinAmount, "max_amount": rules.MaxAmount} {
+		if !amount.IsEmpty() && (!amount.IsValid() || amount.Sign() < 0) {
+			return fmt.Errorf("%s must be a decimal that isn't negative", name)
+		}
+	}
+	for _, allowed := range []struct {
+		name           string
+		values, domain []string
+	}{
+		{"payment type", rules.PaymentTypes, paymentTypes},
+		{"account number code", rules.AccountNumberCodes, accountNumberCodes},
+		{"scheme payment sub type", rules.SchemePaymentSubTypes, schemePaymentSubTypes},
+	} {
+		for _, value := range allowed.values {
+			if !contains(allowed.domain, value) {
+				return fmt.Errorf("%s %s must be one of %s", allowed.name, value, strings.Join(allowed.domain, ", "))
+			}
+		}
+	}
+	for field, length := range rules.MaxLengths {
+		if _, ok := schemeLengthFields[field]; !ok {
+			return fmt.Errorf("the length of %s can't be limited", field)
+		}
+		if length < 1 {
+			return fmt.Errorf("the length of %s must be limited to at least 1", field)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleSet returns the latest version of a scheme's rules that is in effect on a processing date, if there is one
+func (book *schemeRuleBook) ruleSet(scheme, processingDate string) (SchemeRuleSet, bool) {
+	if book == nil {
+		return SchemeRuleSet{}, false
+	}
+	sets := book.sets[scheme]
+	for i := len(sets) - 1; i >= 0; i-- {
+		if sets[i].EffectiveFrom <= processingDate {
+			return sets[i], true
+		}
+	}
+	return SchemeRuleSet{}, false
+}
+
+// rulesFor returns the rules for a scheme payment type, which are the scheme's with those of the type overriding them
+func (set SchemeRuleSet) rulesFor(schemePaymentType string) SchemeRules {
+	rules := set.SchemeRules
+	override, ok := set.SchemePaymentTypes[schemePaymentType]
+	if !ok {
+		return rules
+	}
+	if override.Currencies != nil {
+		rules.Currencies = override.Currencies
+	}
+	if !override.MinAmount.IsEmpty() {
+		rules.MinAmount = override.MinAmount
+	}
+	if !override.MaxAmount.IsEmpty() {
+		rules.MaxAmount = override.MaxAmount
+	}
+	if override.PaymentTypes != nil {
+		rules.PaymentTypes = override.PaymentTypes
+	}
+	if override.AccountNumberCodes != nil {
+		rules.AccountNumberCodes = override.AccountNumberCodes
+	}
+	if override.BankIDCodes != nil {
+		rules.BankIDCodes = override.BankIDCodes
+	}
+	if override.SchemePaymentSubTypes != nil {
+		rules.SchemePaymentSubTypes = override.SchemePaymentSubTypes
+	}
+	if len(override.MaxLengths) > 0 {
+		maxLengths := map[string]int{}
+		for field, length := range rules.MaxLengths {
+			maxLengths[field] = length
+		}
+		for field, length := range override.MaxLengths {
+			maxLengths[field] = length
+		}
+		rules.MaxLengths = maxLengths
+	}
+	return rules
+}
+
+// checkSchemeRules checks a payment against the rules of its scheme in effect on its processing date, returning the
+// rule set that was applied, if any was. payments for schemes without rules are only checked by validatePayment.
+func checkSchemeRules(payment Payment, book *schemeRuleBook) (*SchemeRuleSet, []APIError) {
+	attributes := payment.Attributes
+	set, ok := book.ruleSet(attributes.PaymentScheme, attributes.ProcessingDate)
+	if !ok {
+		return nil, nil
+	}
+
+	v := &paymentValidator{}
+	if len(set.SchemePaymentTypes) > 0 && attributes.SchemePaymentType != "" {
+		if _, ok := set.SchemePaymentTypes[attributes.SchemePaymentType]; !ok {
+			var allowed []string
+			for schemePaymentType := range set.SchemePaymentTypes {
+				allowed = append(allowed, schemePaymentType)
+			}
+			sort.Strings(allowed)
+			v.add("/attributes/scheme_payment_type", codeInvalidValue, fmt.Sprintf("scheme_payment_type must be one of %s for %s payments", strings.Join(allowed, ", "), set.Scheme))
+		}
+	}
+	rules := set.rulesFor(attributes.SchemePaymentType)
+	for _, check := range schemeRuleChecks {
+		check(v, rules, payment)
+	}
+	return &set, v.errs
+}
+
+// schemeOneOf reports a value the scheme doesn't allow. values that are missing are left to validatePayment.
+func (v *paymentValidator) schemeOneOf(pointer, value string, allowed []string, scheme string) {
+	if value == "" || len(allowed) == 0 || contains(allowed, value) {
+		return
+	}
+	v.add(pointer, codeInvalidValue, fmt.Sprintf("%s must be %s for %s payments", path.Base(pointer), strings.Join(allowed, " or "), scheme))
+}
+
+func checkSchemeCurrency(v *paymentValidator, rules SchemeRules, payment Payment) {
+	attributes := payment.Attributes
+	if attributes.Currency == "" || len(rules.Currencies) == 0 || contains(rules.Currencies, attributes.Currency) {
+		return
+	}
+	v.add("/attributes/currency", codeInvalidCurrency, fmt.Sprintf("currency must be %s for %s payments", strings.Join(rules.Currencies, " or "), attributes.PaymentScheme))
+}
+
+func checkSchemeAmount(v *paymentValidator, rules SchemeRules, payment Payment) {
+	attributes := payment.Attributes
+	amount := attributes.Amount
+	if amount.IsEmpty() || !amount.IsValid() || amount.Sign() <= 0 {
+		return
+	}
+	switch {
+	case !rules.MinAmount.IsEmpty() && amount.Cmp(rules.MinAmount) < 0:
+		v.add("/attributes/amount", "amount_below_limit", fmt.Sprintf("amount must be at least %s for %s payments", rules.MinAmount, attributes.PaymentScheme))
+	case !rules.MaxAmount.IsEmpty() && amount.Cmp(rules.MaxAmount) > 0:
+		v.add("/attributes/amount", "amount_above_limit", fmt.Sprintf("amount must be at most %s for %s payments", rules.MaxAmount, attributes.PaymentScheme))
+	}
+}
+
+func checkSchemePaymentType(v *paymentValidator, rules SchemeRules, payment Payment) {
+	attributes := payment.Attributes
+	v.schemeOneOf("/attributes/payment_type", attributes.PaymentType, rules.PaymentTypes, attributes.PaymentScheme)
+	v.schemeOneOf("/attributes/scheme_payment_sub_type", attributes.SchemePaymentSubType, rules.SchemePaymentSubTypes, attributes.PaymentScheme)
+}
+
+// checkSchemeAccounts checks how the debtor and beneficiary accounts are identified. the sponsor's account is in
+// the format of its bank, which can be outside the scheme.
+func checkSchemeAccounts(v *paymentValidator, rules SchemeRules, payment Payment) {
+	attributes := payment.Attributes
+	check := func(pointer string, party DebtorParty) {
+		v.schemeOneOf(pointer+"/account_number_code", party.AccountNumberCode, rules.AccountNumberCodes, attributes.PaymentScheme)
+		v.schemeOneOf(pointer+"/bank_id_code", party.BankIDCode, rules.BankIDCodes, attributes.PaymentScheme)
+	}
+	check("/attributes/debtor_party", partyOf(&attributes.DebtorParty))
+	check("/attributes/beneficiary_party", partyOf(attributes.BeneficiaryParty.DebtorParty))
+}
+
+func checkSchemeLengths(v *paymentValidator, rules SchemeRules, payment Payment) {
+	var fields []string
+	for field := range rules.MaxLengths {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if length := rules.MaxLengths[field]; utf8.RuneCountInString(schemeLengthFields[field](payment.Attributes)) > length {
+			v.add("/attributes/"+field, "too_long", fmt.Sprintf("%s must be at most %d characters for %s payments", path.Base(field), length, payment.Attributes.PaymentScheme))
+		}
+	}
+}
+
+// checkPayment runs every check on a payment that is being written, so that the client can fix all of the problems
+// at once
+func (api *api) checkPayment(payment Payment) []APIError {
+	errs := append(validatePayment(payment), checkSortCodes(payment, api.sortCodeRules)...)
+	_, schemeErrs := checkSchemeRules(payment, api.schemeRules)
+	return append(errs, schemeErrs...)
+}
+
+// PaymentValidation is the result of checking a payment without creating it
+type PaymentValidation struct {
+	Valid          bool   `json:"valid"`
+	PaymentScheme  string `json:"payment_scheme"`
+	RuleSetVersion int    `json:"rule_set_version,omitempty"`
+}
+
+// business logic for POST /v1/payments/validate endpoint, which checks a payment as POST /v1/payments would without
+// creating it. a payment that would be created gets 200 with the version of its scheme's rules that was applied.
+func (api *api) dryRunPayment(w http.ResponseWriter, r *http.Request) {
+
+	payment, ok := decodePayment(w, r)
+	if !ok {
+		return
+	}
+	if !checkOrganisation(w, r, payment) {
+		return
+	}
+	if errs := api.checkPayment(payment); len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+	if !api.checkFX(api.storeFor(r), w, payment, "") {
+		return
+	}
+
+	result := PaymentValidation{Valid: true, PaymentScheme: payment.Attributes.PaymentScheme}
+	if set, ok := api.schemeRules.ruleSet(payment.Attributes.PaymentScheme, payment.Attributes.ProcessingDate); ok {
+		result.RuleSetVersion = set.Version
+	}
+	writeData(w, http.StatusOK, result, Link{Rel: "create", Href: "/v1/payments"})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createSEPAPayment returns an example euro payment between IBANs
+func createSEPAPayment() Payment {
+	payment := createExamplePayment()
+	attributes := &payment.Attributes
+	attributes.PaymentScheme = "SEPA"
+	attributes.Currency = "EUR"
+	attributes.DebtorParty.SponsorParty = &SponsorParty{AccountNumber: "FR1420041010050500013M02606", BankID: "PSSTFRPP", BankIDCode: "SWBIC"}
+	attributes.DebtorParty.AccountNumberCode = "IBAN"
+	attributes.BeneficiaryParty.SponsorParty = &SponsorParty{AccountNumber: "DE89370400440532013000", BankID: "COBADEFF", BankIDCode: "SWBIC"}
+	attributes.BeneficiaryParty.AccountNumberCode = "IBAN"
+	return payment
+}
+
+func TestEmbeddedSchemeRules(t *testing.T) {
+
+	book, err := loadSchemeRules(embeddedSchemeRules, "schemes")
+	require.Nil(t, err)
+	for _, scheme := range paymentSchemes {
+		set, ok := book.ruleSet(scheme, "2017-01-18")
+		assert.True(t, ok, scheme)
+		assert.Equal(t, scheme, set.Scheme)
+	}
+
+	// the example payments keep to the rules of their schemes
+	for _, payment := range []Payment{createExamplePayment(), createSEPAPayment(), createSWIFTPayment(), createBACSPayment(uuid.NewV4(), "1.00")} {
+		set, errs := checkSchemeRules(payment, book)
+		assert.Empty(t, errs, payment.Attributes.PaymentScheme)
+		require.NotNil(t, set)
+		assert.Equal(t, 1, set.Version)
+	}
+}
+
+func TestCheckSchemeRules(t *testing.T) {
+
+	book := mustLoadEmbeddedSchemeRules()
+	for name, test := range map[string]struct {
+		payment  func() Payment
+		pointers map[string]string
+	}{
+		"FPS payments are limited to 1m": {
+			payment: func() Payment {
+				payment := createExamplePayment()
+				payment.Attributes.Amount = MustParseDecimal("1000000.01")
+				return payment
+			},
+			pointers: map[string]string{"/attributes/amount": "amount_above_limit"},
+		},
+		"FPS payments are in GBP": {
+			payment: func() Payment {
+				payment := createExamplePayment()
+				payment.Attributes.Currency = "EUR"
+				return payment
+			},
+			pointers: map[string]string{"/attributes/currency": codeInvalidCurrency},
+		},
+		"FPS payments are credits": {
+			payment: func() Payment {
+				payment := createExamplePayment()
+				payment.Attributes.PaymentType = "Debit"
+				return payment
+			},
+			pointers: map[string]string{"/attributes/payment_type": codeInvalidValue},
+		},
+		"SEPA payments are in EUR between IBANs": {
+			payment: func() Payment {
+				payment := createSEPAPayment()
+				payment.Attributes.Currency = "GBP"
+				payment.Attributes.BeneficiaryParty.AccountNumberCode = "BBAN"
+				return payment
+			},
+			pointers: map[string]string{
+				"/attributes/currency":                              codeInvalidCurrency,
+				"/attributes/beneficiary_party/account_number_code": codeInvalidValue,
+			},
+		},
+		"SEPA instant payments have their own limit": {
+			payment: func() Payment {
+				payment := createSEPAPayment()
+				payment.Attributes.Amount = MustParseDecimal("100000.01")
+				return payment
+			},
+			pointers: map[string]string{"/attributes/amount": "amount_above_limit"},
+		},
+		"BACS payments aren't immediate": {
+			payment: func() Payment {
+				payment := createBACSPayment(uuid.NewV4(), "1.00")
+				payment.Attributes.SchemePaymentType = "ImmediatePayment"
+				return payment
+			},
+			pointers: map[string]string{"/attributes/scheme_payment_type": codeInvalidValue},
+		},
+		"BACS references are 18 characters": {
+			payment: func() Payment {
+				payment := createBACSPayment(uuid.NewV4(), "1.00")
+				payment.Attributes.Reference = strings.Repeat("x", 19)
+				return payment
+			},
+			pointers: map[string]string{"/attributes/reference": "too_long"},
+		},
+		"SWIFT names are 35 characters": {
+			payment: func() Payment {
+				payment := createSWIFTPayment()
+				payment.Attributes.BeneficiaryParty.Name = strings.Repeat("x", 36)
+				return payment
+			},
+			pointers: map[string]string{"/attributes/beneficiary_party/name": "too_long"},
+		},
+		"SEPA names are 70 characters, not bytes": {
+			payment: func() Payment {
+				payment := createSEPAPayment()
+				payment.Attributes.BeneficiaryParty.Name = strings.Repeat("é", 70)
+				return payment
+			},
+			pointers: map[string]string{},
+		},
+		"SEPA names over 70 characters are too long": {
+			payment: func() Payment {
+				payment := createSEPAPayment()
+				payment.Attributes.BeneficiaryParty.Name = strings.Repeat("é", 71)
+				return payment
+			},
+			pointers: map[string]string{"/attributes/beneficiary_party/name": "too_long"},
+		},
+	} {
+		_, errs := checkSchemeRules(test.payment(), book)
+		assert.Equal(t, test.pointers, errorPointers(errs), name)
+	}
+
+	// SEPA payments that aren't instant can be larger
+	payment := createSEPAPayment()
+	payment.Attributes.SchemePaymentType = "ForwardDatedPayment"
+	payment.Attributes.Amount = MustParseDecimal("100000.01")
+	_, errs := checkSchemeRules(payment, book)
+	assert.Empty(t, errs)
+}
+
+func TestSchemeRuleVersionsTakeEffectOnTheirDate(t *testing.T) {
+
+	book, err := loadSchemeRules(fstest.MapFS{
+		"fps.v1.json": {Data: []byte(`{"scheme": "FPS", "version": 1, "max_amount": "250000.00"}`)},
+		"fps.v2.json": {Data: []byte(`{"scheme": "FPS", "version": 2, "effective_from": "2017-02-01", "max_amount": "1000000.00"}`)},
+		"README.md":   {Data: []byte("rule sets that aren't .json files are ignored")},
+	}, ".")
+	require.Nil(t, err)
+
+	payment := createExamplePayment()
+	payment.Attributes.Amount = MustParseDecimal("500000.00")
+	set, errs := checkSchemeRules(payment, book)
+	assert.Equal(t, 1, set.Version)
+	assert.Equal(t, map[string]string{"/attributes/amount": "amount_above_limit"}, errorPointers(errs))
+
+	payment.Attributes.ProcessingDate = "2017-02-01"
+	set, errs = checkSchemeRules(payment, book)
+	assert.Equal(t, 2, set.Version)
+	assert.Empty(t, errs)
+
+	// schemes without rule sets are only validated
+	payment.Attributes.PaymentScheme = "SEPA"
+	set, errs = checkSchemeRules(payment, book)
+	assert.Nil(t, set)
+	assert.Empty(t, errs)
+}
+
+func TestLoadSchemeRulesRejectsBadRuleSets(t *testing.T) {
+
+	for name, files := range map[string][]string{
+		"unknown scheme":   {`{"scheme": "CHAPS", "version": 1}`},
+		"no version":       {`{"scheme": "FPS"}`},
+		"repeated version": {`{"scheme": "FPS", "version": 1}`, `{"scheme": "FPS", "version": 1}`},
+		"bad date":         {`{"scheme": "FPS", "version": 1, "effective_from": "01/02/2017"}`},
+		"bad currency":     {`{"scheme": "FPS", "version": 1, "currencies": ["XYZ"]}`},
+		"bad amount":       {`{"scheme": "FPS", "version": 1, "max_amount": "lots"}`},
+		"unknown field":    {`{"scheme": "FPS", "version": 1, "max_lengths": {"address": 35}}`},
+		"unknown type":     {`{"scheme": "FPS", "version": 1, "scheme_payment_types": {"Cheque": {}}}`},
+		"bad type rules":   {`{"scheme": "FPS", "version": 1, "scheme_payment_types": {"StandingOrder": {"payment_types": ["Refund"]}}}`},
+		"invalid JSON":     {`{"scheme": "FPS",`},
+	} {
+		fsys := fstest.MapFS{}
+		for i, file := range files {
+			fsys[string(rune('a'+i))+".json"] = &fstest.MapFile{Data: []byte(file)}
+		}
+		_, err := loadSchemeRules(fsys, ".")
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestSchemeRulesRunOnCreateAndUpdate(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	payment.Attributes.Amount = MustParseDecimal("1500000.00")
+	rw := sendAs(t, "alice", http.MethodPost, "/v1/payments", payment)
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/attributes/amount": "amount_above_limit"}, errorPointers(response.Errors))
+
+	payment.Attributes.Amount = MustParseDecimal("100.00")
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	payment.Attributes.Currency = "USD"
+	assert.Equal(t, 422, sendAs(t, "alice", http.MethodPut, "/v1/payments/"+payment.ID.String(), payment).Code)
+	payment.Attributes.Currency = "GBP"
+	rw = sendPatch(t, payment, mergePatchContentType, `{"attributes": {"payment_type": "Debit"}}`, nil)
+	assert.Equal(t, 422, rw.Code)
+	assert.Contains(t, rw.Body.String(), "/attributes/payment_type")
+}
+
+func TestValidatePaymentDryRun(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createSEPAPayment()
+	rw := sendAs(t, "alice", http.MethodPost, "/v1/payments/validate", payment)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var result PaymentValidation
+	require.Nil(t, json.Unmarshal(response.Data, &result))
+	assert.Equal(t, PaymentValidation{Valid: true, PaymentScheme: "SEPA", RuleSetVersion: 1}, result)
+
+	// nothing is created
+	assert.Equal(t, 404, sendAs(t, "", http.MethodGet, "/v1/payments/"+payment.ID.String(), nil).Code)
+
+	// problems are reported as they would be when creating the payment
+	payment.Attributes.Currency = "GBP"
+	rw = sendAs(t, "alice", http.MethodPost, "/v1/payments/validate", payment)
+	require.Equal(t, 422, rw.Code)
+	response = APIResponse{}
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/attributes/currency": codeInvalidCurrency}, errorPointers(response.Errors))
+
+	// payments can only be checked for the organisation of the API key
+	_, key := createAPIKey(t, uuid.NewV4(), RoleOperator)
+	assert.Equal(t, 403, sendWithKey(t, key, http.MethodPost, "/v1/payments/validate", mustMarshal(t, payment)).Code)
+	_, auditor := createAPIKey(t, payment.OrganisationID, RoleAuditor)
+	assert.Equal(t, 403, sendWithKey(t, auditor, http.MethodPost, "/v1/payments/validate", mustMarshal(t, payment)).Code)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	defaultStatusReportInterval = 5 * time.Second
+
+	// status reports can be of any version of pacs.002, as the elements that are read haven't changed
+	pacs002NamespacePrefix = "urn:iso:std:iso:20022:tech:xsd:pacs.002."
+)
+
+// the reasons a transaction status from a report couldn't be applied to a payment, and was queued as an exception
+const (
+	ExceptionUnmatched         = "unmatched"
+	ExceptionAmbiguous         = "ambiguous"
+	ExceptionInvalidTransition = "invalid_transition"
+	ExceptionUnknownStatus     = "unknown_status"
+)
+
+// the outcome of each transaction status in a report
+const (
+	ReportOutcomeApplied   = "applied"
+	ReportOutcomeException = "exception"
+)
+
+var ErrStatusExceptionNotFound = errors.New("status report exception not found")
+
+// SchemeStatus is the latest status the scheme reported for a payment. Status is the ISO 20022 transaction status,
+// such as ACSP or RJCT, and ReasonCode the ISO 20022 reason it was given, such as AC01.
+type SchemeStatus struct {
+	Status     string    `json:"status"`
+	ReasonCode string    `json:"reason_code,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	MessageID  string    `json:"message_id"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// StatusReportTransaction is the status of one transaction in a pacs.002 status report
+type StatusReportTransaction struct {
+	StatusID              string `json:"status_id,omitempty" xml:"StsId"`
+	OriginalInstructionID string `json:"original_instruction_id,omitempty" xml:"OrgnlInstrId"`
+	OriginalEndToEndID    string `json:"original_end_to_end_id,omitempty" xml:"OrgnlEndToEndId"`
+	OriginalTransactionID string `json:"original_transaction_id,omitempty" xml:"OrgnlTxId"`
+	OriginalUETR          string `json:"original_uetr,omitempty" xml:"OrgnlUETR"`
+	Status                string `json:"status" xml:"TxSts"`
+	ReasonCode            string `json:"reason_code,omitempty" xml:"StsRsnInf>Rsn>Cd"`
+	Reason                string `json:"reason,omitempty" xml:"StsRsnInf>AddtlInf"`
+}
+
+// pacs002Document is a pacs.002 FIToFIPaymentStatusReport
+type pacs002Document struct {
+	XMLName      xml.Name                  `xml:"Document"`
+	MessageID    string                    `xml:"FIToFIPmtStsRpt>GrpHdr>MsgId"`
+	Transactions []StatusReportTransaction `xml:"FIToFIPmtStsRpt>TxInfAndSts"`
+}
+
+// StatusReportException is a transaction status from a report that couldn't be applied to a payment. exceptions are
+// queued until someone resolves them.
+type StatusReportException struct {
+	tableName struct{} `sql:"status_report_exceptions"`
+
+	ID             uuid.UUID               `json:"id" sql:",pk,type:uuid"`
+	OrganisationID uuid.UUID               `json:"organisation_id" sql:",type:uuid,notnull"`
+	Reason         string                  `json:"reason" sql:",notnull"`
+	Message        string                  `json:"message" sql:",notnull"`
+	PaymentID      *uuid.UUID              `json:"payment_id,omitempty" sql:",type:uuid"`
+	Source         string                  `json:"source" sql:",notnull"`
+	MessageID      string                  `json:"message_id" sql:",notnull"`
+	Transaction    StatusReportTransaction `json:"transaction" sql:",notnull"`
+	ReceivedAt     time.Time               `json:"received_at" sql:",notnull"`
+	ResolvedAt     *time.Time              `json:"resolved_at,omitempty"`
+}
+
+// StatusExceptionQuery selects exceptions. zero values mean no restriction, except that the queue is the unresolved
+// exceptions unless Resolved is set.
+type StatusExceptionQuery struct {
+	OrganisationID uuid.UUID
+	Reason         string
+	Resolved       bool
+	Limit          int
+}
+
+// StatusReportStore persists the exceptions queue
+type StatusReportStore interface {
+	// CreateStatusException queues an exception
+	CreateStatusException(exception *StatusReportException) error
+
+	// GetStatusException returns the exception with the given ID, or ErrStatusExceptionNotFound
+	GetStatusException(id uuid.UUID) (StatusReportException, error)
+
+	// ListStatusExceptions returns the exceptions that are resolved or not, as the query says, newest first
+	ListStatusExceptions(query StatusExceptionQuery) ([]StatusReportException, error)
+
+	// ResolveStatusException takes an exception off the queue, or returns ErrStatusExceptionNotFound
+	ResolveStatusException(id uuid.UUID, at time.Time) error
+}
+
+// StatusReportResult is what happened to each transaction status of a report
+type StatusReportResult struct {
+	MessageID    string                          `json:"message_id"`
+	Transactions []StatusReportTransactionResult `json:"transactions"`
+}
+
+type StatusReportTransactionResult struct {
+	Index       int        `json:"index"`
+	Status      string     `json:"status"`
+	Outcome     string     `json:"outcome"`
+	PaymentID   *uuid.UUID `json:"payment_id,omitempty"`
+	ExceptionID *uuid.UUID `json:"exception_id,omitempty"`
+}
+
+// schemeStatusActions are the actions that take a payment to the status a transaction status reports, in order from
+// submitted. statuses that don't move the payment on, such as pending, have none and are only recorded.
+var schemeStatusActions = map[string][]string{
+	"ACTC": {ActionAccept},
+	"ACCP": {ActionAccept},
+	"ACSP": {ActionAccept},
+	"ACWC": {ActionAccept},
+	"ACSC": {ActionAccept, ActionSettle},
+	"RJCT": {ActionReject},
+	"PDNG": {},
+}
+
+// parsePacs002 reads the transaction statuses of a status report
+func parsePacs002(body []byte) (pacs002Document, error) {
+	var document pacs002Document
+	if err := xml.Unmarshal(body, &document); err != nil {
+		return document, err
+	}
+	if !strings.HasPrefix(document.XMLName.Space, pacs002NamespacePrefix) {
+		return document, fmt.Errorf("not a pacs.002 message")
+	}
+	for i := range document.Transactions {
+		transaction := &document.Transactions[i]
+		transaction.Status = strings.TrimSpace(transaction.Status)
+		if transaction.OriginalEndToEndID == "NOTPROVIDED" {
+			transaction.OriginalEndToEndID = ""
+		}
+	}
+	return document, nil
+}
+
+// matchPayment finds the payment a transaction status is for, by its UETR, which is the payment's ID, or by its end to
+// end reference and scheme payment ID. returns the reason it can't be matched when it isn't.
+func matchPayment(store PaymentStore, transaction StatusReportTransaction) (Payment, string, error) {
+	if transaction.OriginalUETR != "" {
+		id, err := uuid.FromString(transaction.OriginalUETR)
+		if err != nil {
+			return Payment{}, ExceptionUnmatched, nil
+		}
+		payment, err := store.Get(id)
+		if err == ErrPaymentNotFound {
+			return Payment{}, ExceptionUnmatched, nil
+		}
+		return payment, "", err
+	}
+
+	if transaction.OriginalEndToEndID == "" && transaction.OriginalTransactionID == "" {
+		return Payment{}, ExceptionUnmatched, nil
+	}
+	query := PaymentQuery{Limit: 2}
+	query.Filter.EndToEndReference = transaction.OriginalEndToEndID
+	query.Filter.SchemePaymentID = transaction.OriginalTransactionID
+	page, err := store.List(query)
+	switch {
+	case err != nil:
+		return Payment{}, "", err
+	case len(page.Payments) == 0:
+		return Payment{}, ExceptionUnmatched, nil
+	case len(page.Payments) > 1:
+		return Payment{}, ExceptionAmbiguous, nil
+	}
+	return page.Payments[0], "", nil
+}
+
+// applySchemeStatus moves a payment on to the status the scheme reported and records the report on it, returning the
+// action recorded in the audit trail
+func applySchemeStatus(payment *Payment, status SchemeStatus, actions []string, now time.Time) (string, error) {
+	// a payment that has already reached a status on the way, as when reports are resent, carries on from there
+	for i, next := range actions {
+		if transition, _ := findTransition(next); payment.currentStatus() == transition.To {
+			actions = actions[i+1:]
+			break
+		}
+	}
+	action := AuditUpdate
+	for _, next := range actions {
+		if err := applyTransition(payment, next, now); err != nil {
+			return "", err
+		}
+		action = next
+	}
+	payment.Attributes.SchemeStatus = &status
+	return action, nil
+}
+
+// ingestStatusReport applies the transaction statuses of a pacs.002 report to the payments they match in the store,
+// queueing an exception for those that can't be. the report is ingested in one transaction, so it can be tried again
+// if it fails. organisationID is who the report is for, or nil if it is for any.
+func (api *api) ingestStatusReport(store PaymentStore, r *http.Request, organisationID uuid.UUID, source string, document pacs002Document) (StatusReportResult, error) {
+	result := StatusReportResult{MessageID: document.MessageID}
+	err := store.RunInTransaction(func(tx PaymentStore) error {
+		result.Transactions = make([]StatusReportTransactionResult, len(document.Transactions))
+		for i, transaction := range document.Transactions {
+			outcome, err := api.ingestTransactionStatus(tx, r, organisationID, source, document.MessageID, transaction)
+			if err != nil {
+				return err
+			}
+			outcome.Index = i
+			result.Transactions[i] = outcome
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (api *api) ingestTransactionStatus(store PaymentStore, r *http.Request, organisationID uuid.UUID, source, messageID string, transaction StatusReportTransaction) (StatusReportTransactionResult, error) {
+	now := time.Now().UTC()
+	outcome := StatusReportTransactionResult{Status: transaction.Status, Outcome: ReportOutcomeApplied}
+
+	// queue queues the transaction status as an exception, for the organisation of the payment when it was matched
+	queue := func(reason, message string, payment *Payment) (StatusReportTransactionResult, error) {
+		exception := StatusReportException{
+			ID:             uuid.NewV4(),
+			OrganisationID: organisationID,
+			Reason:         reason,
+			Message:        message,
+			Source:         source,
+			MessageID:      messageID,
+			Transaction:    transaction,
+			ReceivedAt:     now,
+		}
+		if payment != nil {
+			exception.OrganisationID, exception.PaymentID = payment.OrganisationID, &payment.ID
+		}
+		if err := store.CreateStatusException(&exception); err != nil {
+			return outcome, err
+		}
+		outcome.Outcome, outcome.ExceptionID = ReportOutcomeException, &exception.ID
+		return outcome, nil
+	}
+
+	payment, unmatched, err := matchPayment(store, transaction)
+	if err != nil {
+		return outcome, err
+	}
+	switch unmatched {
+	case ExceptionAmbiguous:
+		return queue(ExceptionAmbiguous, "More than one payment has the end to end reference and payment ID", nil)
+	case ExceptionUnmatched:
+		return queue(ExceptionUnmatched, "No payment matches the transaction", nil)
+	}
+	outcome.PaymentID = &payment.ID
+
+	actions, known := schemeStatusActions[transaction.Status]
+	if !known {
+		return queue(ExceptionUnknownStatus, fmt.Sprintf("Unknown transaction status %s", transaction.Status), &payment)
+	}
+	before := payment
+	status := SchemeStatus{
+		Status:     transaction.Status,
+		ReasonCode: transaction.ReasonCode,
+		Reason:     transaction.Reason,
+		MessageID:  messageID,
+		ReceivedAt: now,
+	}
+	action, err := applySchemeStatus(&payment, status, actions, now)
+	if err != nil {
+		return queue(ExceptionInvalidTransition, fmt.Sprintf("A payment that is %s can't be reported as %s", before.currentStatus(), transaction.Status), &before)
+	}
+	return outcome, api.audit(store, r, action, &before, func(tx PaymentStore) (*Payment, error) {
+		return &payment, tx.Update(&payment)
+	})
+}
+
+// business logic for POST /v1/status-reports endpoint, which applies a pacs.002 status report to the organisation's
+// payments
+func (api *api) postStatusReport(w http.ResponseWriter, r *http.Request) {
+
+	body, ok := readBody(w, r, maxImportBodySize, "invalid_xml")
+	if !ok {
+		return
+	}
+	document, err := parsePacs002(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_xml", "Invalid pacs.002 message: "+err.Error())
+		return
+	}
+	organisationID, _ := requestOrganisation(r)
+	result, err := api.ingestStatusReport(api.storeFor(r), r, organisationID, "api", document)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, result, Link{Rel: "exceptions", Href: "/v1/status-reports/exceptions"})
+}
+
+// business logic for GET /v1/status-reports/exceptions endpoint. the queue is the unresolved exceptions, newest first,
+// or the resolved ones with filter[resolved]=true.
+func (api *api) getStatusExceptions(w http.ResponseWriter, r *http.Request) {
+
+	values := r.URL.Query()
+	query := StatusExceptionQuery{Reason: values.Get("filter[reason]"), Limit: defaultPageSize}
+	var errs []APIError
+	if resolved := values.Get("filter[resolved]"); resolved != "" {
+		var err error
+		if query.Resolved, err = strconv.ParseBool(resolved); err != nil {
+			errs = append(errs, APIError{Code: "invalid_parameter", Message: "filter[resolved] must be true or false", Parameter: "filter[resolved]"})
+		}
+	}
+	if size := values.Get("page[size]"); size != "" {
+		limit, err := strconv.Atoi(size)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			errs = append(errs, APIError{Code: "invalid_parameter", Message: fmt.Sprintf("Invalid page size, must be between 1 and %d", maxPageSize), Parameter: "page[size]"})
+		}
+		query.Limit = limit
+	}
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusBadRequest, errs...)
+		return
+	}
+
+	exceptions, err := api.storeFor(r).ListStatusExceptions(query)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, exceptions, Link{Rel: "self", Href: r.URL.RequestURI()})
+}
+
+// business logic for GET /v1/status-reports/exceptions/{id} endpoint
+func (api *api) getStatusException(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	exception, err := api.storeFor(r).GetStatusException(id)
+	if err != nil {
+		writeStatusExceptionError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, exception, statusExceptionLinks(exception)...)
+}
+
+// business logic for POST /v1/status-reports/exceptions/{id}/resolve endpoint, which takes an exception off the queue
+// once it has been dealt with
+func (api *api) resolveStatusException(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	store := api.storeFor(r)
+	exception, err := store.GetStatusException(id)
+	if err != nil {
+		writeStatusExceptionError(w, err)
+		return
+	}
+	if exception.ResolvedAt != nil {
+		writeError(w, http.StatusConflict, "already_resolved", "The exception has already been resolved")
+		return
+	}
+	now := time.Now().UTC()
+	if err := store.ResolveStatusException(id, now); err != nil {
+		writeStatusExceptionError(w, err)
+		return
+	}
+	exception.ResolvedAt = &now
+	writeData(w, http.StatusOK, exception, statusExceptionLinks(exception)...)
+}
+
+func writeStatusExceptionError(w http.ResponseWriter, err error) {
+	if err == ErrStatusExceptionNotFound {
+		writeError(w, http.StatusNotFound, "not_found", "Status report exception not found")
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+func statusExceptionLinks(exception StatusReportException) []Link {
+	self := "/v1/status-reports/exceptions/" + exception.ID.String()
+	links := []Link{{Rel: "self", Href: self}}
+	if exception.PaymentID != nil {
+		links = append(links, Link{Rel: "payment", Href: "/v1/payments/" + exception.PaymentID.String()})
+	}
+	if exception.ResolvedAt == nil {
+		links = append(links, Link{Rel: "resolve", Href: self + "/resolve"})
+	}
+	return links
+}
+
+// statusReportWatcher ingests the status reports dropped as .xml files into a directory. reports in the directory are
+// for any organisation, and those in a subdirectory named by an organisation ID only for that organisation. each file
+// is moved to a processed or failed subdirectory next to it once it has been read.
+type statusReportWatcher struct {
+	api *api
+	dir string
+}
+
+// scan ingests every report that has been dropped, and returns how many it ingested
+func (watcher *statusReportWatcher) scan() (int, error) {
+	ingested, err := watcher.scanDir(watcher.dir, watcher.api.store, uuid.Nil)
+	if err != nil {
+		return ingested, err
+	}
+	entries, err := os.ReadDir(watcher.dir)
+	if err != nil {
+		return ingested, err
+	}
+	for _, entry := range entries {
+		organisationID, err := uuid.FromString(entry.Name())
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		store := &organisationStore{PaymentStore: watcher.api.store, organisationID: organisationID}
+		n, err := watcher.scanDir(filepath.Join(watcher.dir, entry.Name()), store, organisationID)
+		ingested += n
+		if err != nil {
+			return ingested, err
+		}
+	}
+	return ingested, nil
+}
+
+func (watcher *statusReportWatcher) scanDir(dir string, store PaymentStore, organisationID uuid.UUID) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	ingested := 0
+	for _, entry := range entries {
+		// files being written should be given another name, such as a leading dot, until they are complete
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.EqualFold(filepath.Ext(name), ".xml") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return ingested, err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/v1/status-reports", nil)
+		if err != nil {
+			return ingested, err
+		}
+		req.Header.Set(actorHeader, "status-report-watcher")
+		req.Header.Set(requestIDHeader, uuid.NewV4().String())
+
+		// a file that isn't a report is put aside rather than tried again
+		destination := "processed"
+		document, err := parsePacs002(body)
+		if err != nil {
+			log.Printf("failed to read status report %s: %s", path, err)
+			destination = "failed"
+		} else {
+			if _, err := watcher.api.ingestStatusReport(store, req, organisationID, "file:"+name, document); err != nil {
+				return ingested, err
+			}
+			ingested++
+		}
+		if err := os.MkdirAll(filepath.Join(dir, destination), 0755); err != nil {
+			return ingested, err
+		}
+		if err := os.Rename(path, filepath.Join(dir, destination, name)); err != nil {
+			return ingested, err
+		}
+	}
+	return ingested, nil
+}
+
+// run scans the directory every interval until done is closed
+func (watcher *statusReportWatcher) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := watcher.scan(); err != nil {
+				log.Printf("failed to ingest status reports: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pacs002 builds a pacs.002 status report of the given transaction statuses
+func pacs002(transactions ...StatusReportTransaction) []byte {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pacs.002.001.10">
+  <FIToFIPmtStsRpt>
+    <GrpHdr><MsgId>STS-` + uuid.NewV4().String()[:8] + `</MsgId><CreDtTm>2017-01-18T09:00:00Z</CreDtTm></GrpHdr>`)
+	for _, transaction := range transactions {
+		body.WriteString("\n    <TxInfAndSts>")
+		for _, element := range [][2]string{
+			{"OrgnlEndToEndId", transaction.OriginalEndToEndID},
+			{"OrgnlTxId", transaction.OriginalTransactionID},
+			{"OrgnlUETR", transaction.OriginalUETR},
+			{"TxSts", transaction.Status},
+		} {
+			if element[1] != "" {
+				fmt.Fprintf(&body, "<%s>%s</%[1]s>", element[0], element[1])
+			}
+		}
+		if transaction.ReasonCode != "" {
+			fmt.Fprintf(&body, "<StsRsnInf><Rsn><Cd>%s</Cd></Rsn><AddtlInf>%s</AddtlInf></StsRsnInf>", transaction.ReasonCode, transaction.Reason)
+		}
+		body.WriteString("</TxInfAndSts>")
+	}
+	body.WriteString("\n  </FIToFIPmtStsRpt>\n</Document>\n")
+	return []byte(body.String())
+}
+
+// sendStatusReport POSTs a status report and decodes the outcome of each transaction status
+func sendStatusReport(t *testing.T, body []byte) []StatusReportTransactionResult {
+	req := httptest.NewRequest(http.MethodPost, "/v1/status-reports", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/xml")
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var result StatusReportResult
+	require.Nil(t, json.Unmarshal(response.Data, &result))
+	return result.Transactions
+}
+
+// getStatusExceptions lists the exceptions queue with the given query
+func getStatusExceptions(t *testing.T, query string) []StatusReportException {
+	rw := sendAs(t, "", http.MethodGet, "/v1/status-reports/exceptions"+query, nil)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var exceptions []StatusReportException
+	require.Nil(t, json.Unmarshal(response.Data, &exceptions))
+	return exceptions
+}
+
+// createSubmittedPayment creates a payment and submits it to the scheme
+func createSubmittedPayment(t *testing.T) Payment {
+	payment := createExamplePayment()
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	require.Equal(t, 200, postAction(t, payment, ActionSubmit).Code)
+	return payment
+}
+
+func TestParsePacs002(t *testing.T) {
+
+	document, err := parsePacs002(pacs002(StatusReportTransaction{OriginalEndToEndID: "NOTPROVIDED", OriginalTransactionID: "123", Status: "RJCT", ReasonCode: "AC01", Reason: "Incorrect account number"}))
+	require.Nil(t, err)
+	require.Len(t, document.Transactions, 1)
+	assert.Equal(t, StatusReportTransaction{OriginalTransactionID: "123", Status: "RJCT", ReasonCode: "AC01", Reason: "Incorrect account number"}, document.Transactions[0])
+	assert.True(t, strings.HasPrefix(document.MessageID, "STS-"))
+
+	// other ISO 20022 messages aren't status reports
+	_, err = parsePacs002(bytes.Replace(pacs002(), []byte("pacs.002.001.10"), []byte("pacs.008.001.08"), 1))
+	assert.NotNil(t, err)
+	_, err = parsePacs002([]byte("<Document>"))
+	assert.NotNil(t, err)
+}
+
+func TestStatusReportBodiesAreLimited(t *testing.T) {
+
+	body := bytes.Repeat([]byte(" "), maxImportBodySize+1)
+	req := httptest.NewRequest(http.MethodPost, "/v1/status-reports", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/xml")
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 413, rw.Code)
+	assert.Contains(t, rw.Body.String(), "body_too_large")
+}
+
+func TestStatusReportAcceptsAndSettlesPayments(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createSubmittedPayment(t)
+	results := sendStatusReport(t, pacs002(StatusReportTransaction{OriginalUETR: payment.ID.String(), Status: "ACSP"}))
+	require.Len(t, results, 1)
+	assert.Equal(t, ReportOutcomeApplied, results[0].Outcome)
+	assert.Equal(t, payment.ID, *results[0].PaymentID)
+
+	stored, err := store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusAccepted, stored.Attributes.Status)
+	require.NotNil(t, stored.Attributes.SchemeStatus)
+	assert.Equal(t, "ACSP", stored.Attributes.SchemeStatus.Status)
+
+	// settlement is reported by the payment's references, and a report sent again doesn't move it on twice
+	report := pacs002(StatusReportTransaction{OriginalEndToEndID: payment.Attributes.EndToEndReference, OriginalTransactionID: payment.Attributes.PaymentID, Status: "ACSC"})
+	for i := 0; i < 2; i++ {
+		results = sendStatusReport(t, report)
+		require.Len(t, results, 1)
+		assert.Equal(t, ReportOutcomeApplied, results[0].Outcome)
+	}
+	stored, err = store.Get(payment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusSettled, stored.Attributes.Status)
+	assert.Len(t, stored.Attributes.StatusHistory, 4)
+	assert.Equal(t, "ACSC", stored.Attributes.SchemeStatus.Status)
+
+	entries, err := store.ListAudit(AuditQuery{PaymentID: payment.ID})
+	require.Nil(t, err)
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	assert.Equal(t, []string{AuditCreate, ActionSubmit, ActionAccept, ActionSettle, AuditUpdate}, actions)
+
+	// a payment that is settled in one step is accepted on the way
+	other := createSubmittedPayment(t)
+	sendStatusReport(t, pacs002(StatusReportTransaction{OriginalUETR: other.ID.String(), Status: "ACSC"}))
+	stored, err = store.Get(other.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusSettled, stored.Attributes.Status)
+
+	// the scheme status can't be patched
+	rw := sendAs(t, "alice", http.MethodPatch, "/v1/payments/"+payment.ID.String(), json.RawMessage(`{"attributes":{"scheme_status":null}}`))
+	assert.NotEqual(t, 200, rw.Code)
+}
+
+func TestStatusReportRejectsPaymentsWithReasons(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createSubmittedPayment(t)
+	results := sendStatusReport(t, pacs002(StatusReportTransaction{OriginalUETR: payment.ID.String(), Status: "RJCT", ReasonCode: "AC01", Reason: "Incorrect account number"}))
+	require.Len(t, results, 1)
+	assert.Equal(t, ReportOutcomeApplied, results[0].Outcome)
+
+	rw := sendAs(t, "", http.MethodGet, "/v1/payments/"+payment.ID.String(), nil)
+	require.Equal(t, 200, rw.Code)
+	rejected, _ := decodePaymentResponse(t, rw)
+	assert.Equal(t, StatusRejected, rejected.Attributes.Status)
+	require.NotNil(t, rejected.Attributes.SchemeStatus)
+	assert.Equal(t, "AC01", rejected.Attributes.SchemeStatus.ReasonCode)
+	assert.Equal(t, "Incorrect account number", rejected.Attributes.SchemeStatus.Reason)
+	assert.NotEmpty(t, rejected.Attributes.SchemeStatus.MessageID)
+}
+
+func TestStatusReportQueuesExceptions(t *testing.T) {
+
+	emptyDatabase(t)
+
+	created := createExamplePayment()
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", created).Code)
+	submitted := createSubmittedPayment(t)
+
+	// two payments with the same references can't be told apart
+	duplicate := createExamplePayment()
+	duplicate.Attributes.PaymentID = "duplicate"
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", duplicate).Code)
+	duplicate.ID = uuid.NewV4()
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", duplicate).Code)
+
+	results := sendStatusReport(t, pacs002(
+		StatusReportTransaction{OriginalUETR: uuid.NewV4().String(), Status: "ACSP"},
+		StatusReportTransaction{OriginalEndToEndID: duplicate.Attributes.EndToEndReference, OriginalTransactionID: "duplicate", Status: "ACSP"},
+		StatusReportTransaction{OriginalUETR: created.ID.String(), Status: "ACSC"},
+		StatusReportTransaction{OriginalUETR: submitted.ID.String(), Status: "XXXX"},
+		StatusReportTransaction{OriginalUETR: submitted.ID.String(), Status: "PDNG"},
+	))
+	require.Len(t, results, 5)
+	for i, outcome := range []string{ReportOutcomeException, ReportOutcomeException, ReportOutcomeException, ReportOutcomeException, ReportOutcomeApplied} {
+		assert.Equal(t, i, results[i].Index)
+		assert.Equal(t, outcome, results[i].Outcome)
+	}
+
+	// the payments haven't moved on, but a pending status is recorded
+	stored, err := store.Get(created.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusCreated, stored.Attributes.Status)
+	assert.Nil(t, stored.Attributes.SchemeStatus)
+	stored, err = store.Get(submitted.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusSubmitted, stored.Attributes.Status)
+	assert.Equal(t, "PDNG", stored.Attributes.SchemeStatus.Status)
+
+	exceptions := getStatusExceptions(t, "")
+	require.Len(t, exceptions, 4)
+	reasons := map[string]StatusReportException{}
+	for _, exception := range exceptions {
+		reasons[exception.Reason] = exception
+	}
+	assert.Nil(t, reasons[ExceptionUnmatched].PaymentID)
+	assert.Nil(t, reasons[ExceptionAmbiguous].PaymentID)
+	assert.Equal(t, created.ID, *reasons[ExceptionInvalidTransition].PaymentID)
+	assert.Equal(t, created.OrganisationID, reasons[ExceptionInvalidTransition].OrganisationID)
+	assert.Equal(t, "ACSC", reasons[ExceptionInvalidTransition].Transaction.Status)
+	assert.Equal(t, submitted.ID, *reasons[ExceptionUnknownStatus].PaymentID)
+	assert.Equal(t, "api", reasons[ExceptionUnknownStatus].Source)
+
+	unmatched := getStatusExceptions(t, "?filter[reason]=unmatched")
+	require.Len(t, unmatched, 1)
+	assert.Equal(t, *results[0].ExceptionID, unmatched[0].ID)
+	assert.Len(t, getStatusExceptions(t, "?page[size]=2"), 2)
+	assert.Equal(t, 400, sendAs(t, "", http.MethodGet, "/v1/status-reports/exceptions?filter[resolved]=maybe", nil).Code)
+
+	// resolved exceptions leave the queue
+	path := "/v1/status-reports/exceptions/" + unmatched[0].ID.String()
+	require.Equal(t, 200, sendAs(t, "", http.MethodGet, path, nil).Code)
+	require.Equal(t, 200, sendAs(t, "bob", http.MethodPost, path+"/resolve", nil).Code)
+	assert.Equal(t, 409, sendAs(t, "bob", http.MethodPost, path+"/resolve", nil).Code)
+	assert.Len(t, getStatusExceptions(t, ""), 3)
+	resolved := getStatusExceptions(t, "?filter[resolved]=true")
+	require.Len(t, resolved, 1)
+	assert.NotNil(t, resolved[0].ResolvedAt)
+	assert.Equal(t, 404, sendAs(t, "", http.MethodGet, "/v1/status-reports/exceptions/"+uuid.NewV4().String(), nil).Code)
+}
+
+func TestStatusReportIsForTheKeysOrganisation(t *testing.T) {
+
+	emptyDatabase(t)
+
+	ours := createSubmittedPayment(t)
+	theirs := createSubmittedPayment(t)
+	_, key := createAPIKey(t, ours.OrganisationID, RoleAdmin)
+
+	report := pacs002(
+		StatusReportTransaction{OriginalUETR: ours.ID.String(), Status: "ACSP"},
+		StatusReportTransaction{OriginalUETR: theirs.ID.String(), Status: "ACSP"},
+	)
+	rw := sendWithKey(t, key, http.MethodPost, "/v1/status-reports", report)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+
+	stored, err := store.Get(theirs.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusSubmitted, stored.Attributes.Status)
+	stored, err = store.Get(ours.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusAccepted, stored.Attributes.Status)
+
+	// the other organisation's payment isn't found, and is queued for the organisation of the key
+	exceptions, err := store.ListStatusExceptions(StatusExceptionQuery{OrganisationID: ours.OrganisationID})
+	require.Nil(t, err)
+	require.Len(t, exceptions, 1)
+	assert.Equal(t, ExceptionUnmatched, exceptions[0].Reason)
+
+	_, other := createAPIKey(t, theirs.OrganisationID, RoleAdmin)
+	assert.Equal(t, 404, sendWithKey(t, other, http.MethodGet, "/v1/status-reports/exceptions/"+exceptions[0].ID.String(), nil).Code)
+
+	_, operator := createAPIKey(t, ours.OrganisationID, RoleOperator)
+	assert.Equal(t, 403, sendWithKey(t, operator, http.MethodPost, "/v1/status-reports", report).Code)
+	assert.Equal(t, 400, sendWithKey(t, key, http.MethodPost, "/v1/status-reports", []byte("<Document>")).Code)
+}
+
+func TestStatusReportWatcher(t *testing.T) {
+
+	emptyDatabase(t)
+
+	dir, err := os.MkdirTemp("", "status-reports")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ours := createSubmittedPayment(t)
+	theirs := createSubmittedPayment(t)
+	organisationDir := filepath.Join(dir, ours.OrganisationID.String())
+	require.Nil(t, os.Mkdir(organisationDir, 0755))
+
+	write := func(path string, body []byte) {
+		require.Nil(t, os.WriteFile(path, body, 0644))
+	}
+	write(filepath.Join(dir, "all.xml"), pacs002(StatusReportTransaction{OriginalUETR: theirs.ID.String(), Status: "RJCT", ReasonCode: "AM04"}))
+	write(filepath.Join(organisationDir, "ours.xml"), pacs002(
+		StatusReportTransaction{OriginalUETR: ours.ID.String(), Status: "ACSC"},
+		StatusReportTransaction{OriginalUETR: theirs.ID.String(), Status: "ACSC"},
+	))
+	write(filepath.Join(dir, "broken.xml"), []byte("<Document>"))
+	write(filepath.Join(dir, ".incomplete.xml"), []byte("<Document>"))
+	write(filepath.Join(dir, "notes.txt"), []byte("not a report"))
+
+	watcher := &statusReportWatcher{api: newAPI(store), dir: dir}
+	ingested, err := watcher.scan()
+	require.Nil(t, err)
+	assert.Equal(t, 2, ingested)
+
+	stored, err := store.Get(theirs.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusRejected, stored.Attributes.Status)
+	assert.Equal(t, "AM04", stored.Attributes.SchemeStatus.ReasonCode)
+	stored, err = store.Get(ours.ID)
+	require.Nil(t, err)
+	assert.Equal(t, StatusSettled, stored.Attributes.Status)
+
+	// reports in an organisation's directory only match that organisation's payments
+	exceptions, err := store.ListStatusExceptions(StatusExceptionQuery{})
+	require.Nil(t, err)
+	require.Len(t, exceptions, 1)
+	assert.Equal(t, ours.OrganisationID, exceptions[0].OrganisationID)
+	assert.Equal(t, "file:ours.xml", exceptions[0].Source)
+
+	entries, err := store.ListAudit(AuditQuery{PaymentID: theirs.ID})
+	require.Nil(t, err)
+	assert.Equal(t, "status-report-watcher", entries[len(entries)-1].Actor)
+
+	for _, path := range []string{
+		filepath.Join(dir, "processed", "all.xml"),
+		filepath.Join(organisationDir, "processed", "ours.xml"),
+		filepath.Join(dir, "failed", "broken.xml"),
+		filepath.Join(dir, ".incomplete.xml"),
+		filepath.Join(dir, "notes.txt"),
+	} {
+		_, err := os.Stat(path)
+		assert.Nil(t, err, path)
+	}
+
+	// nothing is left to ingest
+	ingested, err = watcher.scan()
+	require.Nil(t, err)
+	assert.Equal(t, 0, ingested)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// errors returned by PaymentStore implementations. handlers compare against these rather than backend specific errors.
+var (
+	ErrPaymentNotFound = errors.New("payment not found")
+	ErrPaymentExists   = errors.New("payment already exists")
+	ErrVersionConflict = errors.New("payment version does not match")
+)
+
+// PaymentStore is the persistence layer used by the API handlers. implementations must be safe for concurrent use.
+type PaymentStore interface {
+	// Get returns the payment with the given ID, or ErrPaymentNotFound if there is none or it has been deleted
+	Get(id uuid.UUID) (Payment, error)
+
+	// GetIncludingDeleted returns the payment with the given ID even if it has been deleted, or ErrPaymentNotFound if
+	// it has never existed or has been purged
+	GetIncludingDeleted(id uuid.UUID) (Payment, error)
+
+	// List returns the page of payments described by the query
+	List(query PaymentQuery) (PaymentPage, error)
+
+	// Create inserts a new payment, or returns ErrPaymentExists if one already exists with the same ID
+	Create(payment *Payment) error
+
+	// Update replaces an existing payment as long as its stored version is still payment.Version, then increments the
+	// version on both. returns ErrPaymentNotFound, or ErrVersionConflict if the payment has been changed since. deleted
+	// payments are not found.
+	Update(payment *Payment) error
+
+	// Delete tombstones an existing payment by setting its DeletedAt, as long as its stored version is still the given
+	// version, and increments the version. returns ErrPaymentNotFound, or ErrVersionConflict if the payment has been
+	// changed since. deleted payments are not found.
+	Delete(id uuid.UUID, version uint) error
+
+	// Restore clears the tombstone of a deleted payment as long as its stored version is still the given version, and
+	// increments the version. returns ErrPaymentNotFound if there is no deleted payment with the ID, or
+	// ErrVersionConflict if it has been changed since.
+	Restore(id uuid.UUID, version uint) error
+
+	// PurgeDeleted permanently removes the payments that were deleted before the cutoff, returning them
+	PurgeDeleted(cutoff time.Time) ([]Payment, error)
+
+	IdempotencyKeyStore
+	FXQuoteStore
+	FXRateStore
+	BatchStore
+	AuditStore
+	APIKeyStore
+	RoleStore
+	ApprovalPolicyStore
+	EventStore
+	WebhookStore
+	StatusReportStore
+	SchemeFileStore
+
+	// RunInTransaction calls fn with a store scoped to a single transaction. if fn returns an error, none of the
+	// changes made through the transactional store are kept.
+	RunInTransaction(fn func(store PaymentStore) error) error
+}
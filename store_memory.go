@@ -0,0 +1,1108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// memoryStore is a PaymentStore held entirely in memory, used for tests and for running the API without a database.
+type memoryStore struct {
+	mu   *sync.RWMutex
+	data *memoryData
+	inTx bool // set on stores handed to RunInTransaction callbacks, which already hold the write lock
+}
+
+// memoryData holds the stored records. payments are kept JSON encoded so that callers can never share memory with
+// the store, which also means a shallow copy of the maps is enough to snapshot the data for a transaction.
+// lastSeq is the creation sequence of the most recently created payment.
+type memoryData struct {
+	payments        map[uuid.UUID]memoryPayment
+	lastSeq         int64
+	idempotencyKeys map[string]IdempotencyRecord
+	fxQuotes        map[string]FXQuote
+	fxRates         []FXRate
+	batches         map[uuid.UUID][]byte
+	auditLog        [][]byte
+	events          [][]byte
+	relayOffsets    map[string]int64
+	apiKeys         map[string]APIKey
+	roles           map[string]Role
+	policies        map[string]ApprovalPolicy
+	subscriptions   map[uuid.UUID]Subscription
+	deliveries      map[uuid.UUID][]byte
+	exceptions      map[uuid.UUID][]byte
+	schemeFiles     map[uuid.UUID]schemeFileRecord
+}
+
+// memoryPayment is a stored payment along with its creation sequence, the equivalent of the seq column in postgres
+type memoryPayment struct {
+	encoded []byte
+	seq     int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		mu: &sync.RWMutex{},
+		data: &memoryData{
+			payments:        map[uuid.UUID]memoryPayment{},
+			idempotencyKeys: map[string]IdempotencyRecord{},
+			fxQuotes:        map[string]FXQuote{},
+			batches:         map[uuid.UUID][]byte{},
+			apiKeys:         map[string]APIKey{},
+			roles:           map[string]Role{},
+			policies:        map[string]ApprovalPolicy{},
+			subscriptions:   map[uuid.UUID]Subscription{},
+			deliveries:      map[uuid.UUID][]byte{},
+			relayOffsets:    map[string]int64{},
+			exceptions:      map[uuid.UUID][]byte{},
+			schemeFiles:     map[uuid.UUID]schemeFileRecord{},
+		},
+	}
+}
+
+func (data *memoryData) clone() *memoryData {
+	clone := &memoryData{
+		payments:        make(map[uuid.UUID]memoryPayment, len(data.payments)),
+		lastSeq:         data.lastSeq,
+		idempotencyKeys: make(map[string]IdempotencyRecord, len(data.idempotencyKeys)),
+		fxQuotes:        make(map[string]FXQuote, len(data.fxQuotes)),
+		fxRates:         data.fxRates,
+		batches:         make(map[uuid.UUID][]byte, len(data.batches)),
+		auditLog:        append([][]byte(nil), data.auditLog...),
+		events:          append([][]byte(nil), data.events...),
+		apiKeys:         make(map[string]APIKey, len(data.apiKeys)),
+		roles:           make(map[string]Role, len(data.roles)),
+		policies:        make(map[string]ApprovalPolicy, len(data.policies)),
+		subscriptions:   make(map[uuid.UUID]Subscription, len(data.subscriptions)),
+		deliveries:      make(map[uuid.UUID][]byte, len(data.deliveries)),
+		relayOffsets:    make(map[string]int64, len(data.relayOffsets)),
+		exceptions:      make(map[uuid.UUID][]byte, len(data.exceptions)),
+		schemeFiles:     make(map[uuid.UUID]schemeFileRecord, len(data.schemeFiles)),
+	}
+	for id, payment := range data.payments {
+		clone.payments[id] = payment
+	}
+	for key, record := range data.idempotencyKeys {
+		clone.idempotencyKeys[key] = record
+	}
+	for reference, quote := range data.fxQuotes {
+		clone.fxQuotes[reference] = quote
+	}
+	for id, batch := range data.batches {
+		clone.batches[id] = batch
+	}
+	for hash, key := range data.apiKeys {
+		clone.apiKeys[hash] = key
+	}
+	for name, role := range data.roles {
+		clone.roles[name] = role
+	}
+	for currency, policy := range data.policies {
+		clone.policies[currency] = policy
+	}
+	for id, subscription := range data.subscriptions {
+		clone.subscriptions[id] = subscription
+	}
+	for id, delivery := range data.deliveries {
+		clone.deliveries[id] = delivery
+	}
+	for sink, seq := range data.relayOffsets {
+		clone.relayOffsets[sink] = seq
+	}
+	for id, exception := range data.exceptions {
+		clone.exceptions[id] = exception
+	}
+	for id, file := range data.schemeFiles {
+		clone.schemeFiles[id] = file
+	}
+	return clone
+}
+
+// read calls fn with the data under a read lock, unless the lock is already held by a transaction
+func (store *memoryStore) read(fn func(data *memoryData) error) error {
+	if !store.inTx {
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+	}
+	return fn(store.data)
+}
+
+// write calls fn with the data under the write lock, unless the lock is already held by a transaction
+func (store *memoryStore) write(fn func(data *memoryData) error) error {
+	if !store.inTx {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+	}
+	return fn(store.data)
+}
+
+func (store *memoryStore) Get(id uuid.UUID) (Payment, error) {
+	payment, err := store.GetIncludingDeleted(id)
+	if err == nil && payment.DeletedAt != nil {
+		return Payment{}, ErrPaymentNotFound
+	}
+	return payment, err
+}
+
+func (store *memoryStore) GetIncludingDeleted(id uuid.UUID) (Payment, error) {
+	var payment Payment
+	err := store.read(func(data *memoryData) error {
+		stored, ok := data.payments[id]
+		if !ok {
+			return ErrPaymentNotFound
+		}
+		return json.Unmarshal(stored.encoded, &payment)
+	})
+	return payment, err
+}
+
+// keyedPayment is a payment along with its position in the current sort order
+type keyedPayment struct {
+	payment Payment
+	cursor  PaymentCursor
+}
+
+func (store *memoryStore) List(query PaymentQuery) (PaymentPage, error) {
+	matching := []keyedPayment{}
+	err := store.read(func(data *memoryData) error {
+		for _, stored := range data.payments {
+			var payment Payment
+			if err := json.Unmarshal(stored.encoded, &payment); err != nil {
+				return err
+			}
+			if !matchesFilter(payment, query.Filter) {
+				continue
+			}
+			matching = append(matching, keyedPayment{
+				payment: payment,
+				cursor:  PaymentCursor{Sort: query.Sort.String(), Key: sortKey(payment, query.Sort.Field), Seq: stored.seq},
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return PaymentPage{}, err
+	}
+
+	return pagePayments(matching, query), nil
+}
+
+func matchesFilter(payment Payment, filter PaymentFilter) bool {
+	if payment.DeletedAt != nil && !filter.IncludeDeleted {
+		return false
+	}
+	if filter.OrganisationID != uuid.Nil && payment.OrganisationID != filter.OrganisationID {
+		return false
+	}
+	if filter.Currency != "" && payment.Attributes.Currency != filter.Currency {
+		return false
+	}
+	if filter.PaymentScheme != "" && payment.Attributes.PaymentScheme != filter.PaymentScheme {
+		return false
+	}
+	if filter.EndToEndReference != "" && payment.Attributes.EndToEndReference != filter.EndToEndReference {
+		return false
+	}
+	if filter.SchemePaymentID != "" && payment.Attributes.PaymentID != filter.SchemePaymentID {
+		return false
+	}
+	if filter.ProcessingDateFrom != "" && payment.Attributes.ProcessingDate < filter.ProcessingDateFrom {
+		return false
+	}
+	if filter.ProcessingDateTo != "" && payment.Attributes.ProcessingDate > filter.ProcessingDateTo {
+		return false
+	}
+	// an empty amount compares as zero, as it does in SQL
+	amount := payment.Attributes.Amount
+	if !filter.AmountMin.IsEmpty() && amount.Cmp(filter.AmountMin) < 0 {
+		return false
+	}
+	if !filter.AmountMax.IsEmpty() && amount.Cmp(filter.AmountMax) > 0 {
+		return false
+	}
+	return true
+}
+
+// compareCursors orders two positions by sort key and then creation sequence, in ascending order
+func compareCursors(field string, a, b PaymentCursor) int {
+	if c := compareSortKeys(field, a.Key, b.Key); c != 0 {
+		return c
+	}
+	switch {
+	case a.Seq < b.Seq:
+		return -1
+	case a.Seq > b.Seq:
+		return 1
+	}
+	return 0
+}
+
+// pagePayments sorts the payments and cuts out the page described by the query, in the same way as the postgres store
+func pagePayments(payments []keyedPayment, query PaymentQuery) PaymentPage {
+
+	// scan backwards from the cursor when paging to the previous page, then put the page back in order
+	backwards := query.Before != nil
+	compare := func(a, b PaymentCursor) int {
+		c := compareCursors(query.Sort.Field, a, b)
+		if query.Sort.Descending != backwards {
+			return -c
+		}
+		return c
+	}
+
+	sort.Slice(payments, func(i, j int) bool {
+		return compare(payments[i].cursor, payments[j].cursor) < 0
+	})
+
+	from := query.After
+	if backwards {
+		from = query.Before
+	}
+	if from != nil {
+		start := sort.Search(len(payments), func(i int) bool {
+			return compare(payments[i].cursor, *from) > 0
+		})
+		payments = payments[start:]
+	}
+
+	more := false
+	if query.Limit > 0 && len(payments) > query.Limit {
+		payments = payments[:query.Limit]
+		more = true
+	}
+	if backwards {
+		for i, j := 0, len(payments)-1; i < j; i, j = i+1, j-1 {
+			payments[i], payments[j] = payments[j], payments[i]
+		}
+	}
+
+	page := PaymentPage{Payments: make([]Payment, len(payments))}
+	for i, keyed := range payments {
+		page.Payments[i] = keyed.payment
+	}
+	if len(payments) == 0 {
+		return page
+	}
+
+	first, last := payments[0].cursor, payments[len(payments)-1].cursor
+	if more || backwards {
+		page.Next = &last
+	}
+	if (backwards && more) || query.After != nil {
+		page.Prev = &first
+	}
+	return page
+}
+
+func (store *memoryStore) Create(payment *Payment) error {
+	encoded, err := json.Marshal(payment)
+	if err != nil {
+		return err
+	}
+	return store.write(func(data *memoryData) error {
+		if _, exists := data.payments[payment.ID]; exists {
+			return ErrPaymentExists
+		}
+		data.lastSeq++
+		data.payments[payment.ID] = memoryPayment{encoded: encoded, seq: data.lastSeq}
+		return nil
+	})
+}
+
+// decode a stored payment, for comparing against the version expected by a write
+func (stored memoryPayment) decode() (Payment, error) {
+	var payment Payment
+	err := json.Unmarshal(stored.encoded, &payment)
+	return payment, err
+}
+
+// change compares-and-swaps a stored payment. the payment must exist, be deleted or not as given, and still be at the
+// expected version. change is then applied to it and the version incremented.
+func (store *memoryStore) change(id uuid.UUID, version uint, deleted bool, change func(payment *Payment)) error {
+	return store.write(func(data *memoryData) error {
+		stored, exists := data.payments[id]
+		if !exists {
+			return ErrPaymentNotFound
+		}
+		payment, err := stored.decode()
+		if err != nil {
+			return err
+		}
+		if (payment.DeletedAt != nil) != deleted {
+			return ErrPaymentNotFound
+		}
+		if payment.Version != version {
+			return ErrVersionConflict
+		}
+		change(&payment)
+		payment.Version++
+		encoded, err := json.Marshal(payment)
+		if err != nil {
+			return err
+		}
+		data.payments[id] = memoryPayment{encoded: encoded, seq: stored.seq}
+		return nil
+	})
+}
+
+func (store *memoryStore) Update(payment *Payment) error {
+	updated := *payment
+	err := store.change(payment.ID, payment.Version, false, func(stored *Payment) {
+		// only Delete and Restore change whether a payment is deleted
+		*stored = updated
+		stored.DeletedAt = nil
+	})
+	if err != nil {
+		return err
+	}
+	payment.Version++
+	return nil
+}
+
+func (store *memoryStore) Delete(id uuid.UUID, version uint) error {
+	now := time.Now().UTC()
+	return store.change(id, version, false, func(payment *Payment) {
+		payment.DeletedAt = &now
+	})
+}
+
+func (store *memoryStore) Restore(id uuid.UUID, version uint) error {
+	return store.change(id, version, true, func(payment *Payment) {
+		payment.DeletedAt = nil
+	})
+}
+
+func (store *memoryStore) PurgeDeleted(cutoff time.Time) ([]Payment, error) {
+	purged := []Payment{}
+	err := store.write(func(data *memoryData) error {
+		for id, stored := range data.payments {
+			payment, err := stored.decode()
+			if err != nil {
+				return err
+			}
+			if payment.DeletedAt != nil && payment.DeletedAt.Before(cutoff) {
+				delete(data.payments, id)
+				purged = append(purged, payment)
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// copy the header and body of an idempotency record, so the stored record never shares memory with callers
+func copyIdempotencyRecord(record IdempotencyRecord) IdempotencyRecord {
+	header := http.Header{}
+	for name, values := range record.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	record.Header = header
+	record.Body = append([]byte(nil), record.Body...)
+	return record
+}
+
+func (store *memoryStore) GetIdempotencyKey(key string) (IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	err := store.read(func(data *memoryData) error {
+		stored, ok := data.idempotencyKeys[key]
+		if !ok {
+			return ErrIdempotencyKeyNotFound
+		}
+		record = copyIdempotencyRecord(stored)
+		return nil
+	})
+	return record, err
+}
+
+func (store *memoryStore) CreateIdempotencyKey(record *IdempotencyRecord) error {
+	return store.write(func(data *memoryData) error {
+		if _, exists := data.idempotencyKeys[record.Key]; exists {
+			return ErrIdempotencyKeyExists
+		}
+		data.idempotencyKeys[record.Key] = copyIdempotencyRecord(*record)
+		return nil
+	})
+}
+
+func (store *memoryStore) DeleteIdempotencyKey(key string) error {
+	return store.write(func(data *memoryData) error {
+		delete(data.idempotencyKeys, key)
+		return nil
+	})
+}
+
+func (store *memoryStore) DeleteIdempotencyKeysBefore(cutoff time.Time) (int, error) {
+	removed := 0
+	err := store.write(func(data *memoryData) error {
+		for key, record := range data.idempotencyKeys {
+			if record.CreatedAt.Before(cutoff) {
+				delete(data.idempotencyKeys, key)
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (store *memoryStore) GetFXQuote(contractReference string) (FXQuote, error) {
+	var quote FXQuote
+	err := store.read(func(data *memoryData) error {
+		stored, ok := data.fxQuotes[contractReference]
+		if !ok {
+			return ErrFXQuoteNotFound
+		}
+		quote = stored
+		return nil
+	})
+	return quote, err
+}
+
+func (store *memoryStore) CreateFXQuote(quote *FXQuote) error {
+	return store.write(func(data *memoryData) error {
+		if _, exists := data.fxQuotes[quote.ContractReference]; exists {
+			return ErrFXQuoteExists
+		}
+		data.fxQuotes[quote.ContractReference] = *quote
+		return nil
+	})
+}
+
+func (store *memoryStore) ListFXRates() ([]FXRate, error) {
+	rates := []FXRate{}
+	err := store.read(func(data *memoryData) error {
+		rates = append(rates, data.fxRates...)
+		return nil
+	})
+	return rates, err
+}
+
+// ReplaceFXRates stores a sorted copy of the rates. the stored slice is never changed, only swapped, so clones can
+// share it.
+func (store *memoryStore) ReplaceFXRates(rates []FXRate) error {
+	replacement := append([]FXRate{}, rates...)
+	sort.Slice(replacement, func(i, j int) bool {
+		return fxPair(replacement[i].BaseCurrency, replacement[i].QuoteCurrency) < fxPair(replacement[j].BaseCurrency, replacement[j].QuoteCurrency)
+	})
+	return store.write(func(data *memoryData) error {
+		data.fxRates = replacement
+		return nil
+	})
+}
+
+// GetBatch returns a stored batch. batches are kept JSON encoded, like payments.
+func (store *memoryStore) GetBatch(id uuid.UUID) (PaymentBatch, error) {
+	var batch PaymentBatch
+	err := store.read(func(data *memoryData) error {
+		stored, ok := data.batches[id]
+		if !ok {
+			return ErrBatchNotFound
+		}
+		return json.Unmarshal(stored, &batch)
+	})
+	return batch, err
+}
+
+func (store *memoryStore) CreateBatch(batch *PaymentBatch) error {
+	encoded, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return store.write(func(data *memoryData) error {
+		if _, exists := data.batches[batch.ID]; exists {
+			return ErrBatchExists
+		}
+		data.batches[batch.ID] = encoded
+		return nil
+	})
+}
+
+// AppendAudit adds an encoded entry to the audit log, whose position in the log is its sequence
+func (store *memoryStore) AppendAudit(entry *AuditEntry) error {
+	return store.write(func(data *memoryData) error {
+		entry.Seq = int64(len(data.auditLog)) + 1
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data.auditLog = append(data.auditLog, encoded)
+		return nil
+	})
+}
+
+func (store *memoryStore) ListAudit(query AuditQuery) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := store.read(func(data *memoryData) error {
+		// sequences start at 1, so the entries after query.After start at that index
+		start := int(query.After)
+		if start > len(data.auditLog) {
+			start = len(data.auditLog)
+		}
+		for _, encoded := range data.auditLog[start:] {
+			var entry AuditEntry
+			if err := json.Unmarshal(encoded, &entry); err != nil {
+				return err
+			}
+			switch {
+			case query.OrganisationID != uuid.Nil && entry.OrganisationID != query.OrganisationID:
+			case query.PaymentID != uuid.Nil && entry.PaymentID != query.PaymentID:
+			case query.Actor != "" && entry.Actor != query.Actor:
+			case query.Action != "" && entry.Action != query.Action:
+			case !query.Since.IsZero() && entry.Timestamp.Before(query.Since):
+			case !query.Until.IsZero() && entry.Timestamp.After(query.Until):
+			default:
+				entries = append(entries, entry)
+			}
+			if query.Limit > 0 && len(entries) == query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (store *memoryStore) AppendEvent(event *PaymentEvent) error {
+	return store.write(func(data *memoryData) error {
+		event.Seq = int64(len(data.events)) + 1
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		data.events = append(data.events, encoded)
+		return nil
+	})
+}
+
+func (store *memoryStore) ListEvents(query EventQuery) ([]PaymentEvent, error) {
+	events := []PaymentEvent{}
+	types := map[string]bool{}
+	for _, eventType := range query.Types {
+		types[eventType] = true
+	}
+	err := store.read(func(data *memoryData) error {
+		// sequences start at 1, so the events after query.After start at that index
+		start := int(query.After)
+		if start > len(data.events) {
+			start = len(data.events)
+		}
+		for _, encoded := range data.events[start:] {
+			var event PaymentEvent
+			if err := json.Unmarshal(encoded, &event); err != nil {
+				return err
+			}
+			switch {
+			case query.OrganisationID != uuid.Nil && event.OrganisationID != query.OrganisationID:
+			case len(types) > 0 && !types[event.Type]:
+			default:
+				events = append(events, event)
+			}
+			if query.Limit > 0 && len(events) == query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+func (store *memoryStore) LatestEventSeq() (int64, error) {
+	var seq int64
+	err := store.read(func(data *memoryData) error {
+		seq = int64(len(data.events))
+		return nil
+	})
+	return seq, err
+}
+
+// LockRelayOffset always gets the offset, as transactions hold the store's lock until they end
+func (store *memoryStore) LockRelayOffset(sink string) (int64, bool, error) {
+	var seq int64
+	err := store.read(func(data *memoryData) error {
+		seq = data.relayOffsets[sink]
+		return nil
+	})
+	return seq, err == nil, err
+}
+
+func (store *memoryStore) SetRelayOffset(sink string, seq int64) error {
+	return store.write(func(data *memoryData) error {
+		data.relayOffsets[sink] = seq
+		return nil
+	})
+}
+
+// GetAPIKey returns a copy of a stored key. keys are kept by their hash.
+func (store *memoryStore) GetAPIKey(hash string) (APIKey, error) {
+	var key APIKey
+	err := store.read(func(data *memoryData) error {
+		stored, ok := data.apiKeys[hash]
+		if !ok {
+			return ErrAPIKeyNotFound
+		}
+		key = copyAPIKey(stored)
+		return nil
+	})
+	return key, err
+}
+
+// copy an API key, so the stored key never shares its roles or revocation time with callers
+func copyAPIKey(key APIKey) APIKey {
+	key.Roles = append([]string{}, key.Roles...)
+	if key.RevokedAt != nil {
+		revokedAt := *key.RevokedAt
+		key.RevokedAt = &revokedAt
+	}
+	return key
+}
+
+func (store *memoryStore) CreateAPIKey(key *APIKey) error {
+	return store.write(func(data *memoryData) error {
+		data.apiKeys[key.Hash] = copyAPIKey(*key)
+		return nil
+	})
+}
+
+func (store *memoryStore) ListAPIKeys(organisationID uuid.UUID) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := store.read(func(data *memoryData) error {
+		for _, key := range data.apiKeys {
+			if key.OrganisationID == organisationID {
+				keys = append(keys, copyAPIKey(key))
+			}
+		}
+		return nil
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, err
+}
+
+func (store *memoryStore) RevokeAPIKey(id uuid.UUID, at time.Time) error {
+	return store.write(func(data *memoryData) error {
+		for hash, key := range data.apiKeys {
+			if key.ID == id {
+				key.RevokedAt = &at
+				data.apiKeys[hash] = key
+				return nil
+			}
+		}
+		return ErrAPIKeyNotFound
+	})
+}
+
+func (store *memoryStore) SetAPIKeyRoles(id uuid.UUID, roles []string) error {
+	return store.write(func(data *memoryData) error {
+		for hash, key := range data.apiKeys {
+			if key.ID == id {
+				key.Roles = append([]string{}, roles...)
+				data.apiKeys[hash] = key
+				return nil
+			}
+		}
+		return ErrAPIKeyNotFound
+	})
+}
+
+// roleKey is the key of an organisation's role in the roles map
+func roleKey(organisationID uuid.UUID, name string) string {
+	return organisationID.String() + "/" + name
+}
+
+// copy a role, so the stored role never shares its permissions with callers
+func copyRole(role Role) Role {
+	role.Permissions = append([]string{}, role.Permissions...)
+	return role
+}
+
+func (store *memoryStore) GetRole(organisationID uuid.UUID, name string) (Role, error) {
+	var role Role
+	err := store.read(func(data *memoryData) error {
+		stored, ok := data.roles[roleKey(organisationID, name)]
+		if !ok {
+			return ErrRoleNotFound
+		}
+		role = copyRole(stored)
+		return nil
+	})
+	return role, err
+}
+
+func (store *memoryStore) ListRoles(organisationID uuid.UUID) ([]Role, error) {
+	roles := []Role{}
+	err := store.read(func(data *memoryData) error {
+		for _, role := range data.roles {
+			if role.OrganisationID == organisationID {
+				roles = append(roles, copyRole(role))
+			}
+		}
+		return nil
+	})
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+	return roles, err
+}
+
+func (store *memoryStore) PutRole(role *Role) error {
+	return store.write(func(data *memoryData) error {
+		data.roles[roleKey(role.OrganisationID, role.Name)] = copyRole(*role)
+		return nil
+	})
+}
+
+func (store *memoryStore) DeleteRole(organisationID uuid.UUID, name string) error {
+	return store.write(func(data *memoryData) error {
+		key := roleKey(organisationID, name)
+		if _, ok := data.roles[key]; !ok {
+			return ErrRoleNotFound
+		}
+		delete(data.roles, key)
+		return nil
+	})
+}
+
+// policyKey is the key of an organisation's approval policy for a currency in the policies map
+func policyKey(organisationID uuid.UUID, currency string) string {
+	return organisationID.String() + "/" + currency
+}
+
+func (store *memoryStore) GetApprovalPolicy(organisationID uuid.UUID, currency string) (ApprovalPolicy, error) {
+	var policy ApprovalPolicy
+	err := store.read(func(data *memoryData) error {
+		stored, ok := data.policies[policyKey(organisationID, currency)]
+		if !ok {
+			return ErrApprovalPolicyNotFound
+		}
+		policy = stored
+		return nil
+	})
+	return policy, err
+}
+
+func (store *memoryStore) ListApprovalPolicies(organisationID uuid.UUID) ([]ApprovalPolicy, error) {
+	policies := []ApprovalPolicy{}
+	err := store.read(func(data *memoryData) error {
+		for _, policy := range data.policies {
+			if policy.OrganisationID == organisationID {
+				policies = append(policies, policy)
+			}
+		}
+		return nil
+	})
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Currency < policies[j].Currency
+	})
+	return policies, err
+}
+
+func (store *memoryStore) PutApprovalPolicy(policy *ApprovalPolicy) error {
+	return store.write(func(data *memoryData) error {
+		data.policies[policyKey(policy.OrganisationID, policy.Currency)] = *policy
+		return nil
+	})
+}
+
+func (store *memoryStore) DeleteApprovalPolicy(organisationID uuid.UUID, currency string) error {
+	return store.write(func(data *memoryData) error {
+		key := policyKey(organisationID, currency)
+		if _, ok := data.policies[key]; !ok {
+			return ErrApprovalPolicyNotFound
+		}
+		delete(data.policies, key)
+		return nil
+	})
+}
+
+// copy a subscription, so the stored subscription never shares its event types with callers
+func copySubscription(subscription Subscription) Subscription {
+	subscription.EventTypes = append([]string{}, subscription.EventTypes...)
+	return subscription
+}
+
+func (store *memoryStore) CreateSubscription(subscription *Subscription) error {
+	return store.write(func(data *memoryData) error {
+		data.subscriptions[subscription.ID] = copySubscription(*subscription)
+		return nil
+	})
+}
+
+func (store *memoryStore) GetSubscription(id uuid.UUID) (Subscription, error) {
+	var subscription Subscription
+	err := store.read(func(data *memoryData) error {
+		stored, ok := data.subscriptions[id]
+		if !ok {
+			return ErrSubscriptionNotFound
+		}
+		subscription = copySubscription(stored)
+		return nil
+	})
+	return subscription, err
+}
+
+func (store *memoryStore) ListSubscriptions(organisationID uuid.UUID) ([]Subscription, error) {
+	subscriptions := []Subscription{}
+	err := store.read(func(data *memoryData) error {
+		for _, subscription := range data.subscriptions {
+			if organisationID == uuid.Nil || subscription.OrganisationID == organisationID {
+				subscriptions = append(subscriptions, copySubscription(subscription))
+			}
+		}
+		return nil
+	})
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+	return subscriptions, err
+}
+
+func (store *memoryStore) DeleteSubscription(id uuid.UUID) error {
+	return store.write(func(data *memoryData) error {
+		if _, ok := data.subscriptions[id]; !ok {
+			return ErrSubscriptionNotFound
+		}
+		delete(data.subscriptions, id)
+		for deliveryID, encoded := range data.deliveries {
+			var delivery WebhookDelivery
+			if err := json.Unmarshal(encoded, &delivery); err != nil {
+				return err
+			}
+			if delivery.SubscriptionID == id {
+				delete(data.deliveries, deliveryID)
+			}
+		}
+		return nil
+	})
+}
+
+// CreateDelivery stores a delivery. deliveries are kept JSON encoded, like payments.
+func (store *memoryStore) CreateDelivery(delivery *WebhookDelivery) error {
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return store.write(func(data *memoryData) error {
+		data.deliveries[delivery.ID] = encoded
+		return nil
+	})
+}
+
+func (store *memoryStore) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	due := []WebhookDelivery{}
+	err := store.write(func(data *memoryData) error {
+		deliveries, err := data.decodeDeliveries()
+		if err != nil {
+			return err
+		}
+		for _, delivery := range deliveries {
+			if delivery.Status == DeliveryPending && !delivery.NextAttemptAt.After(now) {
+				due = append(due, delivery)
+			}
+		}
+		sort.Slice(due, func(i, j int) bool {
+			return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+		})
+		if len(due) > limit {
+			due = due[:limit]
+		}
+		for i := range due {
+			due[i].NextAttemptAt = now.Add(lease)
+			encoded, err := json.Marshal(due[i])
+			if err != nil {
+				return err
+			}
+			data.deliveries[due[i].ID] = encoded
+		}
+		return nil
+	})
+	return due, err
+}
+
+func (store *memoryStore) UpdateDelivery(delivery *WebhookDelivery, lease time.Time) error {
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return store.write(func(data *memoryData) error {
+		stored, ok := data.deliveries[delivery.ID]
+		if !ok {
+			return ErrDeliveryLeaseLost
+		}
+		var claimed WebhookDelivery
+		if err := json.Unmarshal(stored, &claimed); err != nil {
+			return err
+		}
+		if claimed.Status != DeliveryPending || !claimed.NextAttemptAt.Equal(lease) {
+			return ErrDeliveryLeaseLost
+		}
+		data.deliveries[delivery.ID] = encoded
+		return nil
+	})
+}
+
+func (store *memoryStore) ListDeliveries(subscriptionID uuid.UUID, limit int) ([]WebhookDelivery, error) {
+	listed := []WebhookDelivery{}
+	err := store.read(func(data *memoryData) error {
+		deliveries, err := data.decodeDeliveries()
+		if err != nil {
+			return err
+		}
+		for _, delivery := range deliveries {
+			if delivery.SubscriptionID == subscriptionID {
+				listed = append(listed, delivery)
+			}
+		}
+		return nil
+	})
+	sort.SliceStable(listed, func(i, j int) bool {
+		return listed[i].CreatedAt.After(listed[j].CreatedAt)
+	})
+	if len(listed) > limit {
+		listed = listed[:limit]
+	}
+	return listed, err
+}
+
+// decodeDeliveries returns every stored delivery
+func (data *memoryData) decodeDeliveries() ([]WebhookDelivery, error) {
+	deliveries := make([]WebhookDelivery, 0, len(data.deliveries))
+	for _, encoded := range data.deliveries {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(encoded, &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// RunInTransaction holds the write lock for the duration of fn, so transactions are serialised. fn works on a copy
+// of the data which replaces the original only if fn succeeds.
+func (store *memoryStore) RunInTransaction(fn func(store PaymentStore) error) error {
+	return store.write(func(data *memoryData) error {
+		tx := &memoryStore{
+			mu:   store.mu,
+			data: data.clone(),
+			inTx: true,
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		*data = *tx.data
+		return nil
+	})
+}
+
+// CreateStatusException stores an exception. exceptions are kept JSON encoded, like payments.
+func (store *memoryStore) CreateStatusException(exception *StatusReportException) error {
+	encoded, err := json.Marshal(exception)
+	if err != nil {
+		return err
+	}
+	return store.write(func(data *memoryData) error {
+		data.exceptions[exception.ID] = encoded
+		return nil
+	})
+}
+
+func (store *memoryStore) GetStatusException(id uuid.UUID) (StatusReportException, error) {
+	var exception StatusReportException
+	err := store.read(func(data *memoryData) error {
+		encoded, ok := data.exceptions[id]
+		if !ok {
+			return ErrStatusExceptionNotFound
+		}
+		return json.Unmarshal(encoded, &exception)
+	})
+	return exception, err
+}
+
+func (store *memoryStore) ListStatusExceptions(query StatusExceptionQuery) ([]StatusReportException, error) {
+	listed := []StatusReportException{}
+	err := store.read(func(data *memoryData) error {
+		for _, encoded := range data.exceptions {
+			var exception StatusReportException
+			if err := json.Unmarshal(encoded, &exception); err != nil {
+				return err
+			}
+			if query.OrganisationID != uuid.Nil && exception.OrganisationID != query.OrganisationID {
+				continue
+			}
+			if query.Reason != "" && exception.Reason != query.Reason {
+				continue
+			}
+			if (exception.ResolvedAt != nil) != query.Resolved {
+				continue
+			}
+			listed = append(listed, exception)
+		}
+		return nil
+	})
+	sort.Slice(listed, func(i, j int) bool {
+		if !listed[i].ReceivedAt.Equal(listed[j].ReceivedAt) {
+			return listed[i].ReceivedAt.After(listed[j].ReceivedAt)
+		}
+		return listed[i].ID.String() < listed[j].ID.String()
+	})
+	if query.Limit > 0 && len(listed) > query.Limit {
+		listed = listed[:query.Limit]
+	}
+	return listed, err
+}
+
+func (store *memoryStore) ResolveStatusException(id uuid.UUID, at time.Time) error {
+	return store.write(func(data *memoryData) error {
+		encoded, ok := data.exceptions[id]
+		if !ok {
+			return ErrStatusExceptionNotFound
+		}
+		var exception StatusReportException
+		if err := json.Unmarshal(encoded, &exception); err != nil {
+			return err
+		}
+		exception.ResolvedAt = &at
+		encoded, err := json.Marshal(exception)
+		if err != nil {
+			return err
+		}
+		data.exceptions[id] = encoded
+		return nil
+	})
+}
+
+// schemeFileRecord is a stored scheme file. the file is JSON encoded like payments, apart from its content, which
+// isn't part of its JSON.
+type schemeFileRecord struct {
+	encoded []byte
+	content string
+}
+
+func (store *memoryStore) CreateSchemeFile(file *SchemeFile) error {
+	encoded, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return store.write(func(data *memoryData) error {
+		data.schemeFiles[file.ID] = schemeFileRecord{encoded: encoded, content: file.Content}
+		return nil
+	})
+}
+
+func (store *memoryStore) GetSchemeFile(id uuid.UUID) (SchemeFile, error) {
+	var file SchemeFile
+	err := store.read(func(data *memoryData) error {
+		record, ok := data.schemeFiles[id]
+		if !ok {
+			return ErrSchemeFileNotFound
+		}
+		file.Content = record.content
+		return json.Unmarshal(record.encoded, &file)
+	})
+	return file, err
+}
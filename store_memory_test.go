@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStoreReturnsCopies(t *testing.T) {
+
+	memory := newMemoryStore()
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, memory.Create(&examplePayment))
+
+	// modifying the caller's payment after creation must not modify the stored payment
+	examplePayment.Attributes.DebtorParty.Name = "Someone Else"
+
+	stored, err := memory.Get(examplePayment.ID)
+	require.Nil(t, err)
+	assert.Equal(t, "Mangoes Incorporated", stored.Attributes.DebtorParty.Name)
+}
+
+func TestMemoryStoreCreateExistingPayment(t *testing.T) {
+
+	memory := newMemoryStore()
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, memory.Create(&examplePayment))
+	assert.Equal(t, ErrPaymentExists, memory.Create(&examplePayment))
+}
+
+func TestMemoryStoreUpdateAndDeleteNonExistentPayment(t *testing.T) {
+
+	memory := newMemoryStore()
+
+	examplePayment := createExamplePayment()
+	assert.Equal(t, ErrPaymentNotFound, memory.Update(&examplePayment))
+	assert.Equal(t, ErrPaymentNotFound, memory.Delete(examplePayment.ID, 0))
+}
+
+func TestMemoryStoreListKeepsInsertionOrderAfterDelete(t *testing.T) {
+
+	memory := newMemoryStore()
+
+	examplePayments := []Payment{createExamplePayment(), createExamplePayment(), createExamplePayment()}
+	for i := range examplePayments {
+		require.Nil(t, memory.Create(&examplePayments[i]))
+	}
+	require.Nil(t, memory.Delete(examplePayments[1].ID, 0))
+
+	page, err := memory.List(PaymentQuery{Sort: PaymentSort{Field: sortCreated}})
+	require.Nil(t, err)
+	assert.EqualValues(t, []Payment{examplePayments[0], examplePayments[2]}, page.Payments)
+}
+
+func TestMemoryStoreTransactionCommits(t *testing.T) {
+
+	memory := newMemoryStore()
+
+	examplePayment := createExamplePayment()
+	err := memory.RunInTransaction(func(tx PaymentStore) error {
+		return tx.Create(&examplePayment)
+	})
+	require.Nil(t, err)
+
+	_, err = memory.Get(examplePayment.ID)
+	assert.Nil(t, err)
+}
+
+func TestMemoryStoreTransactionRollsBackOnError(t *testing.T) {
+
+	memory := newMemoryStore()
+
+	existingPayment := createExamplePayment()
+	require.Nil(t, memory.Create(&existingPayment))
+
+	newPayment := createExamplePayment()
+	failure := errors.New("failure")
+	err := memory.RunInTransaction(func(tx PaymentStore) error {
+		if err := tx.Create(&newPayment); err != nil {
+			return err
+		}
+		if err := tx.Delete(existingPayment.ID, 0); err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	// neither change should have been kept
+	_, err = memory.Get(newPayment.ID)
+	assert.Equal(t, ErrPaymentNotFound, err)
+	_, err = memory.Get(existingPayment.ID)
+	assert.Nil(t, err)
+}
+
+func TestMemoryStoreConcurrentCreates(t *testing.T) {
+
+	memory := newMemoryStore()
+
+	// many goroutines racing to create the same payment must result in exactly one success
+	id := uuid.NewV1()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payment := createExamplePayment()
+			payment.ID = id
+			if err := memory.Create(&payment); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, created)
+}
+
+func TestMemoryStoreUpdateComparesAndSwapsVersion(t *testing.T) {
+
+	memory := newMemoryStore()
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, memory.Create(&examplePayment))
+
+	stale := examplePayment
+	require.Nil(t, memory.Update(&examplePayment))
+	assert.Equal(t, uint(1), examplePayment.Version)
+
+	assert.Equal(t, ErrVersionConflict, memory.Update(&stale))
+	assert.Equal(t, uint(0), stale.Version)
+	assert.Equal(t, ErrVersionConflict, memory.Delete(examplePayment.ID, 0))
+	assert.Nil(t, memory.Delete(examplePayment.ID, 1))
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// postgresStore is a PaymentStore backed by the go-pg ORM. db is either a *pg.DB or, inside a transaction, a *pg.Tx.
+type postgresStore struct {
+	db orm.DB
+}
+
+func newPostgresStore(db *pg.DB) *postgresStore {
+	return &postgresStore{db: db}
+}
+
+func (store *postgresStore) Get(id uuid.UUID) (Payment, error) {
+	return store.get(id, false)
+}
+
+func (store *postgresStore) GetIncludingDeleted(id uuid.UUID) (Payment, error) {
+	return store.get(id, true)
+}
+
+func (store *postgresStore) get(id uuid.UUID, includeDeleted bool) (Payment, error) {
+	payment := Payment{
+		ID: id,
+	}
+	q := store.db.Model(&payment).WherePK()
+	if !includeDeleted {
+		q = q.Where("deleted_at IS NULL")
+	}
+	if err := q.Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return Payment{}, ErrPaymentNotFound
+		}
+		return Payment{}, err
+	}
+	return payment, nil
+}
+
+// SQL expressions for the sort keys, which must match sortKey and the indexes created by the migrations
+const (
+	processingDateSQL = `COALESCE(attributes->>'processing_date', '')`
+	amountSQL         = `COALESCE(amount, 0)`
+)
+
+// paymentRow is a payment along with the columns that aren't part of the payment resource. Amount is a copy of the
+// payment amount as a NUMERIC, so that it can be filtered and sorted on exactly.
+type paymentRow struct {
+	tableName struct{} `sql:"payments"`
+
+	Payment
+	Seq    int64   `sql:"seq"`
+	Amount Decimal `sql:"amount,type:numeric"`
+}
+
+func newPaymentRow(payment Payment) *paymentRow {
+	return &paymentRow{Payment: payment, Amount: payment.Attributes.Amount}
+}
+
+func (store *postgresStore) List(query PaymentQuery) (PaymentPage, error) {
+	rows := []paymentRow{}
+	q := store.db.Model(&rows)
+
+	filter := query.Filter
+	if !filter.IncludeDeleted {
+		q = q.Where("deleted_at IS NULL")
+	}
+	if filter.OrganisationID != uuid.Nil {
+		q = q.Where("organisation_id = ?", filter.OrganisationID)
+	}
+	if filter.Currency != "" {
+		q = q.Where("attributes->>'currency' = ?", filter.Currency)
+	}
+	if filter.PaymentScheme != "" {
+		q = q.Where("attributes->>'payment_scheme' = ?", filter.PaymentScheme)
+	}
+	if filter.EndToEndReference != "" {
+		q = q.Where("attributes->>'end_to_end_reference' = ?", filter.EndToEndReference)
+	}
+	if filter.SchemePaymentID != "" {
+		q = q.Where("attributes->>'payment_id' = ?", filter.SchemePaymentID)
+	}
+	if filter.ProcessingDateFrom != "" {
+		q = q.Where(processingDateSQL+" >= ?", filter.ProcessingDateFrom)
+	}
+	if filter.ProcessingDateTo != "" {
+		q = q.Where(processingDateSQL+" <= ?", filter.ProcessingDateTo)
+	}
+	if !filter.AmountMin.IsEmpty() {
+		q = q.Where(amountSQL+" >= ?::numeric", filter.AmountMin)
+	}
+	if !filter.AmountMax.IsEmpty() {
+		q = q.Where(amountSQL+" <= ?::numeric", filter.AmountMax)
+	}
+
+	var keySQL, keyCast string
+	switch query.Sort.Field {
+	case sortProcessingDate:
+		keySQL = processingDateSQL
+	case sortAmount:
+		keySQL, keyCast = amountSQL, "::numeric"
+	}
+
+	// scan backwards from the cursor when paging to the previous page, then put the page back in order
+	backwards := query.Before != nil
+	descending := query.Sort.Descending != backwards
+	operator, direction := ">", "ASC"
+	if descending {
+		operator, direction = "<", "DESC"
+	}
+
+	from := query.After
+	if backwards {
+		from = query.Before
+	}
+	if from != nil {
+		if keySQL == "" {
+			q = q.Where("seq "+operator+" ?", from.Seq)
+		} else {
+			q = q.Where("("+keySQL+", seq) "+operator+" (?"+keyCast+", ?)", from.Key, from.Seq)
+		}
+	}
+
+	if keySQL != "" {
+		q = q.OrderExpr(keySQL + " " + direction)
+	}
+	q = q.OrderExpr("seq " + direction)
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit + 1) // one more than needed to find out whether there is another page
+	}
+
+	if err := q.Select(); err != nil {
+		return PaymentPage{}, err
+	}
+
+	more := false
+	if query.Limit > 0 && len(rows) > query.Limit {
+		rows = rows[:query.Limit]
+		more = true
+	}
+	if backwards {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	page := PaymentPage{Payments: make([]Payment, len(rows))}
+	for i, row := range rows {
+		page.Payments[i] = row.Payment
+	}
+	if len(rows) == 0 {
+		return page, nil
+	}
+
+	cursor := func(row paymentRow) *PaymentCursor {
+		return &PaymentCursor{Sort: query.Sort.String(), Key: sortKey(row.Payment, query.Sort.Field), Seq: row.Seq}
+	}
+	if more || backwards {
+		page.Next = cursor(rows[len(rows)-1])
+	}
+	if (backwards && more) || query.After != nil {
+		page.Prev = cursor(rows[0])
+	}
+	return page, nil
+}
+
+func (store *postgresStore) Create(payment *Payment) error {
+	// let the primary key decide whether the payment already exists, rather than racing a select against the insert
+	row := newPaymentRow(*payment)
+	result, err := store.db.Model(row).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrPaymentExists
+	}
+	*payment = row.Payment
+	return nil
+}
+
+func (store *postgresStore) Update(payment *Payment) error {
+	// compare-and-swap on the version, so that concurrent updates can't silently overwrite each other
+	expected := payment.Version
+	payment.Version = expected + 1
+	row := newPaymentRow(*payment)
+
+	// only Delete and Restore change whether a payment is deleted
+	result, err := store.db.Model(row).ExcludeColumn("seq", "deleted_at").
+		Where("id = ?", payment.ID).Where("version = ?", expected).Where("deleted_at IS NULL").Update()
+	if err != nil {
+		payment.Version = expected
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		payment.Version = expected
+		return store.missingOrConflict(payment.ID, false)
+	}
+	return nil
+}
+
+func (store *postgresStore) Delete(id uuid.UUID, version uint) error {
+	return store.setDeleted(id, version, false, "now()")
+}
+
+func (store *postgresStore) Restore(id uuid.UUID, version uint) error {
+	return store.setDeleted(id, version, true, "NULL")
+}
+
+// setDeleted compares-and-swaps the tombstone of a payment that is deleted or not as given, incrementing its version
+func (store *postgresStore) setDeleted(id uuid.UUID, version uint, deleted bool, deletedAt string) error {
+	q := store.db.Model(&Payment{}).Set("deleted_at = "+deletedAt).Set("version = version + 1").
+		Where("id = ?", id).Where("version = ?", version)
+	if deleted {
+		q = q.Where("deleted_at IS NOT NULL")
+	} else {
+		q = q.Where("deleted_at IS NULL")
+	}
+	result, err := q.Update()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return store.missingOrConflict(id, deleted)
+	}
+	return nil
+}
+
+// work out why a compare-and-swap on a payment that is deleted or not as given affected no rows
+func (store *postgresStore) missingOrConflict(id uuid.UUID, deleted bool) error {
+	q := store.db.Model(&Payment{}).Where("id = ?", id)
+	if deleted {
+		q = q.Where("deleted_at IS NOT NULL")
+	} else {
+		q = q.Where("deleted_at IS NULL")
+	}
+	exists, err := q.Exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionConflict
+	}
+	return ErrPaymentNotFound
+}
+
+func (store *postgresStore) PurgeDeleted(cutoff time.Time) ([]Payment, error) {
+	purged := []Payment{}
+	_, err := store.db.Model(&purged).Where("deleted_at < ?", cutoff).Returning("*").Delete()
+	if err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+func (store *postgresStore) GetIdempotencyKey(key string) (IdempotencyRecord, error) {
+	record := IdempotencyRecord{
+		Key: key,
+	}
+	if err := store.db.Select(&record); err != nil {
+		if err == pg.ErrNoRows {
+			return IdempotencyRecord{}, ErrIdempotencyKeyNotFound
+		}
+		return IdempotencyRecord{}, err
+	}
+	return record, nil
+}
+
+func (store *postgresStore) CreateIdempotencyKey(record *IdempotencyRecord) error {
+	// a concurrent request with the same key blocks here until the other transaction finishes
+	result, err := store.db.Model(record).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrIdempotencyKeyExists
+	}
+	return nil
+}
+
+func (store *postgresStore) DeleteIdempotencyKey(key string) error {
+	_, err := store.db.Model(&IdempotencyRecord{}).Where("key = ?", key).Delete()
+	return err
+}
+
+func (store *postgresStore) DeleteIdempotencyKeysBefore(cutoff time.Time) (int, error) {
+	result, err := store.db.Model(&IdempotencyRecord{}).Where("created_at < ?", cutoff).Delete()
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+func (store *postgresStore) GetFXQuote(contractReference string) (FXQuote, error) {
+	quote := FXQuote{
+		ContractReference: contractReference,
+	}
+	if err := store.db.Select(&quote); err != nil {
+		if err == pg.ErrNoRows {
+			return FXQuote{}, ErrFXQuoteNotFound
+		}
+		return FXQuote{}, err
+	}
+	return quote, nil
+}
+
+func (store *postgresStore) ListFXRates() ([]FXRate, error) {
+	rates := []FXRate{}
+	if err := store.db.Model(&rates).Order("base_currency ASC", "quote_currency ASC").Select(); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+func (store *postgresStore) ReplaceFXRates(rates []FXRate) error {
+	// concurrent replacements take turns, and quotes see either the old rates or the new ones
+	return store.RunInTransaction(func(tx PaymentStore) error {
+		db := tx.(*postgresStore).db
+		if _, err := db.Exec(`LOCK TABLE "fx_rates" IN EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+		if _, err := db.Model(&FXRate{}).Where("1=1").Delete(); err != nil {
+			return err
+		}
+		if len(rates) == 0 {
+			return nil
+		}
+		_, err := db.Model(&rates).Insert()
+		return err
+	})
+}
+
+func (store *postgresStore) CreateFXQuote(quote *FXQuote) error {
+	result, err := store.db.Model(quote).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrFXQuoteExists
+	}
+	return nil
+}
+
+func (store *postgresStore) GetBatch(id uuid.UUID) (PaymentBatch, error) {
+	batch := PaymentBatch{
+		ID: id,
+	}
+	if err := store.db.Select(&batch); err != nil {
+		if err == pg.ErrNoRows {
+			return PaymentBatch{}, ErrBatchNotFound
+		}
+		return PaymentBatch{}, err
+	}
+	return batch, nil
+}
+
+func (store *postgresStore) CreateBatch(batch *PaymentBatch) error {
+	result, err := store.db.Model(batch).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrBatchExists
+	}
+	return nil
+}
+
+func (store *postgresStore) AppendAudit(entry *AuditEntry) error {
+	_, err := store.db.Model(entry).Insert()
+	return err
+}
+
+func (store *postgresStore) ListAudit(query AuditQuery) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	q := store.db.Model(&entries).Where("seq > ?", query.After).Order("seq ASC")
+	if query.OrganisationID != uuid.Nil {
+		q = q.Where("organisation_id = ?", query.OrganisationID)
+	}
+	if query.PaymentID != uuid.Nil {
+		q = q.Where("payment_id = ?", query.PaymentID)
+	}
+	if query.Actor != "" {
+		q = q.Where("actor = ?", query.Actor)
+	}
+	if query.Action != "" {
+		q = q.Where("action = ?", query.Action)
+	}
+	if !query.Since.IsZero() {
+		q = q.Where(`"timestamp" >= ?`, query.Since)
+	}
+	if !query.Until.IsZero() {
+		q = q.Where(`"timestamp" <= ?`, query.Until)
+	}
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+	if err := q.Select(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// eventSequenceLockID is the postgres advisory lock key held by a transaction from appending an event until it commits
+const eventSequenceLockID = 3300592
+
+// AppendEvent appends an event, once every transaction that appended an event before it has committed. otherwise an
+// event could commit after one with a higher sequence, and a reader resuming from that sequence would never see it.
+func (store *postgresStore) AppendEvent(event *PaymentEvent) error {
+	if _, err := store.db.Exec("SELECT pg_advisory_xact_lock(?)", eventSequenceLockID); err != nil {
+		return err
+	}
+	_, err := store.db.Model(event).Insert()
+	return err
+}
+
+func (store *postgresStore) ListEvents(query EventQuery) ([]PaymentEvent, error) {
+	events := []PaymentEvent{}
+	q := store.db.Model(&events).Where("seq > ?", query.After).Order("seq ASC")
+	if query.OrganisationID != uuid.Nil {
+		q = q.Where("organisation_id = ?", query.OrganisationID)
+	}
+	if len(query.Types) > 0 {
+		q = q.Where("type IN (?)", pg.In(query.Types))
+	}
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+	if err := q.Select(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (store *postgresStore) LatestEventSeq() (int64, error) {
+	var seq int64
+	_, err := store.db.QueryOne(pg.Scan(&seq), "SELECT COALESCE(MAX(seq), 0) FROM payment_events")
+	return seq, err
+}
+
+// LockRelayOffset locks the sink's row, creating it the first time. the lock is skipped rather than waited for, as a
+// replica holding it is already publishing to the sink.
+func (store *postgresStore) LockRelayOffset(sink string) (int64, bool, error) {
+	if _, err := store.db.Model(&RelayOffset{Sink: sink, UpdatedAt: time.Now().UTC()}).OnConflict("DO NOTHING").Insert(); err != nil {
+		return 0, false, err
+	}
+	offset := RelayOffset{Sink: sink}
+	err := store.db.Model(&offset).WherePK().For("UPDATE SKIP LOCKED").Select()
+	if err == pg.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return offset.Seq, true, nil
+}
+
+func (store *postgresStore) SetRelayOffset(sink string, seq int64) error {
+	_, err := store.db.Model(&RelayOffset{Sink: sink, Seq: seq, UpdatedAt: time.Now().UTC()}).WherePK().Update()
+	return err
+}
+
+func (store *postgresStore) GetAPIKey(hash string) (APIKey, error) {
+	var key APIKey
+	if err := store.db.Model(&key).Where("hash = ?", hash).Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return APIKey{}, ErrAPIKeyNotFound
+		}
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+func (store *postgresStore) CreateAPIKey(key *APIKey) error {
+	_, err := store.db.Model(key).Insert()
+	return err
+}
+
+func (store *postgresStore) ListAPIKeys(organisationID uuid.UUID) ([]APIKey, error) {
+	keys := []APIKey{}
+	if err := store.db.Model(&keys).Where("organisation_id = ?", organisationID).Order("created_at ASC").Select(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (store *postgresStore) RevokeAPIKey(id uuid.UUID, at time.Time) error {
+	result, err := store.db.Model(&APIKey{}).Set("revoked_at = ?", at).Where("id = ?", id).Update()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (store *postgresStore) SetAPIKeyRoles(id uuid.UUID, roles []string) error {
+	key := APIKey{ID: id, Roles: append([]string{}, roles...)}
+	result, err := store.db.Model(&key).Column("roles").WherePK().Update()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (store *postgresStore) GetRole(organisationID uuid.UUID, name string) (Role, error) {
+	role := Role{
+		OrganisationID: organisationID,
+		Name:           name,
+	}
+	if err := store.db.Select(&role); err != nil {
+		if err == pg.ErrNoRows {
+			return Role{}, ErrRoleNotFound
+		}
+		return Role{}, err
+	}
+	return role, nil
+}
+
+func (store *postgresStore) ListRoles(organisationID uuid.UUID) ([]Role, error) {
+	roles := []Role{}
+	if err := store.db.Model(&roles).Where("organisation_id = ?", organisationID).Order("name ASC").Select(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (store *postgresStore) PutRole(role *Role) error {
+	_, err := store.db.Model(role).
+		OnConflict("(organisation_id, name) DO UPDATE").
+		Set("description = EXCLUDED.description, permissions = EXCLUDED.permissions").
+		Insert()
+	return err
+}
+
+func (store *postgresStore) DeleteRole(organisationID uuid.UUID, name string) error {
+	result, err := store.db.Model(&Role{}).Where("organisation_id = ?", organisationID).Where("name = ?", name).Delete()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+func (store *postgresStore) GetApprovalPolicy(organisationID uuid.UUID, currency string) (ApprovalPolicy, error) {
+	policy := ApprovalPolicy{
+		OrganisationID: organisationID,
+		Currency:       currency,
+	}
+	if err := store.db.Select(&policy); err != nil {
+		if err == pg.ErrNoRows {
+			return ApprovalPolicy{}, ErrApprovalPolicyNotFound
+		}
+		return ApprovalPolicy{}, err
+	}
+	return policy, nil
+}
+
+func (store *postgresStore) ListApprovalPolicies(organisationID uuid.UUID) ([]ApprovalPolicy, error) {
+	policies := []ApprovalPolicy{}
+	if err := store.db.Model(&policies).Where("organisation_id = ?", organisationID).Order("currency ASC").Select(); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (store *postgresStore) PutApprovalPolicy(policy *ApprovalPolicy) error {
+	_, err := store.db.Model(policy).
+		OnConflict("(organisation_id, currency) DO UPDATE").
+		Set("threshold = EXCLUDED.threshold, approvals = EXCLUDED.approvals").
+		Insert()
+	return err
+}
+
+func (store *postgresStore) DeleteApprovalPolicy(organisationID uuid.UUID, currency string) error {
+	result, err := store.db.Model(&ApprovalPolicy{}).Where("organisation_id = ?", organisationID).Where("currency = ?", currency).Delete()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrApprovalPolicyNotFound
+	}
+	return nil
+}
+
+func (store *postgresStore) CreateSubscription(subscription *Subscription) error {
+	_, err := store.db.Model(subscription).Insert()
+	return err
+}
+
+func (store *postgresStore) GetSubscription(id uuid.UUID) (Subscription, error) {
+	subscription := Subscription{
+		ID: id,
+	}
+	if err := store.db.Select(&subscription); err != nil {
+		if err == pg.ErrNoRows {
+			return Subscription{}, ErrSubscriptionNotFound
+		}
+		return Subscription{}, err
+	}
+	return subscription, nil
+}
+
+func (store *postgresStore) ListSubscriptions(organisationID uuid.UUID) ([]Subscription, error) {
+	subscriptions := []Subscription{}
+	q := store.db.Model(&subscriptions).Order("created_at ASC")
+	if organisationID != uuid.Nil {
+		q = q.Where("organisation_id = ?", organisationID)
+	}
+	if err := q.Select(); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// DeleteSubscription deletes a subscription. its deliveries are deleted by the foreign key cascade.
+func (store *postgresStore) DeleteSubscription(id uuid.UUID) error {
+	result, err := store.db.Model(&Subscription{}).Where("id = ?", id).Delete()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+func (store *postgresStore) CreateDelivery(delivery *WebhookDelivery) error {
+	_, err := store.db.Model(delivery).Insert()
+	return err
+}
+
+func (store *postgresStore) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	// concurrent dispatchers skip the deliveries each other are claiming
+	deliveries := []WebhookDelivery{}
+	_, err := store.db.Query(&deliveries, `
+		UPDATE webhook_deliveries SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at LIMIT ? FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, now.Add(lease), DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (store *postgresStore) UpdateDelivery(delivery *WebhookDelivery, lease time.Time) error {
+	result, err := store.db.Model(delivery).
+		Where("id = ?", delivery.ID).
+		Where("status = ?", DeliveryPending).
+		Where("next_attempt_at = ?", lease).
+		Update()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrDeliveryLeaseLost
+	}
+	return nil
+}
+
+func (store *postgresStore) ListDeliveries(subscriptionID uuid.UUID, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := store.db.Model(&deliveries).Where("subscription_id = ?", subscriptionID).Order("created_at DESC").Limit(limit).Select()
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (store *postgresStore) CreateStatusException(exception *StatusReportException) error {
+	_, err := store.db.Model(exception).Insert()
+	return err
+}
+
+func (store *postgresStore) GetStatusException(id uuid.UUID) (StatusReportException, error) {
+	exception := StatusReportException{
+		ID: id,
+	}
+	if err := store.db.Select(&exception); err != nil {
+		if err == pg.ErrNoRows {
+			return StatusReportException{}, ErrStatusExceptionNotFound
+		}
+		return StatusReportException{}, err
+	}
+	return exception, nil
+}
+
+func (store *postgresStore) ListStatusExceptions(query StatusExceptionQuery) ([]StatusReportException, error) {
+	exceptions := []StatusReportException{}
+	q := store.db.Model(&exceptions).Order("received_at DESC", "id")
+	if query.OrganisationID != uuid.Nil {
+		q = q.Where("organisation_id = ?", query.OrganisationID)
+	}
+	if query.Reason != "" {
+		q = q.Where("reason = ?", query.Reason)
+	}
+	if query.Resolved {
+		q = q.Where("resolved_at IS NOT NULL")
+	} else {
+		q = q.Where("resolved_at IS NULL")
+	}
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+	if err := q.Select(); err != nil {
+		return nil, err
+	}
+	return exceptions, nil
+}
+
+func (store *postgresStore) ResolveStatusException(id uuid.UUID, at time.Time) error {
+	result, err := store.db.Model(&StatusReportException{}).Set("resolved_at = ?", at).Where("id = ?", id).Update()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrStatusExceptionNotFound
+	}
+	return nil
+}
+
+func (store *postgresStore) CreateSchemeFile(file *SchemeFile) error {
+	_, err := store.db.Model(file).Insert()
+	return err
+}
+
+func (store *postgresStore) GetSchemeFile(id uuid.UUID) (SchemeFile, error) {
+	file := SchemeFile{
+		ID: id,
+	}
+	if err := store.db.Select(&file); err != nil {
+		if err == pg.ErrNoRows {
+			return SchemeFile{}, ErrSchemeFileNotFound
+		}
+		return SchemeFile{}, err
+	}
+	return file, nil
+}
+
+func (store *postgresStore) RunInTransaction(fn func(store PaymentStore) error) error {
+	switch db := store.db.(type) {
+	case *pg.DB:
+		return db.RunInTransaction(func(tx *pg.Tx) error {
+			return fn(&postgresStore{db: tx})
+		})
+	case *pg.Tx:
+		// already in a transaction, so nest within it using a savepoint that is rolled back if fn fails
+		if _, err := db.Exec("SAVEPOINT nested_transaction"); err != nil {
+			return err
+		}
+		if err := fn(store); err != nil {
+			if _, rollbackErr := db.Exec("ROLLBACK TO SAVEPOINT nested_transaction"); rollbackErr != nil {
+				return rollbackErr
+			}
+			return err
+		}
+		_, err := db.Exec("RELEASE SAVEPOINT nested_transaction")
+		return err
+	}
+	return fn(store)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	defaultStreamPollInterval = 500 * time.Millisecond
+	defaultStreamHeartbeat    = 15 * time.Second
+
+	// the most events read from the store at a time
+	streamBatchSize = 100
+)
+
+// parseEventQuery parses the filters of GET /v1/payments/stream
+func parseEventQuery(values url.Values) (EventQuery, []APIError) {
+	query := EventQuery{Limit: streamBatchSize}
+	var errs []APIError
+	invalid := func(param, message string) {
+		errs = append(errs, APIError{Code: "invalid_parameter", Message: message, Parameter: param})
+	}
+
+	if organisationID := values.Get("filter[organisation_id]"); organisationID != "" {
+		id, err := uuid.FromString(organisationID)
+		if err != nil {
+			invalid("filter[organisation_id]", "Invalid organisation_id filter")
+		}
+		query.OrganisationID = id
+	}
+	if types := values.Get("filter[type]"); types != "" {
+		known := map[string]bool{}
+		for _, eventType := range paymentEventTypes() {
+			known[eventType] = true
+		}
+		for _, eventType := range strings.Split(types, ",") {
+			if !known[eventType] {
+				invalid("filter[type]", fmt.Sprintf("Unknown event type %s", eventType))
+				continue
+			}
+			query.Types = append(query.Types, eventType)
+		}
+	}
+	return query, errs
+}
+
+// writeStreamEvent writes a payment event in the server-sent events format, with its sequence as the event ID
+func writeStreamEvent(w http.ResponseWriter, event PaymentEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+	return err
+}
+
+// business logic for GET /v1/payments/stream endpoint, which streams payment events as server-sent events as they
+// are committed. a client that reconnects with Last-Event-ID is sent the events it missed, otherwise the stream
+// starts from the next event. comments are sent as heartbeats while there are no events.
+func (api *api) streamPayments(w http.ResponseWriter, r *http.Request) {
+
+	query, errs := parseEventQuery(r.URL.Query())
+	if len(errs) > 0 {
+		writeErrors(w, http.StatusBadRequest, errs...)
+		return
+	}
+
+	store := api.storeFor(r)
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		seq, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || seq < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_last_event_id", "Last-Event-ID must be the id of an event")
+			return
+		}
+		query.After = seq
+	} else {
+		seq, err := store.LatestEventSeq()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		query.After = seq
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", api.streamPollInterval/time.Millisecond)
+	flusher.Flush()
+
+	poll := time.NewTicker(api.streamPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(api.streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		events, err := store.ListEvents(query)
+		if err != nil {
+			// the client reconnects with the last event it was sent
+			log.Printf("failed to read payment events: %s", err)
+			return
+		}
+		for _, event := range events {
+			if err := writeStreamEvent(w, event); err != nil {
+				return
+			}
+			query.After = event.Seq
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+		if len(events) == query.Limit {
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-poll.C:
+		}
+	}
+}
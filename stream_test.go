@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamMessage is a message read from the payment stream. heartbeats only have a comment.
+type streamMessage struct {
+	id      string
+	event   string
+	data    string
+	comment string
+}
+
+// streamReader reads the messages sent on an open payment stream
+type streamReader struct {
+	response *http.Response
+	lines    *bufio.Reader
+}
+
+// openStream opens the payment stream of an API server, authenticating with key if it's given
+func openStream(t *testing.T, serverURL, query, key, lastEventID string) *streamReader {
+	req, err := http.NewRequest(http.MethodGet, serverURL+"/v1/payments/stream"+query, nil)
+	require.Nil(t, err)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	stream := &streamReader{response: response, lines: bufio.NewReader(response.Body)}
+	// the stream starts with the reconnection delay, once it knows where to start from
+	first := stream.next(t)
+	require.Equal(t, streamMessage{}, first)
+	return stream
+}
+
+// next reads the next message from the stream
+func (stream *streamReader) next(t *testing.T) streamMessage {
+	var message streamMessage
+	for {
+		line, err := stream.lines.ReadString('\n')
+		require.Nil(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return message
+		}
+		switch {
+		case strings.HasPrefix(line, ":"):
+			message.comment = strings.TrimSpace(strings.TrimPrefix(line, ":"))
+		case strings.HasPrefix(line, "id: "):
+			message.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			message.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			message.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// nextEvent reads the next event from the stream, skipping heartbeats
+func (stream *streamReader) nextEvent(t *testing.T) (streamMessage, PaymentEvent) {
+	for {
+		message := stream.next(t)
+		if message.event == "" {
+			continue
+		}
+		var event PaymentEvent
+		require.Nil(t, json.Unmarshal([]byte(message.data), &event))
+		assert.Equal(t, fmt.Sprint(event.Seq), message.id)
+		assert.Equal(t, event.Type, message.event)
+		return message, event
+	}
+}
+
+func (stream *streamReader) close() {
+	stream.response.Body.Close()
+}
+
+// newStreamServer serves an API that polls for events and sends heartbeats quickly
+func newStreamServer(authenticate bool) *httptest.Server {
+	api := newTestAPI(store)
+	api.authenticate = authenticate
+	api.streamPollInterval = 10 * time.Millisecond
+	api.streamHeartbeat = time.Hour
+	return httptest.NewServer(api)
+}
+
+func TestStreamSendsNewEventsAndResumes(t *testing.T) {
+
+	emptyDatabase(t)
+
+	// events before the stream is opened aren't sent
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", createExamplePayment()).Code)
+
+	ts := newStreamServer(false)
+	defer ts.Close()
+
+	stream := openStream(t, ts.URL, "", "", "")
+	payment := createExamplePayment()
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	message, event := stream.nextEvent(t)
+	assert.Equal(t, EventPaymentCreated, event.Type)
+	assert.Equal(t, payment.ID, event.PaymentID)
+	assert.Equal(t, payment.OrganisationID, event.OrganisationID)
+	assert.Equal(t, payment.ID, event.Data.ID)
+	stream.close()
+
+	// the events committed while disconnected are sent in order when resuming from the last event seen
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodDelete, "/v1/payments/"+payment.ID.String(), nil).Code)
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodPost, "/v1/payments/"+payment.ID.String()+"/restore", nil).Code)
+
+	stream = openStream(t, ts.URL, "", "", message.id)
+	defer stream.close()
+
+	_, deleted := stream.nextEvent(t)
+	_, restored := stream.nextEvent(t)
+	assert.Equal(t, EventPaymentDeleted, deleted.Type)
+	assert.Equal(t, EventPaymentRestored, restored.Type)
+	assert.Equal(t, event.Seq+1, deleted.Seq)
+	assert.Equal(t, event.Seq+2, restored.Seq)
+}
+
+func TestStreamFilters(t *testing.T) {
+
+	emptyDatabase(t)
+
+	ts := newStreamServer(false)
+	defer ts.Close()
+
+	payment := createExamplePayment()
+	other := createExamplePayment()
+	stream := openStream(t, ts.URL, fmt.Sprintf("?filter[organisation_id]=%s&filter[type]=%s,%s", payment.OrganisationID, EventPaymentDeleted, EventPaymentRestored), "", "")
+	defer stream.close()
+
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", other).Code)
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodDelete, "/v1/payments/"+other.ID.String(), nil).Code)
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	require.Equal(t, 200, sendAs(t, "alice", http.MethodDelete, "/v1/payments/"+payment.ID.String(), nil).Code)
+
+	_, event := stream.nextEvent(t)
+	assert.Equal(t, EventPaymentDeleted, event.Type)
+	assert.Equal(t, payment.ID, event.PaymentID)
+}
+
+func TestStreamIsScopedToTheKeysOrganisation(t *testing.T) {
+
+	emptyDatabase(t)
+
+	ts := newStreamServer(true)
+	defer ts.Close()
+
+	payment := createExamplePayment()
+	_, key := createAPIKey(t, payment.OrganisationID, RoleAuditor)
+	stream := openStream(t, ts.URL, "", key, "")
+	defer stream.close()
+
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", createExamplePayment()).Code)
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	_, event := stream.nextEvent(t)
+	assert.Equal(t, payment.ID, event.PaymentID)
+}
+
+func TestStreamSendsHeartbeats(t *testing.T) {
+
+	emptyDatabase(t)
+
+	api := newTestAPI(store)
+	api.streamPollInterval = time.Hour
+	api.streamHeartbeat = 10 * time.Millisecond
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	stream := openStream(t, ts.URL, "", "", "")
+	defer stream.close()
+
+	assert.Equal(t, streamMessage{comment: "heartbeat"}, stream.next(t))
+	assert.Equal(t, streamMessage{comment: "heartbeat"}, stream.next(t))
+}
+
+func TestStreamWithInvalidParameters(t *testing.T) {
+
+	emptyDatabase(t)
+
+	rw := sendAs(t, "", http.MethodGet, "/v1/payments/stream?filter[type]=payment.created,payment.unknown", nil)
+	assert.Equal(t, 400, rw.Code)
+	assert.Contains(t, rw.Body.String(), "filter[type]")
+
+	rw = sendAs(t, "", http.MethodGet, "/v1/payments/stream?filter[organisation_id]=nope", nil)
+	assert.Equal(t, 400, rw.Code)
+	assert.Contains(t, rw.Body.String(), "filter[organisation_id]")
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/payments/stream", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	rw = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, 400, rw.Code)
+	assert.Contains(t, rw.Body.String(), "invalid_last_event_id")
+}
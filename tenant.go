@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// returned when writing a payment that belongs to a different organisation from the one the store is scoped to
+var ErrOrganisationForbidden = errors.New("payment belongs to another organisation")
+
+// organisationStore scopes a PaymentStore to a single organisation. payments, batches, audit entries, FX quotes and
+// subscriptions of other organisations are never found, and payments and subscriptions can only be created for this
+// organisation. idempotency keys are namespaced, so that organisations can't see each other's responses by reusing a
+// key.
+type organisationStore struct {
+	PaymentStore
+	organisationID uuid.UUID
+}
+
+// storeFor returns the store a request works with, scoped to the organisation it was authenticated for
+func (api *api) storeFor(r *http.Request) PaymentStore {
+	if organisationID, ok := requestOrganisation(r); ok {
+		return &organisationStore{PaymentStore: api.store, organisationID: organisationID}
+	}
+	return api.store
+}
+
+// checkOrganisation writes a 403 response and returns false when the payment is for a different organisation from
+// the one the request was authenticated for
+func checkOrganisation(w http.ResponseWriter, r *http.Request, payment Payment) bool {
+	if organisationID, ok := requestOrganisation(r); ok && payment.OrganisationID != organisationID {
+		writeErrors(w, http.StatusForbidden, APIError{
+			Code:    "forbidden_organisation",
+			Message: "Payments can only be made for the organisation of the API key",
+			Pointer: "/organisation_id",
+		})
+		return false
+	}
+	return true
+}
+
+func (store *organisationStore) Get(id uuid.UUID) (Payment, error) {
+	return store.owned(store.PaymentStore.Get(id))
+}
+
+func (store *organisationStore) GetIncludingDeleted(id uuid.UUID) (Payment, error) {
+	return store.owned(store.PaymentStore.GetIncludingDeleted(id))
+}
+
+// owned hides a fetched payment that belongs to another organisation
+func (store *organisationStore) owned(payment Payment, err error) (Payment, error) {
+	if err == nil && payment.OrganisationID != store.organisationID {
+		return Payment{}, ErrPaymentNotFound
+	}
+	return payment, err
+}
+
+func (store *organisationStore) List(query PaymentQuery) (PaymentPage, error) {
+	if query.Filter.OrganisationID != uuid.Nil && query.Filter.OrganisationID != store.organisationID {
+		return PaymentPage{Payments: []Payment{}}, nil
+	}
+	query.Filter.OrganisationID = store.organisationID
+	return store.PaymentStore.List(query)
+}
+
+func (store *organisationStore) Create(payment *Payment) error {
+	if payment.OrganisationID != store.organisationID {
+		return ErrOrganisationForbidden
+	}
+	return store.PaymentStore.Create(payment)
+}
+
+func (store *organisationStore) Update(payment *Payment) error {
+	if payment.OrganisationID != store.organisationID {
+		return ErrOrganisationForbidden
+	}
+	if _, err := store.Get(payment.ID); err != nil {
+		return err
+	}
+	return store.PaymentStore.Update(payment)
+}
+
+func (store *organisationStore) Delete(id uuid.UUID, version uint) error {
+	if _, err := store.Get(id); err != nil {
+		return err
+	}
+	return store.PaymentStore.Delete(id, version)
+}
+
+func (store *organisationStore) Restore(id uuid.UUID, version uint) error {
+	if _, err := store.GetIncludingDeleted(id); err != nil {
+		return err
+	}
+	return store.PaymentStore.Restore(id, version)
+}
+
+func (store *organisationStore) GetBatch(id uuid.UUID) (PaymentBatch, error) {
+	batch, err := store.PaymentStore.GetBatch(id)
+	if err == nil && batch.OrganisationID != store.organisationID {
+		return PaymentBatch{}, ErrBatchNotFound
+	}
+	return batch, err
+}
+
+func (store *organisationStore) CreateBatch(batch *PaymentBatch) error {
+	batch.OrganisationID = store.organisationID
+	return store.PaymentStore.CreateBatch(batch)
+}
+
+func (store *organisationStore) ListAudit(query AuditQuery) ([]AuditEntry, error) {
+	query.OrganisationID = store.organisationID
+	return store.PaymentStore.ListAudit(query)
+}
+
+func (store *organisationStore) ListEvents(query EventQuery) ([]PaymentEvent, error) {
+	if query.OrganisationID != uuid.Nil && query.OrganisationID != store.organisationID {
+		return []PaymentEvent{}, nil
+	}
+	query.OrganisationID = store.organisationID
+	return store.PaymentStore.ListEvents(query)
+}
+
+func (store *organisationStore) CreateSubscription(subscription *Subscription) error {
+	if subscription.OrganisationID != store.organisationID {
+		return ErrOrganisationForbidden
+	}
+	return store.PaymentStore.CreateSubscription(subscription)
+}
+
+func (store *organisationStore) GetSubscription(id uuid.UUID) (Subscription, error) {
+	subscription, err := store.PaymentStore.GetSubscription(id)
+	if err == nil && subscription.OrganisationID != store.organisationID {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return subscription, err
+}
+
+func (store *organisationStore) ListSubscriptions(organisationID uuid.UUID) ([]Subscription, error) {
+	if organisationID != uuid.Nil && organisationID != store.organisationID {
+		return []Subscription{}, nil
+	}
+	return store.PaymentStore.ListSubscriptions(store.organisationID)
+}
+
+func (store *organisationStore) DeleteSubscription(id uuid.UUID) error {
+	if _, err := store.GetSubscription(id); err != nil {
+		return err
+	}
+	return store.PaymentStore.DeleteSubscription(id)
+}
+
+func (store *organisationStore) ListDeliveries(subscriptionID uuid.UUID, limit int) ([]WebhookDelivery, error) {
+	if _, err := store.GetSubscription(subscriptionID); err != nil {
+		return nil, err
+	}
+	return store.PaymentStore.ListDeliveries(subscriptionID, limit)
+}
+
+func (store *organisationStore) CreateStatusException(exception *StatusReportException) error {
+	exception.OrganisationID = store.organisationID
+	return store.PaymentStore.CreateStatusException(exception)
+}
+
+func (store *organisationStore) GetStatusException(id uuid.UUID) (StatusReportException, error) {
+	exception, err := store.PaymentStore.GetStatusException(id)
+	if err == nil && exception.OrganisationID != store.organisationID {
+		return StatusReportException{}, ErrStatusExceptionNotFound
+	}
+	return exception, err
+}
+
+func (store *organisationStore) ListStatusExceptions(query StatusExceptionQuery) ([]StatusReportException, error) {
+	query.OrganisationID = store.organisationID
+	return store.PaymentStore.ListStatusExceptions(query)
+}
+
+func (store *organisationStore) ResolveStatusException(id uuid.UUID, at time.Time) error {
+	if _, err := store.GetStatusException(id); err != nil {
+		return err
+	}
+	return store.PaymentStore.ResolveStatusException(id, at)
+}
+
+func (store *organisationStore) CreateSchemeFile(file *SchemeFile) error {
+	if file.OrganisationID != store.organisationID {
+		return ErrOrganisationForbidden
+	}
+	return store.PaymentStore.CreateSchemeFile(file)
+}
+
+func (store *organisationStore) GetSchemeFile(id uuid.UUID) (SchemeFile, error) {
+	file, err := store.PaymentStore.GetSchemeFile(id)
+	if err == nil && file.OrganisationID != store.organisationID {
+		return SchemeFile{}, ErrSchemeFileNotFound
+	}
+	return file, err
+}
+
+func (store *organisationStore) GetFXQuote(contractReference string) (FXQuote, error) {
+	quote, err := store.PaymentStore.GetFXQuote(contractReference)
+	if err == nil && quote.OrganisationID != store.organisationID {
+		return FXQuote{}, ErrFXQuoteNotFound
+	}
+	return quote, err
+}
+
+func (store *organisationStore) CreateFXQuote(quote *FXQuote) error {
+	if quote.OrganisationID != store.organisationID {
+		return ErrOrganisationForbidden
+	}
+	return store.PaymentStore.CreateFXQuote(quote)
+}
+
+// idempotencyKey namespaces an Idempotency-Key by organisation
+func (store *organisationStore) idempotencyKey(key string) string {
+	return store.organisationID.String() + ":" + key
+}
+
+func (store *organisationStore) GetIdempotencyKey(key string) (IdempotencyRecord, error) {
+	record, err := store.PaymentStore.GetIdempotencyKey(store.idempotencyKey(key))
+	record.Key = strings.TrimPrefix(record.Key, store.organisationID.String()+":")
+	return record, err
+}
+
+func (store *organisationStore) CreateIdempotencyKey(record *IdempotencyRecord) error {
+	namespaced := *record
+	namespaced.Key = store.idempotencyKey(record.Key)
+	return store.PaymentStore.CreateIdempotencyKey(&namespaced)
+}
+
+func (store *organisationStore) DeleteIdempotencyKey(key string) error {
+	return store.PaymentStore.DeleteIdempotencyKey(store.idempotencyKey(key))
+}
+
+func (store *organisationStore) RunInTransaction(fn func(store PaymentStore) error) error {
+	return store.PaymentStore.RunInTransaction(func(tx PaymentStore) error {
+		return fn(&organisationStore{PaymentStore: tx, organisationID: store.organisationID})
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listedPaymentIDs(t *testing.T, key, path string) []uuid.UUID {
+	rw := sendWithKey(t, key, http.MethodGet, path, nil)
+	require.Equal(t, 200, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var payments []Payment
+	require.Nil(t, json.Unmarshal(response.Data, &payments))
+	var ids []uuid.UUID
+	for _, payment := range payments {
+		ids = append(ids, payment.ID)
+	}
+	return ids
+}
+
+func TestOrganisationsCantSeeEachOthersPayments(t *testing.T) {
+
+	emptyDatabase(t)
+
+	ours, theirs := createExamplePayment(), createExamplePayment()
+	_, ourKey := createAPIKey(t, ours.OrganisationID)
+	_, theirKey := createAPIKey(t, theirs.OrganisationID)
+
+	for key, payment := range map[string]Payment{ourKey: ours, theirKey: theirs} {
+		body, err := json.Marshal(payment)
+		require.Nil(t, err)
+		require.Equal(t, 201, sendWithKey(t, key, http.MethodPost, "/v1/payments", body).Code)
+	}
+
+	assert.Equal(t, []uuid.UUID{ours.ID}, listedPaymentIDs(t, ourKey, "/v1/payments"))
+	assert.Empty(t, listedPaymentIDs(t, ourKey, "/v1/payments?filter[organisation_id]="+theirs.OrganisationID.String()))
+
+	// another organisation's payment is as good as missing
+	self := fmt.Sprintf("/v1/payments/%s", theirs.ID)
+	body, err := json.Marshal(theirs)
+	require.Nil(t, err)
+	assert.Equal(t, 404, sendWithKey(t, ourKey, http.MethodGet, self, nil).Code)
+	assert.Equal(t, 404, sendWithKey(t, ourKey, http.MethodGet, self+"/history", nil).Code)
+	assert.Equal(t, 404, sendWithKey(t, ourKey, http.MethodPost, self+"/actions/submit", nil).Code)
+	assert.Equal(t, 404, sendWithKey(t, ourKey, http.MethodDelete, self, nil).Code)
+	assert.Equal(t, 403, sendWithKey(t, ourKey, http.MethodPut, self, body).Code)
+
+	// and so is its audit trail
+	rw := sendWithKey(t, ourKey, http.MethodGet, "/v1/audit", nil)
+	require.Equal(t, 200, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var entries []AuditEntry
+	require.Nil(t, json.Unmarshal(response.Data, &entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, ours.ID, entries[0].PaymentID)
+
+	_, err = store.Get(theirs.ID)
+	assert.Nil(t, err)
+}
+
+func TestPaymentsCanOnlyBeMadeForTheKeysOrganisation(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	_, key := createAPIKey(t, uuid.NewV4())
+
+	body, err := json.Marshal(payment)
+	require.Nil(t, err)
+	rw := sendWithKey(t, key, http.MethodPost, "/v1/payments", body)
+	require.Equal(t, 403, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/organisation_id": "forbidden_organisation"}, errorPointers(response.Errors))
+
+	// a payment can't be moved to another organisation either
+	_, ourKey := createAPIKey(t, payment.OrganisationID)
+	require.Equal(t, 201, sendWithKey(t, ourKey, http.MethodPost, "/v1/payments", body).Code)
+	payment.OrganisationID = uuid.NewV4()
+	body, err = json.Marshal(payment)
+	require.Nil(t, err)
+	assert.Equal(t, 403, sendWithKey(t, ourKey, http.MethodPut, fmt.Sprintf("/v1/payments/%s", payment.ID), body).Code)
+
+	// each payment of a batch is checked
+	body, err = json.Marshal(map[string]interface{}{"data": []Payment{createExamplePayment()}})
+	require.Nil(t, err)
+	rw = sendWithKey(t, ourKey, http.MethodPost, "/v1/payment-batches", body)
+	require.Equal(t, 422, rw.Code)
+	var batch PaymentBatch
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	require.Nil(t, json.Unmarshal(response.Data, &batch))
+	assert.Equal(t, 403, batch.Items[0].StatusCode)
+	assert.Equal(t, 404, sendWithKey(t, key, http.MethodGet, fmt.Sprintf("/v1/payment-batches/%s", batch.ID), nil).Code)
+	assert.Equal(t, 200, sendWithKey(t, ourKey, http.MethodGet, fmt.Sprintf("/v1/payment-batches/%s", batch.ID), nil).Code)
+}
+
+func TestIdempotencyKeysAreScopedToOrganisations(t *testing.T) {
+
+	emptyDatabase(t)
+
+	scoped := &organisationStore{PaymentStore: store, organisationID: uuid.NewV4()}
+	other := &organisationStore{PaymentStore: store, organisationID: uuid.NewV4()}
+
+	record := IdempotencyRecord{Key: "shared", RequestHash: "hash", StatusCode: 201}
+	require.Nil(t, scoped.CreateIdempotencyKey(&record))
+
+	stored, err := scoped.GetIdempotencyKey("shared")
+	require.Nil(t, err)
+	assert.Equal(t, "shared", stored.Key)
+	_, err = other.GetIdempotencyKey("shared")
+	assert.Equal(t, ErrIdempotencyKeyNotFound, err)
+	assert.Nil(t, other.CreateIdempotencyKey(&record))
+}
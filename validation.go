@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// codes of the errors found when validating a payment
+const (
+	codeRequired         = "required"
+	codeInvalidFormat    = "invalid_format"
+	codeInvalidValue     = "invalid_value"
+	codeInvalidCurrency  = "invalid_currency"
+	codeInvalidPrecision = "invalid_precision"
+	codeInvalidChecksum  = "invalid_checksum"
+)
+
+// the values allowed for the enumerated payment fields
+var (
+	paymentSchemes        = []string{"FPS", "BACS", "SEPA", "SWIFT"}
+	paymentTypes          = []string{"Credit", "Debit"}
+	bearerCodes           = []string{"DEBT", "CRED", "SHAR", "SLEV"}
+	accountNumberCodes    = []string{"IBAN", "BBAN"}
+	schemePaymentTypes    = []string{"ImmediatePayment", "ForwardDatedPayment", "StandingOrder"}
+	schemePaymentSubTypes = []string{"InternetBanking", "TelephoneBanking", "BranchInstruction", "Letter", "Email", "MobilePaymentsService"}
+)
+
+// paymentValidator collects the errors found in a payment, so that they can all be reported at once
+type paymentValidator struct {
+	errs []APIError
+}
+
+// validatePayment checks that a payment is complete and that its fields are well formed, returning an error for every
+// field that is not
+func validatePayment(payment Payment) []APIError {
+	v := &paymentValidator{}
+
+	if v.required("/type", payment.Type) && payment.Type != "Payment" {
+		v.add("/type", codeInvalidValue, "type must be Payment")
+	}
+	v.requiredID("/id", payment.ID)
+	v.requiredID("/organisation_id", payment.OrganisationID)
+
+	attributes := payment.Attributes
+	v.currency("/attributes/currency", attributes.Currency)
+	v.amount("/attributes/amount", attributes.Amount, attributes.Currency, false)
+
+	v.oneOf("/attributes/payment_scheme", attributes.PaymentScheme, paymentSchemes, true)
+	v.oneOf("/attributes/payment_type", attributes.PaymentType, paymentTypes, true)
+	v.oneOf("/attributes/scheme_payment_type", attributes.SchemePaymentType, schemePaymentTypes, false)
+	v.oneOf("/attributes/scheme_payment_sub_type", attributes.SchemePaymentSubType, schemePaymentSubTypes, false)
+
+	if v.required("/attributes/processing_date", attributes.ProcessingDate) {
+		if _, err := time.Parse("2006-01-02", attributes.ProcessingDate); err != nil {
+			v.add("/attributes/processing_date", codeInvalidFormat, "processing_date must be a YYYY-MM-DD date")
+		}
+	}
+
+	v.party("/attributes/debtor_party", &attributes.DebtorParty)
+	v.party("/attributes/beneficiary_party", attributes.BeneficiaryParty.DebtorParty)
+	v.sponsorParty("/attributes/sponsor_party", attributes.SponsorParty)
+
+	// payments over SWIFT are routed to the beneficiary's bank by its BIC
+	if beneficiary := attributes.BeneficiaryParty.DebtorParty; attributes.PaymentScheme == "SWIFT" && beneficiary != nil &&
+		beneficiary.SponsorParty != nil && beneficiary.BankIDCode != "" && beneficiary.BankIDCode != "SWBIC" {
+		v.add("/attributes/beneficiary_party/bank_id_code", codeInvalidValue, "bank_id_code must be SWBIC for SWIFT payments")
+	}
+
+	v.charges("/attributes/charges_information", attributes.ChargesInformation)
+	v.fx("/attributes/fx", attributes.FX)
+
+	return v.errs
+}
+
+func (v *paymentValidator) add(pointer, code, message string) {
+	v.errs = append(v.errs, APIError{Code: code, Message: message, Pointer: pointer})
+}
+
+// required reports a missing value, returning whether the value is present and so can be checked further
+func (v *paymentValidator) required(pointer, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add(pointer, codeRequired, fmt.Sprintf("%s is required", path.Base(pointer)))
+		return false
+	}
+	return true
+}
+
+func (v *paymentValidator) requiredID(pointer string, id uuid.UUID) {
+	if uuid.Equal(id, uuid.Nil) {
+		v.add(pointer, codeRequired, fmt.Sprintf("%s is required", path.Base(pointer)))
+	}
+}
+
+func (v *paymentValidator) oneOf(pointer, value string, allowed []string, required bool) {
+	if value == "" {
+		if required {
+			v.required(pointer, value)
+		}
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(pointer, codeInvalidValue, fmt.Sprintf("%s must be one of %s", path.Base(pointer), strings.Join(allowed, ", ")))
+}
+
+func (v *paymentValidator) currency(pointer, currency string) {
+	if !v.required(pointer, currency) {
+		return
+	}
+	if _, ok := currencyExponent(currency); !ok {
+		v.add(pointer, codeInvalidCurrency, fmt.Sprintf("%s must be an ISO 4217 currency code", path.Base(pointer)))
+	}
+}
+
+// amount checks an amount has no more decimal places than the currency allows. amounts are never negative, the
+// direction of a payment is given by its type. an unknown currency is reported against the currency field.
+func (v *paymentValidator) amount(pointer string, amount Decimal, currency string, allowZero bool) {
+	name := path.Base(pointer)
+	if amount.IsEmpty() {
+		v.add(pointer, codeRequired, fmt.Sprintf("%s is required", name))
+		return
+	}
+	if !amount.IsValid() {
+		v.add(pointer, codeInvalidFormat, fmt.Sprintf("%s must be a decimal, such as 100.00", name))
+		return
+	}
+	switch {
+	case amount.Sign() < 0:
+		v.add(pointer, codeInvalidValue, fmt.Sprintf("%s must not be negative", name))
+	case amount.Sign() == 0 && !allowZero:
+		v.add(pointer, codeInvalidValue, fmt.Sprintf("%s must be greater than zero", name))
+	}
+	if _, err := NewMoney(amount, currency); err == ErrExcessPrecision {
+		exponent, _ := currencyExponent(currency)
+		v.add(pointer, codeInvalidPrecision, fmt.Sprintf("%s must have at most %d decimal places in %s", name, exponent, currency))
+	}
+}
+
+// party checks the debtor or beneficiary of a payment, which must be identified well enough to route the payment
+func (v *paymentValidator) party(pointer string, party *DebtorParty) {
+	if party == nil {
+		party = &DebtorParty{}
+	}
+	v.required(pointer+"/name", party.Name)
+	v.oneOf(pointer+"/account_number_code", party.AccountNumberCode, accountNumberCodes, true)
+
+	account := SponsorParty{}
+	if party.SponsorParty != nil {
+		account = *party.SponsorParty
+	}
+	v.required(pointer+"/account_number", account.AccountNumber)
+	v.required(pointer+"/bank_id", account.BankID)
+	v.required(pointer+"/bank_id_code", account.BankIDCode)
+	v.account(pointer, party.AccountNumberCode, account)
+}
+
+// sponsorParty checks the sponsor of a payment, which is optional but must be complete when given
+func (v *paymentValidator) sponsorParty(pointer string, sponsor SponsorParty) {
+	if sponsor == (SponsorParty{}) {
+		return
+	}
+	v.required(pointer+"/account_number", sponsor.AccountNumber)
+	v.required(pointer+"/bank_id", sponsor.BankID)
+	v.required(pointer+"/bank_id_code", sponsor.BankIDCode)
+	v.account(pointer, "", sponsor)
+}
+
+// account checks the format of an account and the bank that holds it. sponsors have no account number code, their
+// account number is in the format of their bank.
+func (v *paymentValidator) account(pointer, accountNumberCode string, account SponsorParty) {
+	switch {
+	case account.BankID == "":
+	case account.BankIDCode == "GBDSC" && !isSortCode(account.BankID):
+		v.add(pointer+"/bank_id", codeInvalidFormat, "bank_id must be a 6 digit sort code")
+	case account.BankIDCode == "SWBIC" && !isBIC(account.BankID):
+		v.add(pointer+"/bank_id", codeInvalidFormat, "bank_id must be an 8 or 11 character BIC")
+	}
+
+	if account.AccountNumber == "" {
+		return
+	}
+	if accountNumberCode == "IBAN" {
+		switch err := checkIBAN(account.AccountNumber); err {
+		case nil:
+		case ErrIBANChecksum:
+			v.add(pointer+"/account_number", codeInvalidChecksum, "account_number is not a valid IBAN, its check digits are incorrect")
+		case ErrIBANLength:
+			length := ibanLengths[account.AccountNumber[:2]]
+			v.add(pointer+"/account_number", codeInvalidFormat, fmt.Sprintf("account_number must be %d characters for an IBAN in %s", length, account.AccountNumber[:2]))
+		default:
+			v.add(pointer+"/account_number", codeInvalidFormat, "account_number must be an IBAN, without spaces")
+		}
+		return
+	}
+	if account.BankIDCode == "GBDSC" && !isUKAccountNumber(account.AccountNumber) {
+		v.add(pointer+"/account_number", codeInvalidFormat, "account_number must be an 8 digit account number")
+	}
+}
+
+func (v *paymentValidator) charges(pointer string, charges ChargesInformation) {
+	v.oneOf(pointer+"/bearer_code", charges.BearerCode, bearerCodes, true)
+
+	for i, charge := range charges.SenderCharges {
+		chargePointer := fmt.Sprintf("%s/sender_charges/%d", pointer, i)
+		v.currency(chargePointer+"/currency", charge.Currency)
+		v.amount(chargePointer+"/amount", charge.Amount, charge.Currency, true)
+	}
+
+	// receiver charges are optional, but an amount needs a currency
+	if !charges.ReceiverChargesAmount.IsEmpty() || charges.ReceiverChargesCurrency != "" {
+		v.currency(pointer+"/receiver_charges_currency", charges.ReceiverChargesCurrency)
+		v.amount(pointer+"/receiver_charges_amount", charges.ReceiverChargesAmount, charges.ReceiverChargesCurrency, true)
+	}
+}
+
+// fx checks the foreign exchange details, which are only given when the payment was converted from another currency
+func (v *paymentValidator) fx(pointer string, fx FX) {
+	if fx.ExchangeRate.IsEmpty() && fx.OriginalAmount.IsEmpty() && fx.OriginalCurrency == "" {
+		return
+	}
+	switch {
+	case fx.ExchangeRate.IsEmpty():
+		v.add(pointer+"/exchange_rate", codeRequired, "exchange_rate is required")
+	case !fx.ExchangeRate.IsValid():
+		v.add(pointer+"/exchange_rate", codeInvalidFormat, "exchange_rate must be a decimal, such as 1.25000")
+	case fx.ExchangeRate.Sign() <= 0:
+		v.add(pointer+"/exchange_rate", codeInvalidValue, "exchange_rate must be greater than zero")
+	}
+	v.currency(pointer+"/original_currency", fx.OriginalCurrency)
+	v.amount(pointer+"/original_amount", fx.OriginalAmount, fx.OriginalCurrency, false)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errorPointers returns the pointer and code of each error, to compare without the messages
+func errorPointers(errs []APIError) map[string]string {
+	pointers := map[string]string{}
+	for _, err := range errs {
+		pointers[err.Pointer] = err.Code
+	}
+	return pointers
+}
+
+func TestValidatePaymentAcceptsExamplePayments(t *testing.T) {
+
+	assert.Empty(t, validatePayment(createExamplePayment()))
+
+	for _, payment := range readSamplePayments(t) {
+		assert.Empty(t, validatePayment(payment), payment.ID.String())
+	}
+}
+
+func TestValidatePaymentReportsEveryMissingField(t *testing.T) {
+
+	pointers := errorPointers(validatePayment(Payment{}))
+
+	for _, pointer := range []string{
+		"/type",
+		"/id",
+		"/organisation_id",
+		"/attributes/amount",
+		"/attributes/currency",
+		"/attributes/payment_scheme",
+		"/attributes/payment_type",
+		"/attributes/processing_date",
+		"/attributes/debtor_party/name",
+		"/attributes/debtor_party/account_number",
+		"/attributes/beneficiary_party/name",
+		"/attributes/beneficiary_party/bank_id",
+		"/attributes/charges_information/bearer_code",
+	} {
+		assert.Equal(t, codeRequired, pointers[pointer], pointer)
+	}
+
+	// optional fields are only checked when they are given
+	assert.NotContains(t, pointers, "/attributes/fx/exchange_rate")
+	assert.NotContains(t, pointers, "/attributes/sponsor_party/bank_id")
+	assert.NotContains(t, pointers, "/attributes/scheme_payment_type")
+}
+
+func TestValidatePaymentChecksFormats(t *testing.T) {
+
+	payment := createExamplePayment()
+	payment.Type = "Refund"
+	payment.Attributes.Amount = MustParseDecimal("-5")
+	payment.Attributes.PaymentScheme = "CHAPS"
+	payment.Attributes.ProcessingDate = "18/01/2017"
+	payment.Attributes.DebtorParty.AccountNumberCode = "SORT"
+	payment.Attributes.ChargesInformation.SenderCharges[1].Currency = "XYZ"
+	payment.Attributes.FX = FX{ExchangeRate: MustParseDecimal("0"), OriginalAmount: MustParseDecimal("200.42")}
+
+	assert.Equal(t, map[string]string{
+		"/type":                       codeInvalidValue,
+		"/attributes/amount":          codeInvalidValue,
+		"/attributes/payment_scheme":  codeInvalidValue,
+		"/attributes/processing_date": codeInvalidFormat,
+		"/attributes/debtor_party/account_number_code":              codeInvalidValue,
+		"/attributes/charges_information/sender_charges/1/currency": codeInvalidCurrency,
+		"/attributes/fx/exchange_rate":                              codeInvalidValue,
+		"/attributes/fx/original_currency":                          codeRequired,
+	}, errorPointers(validatePayment(payment)))
+}
+
+func TestValidatePaymentChecksPrecisionForCurrency(t *testing.T) {
+
+	payment := createExamplePayment()
+	payment.Attributes.Amount = MustParseDecimal("100.005")
+	assert.Equal(t, map[string]string{"/attributes/amount": codeInvalidPrecision}, errorPointers(validatePayment(payment)))
+
+	// the yen has no minor unit
+	payment.Attributes.Currency = "JPY"
+	payment.Attributes.Amount = MustParseDecimal("100.5")
+	assert.Equal(t, map[string]string{"/attributes/amount": codeInvalidPrecision}, errorPointers(validatePayment(payment)))
+	payment.Attributes.Amount = MustParseDecimal("100")
+	assert.Empty(t, validatePayment(payment))
+
+	payment.Attributes.Currency = "GBP"
+	payment.Attributes.Amount = MustParseDecimal("0.00")
+	assert.Equal(t, map[string]string{"/attributes/amount": codeInvalidValue}, errorPointers(validatePayment(payment)))
+}
+
+func TestCreateInvalidPaymentReturnsFieldErrors(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	examplePayment.Attributes.Currency = "ZZZ"
+	examplePayment.Attributes.BeneficiaryParty.DebtorParty = nil
+
+	jsonBytes, err := json.Marshal(examplePayment)
+	require.Nil(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", bytes.NewBuffer(jsonBytes))
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 422, rw.Code)
+
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	pointers := errorPointers(response.Errors)
+	assert.Equal(t, codeInvalidCurrency, pointers["/attributes/currency"])
+	assert.Equal(t, codeRequired, pointers["/attributes/beneficiary_party/account_number"])
+	assert.NotEmpty(t, response.Errors[0].Message)
+
+	_, err = store.Get(examplePayment.ID)
+	assert.Equal(t, ErrPaymentNotFound, err)
+}
+
+func TestUpdateInvalidPaymentReturnsFieldErrors(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	require.Nil(t, store.Create(&examplePayment))
+
+	examplePayment.Attributes.Amount = Decimal{}
+	rw := putPayment(t, examplePayment, nil)
+	require.Equal(t, 422, rw.Code)
+
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, []APIError{{Code: codeRequired, Message: "amount is required", Pointer: "/attributes/amount"}}, response.Errors)
+}
+
+func TestCreatePaymentWithMalformedAmount(t *testing.T) {
+
+	emptyDatabase(t)
+
+	examplePayment := createExamplePayment()
+	jsonBytes, err := json.Marshal(examplePayment)
+	require.Nil(t, err)
+	jsonBytes = bytes.Replace(jsonBytes, []byte(`"amount":"100.00"`), []byte(`"amount":"one hundred"`), 1)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", bytes.NewBuffer(jsonBytes))
+	rw := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rw, req)
+	require.Equal(t, 422, rw.Code)
+
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, []APIError{{Code: codeInvalidFormat, Message: "amount must be a decimal, such as 100.00", Pointer: "/attributes/amount"}}, response.Errors)
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// the state of a delivery. a delivery is retried until it succeeds or runs out of attempts, when it is dead.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// headers sent with every delivery
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+const (
+	defaultWebhookInterval    = time.Second
+	defaultWebhookMaxAttempts = 8
+	defaultWebhookBackoff     = 10 * time.Second
+	defaultWebhookMaxBackoff  = time.Hour
+
+	// how long a claimed delivery is hidden from other dispatchers, in case this one stops before finishing it
+	webhookLease = time.Minute
+
+	// how long a batch of claimed deliveries has to be sent. it is well inside the lease, so the outcomes are saved
+	// before another dispatcher can claim the deliveries again.
+	webhookSendDeadline = webhookLease / 2
+
+	// the most deliveries attempted in one go, and listed in a delivery log
+	webhookBatchSize = 100
+)
+
+var (
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	ErrDeliveryLeaseLost    = errors.New("delivery lease has expired")
+)
+
+// Subscription registers a URL to be sent an organisation's payment events. the secret signs the deliveries, and is
+// only shown when the subscription is created.
+type Subscription struct {
+	tableName struct{} `sql:"subscriptions"`
+
+	ID             uuid.UUID `json:"id" sql:",pk,type:uuid"`
+	OrganisationID uuid.UUID `json:"organisation_id" sql:",type:uuid,notnull"`
+	CallbackURL    string    `json:"callback_url" sql:",notnull"`
+	EventTypes     []string  `json:"event_types" sql:",notnull"`
+	Secret         string    `json:"secret,omitempty" sql:",notnull"`
+	CreatedAt      time.Time `json:"created_at" sql:",notnull"`
+}
+
+// subscribes reports whether the subscription wants events of the type
+func (subscription Subscription) subscribes(eventType string) bool {
+	for _, subscribed := range subscription.EventTypes {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an event waiting to be sent, or that has been sent, to a subscription, along with each attempt
+// to send it. pending deliveries are the outbox.
+type WebhookDelivery struct {
+	tableName struct{} `sql:"webhook_deliveries"`
+
+	ID             uuid.UUID         `json:"id" sql:",pk,type:uuid"`
+	SubscriptionID uuid.UUID         `json:"subscription_id" sql:",type:uuid,notnull"`
+	EventID        uuid.UUID         `json:"event_id" sql:",type:uuid,notnull"`
+	EventType      string            `json:"event_type" sql:",notnull"`
+	Event          PaymentEvent      `json:"event" sql:",notnull"`
+	Status         string            `json:"status" sql:",notnull"`
+	Attempts       []DeliveryAttempt `json:"attempts" sql:",notnull"`
+	NextAttemptAt  time.Time         `json:"next_attempt_at" sql:",notnull"`
+	CreatedAt      time.Time         `json:"created_at" sql:",notnull"`
+	DeliveredAt    *time.Time        `json:"delivered_at,omitempty"`
+}
+
+// DeliveryAttempt is one try at sending a delivery: the response status, or why there was no response
+type DeliveryAttempt struct {
+	Timestamp  time.Time `json:"timestamp"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// WebhookStore persists subscriptions and their deliveries
+type WebhookStore interface {
+	// CreateSubscription inserts a new subscription
+	CreateSubscription(subscription *Subscription) error
+
+	// GetSubscription returns the subscription with the given ID, or ErrSubscriptionNotFound
+	GetSubscription(id uuid.UUID) (Subscription, error)
+
+	// ListSubscriptions returns the subscriptions of an organisation, or of every organisation for uuid.Nil, oldest
+	// first
+	ListSubscriptions(organisationID uuid.UUID) ([]Subscription, error)
+
+	// DeleteSubscription removes a subscription along with its deliveries, or returns ErrSubscriptionNotFound
+	DeleteSubscription(id uuid.UUID) error
+
+	// CreateDelivery adds a delivery to the outbox
+	CreateDelivery(delivery *WebhookDelivery) error
+
+	// ClaimDeliveries returns up to limit pending deliveries that are due at now, choosing the earliest due, and
+	// postpones them by the lease so that they aren't claimed again while they are being sent
+	ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error)
+
+	// UpdateDelivery saves the outcome of an attempt to send a delivery, if it is still claimed with the lease it
+	// was claimed with. returns ErrDeliveryLeaseLost if it isn't, because another dispatcher may have claimed it since.
+	UpdateDelivery(delivery *WebhookDelivery, lease time.Time) error
+
+	// ListDeliveries returns up to limit of a subscription's deliveries, newest first
+	ListDeliveries(subscriptionID uuid.UUID, limit int) ([]WebhookDelivery, error)
+}
+
+// enqueueWebhooks adds a delivery of an event to the outbox for each subscription to it. it is called in the
+// transaction making the change, so deliveries are queued if and only if the change is kept.
+func enqueueWebhooks(store PaymentStore, event PaymentEvent) error {
+	subscriptions, err := store.ListSubscriptions(event.OrganisationID)
+	if err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if !subscription.subscribes(event.Type) {
+			continue
+		}
+		delivery := WebhookDelivery{
+			ID:             uuid.NewV4(),
+			SubscriptionID: subscription.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			Event:          event,
+			Status:         DeliveryPending,
+			Attempts:       []DeliveryAttempt{},
+			NextAttemptAt:  event.CreatedAt,
+			CreatedAt:      event.CreatedAt,
+		}
+		if err := store.CreateDelivery(&delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signWebhook returns the signature header for a delivery body sent at the given time: the time and the hex
+// HMAC-SHA256 of "<time>.<body>" keyed by the subscription secret
+func signWebhook(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
+// webhookDispatcher sends the deliveries in the outbox, retrying failed ones with exponential backoff
+type webhookDispatcher struct {
+	store  PaymentStore
+	client *http.Client
+
+	// how many times a delivery is tried before it is dead, and how long to wait before the first retry. the wait
+	// doubles with each retry, up to maxBackoff.
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	// the time deliveries are claimed at, and each attempt is signed and recorded at
+	now func() time.Time
+}
+
+func newWebhookDispatcher(store PaymentStore) *webhookDispatcher {
+	return &webhookDispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: defaultWebhookMaxAttempts,
+		backoff:     defaultWebhookBackoff,
+		maxBackoff:  defaultWebhookMaxBackoff,
+		now: func() time.Time {
+			return time.Now().UTC()
+		},
+	}
+}
+
+// retryDelay returns how long to wait after the given number of failed attempts
+func (dispatcher *webhookDispatcher) retryDelay(attempts int) time.Duration {
+	delay := dispatcher.backoff
+	for i := 1; i < attempts && delay < dispatcher.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > dispatcher.maxBackoff {
+		delay = dispatcher.maxBackoff
+	}
+	return delay
+}
+
+// dispatch tries every delivery that is due, and returns how many it tried. the deliveries are sent at once, and
+// given until the send deadline, so that they are all finished while they are still claimed.
+func (dispatcher *webhookDispatcher) dispatch() (int, error) {
+	claimedAt := dispatcher.now()
+	deliveries, err := dispatcher.store.ClaimDeliveries(claimedAt, webhookLease, webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(webhookSendDeadline))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(deliveries))
+	for i := range deliveries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = dispatcher.deliver(ctx, &deliveries[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return len(deliveries), err
+		}
+	}
+	return len(deliveries), nil
+}
+
+// deliver makes an attempt at a claimed delivery and saves the outcome, unless another dispatcher has claimed it
+// since
+func (dispatcher *webhookDispatcher) deliver(ctx context.Context, delivery *WebhookDelivery) error {
+	subscription, err := dispatcher.store.GetSubscription(delivery.SubscriptionID)
+	if err == ErrSubscriptionNotFound {
+		// deleted since the delivery was claimed, which deleted the delivery too
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lease := delivery.NextAttemptAt
+	dispatcher.attempt(ctx, delivery, subscription)
+	err = dispatcher.store.UpdateDelivery(delivery, lease)
+	if err == ErrDeliveryLeaseLost {
+		log.Printf("webhook delivery %s was claimed again before its attempt was saved", delivery.ID)
+		return nil
+	}
+	return err
+}
+
+// attempt sends a delivery to its subscription, recording the outcome on the delivery
+func (dispatcher *webhookDispatcher) attempt(ctx context.Context, delivery *WebhookDelivery, subscription Subscription) {
+	now := dispatcher.now()
+	attempt := DeliveryAttempt{Timestamp: now}
+	if err := dispatcher.send(ctx, delivery, subscription, now, &attempt); err != nil {
+		attempt.Error = err.Error()
+	}
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	switch {
+	case attempt.Error == "":
+		delivery.Status = DeliveryDelivered
+		delivery.DeliveredAt = &now
+	case len(delivery.Attempts) >= dispatcher.maxAttempts:
+		delivery.Status = DeliveryDead
+	default:
+		delivery.NextAttemptAt = now.Add(dispatcher.retryDelay(len(delivery.Attempts)))
+	}
+}
+
+// send POSTs the signed event to the subscription's URL. anything but a 2xx response is an error.
+func (dispatcher *webhookDispatcher) send(ctx context.Context, delivery *WebhookDelivery, subscription Subscription, now time.Time, attempt *DeliveryAttempt) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, subscription.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.EventType)
+	req.Header.Set(webhookDeliveryHeader, delivery.ID.String())
+	req.Header.Set(webhookSignatureHeader, signWebhook(subscription.Secret, now, body))
+
+	resp, err := dispatcher.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded %s", resp.Status)
+	}
+	return nil
+}
+
+// run dispatches due deliveries every interval, until done is closed. a nil done channel runs forever.
+func (dispatcher *webhookDispatcher) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := dispatcher.dispatch(); err != nil {
+				log.Printf("failed to dispatch webhooks: %s", err)
+			}
+		}
+	}
+}
+
+// newWebhookSecret generates the secret deliveries to a subscription are signed with
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// validateSubscription checks a subscription being created, returning every problem with it
+func validateSubscription(subscription Subscription) []APIError {
+	var errs []APIError
+	if subscription.OrganisationID == uuid.Nil {
+		errs = append(errs, APIError{Code: codeRequired, Message: "organisation_id is required", Pointer: "/organisation_id"})
+	}
+	if callback, err := url.Parse(subscription.CallbackURL); err != nil || (callback.Scheme != "http" && callback.Scheme != "https") || callback.Host == "" {
+		errs = append(errs, APIError{Code: codeInvalidFormat, Message: "callback_url must be an absolute http or https URL", Pointer: "/callback_url"})
+	}
+	if len(subscription.EventTypes) == 0 {
+		errs = append(errs, APIError{Code: codeRequired, Message: "event_types is required", Pointer: "/event_types"})
+	}
+	known := map[string]bool{}
+	for _, eventType := range paymentEventTypes() {
+		known[eventType] = true
+	}
+	for i, eventType := range subscription.EventTypes {
+		if !known[eventType] {
+			errs = append(errs, APIError{Code: codeInvalidValue, Message: fmt.Sprintf("unknown event type %s", eventType), Pointer: fmt.Sprintf("/event_types/%d", i)})
+		}
+	}
+	return errs
+}
+
+// business logic for POST /v1/subscriptions endpoint. the response is the only time the secret is shown.
+func (api *api) createSubscription(w http.ResponseWriter, r *http.Request) {
+
+	var subscription Subscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	// subscriptions are for the organisation of the API key unless another is given, which is refused
+	if organisationID, ok := requestOrganisation(r); ok && subscription.OrganisationID == uuid.Nil {
+		subscription.OrganisationID = organisationID
+	}
+	if !checkOrganisation(w, r, Payment{OrganisationID: subscription.OrganisationID}) {
+		return
+	}
+	if errs := validateSubscription(subscription); len(errs) > 0 {
+		writeErrors(w, http.StatusUnprocessableEntity, errs...)
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	subscription.ID = uuid.NewV4()
+	subscription.Secret = secret
+	subscription.CreatedAt = time.Now().UTC()
+	sort.Strings(subscription.EventTypes)
+
+	if err := api.storeFor(r).CreateSubscription(&subscription); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	self := fmt.Sprintf("/v1/subscriptions/%s", subscription.ID)
+	w.Header().Set("Location", self)
+	writeData(w, http.StatusCreated, subscription, subscriptionLinks(subscription)...)
+}
+
+// subscriptionLinks returns the HATEOAS links for a subscription: itself and its delivery log
+func subscriptionLinks(subscription Subscription) []Link {
+	self := fmt.Sprintf("/v1/subscriptions/%s", subscription.ID)
+	return []Link{
+		{Rel: "self", Href: self},
+		{Rel: "deliveries", Href: self + "/deliveries"},
+	}
+}
+
+// business logic for GET /v1/subscriptions endpoint
+func (api *api) getSubscriptions(w http.ResponseWriter, r *http.Request) {
+
+	var organisationID uuid.UUID
+	if filter := r.URL.Query().Get("filter[organisation_id]"); filter != "" {
+		var err error
+		if organisationID, err = uuid.FromString(filter); err != nil {
+			writeErrors(w, http.StatusBadRequest, APIError{Code: "invalid_parameter", Message: "Invalid organisation_id filter", Parameter: "filter[organisation_id]"})
+			return
+		}
+	}
+
+	subscriptions, err := api.storeFor(r).ListSubscriptions(organisationID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	writeData(w, http.StatusOK, subscriptions, Link{Rel: "self", Href: "/v1/subscriptions"})
+}
+
+// subscriptionFromRequest fetches the subscription in the URL. if it can't be, an error response is written and ok
+// is false.
+func (api *api) subscriptionFromRequest(w http.ResponseWriter, r *http.Request) (subscription Subscription, ok bool) {
+	id, ok := paymentIDFromRequest(w, r)
+	if !ok {
+		return Subscription{}, false
+	}
+	subscription, err := api.storeFor(r).GetSubscription(id)
+	if err != nil {
+		if err == ErrSubscriptionNotFound {
+			writeError(w, http.StatusNotFound, "not_found", "Subscription not found")
+			return Subscription{}, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return Subscription{}, false
+	}
+	subscription.Secret = ""
+	return subscription, true
+}
+
+// business logic for GET /v1/subscriptions/{id} endpoint
+func (api *api) getSubscription(w http.ResponseWriter, r *http.Request) {
+
+	subscription, ok := api.subscriptionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	writeData(w, http.StatusOK, subscription, subscriptionLinks(subscription)...)
+}
+
+// business logic for DELETE /v1/subscriptions/{id} endpoint. deliveries that haven't been sent yet never will be.
+func (api *api) deleteSubscription(w http.ResponseWriter, r *http.Request) {
+
+	subscription, ok := api.subscriptionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := api.storeFor(r).DeleteSubscription(subscription.ID); err != nil && err != ErrSubscriptionNotFound {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	//default to 200 response code
+}
+
+// business logic for GET /v1/subscriptions/{id}/deliveries endpoint, the delivery log of a subscription
+func (api *api) getDeliveries(w http.ResponseWriter, r *http.Request) {
+
+	subscription, ok := api.subscriptionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	limit := webhookBatchSize
+	if size := r.URL.Query().Get("page[size]"); size != "" {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed < 1 || parsed > webhookBatchSize {
+			writeErrors(w, http.StatusBadRequest, APIError{Code: "invalid_parameter", Message: fmt.Sprintf("Invalid page size, must be between 1 and %d", webhookBatchSize), Parameter: "page[size]"})
+			return
+		}
+		limit = parsed
+	}
+
+	deliveries, err := api.storeFor(r).ListDeliveries(subscription.ID, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, deliveries, Link{Rel: "self", Href: fmt.Sprintf("/v1/subscriptions/%s/deliveries", subscription.ID)})
+}
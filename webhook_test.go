@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver records the webhooks sent to it, responding with status
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	receiver.requests = append(receiver.requests, r)
+	receiver.bodies = append(receiver.bodies, body)
+	w.WriteHeader(receiver.status)
+}
+
+func createSubscription(t *testing.T, organisationID uuid.UUID, callbackURL string, eventTypes ...string) Subscription {
+	rw := sendAs(t, "", http.MethodPost, "/v1/subscriptions", Subscription{OrganisationID: organisationID, CallbackURL: callbackURL, EventTypes: eventTypes})
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var subscription Subscription
+	require.Nil(t, json.Unmarshal(response.Data, &subscription))
+	return subscription
+}
+
+func getDeliveries(t *testing.T, subscription Subscription) []WebhookDelivery {
+	rw := sendAs(t, "", http.MethodGet, fmt.Sprintf("/v1/subscriptions/%s/deliveries", subscription.ID), nil)
+	require.Equal(t, 200, rw.Code, rw.Body.String())
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var deliveries []WebhookDelivery
+	require.Nil(t, json.Unmarshal(response.Data, &deliveries))
+	return deliveries
+}
+
+func TestSignWebhook(t *testing.T) {
+
+	body := []byte(`{"id":"1"}`)
+	timestamp := time.Unix(1500000000, 0)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(`1500000000.{"id":"1"}`))
+	assert.Equal(t, "t=1500000000,v1="+hex.EncodeToString(mac.Sum(nil)), signWebhook("secret", timestamp, body))
+	assert.NotEqual(t, signWebhook("secret", timestamp, body), signWebhook("other", timestamp, body))
+}
+
+func TestRetryDelayBacksOffExponentially(t *testing.T) {
+
+	dispatcher := newWebhookDispatcher(store)
+	assert.Equal(t, 10*time.Second, dispatcher.retryDelay(1))
+	assert.Equal(t, 20*time.Second, dispatcher.retryDelay(2))
+	assert.Equal(t, 80*time.Second, dispatcher.retryDelay(4))
+	assert.Equal(t, time.Hour, dispatcher.retryDelay(20))
+}
+
+func TestWebhooksAreSignedAndDelivered(t *testing.T) {
+
+	emptyDatabase(t)
+
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	callback := httptest.NewServer(receiver)
+	defer callback.Close()
+
+	payment := createExamplePayment()
+	subscription := createSubscription(t, payment.OrganisationID, callback.URL, EventPaymentCreated, "payment.submitted")
+	require.NotEmpty(t, subscription.Secret)
+
+	// only the events subscribed to are queued, and only for writes that succeed
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	require.Equal(t, 400, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+	payment.Attributes.Reference = "changed"
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPut, fmt.Sprintf("/v1/payments/%s", payment.ID), payment).Code)
+	require.Equal(t, 200, postAction(t, payment, ActionSubmit).Code)
+	other := createExamplePayment()
+	other.OrganisationID = payment.OrganisationID
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", other).Code)
+
+	// nor are other organisations' events
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", createExamplePayment()).Code)
+
+	dispatcher := newWebhookDispatcher(store)
+	now := time.Now().UTC()
+	dispatcher.now = func() time.Time { return now }
+	sent, err := dispatcher.dispatch()
+	require.Nil(t, err)
+	assert.Equal(t, 3, sent)
+
+	require.Len(t, receiver.requests, 3)
+	var types []string
+	for i, req := range receiver.requests {
+		assert.Equal(t, signWebhook(subscription.Secret, now, receiver.bodies[i]), req.Header.Get(webhookSignatureHeader))
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		var event PaymentEvent
+		require.Nil(t, json.Unmarshal(receiver.bodies[i], &event))
+		assert.Equal(t, event.Type, req.Header.Get(webhookEventHeader))
+		types = append(types, event.Type)
+		if event.Type == "payment.submitted" {
+			assert.Equal(t, payment.ID, event.Data.ID)
+			assert.Equal(t, StatusSubmitted, event.Data.Attributes.Status)
+		}
+	}
+	assert.ElementsMatch(t, []string{EventPaymentCreated, EventPaymentCreated, "payment.submitted"}, types)
+
+	// delivered webhooks aren't sent again
+	dispatcher.now = func() time.Time { return now.Add(time.Hour) }
+	sent, err = dispatcher.dispatch()
+	require.Nil(t, err)
+	assert.Equal(t, 0, sent)
+
+	deliveries := getDeliveries(t, subscription)
+	require.Len(t, deliveries, 3)
+	for _, delivery := range deliveries {
+		assert.Equal(t, DeliveryDelivered, delivery.Status)
+		require.Len(t, delivery.Attempts, 1)
+		assert.Equal(t, http.StatusNoContent, delivery.Attempts[0].StatusCode)
+		assert.NotNil(t, delivery.DeliveredAt)
+	}
+}
+
+func TestFailedWebhooksAreRetriedThenDead(t *testing.T) {
+
+	emptyDatabase(t)
+
+	receiver := &webhookReceiver{status: http.StatusInternalServerError}
+	callback := httptest.NewServer(receiver)
+	defer callback.Close()
+
+	payment := createExamplePayment()
+	subscription := createSubscription(t, payment.OrganisationID, callback.URL, EventPaymentCreated)
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	dispatcher := newWebhookDispatcher(store)
+	dispatcher.maxAttempts = 3
+	now := time.Now().UTC()
+
+	dispatch := func(at time.Time, expected int) {
+		dispatcher.now = func() time.Time { return at }
+		sent, err := dispatcher.dispatch()
+		require.Nil(t, err)
+		assert.Equal(t, expected, sent)
+	}
+	dispatch(now, 1)
+	deliveries := getDeliveries(t, subscription)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, DeliveryPending, deliveries[0].Status)
+	assert.True(t, deliveries[0].NextAttemptAt.Equal(now.Add(10*time.Second)))
+
+	dispatch(now.Add(5*time.Second), 0)
+	dispatch(now.Add(10*time.Second), 1)
+	dispatch(now.Add(20*time.Second), 0)
+	dispatch(now.Add(30*time.Second), 1)
+	dispatch(now.Add(24*time.Hour), 0)
+
+	deliveries = getDeliveries(t, subscription)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, DeliveryDead, deliveries[0].Status)
+	require.Len(t, deliveries[0].Attempts, 3)
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].Attempts[2].StatusCode)
+	assert.Contains(t, deliveries[0].Attempts[2].Error, "500")
+	assert.Len(t, receiver.requests, 3)
+
+	// unreachable callbacks are retried too
+	callback.Close()
+	other := createExamplePayment()
+	other.OrganisationID = payment.OrganisationID
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", other).Code)
+	dispatch(now.Add(25*time.Hour), 1)
+	deliveries = getDeliveries(t, subscription)
+	assert.Equal(t, DeliveryPending, deliveries[0].Status)
+	assert.NotEmpty(t, deliveries[0].Attempts[0].Error)
+}
+
+func TestManageSubscriptions(t *testing.T) {
+
+	emptyDatabase(t)
+
+	organisationID := uuid.NewV4()
+	_, admin := createAPIKey(t, organisationID)
+	_, operator := createAPIKey(t, organisationID, RoleOperator)
+	_, otherAdmin := createAPIKey(t, uuid.NewV4())
+
+	rw := sendWithKey(t, admin, http.MethodPost, "/v1/subscriptions", []byte(`{"callback_url": "ftp://example.com", "event_types": ["payment.created", "payment.exploded"]}`))
+	require.Equal(t, 422, rw.Code)
+	var response APIResponse
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"/callback_url": codeInvalidFormat, "/event_types/1": codeInvalidValue}, errorPointers(response.Errors))
+
+	// subscriptions are for the organisation of the key
+	rw = sendWithKey(t, admin, http.MethodPost, "/v1/subscriptions", []byte(`{"callback_url": "https://example.com/hooks", "event_types": ["payment.settled"]}`))
+	require.Equal(t, 201, rw.Code, rw.Body.String())
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	var subscription Subscription
+	require.Nil(t, json.Unmarshal(response.Data, &subscription))
+	assert.Equal(t, organisationID, subscription.OrganisationID)
+	assert.NotEmpty(t, subscription.Secret)
+	self := rw.Header().Get("Location")
+
+	rw = sendWithKey(t, admin, http.MethodPost, "/v1/subscriptions", []byte(fmt.Sprintf(`{"organisation_id": "%s", "callback_url": "https://example.com", "event_types": ["payment.created"]}`, uuid.NewV4())))
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, 403, sendWithKey(t, operator, http.MethodGet, "/v1/subscriptions", nil).Code)
+
+	// the secret is only shown once
+	rw = sendWithKey(t, admin, http.MethodGet, self, nil)
+	require.Equal(t, 200, rw.Code)
+	assert.False(t, strings.Contains(rw.Body.String(), subscription.Secret))
+
+	assert.Equal(t, 404, sendWithKey(t, otherAdmin, http.MethodGet, self, nil).Code)
+	assert.Equal(t, 404, sendWithKey(t, otherAdmin, http.MethodGet, self+"/deliveries", nil).Code)
+	assert.Equal(t, 404, sendWithKey(t, otherAdmin, http.MethodDelete, self, nil).Code)
+	rw = sendWithKey(t, otherAdmin, http.MethodGet, "/v1/subscriptions", nil)
+	require.Equal(t, 200, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, "[]", string(response.Data))
+
+	// a filter that isn't an organisation is refused, rather than listing every organisation's subscriptions
+	rw = sendJSON(t, http.MethodGet, "/v1/subscriptions?filter[organisation_id]=nonsense", "")
+	require.Equal(t, 400, rw.Code)
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&response))
+	assert.Equal(t, "filter[organisation_id]", response.Errors[0].Parameter)
+
+	// deleting a subscription drops the deliveries it was waiting for
+	require.Nil(t, store.CreateDelivery(&WebhookDelivery{ID: uuid.NewV4(), SubscriptionID: subscription.ID, Status: DeliveryPending, Attempts: []DeliveryAttempt{}}))
+	assert.Equal(t, 200, sendWithKey(t, admin, http.MethodDelete, self, nil).Code)
+	assert.Equal(t, 404, sendWithKey(t, admin, http.MethodGet, self, nil).Code)
+	deliveries, err := store.ListDeliveries(subscription.ID, webhookBatchSize)
+	require.Nil(t, err)
+	assert.Empty(t, deliveries)
+}
+
+func TestWebhookAttemptsAreSignedWhenTheyAreSent(t *testing.T) {
+
+	emptyDatabase(t)
+
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	callback := httptest.NewServer(receiver)
+	defer callback.Close()
+
+	payment := createExamplePayment()
+	subscription := createSubscription(t, payment.OrganisationID, callback.URL, EventPaymentCreated)
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	// the deliveries are claimed at one time, and sent later
+	claimedAt := time.Now().UTC()
+	sentAt := claimedAt.Add(20 * time.Second)
+	dispatcher := newWebhookDispatcher(store)
+	calls := 0
+	dispatcher.now = func() time.Time {
+		calls++
+		if calls == 1 {
+			return claimedAt
+		}
+		return sentAt
+	}
+	sent, err := dispatcher.dispatch()
+	require.Nil(t, err)
+	require.Equal(t, 1, sent)
+
+	require.Len(t, receiver.requests, 1)
+	assert.Equal(t, signWebhook(subscription.Secret, sentAt, receiver.bodies[0]), receiver.requests[0].Header.Get(webhookSignatureHeader))
+	deliveries := getDeliveries(t, subscription)
+	require.Len(t, deliveries, 1)
+	assert.True(t, deliveries[0].Attempts[0].Timestamp.Equal(sentAt))
+	assert.True(t, deliveries[0].DeliveredAt.Equal(sentAt))
+}
+
+func TestDeliveriesClaimedAgainArentOverwritten(t *testing.T) {
+
+	emptyDatabase(t)
+
+	payment := createExamplePayment()
+	createSubscription(t, payment.OrganisationID, "http://localhost/hooks", EventPaymentCreated)
+	require.Equal(t, 201, sendAs(t, "alice", http.MethodPost, "/v1/payments", payment).Code)
+
+	now := time.Now().UTC()
+	first, err := store.ClaimDeliveries(now, webhookLease, webhookBatchSize)
+	require.Nil(t, err)
+	require.Len(t, first, 1)
+
+	// the lease runs out before the first dispatcher saves its attempt, and another claims the delivery
+	second, err := store.ClaimDeliveries(now.Add(webhookLease), webhookLease, webhookBatchSize)
+	require.Nil(t, err)
+	require.Len(t, second, 1)
+
+	lease := second[0].NextAttemptAt
+	second[0].Status = DeliveryDelivered
+	second[0].Attempts = append(second[0].Attempts, DeliveryAttempt{Timestamp: now.Add(webhookLease), StatusCode: http.StatusOK})
+	require.Nil(t, store.UpdateDelivery(&second[0], lease))
+
+	first[0].Attempts = append(first[0].Attempts, DeliveryAttempt{Timestamp: now, Error: "timeout"})
+	assert.Equal(t, ErrDeliveryLeaseLost, store.UpdateDelivery(&first[0], now.Add(webhookLease)))
+}